@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"chroma1/internal/acl"
+	"chroma1/internal/acl/storage"
+	aclfile "chroma1/internal/acl/storage/file"
+	aclredis "chroma1/internal/acl/storage/redis"
+	aclsqlite "chroma1/internal/acl/storage/sqlite"
+	dbsqlite "chroma1/internal/db/sqlite"
+)
+
+const (
+	// Environment variable holding the server secret API keys are hashed with.
+	keySecretEnv = "ACL_KEY_SECRET"
+)
+
+// storeFlags registers the flags locating the ACL store and the database, shared by subcommands.
+func storeFlags(fs *flag.FlagSet) (aclPath, dbPath *string) {
+	aclPath = fs.String("acl", "", "path to the SQLite ACL store")
+	dbPath = fs.String("db", "", "path to the SQLite database the ACLs protect")
+	return aclPath, dbPath
+}
+
+// openACLManager opens the ACL store and database and builds an ACLManager over them. The returned function closes
+// all three.
+func openACLManager(ctx context.Context, aclPath, dbPath string) (*acl.ACLManager, func(), error) {
+	if aclPath == "" || dbPath == "" {
+		return nil, nil, fmt.Errorf("both -acl and -db are required")
+	}
+	storage, err := aclsqlite.NewSQLiteACLStorage(ctx, aclPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error opening ACL store %s: %w", aclPath, err)
+	}
+	database, err := dbsqlite.NewSQLiteDB(ctx, dbPath)
+	if err != nil {
+		storage.Close()
+		return nil, nil, fmt.Errorf("error opening database %s: %w", dbPath, err)
+	}
+	closeAll := func() {
+		database.Close()
+		storage.Close()
+	}
+	pks, err := database.GetPKs(ctx)
+	if err != nil {
+		closeAll()
+		return nil, nil, err
+	}
+	numeric, err := database.GetNumericPKs(ctx)
+	if err != nil {
+		closeAll()
+		return nil, nil, err
+	}
+	fks, err := database.GetForeignKeys(ctx)
+	if err != nil {
+		closeAll()
+		return nil, nil, err
+	}
+	man, err := acl.NewACLManager(ctx, storage, pks,
+		acl.WithKeySecret([]byte(os.Getenv(keySecretEnv))),
+		acl.WithNumericKeys(numeric),
+		acl.WithForeignKeyInheritance(fks, database))
+	if err != nil {
+		closeAll()
+		return nil, nil, err
+	}
+	return man, func() {
+		man.Close()
+		closeAll()
+	}, nil
+}
+
+// openStore opens the ACL store at location, which is one of:
+//   - redis://[user:password@]host:port[/db][?prefix=acl:] for a Redis store
+//   - a path ending in .yaml, .yml or .json for a policy file
+//   - any other path for a SQLite store
+func openStore(ctx context.Context, location string) (storage.ACLStorage, error) {
+	if strings.HasPrefix(location, "redis://") {
+		u, err := url.Parse(location)
+		if err != nil {
+			return nil, fmt.Errorf("invalid Redis URL: %w", err)
+		}
+		var opts []aclredis.Option
+		if u.User != nil {
+			password, _ := u.User.Password()
+			opts = append(opts, aclredis.WithAuth(u.User.Username(), password))
+		}
+		if db := strings.TrimPrefix(u.Path, "/"); db != "" {
+			n, err := strconv.Atoi(db)
+			if err != nil {
+				return nil, fmt.Errorf("invalid Redis database %q", db)
+			}
+			opts = append(opts, aclredis.WithDB(n))
+		}
+		if prefix := u.Query().Get("prefix"); prefix != "" {
+			opts = append(opts, aclredis.WithKeyPrefix(prefix))
+		}
+		return aclredis.NewRedisACLStorage(ctx, u.Host, opts...)
+	}
+	switch strings.ToLower(filepath.Ext(location)) {
+	case ".yaml", ".yml", ".json":
+		return aclfile.NewFileACLStorage(ctx, location)
+	}
+	return aclsqlite.NewSQLiteACLStorage(ctx, location)
+}
@@ -0,0 +1,141 @@
+package acl
+
+import (
+	"context"
+	"sort"
+
+	"chroma1/model/identity"
+	"chroma1/model/permissions"
+)
+
+// Sources of access reported by WhoCanAccess.
+const (
+	// a user's own grant on specific rows
+	AccessDirect = "direct"
+	// a user's own grant on every row of the table, or every row but some
+	AccessWildcard = "wildcard"
+	// a grant held through a role
+	AccessRole       = "role"
+	AccessInherited  = "inherited"
+	AccessBreakGlass = "break_glass"
+)
+
+// Access is one way in which a user can access rows of a table.
+type Access struct {
+	User   string `json:"user"`
+	Source string `json:"source"`
+	// The grant giving access. For inherited access this is the grant on the ancestor table.
+	Permission *permissions.Permission `json:"permission,omitempty"`
+	// For inherited access, the tables followed through foreign keys, from the table asked about to the ancestor.
+	Via []string `json:"via,omitempty"`
+	// For break-glass access, the active elevation.
+	Elevation *Elevation `json:"elevation,omitempty"`
+	// Disabled users keep their grants but cannot currently use them.
+	Disabled bool `json:"disabled,omitempty"`
+}
+
+// WhoCanAccess returns every way in which users can access table: through a grant on the table, which is direct,
+// wildcard or role as grantSource says, through an inheritable grant on an ancestor table, or through an active
+// break-glass elevation. A non-nil key narrows the search to grants covering that
+// row, and a non-zero permType to grants of that type. Expired grants are skipped; grants that are conditional or not
+// yet active are included, as they may apply. Only admins may call it.
+func (acl *ACLManager) WhoCanAccess(ctx context.Context, caller *identity.Identity, table string, key []string, permType permissions.PermissionType) ([]*Access, error) {
+	acl.mu.Lock()
+	defer acl.mu.Unlock()
+
+	if !acl.isAdmin(caller) {
+		return nil, NotAdminError
+	}
+
+	now := acl.now()
+	var found []*Access
+	if err := acl.collectAccess(ctx, table, key, permType, []string{table}, &found); err != nil {
+		return nil, err
+	}
+	if permType == 0 || permType == permissions.Read {
+		for user, e := range acl.elevations {
+			if now.Before(e.ExpiresAt) {
+				found = append(found, &Access{User: user, Source: AccessBreakGlass, Elevation: e})
+			}
+		}
+	}
+
+	accesses := make([]*Access, 0, len(found))
+	for _, a := range found {
+		if a.Permission != nil && a.Permission.ExpiredAt(now) {
+			continue
+		}
+		_, a.Disabled = acl.disabledUsers[a.User]
+		accesses = append(accesses, a)
+	}
+	sort.SliceStable(accesses, func(i, j int) bool {
+		return accesses[i].User < accesses[j].User
+	})
+	return accesses, nil
+}
+
+// collectAccess appends the grants on the last table of path matching key and permType, then follows foreign keys
+// to the table's parents, where only inheritable grants count. Must be called with acl.mu held.
+func (acl *ACLManager) collectAccess(ctx context.Context, table string, key []string, permType permissions.PermissionType, path []string, found *[]*Access) error {
+	inherited := len(path) > 1
+	// loading permissions may reindex them, so settle on the users first
+	users := make([]string, 0, len(acl.grantees[table]))
+	for user := range acl.grantees[table] {
+		users = append(users, user)
+	}
+	sort.Strings(users)
+	for _, user := range users {
+		// expired cache entries are read from storage again rather than skipped
+		perms, err := acl.getPerms(ctx, user)
+		if err != nil {
+			return err
+		}
+		for _, p := range perms {
+			if p.Table != table || (permType != 0 && p.Type != permType) || (inherited && !p.Inherit) {
+				continue
+			}
+			if key != nil && !p.CoversKey(key) {
+				continue
+			}
+			a := &Access{User: user, Source: grantSource(p), Permission: p}
+			if inherited {
+				a.Source = AccessInherited
+				a.Via = append([]string(nil), path[1:]...)
+			}
+			*found = append(*found, a)
+		}
+	}
+
+	if len(path) > maxInheritanceDepth {
+		return nil
+	}
+	for _, fk := range acl.foreignKeys[table] {
+		parentKey := []string(nil)
+		if key != nil {
+			req := permissions.Permission{Type: permType, Table: table, RowKeys: [][]string{key}}
+			parentReq, ok, err := acl.parentRequirement(ctx, req, nil, nil, fk)
+			if err != nil {
+				return err
+			}
+			if !ok || len(parentReq.RowKeys) == 0 {
+				continue // the row references no parent row
+			}
+			parentKey = parentReq.RowKeys[0]
+		}
+		if err := acl.collectAccess(ctx, fk.Table, parentKey, permType, append(path, fk.Table), found); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// grantSource returns how a grant on the table asked about gives access: through a role, on every row, or directly.
+func grantSource(p *permissions.Permission) string {
+	switch {
+	case p.Role != "":
+		return AccessRole
+	case p.Blanket() || p.HasExceptions():
+		return AccessWildcard
+	}
+	return AccessDirect
+}
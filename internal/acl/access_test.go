@@ -0,0 +1,107 @@
+package acl_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"chroma1/internal/acl"
+	"chroma1/internal/acl/storage/storagetest"
+	"chroma1/internal/db"
+	"chroma1/model/identity"
+	"chroma1/model/permissions"
+)
+
+func TestWhoCanAccess(t *testing.T) {
+	ctx := context.Background()
+	fks := map[string][]db.ForeignKey{
+		"orders": {{Table: "accounts", From: []string{"account_id"}, To: []string{"id"}}},
+	}
+	rows := rowTable{"orders": {"10": {"account_id": "1"}}}
+	man, s, _ := newManager(t, []*permissions.Permission{
+		{Type: permissions.Read, Table: "accounts", RowKeys: [][]string{{"1"}, {"2"}}},
+		{Type: permissions.Write, Table: "orders"},
+	}, acl.WithForeignKeyInheritance(fks, rows))
+	for user, grants := range map[string][]*permissions.Permission{
+		"bob": {
+			{Type: permissions.Read, Table: "accounts", ExceptKeys: [][]string{{"2"}}},
+			{Type: permissions.Write, Table: "accounts", RowKeys: [][]string{{"1"}}, Role: "ops"},
+		},
+		"carol": {{Type: permissions.Read, Table: "accounts", RowKeys: [][]string{{"1"}}, Inherit: true}},
+		"dave":  {{Type: permissions.Read, Table: "accounts", ExpiresAt: at(-time.Hour)}},
+		"erin":  nil,
+	} {
+		assert.NoError(t, s.CreateUser(ctx, user, storagetest.NewKey(user), false))
+		assert.NoError(t, s.StoreUserPerms(ctx, user, grants))
+	}
+	assert.NoError(t, s.SetBreakGlass("erin", true))
+	assert.NoError(t, man.Reload(ctx))
+	_, err := man.BreakGlass(ctx, &identity.Identity{User: "erin"}, "incident 1", time.Hour)
+	assert.NoError(t, err)
+
+	_, err = man.WhoCanAccess(ctx, alice, "accounts", nil, 0)
+	assert.ErrorIs(t, err, acl.NotAdminError)
+
+	testcases := []struct {
+		name     string
+		table    string
+		key      []string
+		permType permissions.PermissionType
+		exp      []string
+	}{
+		{
+			name:  "table",
+			table: "accounts",
+			exp:   []string{"alice direct", "bob wildcard", "bob role", "carol direct", "erin break_glass"},
+		},
+		{
+			name:  "row",
+			table: "accounts",
+			key:   []string{"2"},
+			exp:   []string{"alice direct", "erin break_glass"},
+		},
+		{
+			name:     "type",
+			table:    "accounts",
+			permType: permissions.Write,
+			exp:      []string{"bob role"},
+		},
+		{
+			name:  "child row",
+			table: "orders",
+			key:   []string{"10"},
+			exp:   []string{"alice wildcard", "carol inherited", "erin break_glass"},
+		},
+		{
+			name:     "child row and type",
+			table:    "orders",
+			key:      []string{"10"},
+			permType: permissions.Read,
+			exp:      []string{"carol inherited", "erin break_glass"},
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			accesses, err := man.WhoCanAccess(ctx, root, tc.table, tc.key, tc.permType)
+			if !assert.NoError(t, err) {
+				return
+			}
+			got := make([]string, len(accesses))
+			for i, a := range accesses {
+				got[i] = a.User + " " + a.Source
+				switch a.Source {
+				case acl.AccessBreakGlass:
+					assert.NotNil(t, a.Elevation)
+				case acl.AccessInherited:
+					assert.Equal(t, []string{"accounts"}, a.Via)
+					assert.Equal(t, "accounts", a.Permission.Table)
+				default:
+					assert.Equal(t, tc.table, a.Permission.Table)
+				}
+			}
+			assert.Equal(t, tc.exp, got)
+		})
+	}
+}
@@ -2,47 +2,241 @@ package acl
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"reflect"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
+	"chroma1/internal/acl/cache"
+	"chroma1/internal/acl/condition"
+	"chroma1/internal/acl/storage"
+	"chroma1/internal/db"
 	"chroma1/internal/parsing"
+	"chroma1/model/identity"
+	"chroma1/model/keys"
 	"chroma1/model/permissions"
-
-	"golang.org/x/exp/slices"
 )
 
 var (
-	NotAdminError = fmt.Errorf("not an admin")
+	NotAdminError        = fmt.Errorf("not an admin")
+	NoSuchKeyError       = fmt.Errorf("no such key found")
+	UnauthenticatedError = fmt.Errorf("caller is not a known user")
+	UserDisabledError    = fmt.Errorf("user is disabled")
+	// Returned by conditional permission changes when the user's permissions changed since the given version.
+	VersionConflictError = storage.VersionConflictError
+	// Returned when a grant read from storage has no ID, so it cannot be replaced conditionally.
+	MissingGrantIDError = fmt.Errorf("grant has no id in storage")
 )
 
-type ACLStorage interface {
-	StoreUserPerms(ctx context.Context, user string, perms []*permissions.Permission) error
-	GetUserPerms(ctx context.Context, user string) ([]*permissions.Permission, error)
-	// Gets a map from user id to permissions, a set of keys belonging to admins, map from key to userid
-	GetAllUserInfo(ctx context.Context) (map[string][]*permissions.Permission, map[string]struct{}, map[string]string, error)
-	Close() error
-}
+// maxWriteAttempts bounds how often a change to a user's permissions is reapplied when another writer changed them
+// first.
+const maxWriteAttempts = 5
+
+// ACLStorage is the backing store for ACLs. See the storage package for the interface and its implementations.
+type ACLStorage = storage.ACLStorage
 
 type ACLManager struct {
-	storage   ACLStorage                           // permanent storage for ACLs
-	perms     map[string][]*permissions.Permission // map from user/key to permissions. TODO: replace with cache for distributed case.
-	adminKeys map[string]struct{}
-	keyToUser map[string]string
-	tablePKs  map[string][]string
+	mu       sync.Mutex                                      // guards the maps below, which the sweeper also modifies
+	storage  ACLStorage                                      // permanent storage for ACLs
+	perms    *cache.Cache[string, []*permissions.Permission] // user to permissions, read through from storage
+	admins   map[string]struct{}                             // admin user ids
+	keys     map[string]*keys.APIKey                         // map from key id to key
+	tablePKs map[string][]string
+	now      func() time.Time
+
+	numericPKs       map[string][]bool // whether each primary key column has numeric affinity, see parsing.Parse
+	keySecret        []byte            // server secret used to HMAC API keys
+	disabledUsers    map[string]struct{}
+	tableAdmins      map[string]map[string]struct{} // user id to the set of tables they administer
+	conditions       map[string]*condition.Expr     // compiled permission conditions by source
+	foreignKeys      map[string][]db.ForeignKey     // child table to its foreign keys, for inherited permissions
+	rows             RowResolver
+	breakGlassUsers  map[string]struct{}
+	elevations       map[string]*Elevation // active break-glass elevations by user id
+	maxElevationTime time.Duration
+	grantees         map[string]map[string]struct{}       // table to the users holding a grant on it, for WhoCanAccess
+	indexed          map[string][]*permissions.Permission // the permissions each user is indexed in grantees by
+	version          uint64                               // storage change version the caches reflect at least
+	cacheOpts        []cache.Option
+	closed           chan struct{} // closed by Close, stopping the sweeper and watcher
+	closeOnce        sync.Once
+	background       sync.WaitGroup // the sweeper and watcher goroutines
 }
 
-func NewACLManager(ctx context.Context, storage ACLStorage, tablePKs map[string][]string) (*ACLManager, error) {
-	p, admins, keyToUser, err := storage.GetAllUserInfo(ctx)
-	if err != nil {
+// Option configures optional ACLManager behaviour.
+type Option func(*ACLManager)
+
+// WithClock overrides the clock used to evaluate permission validity windows. Defaults to time.Now.
+func WithClock(now func() time.Time) Option {
+	return func(acl *ACLManager) {
+		acl.now = now
+	}
+}
+
+// WithPermissionCache refetches a user's permissions from storage in the background once they are older than refresh,
+// serving the cached ones meanwhile, and stops serving them once older than expire. By default permissions are cached
+// until changed through this ACLManager, which suits a store only it writes to. expire should be well above refresh,
+// so that queries keep being checked through short storage outages; zero never expires.
+func WithPermissionCache(refresh, expire time.Duration) Option {
+	return func(acl *ACLManager) {
+		acl.cacheOpts = append(acl.cacheOpts, cache.WithRefreshAfter(refresh), cache.WithExpireAfter(expire))
+	}
+}
+
+// WithNumericKeys says which primary key columns have numeric affinity, as db.DB.GetNumericPKs returns. Queries are
+// only narrowed to key ranges on those; by default no column is numeric.
+func WithNumericKeys(numeric map[string][]bool) Option {
+	return func(acl *ACLManager) {
+		acl.numericPKs = numeric
+	}
+}
+
+func NewACLManager(ctx context.Context, storage ACLStorage, tablePKs map[string][]string, opts ...Option) (*ACLManager, error) {
+	acl := &ACLManager{
+		storage:          storage,
+		tablePKs:         tablePKs,
+		now:              time.Now,
+		conditions:       make(map[string]*condition.Expr),
+		elevations:       make(map[string]*Elevation),
+		maxElevationTime: defaultMaxElevationTime,
+		closed:           make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(acl)
+	}
+	acl.perms = cache.New(acl.fetchPerms, append(acl.cacheOpts, cache.WithClock(acl.now))...)
+	acl.perms.OnRefresh(func(user string) {
+		acl.mu.Lock()
+		defer acl.mu.Unlock()
+		if perms, ok := acl.perms.Peek(user); ok {
+			acl.index(user, perms)
+		}
+	})
+	if len(acl.keySecret) == 0 {
+		acl.Close()
+		return nil, MissingKeySecretError
+	}
+	if err := acl.load(ctx); err != nil {
+		acl.Close()
 		return nil, err
 	}
-	return &ACLManager{
-		storage:   storage,
-		tablePKs:  tablePKs,
-		perms:     p,
-		adminKeys: admins,
-		keyToUser: keyToUser,
-	}, nil
+	if err := acl.hashPlaintextKeys(ctx); err != nil {
+		acl.Close()
+		return nil, err
+	}
+	return acl, nil
+}
+
+// Close stops the sweeper and watcher, waiting for them to return, and the permission cache's background refreshes.
+// The storage is left open for its owner to close. Close is safe to call more than once.
+func (acl *ACLManager) Close() {
+	acl.closeOnce.Do(func() {
+		close(acl.closed)
+		acl.perms.Close()
+	})
+	acl.background.Wait()
+}
+
+// untilClosed returns a context derived from ctx that is also cancelled once the manager is closed.
+func (acl *ACLManager) untilClosed(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-acl.closed:
+			cancel()
+		}
+	}()
+	return ctx, cancel
+}
+
+// Reload replaces the cached users, grants and keys with the current contents of storage, for when storage was changed
+// other than through this ACLManager. Nothing is replaced if reading storage fails. Active break-glass elevations are
+// read back too.
+func (acl *ACLManager) Reload(ctx context.Context) error {
+	acl.mu.Lock()
+	defer acl.mu.Unlock()
+
+	if err := acl.load(ctx); err != nil {
+		return err
+	}
+	return acl.hashPlaintextKeys(ctx)
+}
+
+// load reads users, grants, keys and active elevations from storage into the caches, replacing them only once
+// everything has been read. Must be called with acl.mu held.
+func (acl *ACLManager) load(ctx context.Context) error {
+	// read first, so that changes made while loading are applied again rather than missed
+	version, err := acl.storage.ChangeVersion(ctx)
+	if err != nil {
+		return err
+	}
+	p, admins, err := acl.storage.GetAllUserInfo(ctx)
+	if err != nil {
+		return err
+	}
+	allKeys, err := acl.storage.GetAllKeys(ctx)
+	if err != nil {
+		return err
+	}
+	keysByID := make(map[string]*keys.APIKey, len(allKeys))
+	for _, k := range allKeys {
+		keysByID[k.ID] = k
+	}
+	disabled, err := acl.storage.GetDisabledUsers(ctx)
+	if err != nil {
+		return err
+	}
+	tableAdmins, err := acl.storage.GetTableAdmins(ctx)
+	if err != nil {
+		return err
+	}
+	breakGlass, err := acl.storage.GetBreakGlassUsers(ctx)
+	if err != nil {
+		return err
+	}
+	active, err := acl.storage.GetActiveElevations(ctx, acl.now())
+	if err != nil {
+		return err
+	}
+	elevations := make(map[string]*Elevation, len(active))
+	for _, e := range active {
+		_, exists := p[e.User]
+		_, allowed := breakGlass[e.User]
+		_, isDisabled := disabled[e.User]
+		if !exists || !allowed || isDisabled {
+			// revoked along with the user's break-glass rights
+			continue
+		}
+		// oldest first, so a user's latest elevation replaces the earlier ones, as BreakGlass does
+		elevations[e.User] = &Elevation{ID: e.ID, User: e.User, Reason: e.Reason, Start: e.Start, ExpiresAt: e.End}
+	}
+
+	acl.grantees = make(map[string]map[string]struct{})
+	acl.indexed = make(map[string][]*permissions.Permission, len(p))
+	acl.admins = admins
+	acl.keys = keysByID
+	acl.disabledUsers = disabled
+	acl.tableAdmins = tableSets(tableAdmins)
+	acl.breakGlassUsers = breakGlass
+	acl.elevations = elevations
+	acl.version = version
+	for user, perms := range p {
+		for _, perm := range perms {
+			permissions.Normalize(perm)
+		}
+		acl.index(user, perms)
+	}
+	acl.perms.Reset(p)
+	return nil
+}
+
+// CacheStats returns the permission cache's counters of hits, misses, stale values served and refreshes.
+func (acl *ACLManager) CacheStats() cache.Stats {
+	return acl.perms.Stats()
 }
 
 type InsufficientPermissionsError struct {
@@ -59,186 +253,584 @@ func (err InsufficientPermissionsError) Error() string {
 }
 
 // CheckPermissions checks if the given sql can be run by the given user. Will raise an error if not allowed.
-func (acl *ACLManager) CheckPermissions(ctx context.Context, key, sql string) error {
-	user, ok := acl.keyToUser[key]
-	if !ok {
-		return fmt.Errorf("no such key found")
+// If the user is under an active break-glass elevation, the query is recorded against it and the elevation is returned
+// so the caller can tag the result. acl.mu is only held while reading the manager's state, not while loading
+// permissions, following foreign keys or recording the query, so that a slow store does not hold up other callers.
+func (acl *ACLManager) CheckPermissions(ctx context.Context, caller *identity.Identity, sql string) (*Elevation, error) {
+	acl.mu.Lock()
+	user, err := acl.callerUser(caller)
+	now := acl.now()
+	var elevation *Elevation
+	if err == nil {
+		elevation = acl.activeElevation(user, now)
 	}
-	reqs, err := parsing.Parse(sql, acl.tablePKs)
+	acl.mu.Unlock()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	perms, err := acl.getPerms(ctx, user)
+	reqs, err := parsing.Parse(sql, acl.tablePKs, acl.numericPKs)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	perms, err := acl.perms.Get(ctx, user)
+	if err != nil {
+		acl.mu.Lock()
+		acl.forgetIfDeleted(user, err)
+		acl.mu.Unlock()
+		return nil, err
 	}
 
-	failingReqs := make([]*parsing.RequiredPermission, 0)
-	for _, req := range reqs {
-		if !reqPasses(req.Perm, perms) {
-			failingReqs = append(failingReqs, req)
-		}
+	acl.mu.Lock()
+	// the cache may have loaded or refreshed them, unless a write replaced them meanwhile
+	if cached, ok := acl.perms.Peek(user); ok && sameSlice(cached, perms) {
+		acl.index(user, perms)
+	}
+	applies := appliesWith(caller, now, acl.compiledConditions(perms))
+	acl.mu.Unlock()
+
+	failingReqs, err := acl.failingRequirements(ctx, reqs, perms, applies, elevation != nil)
+	if err != nil {
+		return nil, err
 	}
 	if len(failingReqs) > 0 {
-		return InsufficientPermissionsError{
+		return nil, InsufficientPermissionsError{
 			failingRequirements: failingReqs,
 		}
 	}
-	return nil
+	if elevation != nil {
+		if err := acl.storage.RecordElevatedQuery(ctx, elevation.ID, sql, now); err != nil {
+			return nil, fmt.Errorf("error recording elevated query for %s: %w", user, err)
+		}
+	}
+	return elevation, nil
 }
 
-func (acl *ACLManager) AddPermissions(ctx context.Context, key, user string, toAdd []*permissions.Permission) error {
-	if _, ok := acl.adminKeys[key]; !ok {
-		return NotAdminError
+// failingRequirements returns the requirements that the permissions perms selected by applies do not satisfy. If
+// elevated, reads pass as under a break-glass elevation. It only reads the manager's configuration, so acl.mu need not
+// be held unless applies requires it.
+func (acl *ACLManager) failingRequirements(ctx context.Context, reqs []*parsing.RequiredPermission, perms []*permissions.Permission, applies func(*permissions.Permission) bool, elevated bool) ([]*parsing.RequiredPermission, error) {
+	failingReqs := make([]*parsing.RequiredPermission, 0)
+	for _, req := range reqs {
+		if elevated && req.Perm.Type == permissions.Read {
+			continue // break-glass grants blanket read access
+		}
+		if reqPasses(req.Perm, perms, applies) {
+			continue
+		}
+		inherited, err := acl.inheritedPasses(ctx, req.Perm, req.Assigned, req.Inserted, perms, applies, 0)
+		if err != nil {
+			return nil, err
+		}
+		if !inherited {
+			failingReqs = append(failingReqs, req)
+		}
 	}
+	return failingReqs, nil
+}
 
-	perms, err := acl.getPerms(ctx, user)
-	if err != nil {
+func (acl *ACLManager) AddPermissions(ctx context.Context, caller *identity.Identity, user string, toAdd []*permissions.Permission) error {
+	acl.mu.Lock()
+	defer acl.mu.Unlock()
+
+	if err := acl.authorizeGrant(ctx, caller, toAdd); err != nil {
 		return err
 	}
+	for _, ta := range toAdd {
+		if _, err := acl.compileCondition(ta.Condition); err != nil {
+			return err
+		}
+	}
+
+	_, err := acl.updatePerms(ctx, user, "", func(perms []*permissions.Permission) []*permissions.Permission {
+		return withAdded(perms, toAdd)
+	})
+	return err
+}
 
+// AddPermissionsIf adds permissions as AddPermissions does, but only if the user's permissions are still at version, as
+// returned by GetPermissions, and returns their new version. Otherwise it fails with VersionConflictError, and the
+// caller should read the permissions again before deciding whether to retry. An empty version makes it unconditional.
+func (acl *ACLManager) AddPermissionsIf(ctx context.Context, caller *identity.Identity, user, version string, toAdd []*permissions.Permission) (string, error) {
+	acl.mu.Lock()
+	defer acl.mu.Unlock()
+
+	if err := acl.authorizeGrant(ctx, caller, toAdd); err != nil {
+		return "", err
+	}
 	for _, ta := range toAdd {
-		for _, p := range perms {
-			if p.Table == ta.Table && p.Type == ta.Type {
-				updatePermAdd(p, ta)
-			}
+		if _, err := acl.compileCondition(ta.Condition); err != nil {
+			return "", err
 		}
-		perms = append(perms, ta)
 	}
 
-	if err := acl.storage.StoreUserPerms(ctx, user, perms); err != nil {
-		return fmt.Errorf("error storing user permissions for %s: %w", user, err)
+	return acl.updatePerms(ctx, user, version, func(perms []*permissions.Permission) []*permissions.Permission {
+		return withAdded(perms, toAdd)
+	})
+}
+
+func (acl *ACLManager) RemovePermissions(ctx context.Context, caller *identity.Identity, user string, toRem []*permissions.Permission) error {
+	acl.mu.Lock()
+	defer acl.mu.Unlock()
+
+	if err := acl.authorizeRevoke(caller, toRem); err != nil {
+		return err
 	}
 
-	return nil
+	_, err := acl.updatePerms(ctx, user, "", func(perms []*permissions.Permission) []*permissions.Permission {
+		return withRemoved(perms, toRem)
+	})
+	return err
+}
+
+// RemovePermissionsIf removes permissions as RemovePermissions does, but only if the user's permissions are still at
+// version, as AddPermissionsIf does.
+func (acl *ACLManager) RemovePermissionsIf(ctx context.Context, caller *identity.Identity, user, version string, toRem []*permissions.Permission) (string, error) {
+	acl.mu.Lock()
+	defer acl.mu.Unlock()
+
+	if err := acl.authorizeRevoke(caller, toRem); err != nil {
+		return "", err
+	}
+
+	return acl.updatePerms(ctx, user, version, func(perms []*permissions.Permission) []*permissions.Permission {
+		return withRemoved(perms, toRem)
+	})
+}
+
+// GetPermissions reads user's permissions from storage, along with their version for AddPermissionsIf and
+// RemovePermissionsIf.
+func (acl *ACLManager) GetPermissions(ctx context.Context, caller *identity.Identity, user string) ([]*permissions.Permission, string, error) {
+	acl.mu.Lock()
+	defer acl.mu.Unlock()
+
+	if !acl.isAdmin(caller) {
+		return nil, "", NotAdminError
+	}
+
+	return acl.fetchPermsVersion(ctx, user)
 }
 
-func (acl *ACLManager) RemovePermissions(ctx context.Context, key, user string, toRem []*permissions.Permission) error {
-	if _, ok := acl.adminKeys[key]; !ok {
-		return NotAdminError
+// GetAllPermissions reads every user's permissions from storage. Only admins may call it.
+func (acl *ACLManager) GetAllPermissions(ctx context.Context, caller *identity.Identity) (map[string][]*permissions.Permission, error) {
+	acl.mu.Lock()
+	admin := acl.isAdmin(caller)
+	acl.mu.Unlock()
+	if !admin {
+		return nil, NotAdminError
 	}
 
-	perms, err := acl.getPerms(ctx, user)
+	return acl.fetchAllPerms(ctx)
+}
+
+// SweepExpired removes every expired permission from storage, updating the cached users. It also revokes break-glass
+// elevations whose window has ended and deletes expired API keys.
+func (acl *ACLManager) SweepExpired(ctx context.Context) error {
+	// cached permissions may have expired, so look for expired grants in storage
+	all, err := acl.fetchAllPerms(ctx)
 	if err != nil {
 		return err
 	}
 
-	for _, ta := range toRem {
-		for i, p := range perms {
-			if p.Table == ta.Table && p.Type == ta.Type {
-				shouldDelete, err := updatePermRemove(p, ta)
-				if err != nil {
-					return err
-				}
-				if shouldDelete {
-					perms[i] = perms[len(perms)-1]
-					perms = perms[:len(perms)-1]
-					break
-				}
+	acl.mu.Lock()
+	defer acl.mu.Unlock()
+
+	now := acl.now()
+	for user, e := range acl.elevations {
+		if !now.Before(e.ExpiresAt) {
+			delete(acl.elevations, user)
+		}
+	}
+	for id, k := range acl.keys {
+		if k.ValidAt(now) {
+			continue
+		}
+		if err := acl.storage.DeleteKey(ctx, id); err != nil {
+			return fmt.Errorf("error deleting expired key %s: %w", id, err)
+		}
+		delete(acl.keys, id)
+	}
+	unexpired := func(perms []*permissions.Permission) []*permissions.Permission {
+		kept := make([]*permissions.Permission, 0, len(perms))
+		for _, p := range perms {
+			if !p.ExpiredAt(now) {
+				kept = append(kept, p)
 			}
 		}
+		return kept
 	}
-
-	if err := acl.storage.StoreUserPerms(ctx, user, perms); err != nil {
-		return fmt.Errorf("error storing user permissions for %s: %w", user, err)
+	for user, perms := range all {
+		if len(unexpired(perms)) == len(perms) {
+			continue
+		}
+		if _, err := acl.updatePerms(ctx, user, "", unexpired); err != nil {
+			return err
+		}
 	}
-
 	return nil
 }
 
-func (acl *ACLManager) GetPermissions(ctx context.Context, key, user string) ([]*permissions.Permission, error) {
-	if _, ok := acl.adminKeys[key]; !ok {
-		return nil, NotAdminError
-	}
+// StartSweeper runs SweepExpired every interval until ctx is cancelled or the manager is closed. Errors are passed to
+// onErr if it is non-nil.
+func (acl *ACLManager) StartSweeper(ctx context.Context, interval time.Duration, onErr func(error)) {
+	ctx, cancel := acl.untilClosed(ctx)
+	acl.background.Add(1)
+	go func() {
+		defer acl.background.Done()
+		defer cancel()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := acl.SweepExpired(ctx); err != nil && onErr != nil {
+					onErr(err)
+				}
+			}
+		}
+	}()
+}
 
-	return acl.getPerms(ctx, user)
+// reqPasses reports whether one of perms satisfies req. Only permissions for which applies returns true are considered.
+func reqPasses(req permissions.Permission, perms []*permissions.Permission, applies func(*permissions.Permission) bool) bool {
+	return satisfyingGrant(req, perms, applies) != nil
 }
 
-func (acl *ACLManager) GetAllPermissions(key string) (map[string][]*permissions.Permission, error) {
-	if _, ok := acl.adminKeys[key]; !ok {
-		return nil, NotAdminError
+// satisfyingGrant returns the first of perms that satisfies req, or nil if none does.
+func satisfyingGrant(req permissions.Permission, perms []*permissions.Permission, applies func(*permissions.Permission) bool) *permissions.Permission {
+	for _, p := range perms {
+		if !applies(p) {
+			continue
+		}
+		if p.Table == req.Table && p.Type == req.Type && p.CoversRows(&req) {
+			return p
+		}
 	}
+	return nil // no relevant permission found
+}
 
-	// TODO: use the storage.GetAllPermissions method in the distributed case
-	return acl.perms, nil
+// sameGrant reports whether p and o can be merged into one grant. Grants with different validity windows, conditions,
+// inheritance or grant options are kept separate so that each can be expired, evaluated or revoked on its own.
+func sameGrant(p, o *permissions.Permission) bool {
+	return p.Table == o.Table && p.Type == o.Type && p.SameWindow(o) && p.Condition == o.Condition &&
+		p.Inherit == o.Inherit && p.GrantOption == o.GrantOption
 }
 
-func reqPasses(req permissions.Permission, perms []*permissions.Permission) bool {
+// withAdded returns perms with toAdd merged in. Neither list is modified, so the cache stays intact if storing the
+// result fails.
+func withAdded(perms, toAdd []*permissions.Permission) []*permissions.Permission {
+	merged := make([]*permissions.Permission, 0, len(perms)+len(toAdd))
 	for _, p := range perms {
-		if p.Table == req.Table && p.Type == req.Type {
-			if p.RowKeys == nil {
-				return true // blanket permissions
-			}
-			if req.RowKeys == nil {
-				return false // requires full-table, but only a subset is allowed
+		merged = append(merged, p.Clone())
+	}
+	for _, ta := range toAdd {
+		add := ta.Clone()
+		add.ID = "" // a new grant, unless merged into an existing one
+		merged = append(merged, add)
+	}
+	return compactPerms(merged)
+}
+
+// withRemoved returns perms with toRem removed. Removal applies to every matching grant, regardless of its validity
+// window. Neither list is modified.
+func withRemoved(perms, toRem []*permissions.Permission) []*permissions.Permission {
+	kept := make([]*permissions.Permission, 0, len(perms))
+	for _, p := range perms {
+		kept = append(kept, p.Clone())
+	}
+	for _, ta := range toRem {
+		next := kept[:0]
+		for _, p := range kept {
+			if p.Table == ta.Table && p.Type == ta.Type && updatePermRemove(p, ta) {
+				continue
 			}
-			for _, k := range req.RowKeys {
-				if _, ok := slices.BinarySearchFunc(p.RowKeys, k, pkCmp); !ok {
-					return false
-				}
+			next = append(next, p)
+		}
+		kept = next
+	}
+	return compactPerms(kept)
+}
+
+// compactPerms normalizes every permission, merges those that are the same grant and drops those left without rows.
+// The list is modified in place.
+func compactPerms(perms []*permissions.Permission) []*permissions.Permission {
+	out := perms[:0]
+	for _, p := range perms {
+		permissions.Normalize(p)
+		if p.Empty() {
+			continue
+		}
+		merged := false
+		for _, o := range out {
+			if sameGrant(o, p) {
+				updatePermAdd(o, p)
+				merged = true
+				break
 			}
 		}
+		if !merged {
+			out = append(out, p)
+		}
 	}
-	return false // no relevant permission found
+	return out
 }
 
+// updatePermAdd merges addition into original. Both must be normalized.
 func updatePermAdd(original, addition *permissions.Permission) {
-	if addition.RowKeys == nil {
+	if addition.Blanket() {
 		original.RowKeys = nil
+		original.RowRanges = nil
+		original.ExceptKeys = nil
 	}
-	if original.RowKeys == nil {
+	if original.Blanket() {
 		return
 	}
-	// TODO: optimize this (via merge) for large cases
-	for _, k := range addition.RowKeys {
-		if idx, ok := slices.BinarySearchFunc(original.RowKeys, k, pkCmp); !ok {
-			original.RowKeys = append(original.RowKeys, []string{}) // append a dummy value to expand the slice by 1
-			copy(original.RowKeys[idx+1:], original.RowKeys[idx:])
-			original.RowKeys[idx] = k
+	if original.HasExceptions() || addition.HasExceptions() {
+		// the result covers all rows but those excluded by one side and not covered by the other
+		all, other := original, addition
+		if !all.HasExceptions() {
+			all, other = addition, original
+		}
+		except := make([][]string, 0, len(all.ExceptKeys))
+		for _, k := range all.ExceptKeys {
+			if !other.CoversKey(k) {
+				except = append(except, k)
+			}
+		}
+		if len(except) == 0 {
+			except = nil
 		}
+		original.RowKeys, original.RowRanges, original.ExceptKeys = nil, nil, except
+		return
+	}
+	original.RowKeys = permissions.UnionKeys(original.RowKeys, addition.RowKeys)
+	if addition.RowRanges != nil {
+		original.RowRanges = permissions.UnionRanges(original.RowRanges, addition.RowRanges)
 	}
+	permissions.Normalize(original) // drop keys the new ranges cover
 }
 
 // Returns a bool indicating whether the targeted permission is now empty and can thus be deleted.
-// Returns an error if trying to remove specific rows from a blanket permission.
-func updatePermRemove(original, toRemove *permissions.Permission) (bool, error) {
-	if toRemove.RowKeys != nil && original.RowKeys == nil {
-		return false, fmt.Errorf("cannot remove specific keys from blanket permission")
+// Removing specific rows from a blanket permission leaves a permission on all rows except those.
+func updatePermRemove(original, toRemove *permissions.Permission) bool {
+	if toRemove.Blanket() {
+		// removing blanket permissions from a subset permission is a no-op
+		return original.Blanket() || original.HasExceptions()
+	}
+	if toRemove.HasExceptions() {
+		// removing all rows but some leaves at most those
+		kept := make([][]string, 0, len(toRemove.ExceptKeys))
+		for _, k := range permissions.SortKeys(append([][]string(nil), toRemove.ExceptKeys...)) {
+			if original.CoversKey(k) {
+				kept = append(kept, k)
+			}
+		}
+		original.RowKeys, original.RowRanges, original.ExceptKeys = kept, nil, nil
+		return len(kept) == 0
+	}
+
+	removed := permissions.SortKeys(append([][]string(nil), toRemove.RowKeys...))
+	if original.Blanket() || original.HasExceptions() {
+		if len(toRemove.RowRanges) == 0 {
+			original.ExceptKeys = permissions.UnionKeys(original.ExceptKeys, removed)
+			return false
+		}
+		// too many rows to list as exceptions: keep the ranges between them instead
+		original.RowRanges = permissions.SubtractRanges([]permissions.KeyRange{{}}, permissions.PointRanges(original.ExceptKeys))
+		original.RowKeys, original.ExceptKeys = [][]string{}, nil
 	}
-	if toRemove.RowKeys == nil && original.RowKeys == nil {
-		return true, nil
+
+	// Removed keys are also cut out of any range holding them, and removed ranges take any keys they hold with them.
+	original.RowKeys = permissions.SubtractKeys(original.RowKeys, removed)
+	cut := append([]permissions.KeyRange{}, toRemove.RowRanges...)
+	if original.RowRanges != nil {
+		cut = append(cut, permissions.PointRanges(removed)...)
 	}
-	if toRemove.RowKeys == nil && original.RowKeys != nil {
-		return false, nil // removing blanket permissions from a subset permission is a no-op
+	if original.RowRanges != nil && len(cut) > 0 {
+		original.RowRanges = permissions.SubtractRanges(original.RowRanges, cut)
 	}
-	for _, k := range toRemove.RowKeys {
-		if idx, ok := slices.BinarySearchFunc(original.RowKeys, k, pkCmp); ok {
-			original.RowKeys = append(original.RowKeys[:idx], original.RowKeys[idx+1:]...)
+	if len(toRemove.RowRanges) > 0 {
+		kept := make([][]string, 0, len(original.RowKeys))
+		for _, k := range original.RowKeys {
+			if !(&permissions.Permission{RowRanges: toRemove.RowRanges}).CoversKey(k) {
+				kept = append(kept, k)
+			}
 		}
+		original.RowKeys = kept
 	}
-	return len(original.RowKeys) == 0, nil
+	permissions.Normalize(original)
+	return original.Empty()
 }
 
-func (acl *ACLManager) getPerms(ctx context.Context, user string) ([]*permissions.Permission, error) {
-	perms, ok := acl.perms[user]
-	var err error
-	if !ok {
-		perms, err = acl.storage.GetUserPerms(ctx, user)
+// updatePerms applies change to user's permissions as stored and writes the result through to storage, returning the
+// permissions' new version. If version is empty, a write that conflicts with another writer's is retried with the
+// permissions as they then are, so change must be a commutative edit such as adding or removing grants. Otherwise the
+// permissions must be at version, or VersionConflictError is returned. Must be called with acl.mu held.
+func (acl *ACLManager) updatePerms(ctx context.Context, user, version string, change func([]*permissions.Permission) []*permissions.Permission) (string, error) {
+	for attempt := 0; attempt < maxWriteAttempts; attempt++ {
+		perms, current, err := acl.fetchPermsVersion(ctx, user)
 		if err != nil {
-			return nil, fmt.Errorf("error fetching user %s from storage: %w", user, err)
+			return "", err
+		}
+		if version != "" && current != version {
+			return "", fmt.Errorf("%w: %s is at version %q, not %q", VersionConflictError, user, current, version)
+		}
+		newVersion, err := acl.storePerms(ctx, user, current, perms, change(perms))
+		if version != "" || !errors.Is(err, VersionConflictError) {
+			return newVersion, err
+		}
+	}
+	return "", fmt.Errorf("error storing user permissions for %s: %w %d times", user, VersionConflictError, maxWriteAttempts)
+}
+
+// storePerms writes perms through to storage in place of old, the user's permissions at version, and then updates the
+// cached permissions for user. Only the grants that differ from old are written. Returns the new version. Must be
+// called with acl.mu held.
+func (acl *ACLManager) storePerms(ctx context.Context, user, version string, old, perms []*permissions.Permission) (string, error) {
+	byID := make(map[string]*permissions.Permission, len(old))
+	for _, p := range old {
+		if p.ID == "" {
+			// stores identify every grant they hold, and one that does not cannot be replaced conditionally
+			return "", fmt.Errorf("%w: a grant of %s on %s", MissingGrantIDError, user, p.Table)
+		}
+		byID[p.ID] = p
+	}
+
+	store := make([]*permissions.Permission, 0)
+	for _, p := range perms {
+		if p.ID == "" {
+			id, err := randomToken()
+			if err != nil {
+				return "", err
+			}
+			p.ID = id
+		} else if o, ok := byID[p.ID]; ok && reflect.DeepEqual(o, p) {
+			delete(byID, p.ID)
+			continue
 		}
+		delete(byID, p.ID)
+		store = append(store, p)
 	}
-	acl.perms[user] = perms
+	remove := make([]string, 0, len(byID))
+	for id := range byID {
+		remove = append(remove, id)
+	}
+	sort.Strings(remove)
+	if len(store) == 0 && len(remove) == 0 {
+		acl.cachePerms(user, perms)
+		return version, nil
+	}
+
+	newVersion, err := acl.storage.UpdateGrantsIf(ctx, user, version, store, remove)
+	if err != nil {
+		return "", fmt.Errorf("error storing user permissions for %s: %w", user, err)
+	}
+	acl.cachePerms(user, perms)
+	return newVersion, nil
+}
+
+// cachePerms replaces the cached permissions for user, keeping the grantees index in step. Must be called with acl.mu
+// held.
+func (acl *ACLManager) cachePerms(user string, perms []*permissions.Permission) {
+	acl.perms.Set(user, perms)
+	acl.index(user, perms)
+}
+
+// uncachePerms drops the cached permissions for user from the cache and the grantees index. Must be called with acl.mu
+// held.
+func (acl *ACLManager) uncachePerms(user string) {
+	acl.perms.Delete(user)
+	acl.unindex(user)
+}
+
+// index records user in the grantees index under the tables of perms, unless it already is. Must be called with
+// acl.mu held.
+func (acl *ACLManager) index(user string, perms []*permissions.Permission) {
+	if old, ok := acl.indexed[user]; ok && sameSlice(old, perms) {
+		return
+	}
+	acl.unindex(user)
+	acl.indexed[user] = perms
+	for _, p := range perms {
+		users, ok := acl.grantees[p.Table]
+		if !ok {
+			users = make(map[string]struct{})
+			acl.grantees[p.Table] = users
+		}
+		users[user] = struct{}{}
+	}
+}
+
+// Must be called with acl.mu held.
+func (acl *ACLManager) unindex(user string) {
+	for _, p := range acl.indexed[user] {
+		if users, ok := acl.grantees[p.Table]; ok {
+			delete(users, user)
+			if len(users) == 0 {
+				delete(acl.grantees, p.Table)
+			}
+		}
+	}
+	delete(acl.indexed, user)
+}
+
+// sameSlice reports whether a and b are the same slice. Cached permission lists are replaced rather than modified, so
+// this tells whether a user's permissions changed.
+func sameSlice(a, b []*permissions.Permission) bool {
+	return len(a) == len(b) && (len(a) == 0 || &a[0] == &b[0])
+}
+
+// Must be called with acl.mu held.
+func (acl *ACLManager) getPerms(ctx context.Context, user string) ([]*permissions.Permission, error) {
+	perms, err := acl.perms.Get(ctx, user)
+	if err != nil {
+		acl.forgetIfDeleted(user, err)
+		return nil, err
+	}
+	// the cache may have loaded or refreshed them
+	acl.index(user, perms)
 	return perms, nil
 }
 
-func pkCmp(a, b []string) int {
-	for i := range a {
-		cmpVal := strings.Compare(a[i], b[i])
-		if cmpVal != 0 {
-			return cmpVal
+// fetchPermsVersion reads user's permissions and their version from storage, refreshing the cache with them. Must be
+// called with acl.mu held.
+func (acl *ACLManager) fetchPermsVersion(ctx context.Context, user string) ([]*permissions.Permission, string, error) {
+	perms, version, err := acl.storage.GetUserPermsVersion(ctx, user)
+	if err != nil {
+		acl.forgetIfDeleted(user, err)
+		return nil, "", fmt.Errorf("error fetching user %s from storage: %w", user, err)
+	}
+	for _, perm := range perms {
+		permissions.Normalize(perm)
+	}
+	acl.cachePerms(user, perms)
+	return perms, version, nil
+}
+
+// fetchAllPerms reads every user's permissions from storage, without caching them.
+func (acl *ACLManager) fetchAllPerms(ctx context.Context) (map[string][]*permissions.Permission, error) {
+	all, _, err := acl.storage.GetAllUserInfo(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching permissions from storage: %w", err)
+	}
+	for _, perms := range all {
+		for _, perm := range perms {
+			permissions.Normalize(perm)
 		}
 	}
-	return 0
+	return all, nil
+}
+
+// fetchPerms loads user's permissions for the cache.
+func (acl *ACLManager) fetchPerms(ctx context.Context, user string) ([]*permissions.Permission, error) {
+	perms, err := acl.storage.GetUserPerms(ctx, user)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching user %s from storage: %w", user, err)
+	}
+	for _, perm := range perms {
+		permissions.Normalize(perm)
+	}
+	return perms, nil
 }
@@ -0,0 +1,371 @@
+package acl_test
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"chroma1/internal/acl"
+	"chroma1/internal/acl/storage"
+	"chroma1/internal/acl/storage/memory"
+	"chroma1/internal/acl/storage/storagetest"
+	"chroma1/model/identity"
+	"chroma1/model/permissions"
+)
+
+var (
+	t0    = time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	root  = &identity.Identity{User: "root"}
+	alice = &identity.Identity{User: "alice"}
+)
+
+// clock is a settable clock, safe to read from the sweeper's goroutine.
+type clock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *clock) Set(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = now
+}
+
+// newManager returns an ACLManager over a memory store holding the admin root and alice with the given grants, and the
+// clock it runs on, set to t0.
+func newManager(t *testing.T, grants []*permissions.Permission, opts ...acl.Option) (*acl.ACLManager, *memory.MemoryACLStorage, *clock) {
+	t.Helper()
+	ctx := context.Background()
+	s := memory.NewMemoryACLStorage()
+	t.Cleanup(func() { s.Close() })
+	assert.NoError(t, s.CreateUser(ctx, "root", storagetest.NewKey("root"), true))
+	assert.NoError(t, s.CreateUser(ctx, "alice", storagetest.NewKey("alice"), false))
+	if grants != nil {
+		assert.NoError(t, s.StoreUserPerms(ctx, "alice", grants))
+	}
+
+	c := &clock{now: t0}
+	opts = append([]acl.Option{acl.WithClock(c.Now), acl.WithKeySecret([]byte("secret"))}, opts...)
+	man, err := acl.NewACLManager(ctx, s, map[string][]string{"accounts": {"id"}, "orders": {"id"}}, opts...)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	t.Cleanup(man.Close)
+	return man, s, c
+}
+
+func at(d time.Duration) *time.Time {
+	t := t0.Add(d)
+	return &t
+}
+
+func TestValidityWindow(t *testing.T) {
+	man, _, c := newManager(t, []*permissions.Permission{
+		{Type: permissions.Read, Table: "accounts", NotBefore: at(time.Hour), ExpiresAt: at(2 * time.Hour)},
+	})
+	ctx := context.Background()
+	sql := "SELECT * FROM accounts WHERE id = 1"
+
+	for _, tc := range []struct {
+		now     time.Duration
+		allowed bool
+	}{
+		{now: 0, allowed: false},
+		{now: time.Hour, allowed: true},
+		{now: 90 * time.Minute, allowed: true},
+		{now: 2 * time.Hour, allowed: false},
+	} {
+		c.Set(t0.Add(tc.now))
+		_, err := man.CheckPermissions(ctx, alice, sql)
+		if tc.allowed {
+			assert.NoError(t, err, "at %v", tc.now)
+		} else {
+			assert.ErrorAs(t, err, &acl.InsufficientPermissionsError{}, "at %v", tc.now)
+		}
+	}
+}
+
+func TestSweepExpired(t *testing.T) {
+	man, s, c := newManager(t, []*permissions.Permission{
+		{Type: permissions.Read, Table: "accounts", ExpiresAt: at(time.Hour)},
+		{Type: permissions.Read, Table: "orders", ExpiresAt: at(3 * time.Hour)},
+	})
+	ctx := context.Background()
+	key, err := man.MintKey(ctx, alice, "alice", "ci", at(time.Hour))
+	assert.NoError(t, err)
+
+	// nothing has expired yet
+	assert.NoError(t, man.SweepExpired(ctx))
+	perms, err := s.GetUserPerms(ctx, "alice")
+	assert.NoError(t, err)
+	assert.Len(t, perms, 2)
+
+	c.Set(t0.Add(2 * time.Hour))
+	assert.NoError(t, man.SweepExpired(ctx))
+	perms, err = s.GetUserPerms(ctx, "alice")
+	assert.NoError(t, err)
+	if assert.Len(t, perms, 1) {
+		assert.Equal(t, "orders", perms[0].Table)
+	}
+	allKeys, err := s.GetAllKeys(ctx)
+	assert.NoError(t, err)
+	for _, k := range allKeys {
+		assert.NotEqual(t, key.ID, k.ID, "the expired key is deleted")
+	}
+	_, err = man.AuthenticateKey(key.Secret)
+	assert.ErrorIs(t, err, acl.NoSuchKeyError)
+
+	_, err = man.CheckPermissions(ctx, alice, "SELECT * FROM orders WHERE id = 1")
+	assert.NoError(t, err)
+	_, err = man.CheckPermissions(ctx, alice, "SELECT * FROM accounts WHERE id = 1")
+	assert.ErrorAs(t, err, &acl.InsufficientPermissionsError{})
+}
+
+func TestStartSweeper(t *testing.T) {
+	man, s, c := newManager(t, []*permissions.Permission{
+		{Type: permissions.Read, Table: "accounts", ExpiresAt: at(time.Hour)},
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	errs := make(chan error, 1)
+	man.StartSweeper(ctx, 10*time.Millisecond, func(err error) {
+		select {
+		case errs <- err:
+		default:
+		}
+	})
+	time.Sleep(50 * time.Millisecond)
+	perms, err := s.GetUserPerms(ctx, "alice")
+	assert.NoError(t, err)
+	assert.Len(t, perms, 1, "the grant is kept until it expires")
+
+	c.Set(t0.Add(time.Hour))
+	assert.Eventually(t, func() bool {
+		perms, err := s.GetUserPerms(ctx, "alice")
+		return err == nil && len(perms) == 0
+	}, time.Second, 10*time.Millisecond)
+	select {
+	case err := <-errs:
+		t.Errorf("sweeper failed: %v", err)
+	default:
+	}
+}
+
+func TestClose(t *testing.T) {
+	man, s, c := newManager(t, []*permissions.Permission{
+		{ID: "g1", Type: permissions.Read, Table: "accounts", ExpiresAt: at(time.Hour)},
+	})
+	ctx := context.Background()
+	man.StartSweeper(ctx, 10*time.Millisecond, nil)
+	man.StartWatching(ctx, nil)
+	orders := "SELECT * FROM orders WHERE id = 1"
+
+	// changes made elsewhere are watched until the manager is closed
+	assert.NoError(t, s.UpdateGrants(ctx, "alice", []*permissions.Permission{{ID: "g2", Type: permissions.Read, Table: "orders"}}, nil))
+	assert.Eventually(t, func() bool {
+		_, err := man.CheckPermissions(ctx, alice, orders)
+		return err == nil
+	}, time.Second, 10*time.Millisecond)
+	man.Close()
+	man.Close()
+	assert.NoError(t, s.UpdateGrants(ctx, "alice", nil, []string{"g2"}))
+	c.Set(t0.Add(time.Hour))
+	time.Sleep(50 * time.Millisecond)
+
+	_, err := man.CheckPermissions(ctx, alice, orders)
+	assert.NoError(t, err, "the removal is not seen")
+	perms, err := s.GetUserPerms(ctx, "alice")
+	assert.NoError(t, err)
+	if assert.Len(t, perms, 1) {
+		assert.Equal(t, "g1", perms[0].ID, "the expired grant is not swept")
+	}
+}
+
+// TestDeletedElsewhere checks that a user deleted from storage by another process stops existing once their cached
+// permissions expire, rather than lingering in the cache.
+func TestDeletedElsewhere(t *testing.T) {
+	man, s, c := newManager(t, []*permissions.Permission{
+		{ID: "g1", Type: permissions.Read, Table: "accounts"},
+	}, acl.WithPermissionCache(time.Minute, time.Hour))
+	ctx := context.Background()
+	sql := "SELECT * FROM accounts WHERE id = 1"
+	assert.NoError(t, s.DeleteUser(ctx, "alice"))
+
+	// the cached permissions are served until they expire
+	c.Set(t0.Add(30 * time.Second))
+	_, err := man.CheckPermissions(ctx, alice, sql)
+	assert.NoError(t, err)
+
+	// then storage is asked, and the user forgotten
+	c.Set(t0.Add(2 * time.Hour))
+	_, err = man.CheckPermissions(ctx, alice, sql)
+	assert.ErrorIs(t, err, storage.NoSuchUserError)
+	_, err = man.CheckPermissions(ctx, alice, sql)
+	assert.ErrorIs(t, err, acl.UnauthenticatedError)
+	_, err = man.Explain(ctx, root, "alice", sql)
+	assert.ErrorIs(t, err, acl.NoSuchUserError)
+	_, err = man.CreateUser(ctx, root, "alice", false)
+	assert.NoError(t, err, "and can be created again")
+}
+
+func TestStoreFaults(t *testing.T) {
+	man, s, c := newManager(t, []*permissions.Permission{
+		{ID: "g1", Type: permissions.Read, Table: "accounts"},
+	}, acl.WithPermissionCache(time.Minute, time.Hour))
+	ctx := context.Background()
+	injected := fmt.Errorf("injected")
+	accounts, orders := "SELECT * FROM accounts WHERE id = 1", "SELECT * FROM orders WHERE id = 1"
+
+	// a stale entry is served while refreshing it fails
+	s.InjectFault(memory.Fault{Ops: []string{"GetUserPerms"}, Err: injected})
+	c.Set(t0.Add(2 * time.Minute))
+	_, err := man.CheckPermissions(ctx, alice, accounts)
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool { return man.CacheStats().RefreshErrors == 1 }, time.Second, 10*time.Millisecond)
+
+	// and refreshed by a later lookup once the store is back
+	assert.NoError(t, s.StoreUserPerms(ctx, "alice", []*permissions.Permission{
+		{ID: "g1", Type: permissions.Read, Table: "accounts"},
+		{ID: "g2", Type: permissions.Read, Table: "orders"},
+	}))
+	s.ClearFaults()
+	c.Set(t0.Add(4 * time.Minute))
+	assert.Eventually(t, func() bool {
+		_, err := man.CheckPermissions(ctx, alice, orders)
+		return err == nil
+	}, time.Second, 10*time.Millisecond)
+
+	// an expired entry is not served, so the check fails with the store
+	s.InjectFault(memory.Fault{Ops: []string{"GetUserPerms"}, Err: injected})
+	c.Set(t0.Add(2 * time.Hour))
+	_, err = man.CheckPermissions(ctx, alice, accounts)
+	assert.ErrorIs(t, err, injected)
+	s.ClearFaults()
+	_, err = man.CheckPermissions(ctx, alice, accounts)
+	assert.NoError(t, err)
+
+	// a failed grant changes neither storage nor the cache
+	s.InjectFault(memory.Fault{Ops: []string{"UpdateGrantsIf"}, Err: injected})
+	err = man.AddPermissions(ctx, root, "alice", []*permissions.Permission{{Type: permissions.Write, Table: "accounts"}})
+	assert.ErrorIs(t, err, injected)
+	s.ClearFaults()
+	perms, err := s.GetUserPerms(ctx, "alice")
+	assert.NoError(t, err)
+	assert.Len(t, perms, 2)
+	_, err = man.CheckPermissions(ctx, alice, "DELETE FROM accounts WHERE id = 1")
+	assert.ErrorAs(t, err, &acl.InsufficientPermissionsError{})
+}
+
+func TestExpiredCacheEntries(t *testing.T) {
+	man, s, c := newManager(t, []*permissions.Permission{
+		{ID: "g1", Type: permissions.Read, Table: "accounts"},
+		{ID: "g2", Type: permissions.Read, Table: "orders", ExpiresAt: at(3 * time.Hour)},
+	}, acl.WithPermissionCache(time.Minute, time.Hour))
+	ctx := context.Background()
+	injected := fmt.Errorf("injected")
+
+	// expired cache entries are read from storage, not skipped
+	c.Set(t0.Add(2 * time.Hour))
+	all, err := man.GetAllPermissions(ctx, root)
+	assert.NoError(t, err)
+	assert.Len(t, all["alice"], 2)
+	c.Set(t0.Add(4 * time.Hour))
+	accesses, err := man.WhoCanAccess(ctx, root, "accounts", nil, 0)
+	assert.NoError(t, err)
+	if assert.Len(t, accesses, 1) {
+		assert.Equal(t, "alice", accesses[0].User)
+	}
+	c.Set(t0.Add(6 * time.Hour))
+	assert.NoError(t, man.SweepExpired(ctx))
+	perms, err := s.GetUserPerms(ctx, "alice")
+	assert.NoError(t, err)
+	if assert.Len(t, perms, 1) {
+		assert.Equal(t, "g1", perms[0].ID)
+	}
+
+	// or fail with the store
+	c.Set(t0.Add(8 * time.Hour))
+	s.InjectFault(memory.Fault{Ops: []string{"GetAllUserInfo", "GetUserPerms"}, Err: injected})
+	_, err = man.GetAllPermissions(ctx, root)
+	assert.ErrorIs(t, err, injected)
+	_, err = man.WhoCanAccess(ctx, root, "accounts", nil, 0)
+	assert.ErrorIs(t, err, injected)
+	assert.ErrorIs(t, man.SweepExpired(ctx), injected)
+}
+
+// TestSlowStore checks that a check waiting on the store does not hold up checks that need not.
+func TestSlowStore(t *testing.T) {
+	man, s, c := newManager(t, []*permissions.Permission{
+		{ID: "g1", Type: permissions.Read, Table: "accounts"},
+	}, acl.WithPermissionCache(time.Minute, time.Hour))
+	ctx := context.Background()
+	sql := "SELECT * FROM accounts WHERE id = 1"
+
+	c.Set(t0.Add(2 * time.Hour))
+	s.InjectFault(memory.Fault{Ops: []string{"GetUserPerms"}, Latency: time.Second, Times: 1})
+	slow := make(chan error, 1)
+	go func() {
+		_, err := man.CheckPermissions(ctx, alice, sql)
+		slow <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	start := time.Now()
+	_, err := man.CheckPermissions(ctx, root, sql)
+	assert.ErrorAs(t, err, &acl.InsufficientPermissionsError{})
+	assert.Less(t, time.Since(start), 500*time.Millisecond)
+	select {
+	case err := <-slow:
+		t.Errorf("the slow check finished first: %v", err)
+	default:
+	}
+	assert.NoError(t, <-slow)
+}
+
+// idlessStorage reads grants back without their ids, as no store should, counting the reads.
+type idlessStorage struct {
+	*memory.MemoryACLStorage
+	reads *int
+}
+
+func (s idlessStorage) GetUserPermsVersion(ctx context.Context, user string) ([]*permissions.Permission, string, error) {
+	*s.reads++
+	perms, version, err := s.MemoryACLStorage.GetUserPermsVersion(ctx, user)
+	for _, p := range perms {
+		p.ID = ""
+	}
+	return perms, version, err
+}
+
+func TestGrantsWithoutIDs(t *testing.T) {
+	_, s, _ := newManager(t, []*permissions.Permission{{Type: permissions.Read, Table: "accounts"}})
+	ctx := context.Background()
+	reads := 0
+	man, err := acl.NewACLManager(ctx, idlessStorage{s, &reads}, map[string][]string{"accounts": {"id"}}, acl.WithKeySecret([]byte("secret")))
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	// the grants are not replaced wholesale, which could not be made conditional, nor is the write retried
+	reads = 0
+	err = man.AddPermissions(ctx, root, "alice", []*permissions.Permission{{Type: permissions.Read, Table: "orders"}})
+	assert.ErrorIs(t, err, acl.MissingGrantIDError)
+	assert.NotErrorIs(t, err, acl.VersionConflictError)
+	assert.Equal(t, 1, reads)
+	perms, err := s.GetUserPerms(ctx, "alice")
+	assert.NoError(t, err)
+	if assert.Len(t, perms, 1) {
+		assert.Equal(t, "accounts", perms[0].Table)
+	}
+}
@@ -0,0 +1,88 @@
+package acl
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"chroma1/model/identity"
+)
+
+const (
+	defaultMaxElevationTime = time.Hour
+)
+
+var (
+	NotBreakGlassError = fmt.Errorf("user is not allowed to break glass")
+	MissingReasonError = fmt.Errorf("a justification is required to break glass")
+)
+
+// Elevation is a temporary, self-granted blanket read access for a break-glass user.
+type Elevation struct {
+	ID        string    `json:"id"`
+	User      string    `json:"user"`
+	Reason    string    `json:"reason"`
+	Start     time.Time `json:"start"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// WithMaxElevationTime bounds the window a break-glass elevation may request. Defaults to one hour.
+func WithMaxElevationTime(d time.Duration) Option {
+	return func(acl *ACLManager) {
+		acl.maxElevationTime = d
+	}
+}
+
+// BreakGlass elevates the caller to blanket read access for the given duration, capped at the configured maximum.
+// The user must carry the break-glass flag in storage and must supply a reason, which is recorded with the elevation.
+// An existing elevation is replaced.
+func (acl *ACLManager) BreakGlass(ctx context.Context, caller *identity.Identity, reason string, duration time.Duration) (*Elevation, error) {
+	acl.mu.Lock()
+	defer acl.mu.Unlock()
+
+	user, err := acl.callerUser(caller)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := acl.breakGlassUsers[user]; !ok {
+		return nil, NotBreakGlassError
+	}
+	if reason == "" {
+		return nil, MissingReasonError
+	}
+	if duration <= 0 || duration > acl.maxElevationTime {
+		duration = acl.maxElevationTime
+	}
+
+	id, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+	now := acl.now()
+	e := &Elevation{
+		ID:        id,
+		User:      user,
+		Reason:    reason,
+		Start:     now,
+		ExpiresAt: now.Add(duration),
+	}
+	if err := acl.storage.RecordElevation(ctx, e.ID, e.User, e.Reason, e.Start, e.ExpiresAt); err != nil {
+		return nil, fmt.Errorf("error recording elevation for %s: %w", user, err)
+	}
+	acl.elevations[user] = e
+	return e, nil
+}
+
+// activeElevation returns the user's elevation if it is still within its window, revoking it otherwise.
+// Must be called with acl.mu held.
+func (acl *ACLManager) activeElevation(user string, now time.Time) *Elevation {
+	e, ok := acl.elevations[user]
+	if !ok {
+		return nil
+	}
+	if !now.Before(e.ExpiresAt) {
+		delete(acl.elevations, user)
+		return nil
+	}
+	return e
+}
@@ -0,0 +1,95 @@
+package acl_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"chroma1/internal/acl"
+)
+
+func TestBreakGlass(t *testing.T) {
+	ctx := context.Background()
+	man, s, c := newManager(t, nil, acl.WithMaxElevationTime(30*time.Minute))
+	read, write := "SELECT * FROM accounts WHERE id = 1", "DELETE FROM accounts WHERE id = 1"
+
+	// only users carrying the flag in storage may break glass
+	_, err := man.BreakGlass(ctx, alice, "incident 1", time.Minute)
+	assert.ErrorIs(t, err, acl.NotBreakGlassError)
+	assert.NoError(t, s.SetBreakGlass("alice", true))
+	assert.NoError(t, man.Reload(ctx))
+	_, err = man.BreakGlass(ctx, alice, "", time.Minute)
+	assert.ErrorIs(t, err, acl.MissingReasonError)
+
+	// the window is capped at the maximum
+	e, err := man.BreakGlass(ctx, alice, "incident 1", 2*time.Hour)
+	assert.NoError(t, err)
+	assert.Equal(t, "alice", e.User)
+	assert.Equal(t, "incident 1", e.Reason)
+	assert.Equal(t, t0, e.Start)
+	assert.Equal(t, t0.Add(30*time.Minute), e.ExpiresAt)
+
+	// elevated reads pass and are tagged with the elevation, writes still need a grant
+	tagged, err := man.CheckPermissions(ctx, alice, read)
+	assert.NoError(t, err)
+	if assert.NotNil(t, tagged) {
+		assert.Equal(t, e.ID, tagged.ID)
+	}
+	_, err = man.CheckPermissions(ctx, alice, write)
+	assert.ErrorAs(t, err, &acl.InsufficientPermissionsError{})
+	recorded := s.Elevations()
+	if assert.Len(t, recorded, 1) {
+		assert.Equal(t, e.ID, recorded[0].ID)
+		assert.Equal(t, "incident 1", recorded[0].Reason)
+		if assert.Len(t, recorded[0].Queries, 1) {
+			assert.Equal(t, read, recorded[0].Queries[0].SQL)
+		}
+	}
+
+	// and the elevation is revoked once its window ends
+	c.Set(t0.Add(30 * time.Minute))
+	tagged, err = man.CheckPermissions(ctx, alice, read)
+	assert.ErrorAs(t, err, &acl.InsufficientPermissionsError{})
+	assert.Nil(t, tagged)
+}
+
+func TestBreakGlassRestart(t *testing.T) {
+	ctx := context.Background()
+	man, s, c := newManager(t, nil)
+	sql := "SELECT * FROM accounts WHERE id = 1"
+	assert.NoError(t, s.SetBreakGlass("alice", true))
+	assert.NoError(t, man.Reload(ctx))
+	e, err := man.BreakGlass(ctx, alice, "incident 1", time.Hour)
+	assert.NoError(t, err)
+
+	restart := func() *acl.ACLManager {
+		man, err := acl.NewACLManager(ctx, s, map[string][]string{"accounts": {"id"}},
+			acl.WithClock(c.Now), acl.WithKeySecret([]byte("secret")))
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		return man
+	}
+
+	// an active elevation is read back from storage
+	c.Set(t0.Add(30 * time.Minute))
+	tagged, err := restart().CheckPermissions(ctx, alice, sql)
+	assert.NoError(t, err)
+	if assert.NotNil(t, tagged) {
+		assert.Equal(t, e.ID, tagged.ID)
+		assert.Equal(t, e.ExpiresAt, tagged.ExpiresAt)
+	}
+
+	// unless it has ended
+	c.Set(t0.Add(time.Hour))
+	_, err = restart().CheckPermissions(ctx, alice, sql)
+	assert.ErrorAs(t, err, &acl.InsufficientPermissionsError{})
+
+	// or the user has lost the right to break glass
+	c.Set(t0)
+	assert.NoError(t, s.SetBreakGlass("alice", false))
+	_, err = restart().CheckPermissions(ctx, alice, sql)
+	assert.ErrorAs(t, err, &acl.InsufficientPermissionsError{})
+}
@@ -0,0 +1,275 @@
+// Package cache is a read-through cache for values held in a backing store. Entries are served from memory until they
+// expire; once stale they are still served while being refreshed in the background, so that a short store outage
+// delays updates rather than failing lookups.
+package cache
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Loader reads the value for key from the backing store.
+type Loader[K comparable, V any] func(ctx context.Context, key K) (V, error)
+
+// Stats counts what the cache has done since it was created.
+type Stats struct {
+	Hits          uint64 // lookups served fresh from memory
+	StaleServed   uint64 // lookups served a stale value while it was being refreshed
+	Misses        uint64 // lookups that had to wait for the store, because the key was missing or expired
+	LoadErrors    uint64 // misses the store failed to load
+	Refreshes     uint64 // background refreshes that replaced a stale value
+	RefreshErrors uint64 // background refreshes the store failed
+}
+
+type config struct {
+	refreshAfter time.Duration
+	expireAfter  time.Duration
+	now          func() time.Time
+}
+
+// Option configures optional Cache behaviour.
+type Option func(*config)
+
+// WithRefreshAfter sets how old an entry may get before lookups trigger a background refresh. Zero, the default, never
+// refreshes.
+func WithRefreshAfter(d time.Duration) Option {
+	return func(c *config) {
+		c.refreshAfter = d
+	}
+}
+
+// WithExpireAfter sets how old an entry may get before it is no longer served, and lookups wait for the store instead.
+// It should be well above the refresh interval, to ride out store outages. Zero, the default, never expires entries.
+func WithExpireAfter(d time.Duration) Option {
+	return func(c *config) {
+		c.expireAfter = d
+	}
+}
+
+// WithClock overrides the clock entry ages are measured with. Defaults to time.Now.
+func WithClock(now func() time.Time) Option {
+	return func(c *config) {
+		c.now = now
+	}
+}
+
+type entry[V any] struct {
+	value     V
+	loadedAt  time.Time
+	refreshAt time.Time // zero if never refreshed
+	// set while a background refresh is running
+	refreshing bool
+}
+
+// call is a load in progress, shared by every lookup that missed the key meanwhile.
+type call[V any] struct {
+	done  chan struct{}
+	value V
+	err   error
+}
+
+// Cache is safe for concurrent use.
+type Cache[K comparable, V any] struct {
+	load   Loader[K, V]
+	config config
+	// runs background refreshes, which outlive the lookups that start them
+	ctx       context.Context
+	cancel    context.CancelFunc
+	onRefresh func(key K)
+
+	mu      sync.Mutex
+	entries map[K]*entry[V]
+	calls   map[K]*call[V]
+
+	hits, staleServed, misses, loadErrors, refreshes, refreshErrors atomic.Uint64
+}
+
+// New returns an empty cache loading values with load.
+func New[K comparable, V any](load Loader[K, V], opts ...Option) *Cache[K, V] {
+	c := &Cache[K, V]{
+		load:    load,
+		config:  config{now: time.Now},
+		entries: make(map[K]*entry[V]),
+		calls:   make(map[K]*call[V]),
+	}
+	for _, opt := range opts {
+		opt(&c.config)
+	}
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	return c
+}
+
+// OnRefresh sets a function called after a background refresh replaces the value for key, e.g. to update indexes
+// derived from the cache. It is called without the cache's lock held, so it may use the cache.
+func (c *Cache[K, V]) OnRefresh(fn func(key K)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.onRefresh = fn
+}
+
+// Get returns the value for key, loading it if missing or expired. Concurrent lookups of a key being loaded wait for
+// that load rather than starting their own. A stale value is returned at once, and refreshed in the background.
+func (c *Cache[K, V]) Get(ctx context.Context, key K) (V, error) {
+	c.mu.Lock()
+	now := c.config.now()
+	prev := c.entries[key]
+	if prev != nil && !c.expired(prev, now) {
+		if c.stale(prev, now) {
+			c.staleServed.Add(1)
+			if !prev.refreshing && !now.Before(prev.refreshAt) {
+				prev.refreshing = true
+				go c.refresh(key, prev)
+			}
+		} else {
+			c.hits.Add(1)
+		}
+		v := prev.value
+		c.mu.Unlock()
+		return v, nil
+	}
+
+	c.misses.Add(1)
+	if cl, ok := c.calls[key]; ok {
+		c.mu.Unlock()
+		select {
+		case <-cl.done:
+			return cl.value, cl.err
+		case <-ctx.Done():
+			var zero V
+			return zero, ctx.Err()
+		}
+	}
+	cl := &call[V]{done: make(chan struct{})}
+	c.calls[key] = cl
+	c.mu.Unlock()
+
+	cl.value, cl.err = c.load(ctx, key)
+
+	c.mu.Lock()
+	delete(c.calls, key)
+	if cl.err != nil {
+		c.loadErrors.Add(1)
+	} else if c.entries[key] == prev {
+		// only if nothing was stored meanwhile, which would be newer
+		c.entries[key] = &entry[V]{value: cl.value, loadedAt: c.config.now()}
+	}
+	c.mu.Unlock()
+	close(cl.done)
+	return cl.value, cl.err
+}
+
+// refresh reloads a stale entry. A failed refresh is retried by a lookup after the refresh interval.
+func (c *Cache[K, V]) refresh(key K, e *entry[V]) {
+	v, err := c.load(c.ctx, key)
+
+	c.mu.Lock()
+	now := c.config.now()
+	if c.entries[key] != e {
+		// replaced meanwhile
+		c.mu.Unlock()
+		return
+	}
+	if err != nil {
+		c.refreshErrors.Add(1)
+		e.refreshing = false
+		e.refreshAt = now.Add(c.config.refreshAfter)
+		c.mu.Unlock()
+		return
+	}
+	c.refreshes.Add(1)
+	c.entries[key] = &entry[V]{value: v, loadedAt: now}
+	onRefresh := c.onRefresh
+	c.mu.Unlock()
+	if onRefresh != nil {
+		onRefresh(key)
+	}
+}
+
+// Must be called with c.mu held.
+func (c *Cache[K, V]) stale(e *entry[V], now time.Time) bool {
+	return c.config.refreshAfter > 0 && now.Sub(e.loadedAt) >= c.config.refreshAfter
+}
+
+// Must be called with c.mu held.
+func (c *Cache[K, V]) expired(e *entry[V], now time.Time) bool {
+	return c.config.expireAfter > 0 && now.Sub(e.loadedAt) >= c.config.expireAfter
+}
+
+// Peek returns the value for key if it is cached and not expired, without loading it or counting a lookup.
+func (c *Cache[K, V]) Peek(key K) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok || c.expired(e, c.config.now()) {
+		var zero V
+		return zero, false
+	}
+	return e.value, true
+}
+
+// Contains reports whether key has been cached, even if its value has since expired. Expired entries are kept until
+// replaced, so this tracks the keys known to exist through store outages.
+func (c *Cache[K, V]) Contains(key K) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.entries[key]
+	return ok
+}
+
+// Set caches value for key as freshly loaded, e.g. after writing it through to the store.
+func (c *Cache[K, V]) Set(key K, value V) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[key] = &entry[V]{value: value, loadedAt: c.config.now()}
+}
+
+// Delete drops key from the cache.
+func (c *Cache[K, V]) Delete(key K) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, key)
+}
+
+// Reset replaces the whole cache with values, as freshly loaded.
+func (c *Cache[K, V]) Reset(values map[K]V) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.config.now()
+	c.entries = make(map[K]*entry[V], len(values))
+	for k, v := range values {
+		c.entries[k] = &entry[V]{value: v, loadedAt: now}
+	}
+}
+
+// Entries returns the cached values that have not expired.
+func (c *Cache[K, V]) Entries() map[K]V {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.config.now()
+	res := make(map[K]V, len(c.entries))
+	for k, e := range c.entries {
+		if !c.expired(e, now) {
+			res[k] = e.value
+		}
+	}
+	return res
+}
+
+// Stats returns the cache's counters.
+func (c *Cache[K, V]) Stats() Stats {
+	return Stats{
+		Hits:          c.hits.Load(),
+		StaleServed:   c.staleServed.Load(),
+		Misses:        c.misses.Load(),
+		LoadErrors:    c.loadErrors.Load(),
+		Refreshes:     c.refreshes.Load(),
+		RefreshErrors: c.refreshErrors.Load(),
+	}
+}
+
+// Close cancels background refreshes in progress. The cache can still be used, but refreshes started later fail.
+func (c *Cache[K, V]) Close() {
+	c.cancel()
+}
@@ -0,0 +1,217 @@
+package cache_test
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"chroma1/internal/acl/cache"
+)
+
+// clock is a fake clock advanced by hand.
+type clock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func newClock() *clock {
+	return &clock{now: time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *clock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// store is a backing store whose values and failures are set by tests.
+type store struct {
+	mu     sync.Mutex
+	values map[string]int
+	err    error
+	loads  int
+	gate   chan struct{} // if set, loads wait for it to be closed
+}
+
+func (s *store) set(key string, v int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.values[key] = v
+}
+
+func (s *store) fail(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.err = err
+}
+
+func (s *store) loadCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.loads
+}
+
+func (s *store) load(ctx context.Context, key string) (int, error) {
+	s.mu.Lock()
+	gate := s.gate
+	s.mu.Unlock()
+	if gate != nil {
+		<-gate
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.loads++
+	if s.err != nil {
+		return 0, s.err
+	}
+	v, ok := s.values[key]
+	if !ok {
+		return 0, fmt.Errorf("no such key %s", key)
+	}
+	return v, nil
+}
+
+func newCache(clk *clock) (*cache.Cache[string, int], *store, chan string) {
+	s := &store{values: map[string]int{"a": 1}}
+	c := cache.New[string, int](s.load, cache.WithRefreshAfter(time.Minute), cache.WithExpireAfter(time.Hour), cache.WithClock(clk.Now))
+	refreshed := make(chan string, 10)
+	c.OnRefresh(func(key string) { refreshed <- key })
+	return c, s, refreshed
+}
+
+func get(t *testing.T, c *cache.Cache[string, int], key string) int {
+	t.Helper()
+	v, err := c.Get(context.Background(), key)
+	assert.NoError(t, err)
+	return v
+}
+
+func waitRefresh(t *testing.T, refreshed chan string, key string) {
+	t.Helper()
+	select {
+	case k := <-refreshed:
+		assert.Equal(t, key, k)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("%s was not refreshed", key)
+	}
+}
+
+func TestStaleWhileRevalidate(t *testing.T) {
+	clk := newClock()
+	c, s, refreshed := newCache(clk)
+
+	assert.Equal(t, 1, get(t, c, "a"), "miss")
+	s.set("a", 2)
+	clk.Advance(59 * time.Second)
+	assert.Equal(t, 1, get(t, c, "a"), "fresh")
+
+	// a stale value is served while it is refreshed
+	clk.Advance(time.Second)
+	assert.Equal(t, 1, get(t, c, "a"))
+	waitRefresh(t, refreshed, "a")
+	assert.Equal(t, 2, get(t, c, "a"))
+	assert.Equal(t, cache.Stats{Hits: 2, StaleServed: 1, Misses: 1, Refreshes: 1}, c.Stats())
+
+	// an expired value is not served, but loaded again
+	s.set("a", 3)
+	clk.Advance(time.Hour)
+	assert.Equal(t, 3, get(t, c, "a"))
+	assert.Equal(t, uint64(2), c.Stats().Misses)
+}
+
+func TestRefreshErrors(t *testing.T) {
+	clk := newClock()
+	c, s, _ := newCache(clk)
+	assert.Equal(t, 1, get(t, c, "a"))
+
+	// while the store is down, the stale value is served until it expires
+	s.fail(fmt.Errorf("store down"))
+	clk.Advance(time.Minute)
+	assert.Equal(t, 1, get(t, c, "a"))
+	assert.Eventually(t, func() bool { return c.Stats().RefreshErrors == 1 }, 5*time.Second, time.Millisecond)
+	assert.Equal(t, 1, get(t, c, "a"))
+	assert.Equal(t, 2, s.loadCount(), "a failed refresh is not retried until the refresh interval has passed")
+
+	clk.Advance(time.Hour)
+	_, err := c.Get(context.Background(), "a")
+	assert.Error(t, err)
+	_, ok := c.Peek("a")
+	assert.False(t, ok)
+	assert.Empty(t, c.Entries())
+	assert.True(t, c.Contains("a"), "expired keys are still known")
+	assert.Equal(t, uint64(1), c.Stats().LoadErrors)
+
+	// once the store is back, lookups recover
+	s.fail(nil)
+	assert.Equal(t, 1, get(t, c, "a"))
+}
+
+func TestConcurrentMisses(t *testing.T) {
+	clk := newClock()
+	c, s, _ := newCache(clk)
+	s.gate = make(chan struct{})
+
+	const lookups = 10
+	var wg sync.WaitGroup
+	for i := 0; i < lookups; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.Equal(t, 1, get(t, c, "a"))
+		}()
+	}
+	assert.Eventually(t, func() bool { return c.Stats().Misses == lookups }, 5*time.Second, time.Millisecond)
+	close(s.gate)
+	wg.Wait()
+	assert.Equal(t, 1, s.loadCount(), "concurrent misses share one load")
+
+	// a waiting lookup gives up when its context ends, without affecting the load
+	s.mu.Lock()
+	s.gate = make(chan struct{})
+	s.mu.Unlock()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, err := c.Get(context.Background(), "b")
+		assert.Error(t, err)
+	}()
+	assert.Eventually(t, func() bool { return c.Stats().Misses == lookups+1 }, 5*time.Second, time.Millisecond)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := c.Get(ctx, "b")
+	assert.ErrorIs(t, err, context.Canceled)
+	close(s.gate)
+	<-done
+}
+
+func TestWritesWin(t *testing.T) {
+	clk := newClock()
+	c, s, _ := newCache(clk)
+	assert.Equal(t, 1, get(t, c, "a"))
+
+	// a value set while a refresh is running is not overwritten by it
+	s.gate = make(chan struct{})
+	clk.Advance(time.Minute)
+	assert.Equal(t, 1, get(t, c, "a"))
+	c.Set("a", 5)
+	close(s.gate)
+	assert.Eventually(t, func() bool { return s.loadCount() == 2 }, 5*time.Second, time.Millisecond)
+	assert.Equal(t, 5, get(t, c, "a"))
+	assert.Equal(t, uint64(0), c.Stats().Refreshes)
+
+	c.Reset(map[string]int{"b": 2})
+	assert.False(t, c.Contains("a"))
+	assert.Equal(t, map[string]int{"b": 2}, c.Entries())
+	c.Delete("b")
+	assert.Empty(t, c.Entries())
+}
@@ -0,0 +1,261 @@
+// Package condition implements the small expression language used to attach conditions to permissions.
+//
+// A condition is a boolean expression over the request environment, for example:
+//
+//	claims.service == "batch" && cidr(source_ip, "10.0.0.0/8")
+//	claims.on_call == true || time.hour in [9, 10, 11, 12, 13, 14, 15, 16]
+//
+// Supported are string, number, boolean and null literals, lists, dotted identifiers resolved against the
+// environment, the comparison operators == != < <= > >= and in, the logical operators && || and !, parentheses, and
+// the functions listed in the functions map. Expressions have no side effects and their size and nesting are bounded.
+// Identifiers missing from the environment evaluate to null.
+package condition
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Expr is a compiled condition.
+type Expr struct {
+	src  string
+	root node
+}
+
+// Compile parses a condition so it can be evaluated repeatedly.
+func Compile(src string) (*Expr, error) {
+	root, err := parse(src)
+	if err != nil {
+		return nil, fmt.Errorf("invalid condition %q: %w", src, err)
+	}
+	return &Expr{
+		src:  src,
+		root: root,
+	}, nil
+}
+
+func (e *Expr) String() string {
+	return e.src
+}
+
+// Eval evaluates the condition against env. It is an error for the condition not to produce a boolean.
+func (e *Expr) Eval(env map[string]interface{}) (bool, error) {
+	v, err := eval(e.root, env)
+	if err != nil {
+		return false, fmt.Errorf("error evaluating condition %q: %w", e.src, err)
+	}
+	b, ok := v.(bool)
+	if !ok {
+		return false, fmt.Errorf("condition %q evaluated to %v, not a boolean", e.src, v)
+	}
+	return b, nil
+}
+
+var functions = map[string]func(args []interface{}) (interface{}, error){
+	// cidr(ip, block) reports whether the address ip falls inside the CIDR block.
+	"cidr": func(args []interface{}) (interface{}, error) {
+		if len(args) != 2 {
+			return nil, fmt.Errorf("cidr takes 2 arguments")
+		}
+		ip, ok1 := args[0].(string)
+		block, ok2 := args[1].(string)
+		if !ok1 || !ok2 {
+			return false, nil
+		}
+		_, n, err := net.ParseCIDR(block)
+		if err != nil {
+			return nil, err
+		}
+		parsed := net.ParseIP(ip)
+		return parsed != nil && n.Contains(parsed), nil
+	},
+	// starts_with(s, prefix) reports whether the string s begins with prefix.
+	"starts_with": func(args []interface{}) (interface{}, error) {
+		if len(args) != 2 {
+			return nil, fmt.Errorf("starts_with takes 2 arguments")
+		}
+		s, ok1 := args[0].(string)
+		prefix, ok2 := args[1].(string)
+		return ok1 && ok2 && strings.HasPrefix(s, prefix), nil
+	},
+}
+
+func eval(n node, env map[string]interface{}) (interface{}, error) {
+	switch v := n.(type) {
+	case *literal:
+		return v.val, nil
+	case *ident:
+		return lookup(env, v.path), nil
+	case *list:
+		res := make([]interface{}, len(v.elems))
+		for i, e := range v.elems {
+			val, err := eval(e, env)
+			if err != nil {
+				return nil, err
+			}
+			res[i] = val
+		}
+		return res, nil
+	case *not:
+		b, err := evalBool(v.operand, env)
+		if err != nil {
+			return nil, err
+		}
+		return !b, nil
+	case *call:
+		args := make([]interface{}, len(v.args))
+		for i, a := range v.args {
+			val, err := eval(a, env)
+			if err != nil {
+				return nil, err
+			}
+			args[i] = val
+		}
+		return functions[v.name](args)
+	case *binary:
+		return evalBinary(v, env)
+	}
+	return nil, fmt.Errorf("unknown expression node %T", n)
+}
+
+func evalBool(n node, env map[string]interface{}) (bool, error) {
+	v, err := eval(n, env)
+	if err != nil {
+		return false, err
+	}
+	b, ok := v.(bool)
+	if !ok {
+		return false, fmt.Errorf("expected a boolean, got %v", v)
+	}
+	return b, nil
+}
+
+func evalBinary(b *binary, env map[string]interface{}) (interface{}, error) {
+	// Logical operators short-circuit.
+	switch b.op {
+	case "&&", "||":
+		l, err := evalBool(b.left, env)
+		if err != nil {
+			return nil, err
+		}
+		if l == (b.op == "||") {
+			return l, nil
+		}
+		return evalBool(b.right, env)
+	}
+
+	l, err := eval(b.left, env)
+	if err != nil {
+		return nil, err
+	}
+	r, err := eval(b.right, env)
+	if err != nil {
+		return nil, err
+	}
+	switch b.op {
+	case "==":
+		return equal(l, r), nil
+	case "!=":
+		return !equal(l, r), nil
+	case "in":
+		elems, ok := r.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("right side of in must be a list, got %v", r)
+		}
+		for _, e := range elems {
+			if equal(l, e) {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+
+	// Ordering comparisons only apply to two numbers or two strings; anything else (including null) is false.
+	if lf, ok := l.(float64); ok {
+		if rf, ok := r.(float64); ok {
+			return compare(b.op, lf < rf, lf == rf), nil
+		}
+	}
+	if ls, ok := l.(string); ok {
+		if rs, ok := r.(string); ok {
+			return compare(b.op, ls < rs, ls == rs), nil
+		}
+	}
+	return false, nil
+}
+
+func compare(op string, less, eq bool) bool {
+	switch op {
+	case "<":
+		return less
+	case "<=":
+		return less || eq
+	case ">":
+		return !less && !eq
+	case ">=":
+		return !less
+	}
+	return false
+}
+
+func equal(a, b interface{}) bool {
+	switch av := a.(type) {
+	case []interface{}:
+		bv, ok := b.([]interface{})
+		if !ok || len(av) != len(bv) {
+			return false
+		}
+		for i := range av {
+			if !equal(av[i], bv[i]) {
+				return false
+			}
+		}
+		return true
+	case map[string]interface{}:
+		return false
+	}
+	if _, ok := b.([]interface{}); ok {
+		return false
+	}
+	if _, ok := b.(map[string]interface{}); ok {
+		return false
+	}
+	return a == b
+}
+
+// lookup resolves a dotted path through nested maps, normalizing values to the types the language understands.
+func lookup(env map[string]interface{}, path []string) interface{} {
+	var cur interface{} = env
+	for _, p := range path {
+		switch m := cur.(type) {
+		case map[string]interface{}:
+			cur = m[p]
+		case map[string]string:
+			s, ok := m[p]
+			if !ok {
+				return nil
+			}
+			cur = s
+		default:
+			return nil
+		}
+	}
+	return normalize(cur)
+}
+
+func normalize(v interface{}) interface{} {
+	switch x := v.(type) {
+	case int:
+		return float64(x)
+	case int64:
+		return float64(x)
+	case []string:
+		res := make([]interface{}, len(x))
+		for i, s := range x {
+			res[i] = s
+		}
+		return res
+	}
+	return v
+}
@@ -0,0 +1,103 @@
+package condition_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"chroma1/internal/acl/condition"
+)
+
+func TestEval(t *testing.T) {
+	env := map[string]interface{}{
+		"user":      "alice",
+		"source_ip": "10.1.2.3",
+		"claims": map[string]interface{}{
+			"service": "batch",
+			"on_call": true,
+			"level":   float64(3),
+			"groups":  []interface{}{"eng", "sre"},
+		},
+		"time": map[string]interface{}{
+			"hour":    14,
+			"weekday": "Tuesday",
+		},
+	}
+
+	testcases := []struct {
+		cond string
+		exp  bool
+	}{
+		{cond: `claims.service == "batch"`, exp: true},
+		{cond: `claims.service == 'web'`, exp: false},
+		{cond: `claims.service != "web"`, exp: true},
+		{cond: `claims.on_call`, exp: true},
+		{cond: `!claims.on_call`, exp: false},
+		{cond: `claims.on_call == true && user == "alice"`, exp: true},
+		{cond: `claims.on_call == false || user == "alice"`, exp: true},
+		{cond: `claims.level >= 3 && claims.level < 4`, exp: true},
+		{cond: `claims.level > 3`, exp: false},
+		{cond: `time.hour >= 9 && time.hour < 17`, exp: true},
+		{cond: `time.weekday in ["Saturday", "Sunday"]`, exp: false},
+		{cond: `"sre" in claims.groups`, exp: true},
+		{cond: `cidr(source_ip, "10.0.0.0/8")`, exp: true},
+		{cond: `cidr(source_ip, "192.168.0.0/16")`, exp: false},
+		{cond: `starts_with(user, "al")`, exp: true},
+		{cond: `claims.missing == null`, exp: true},
+		{cond: `claims.missing == "x"`, exp: false},
+		{cond: `claims.missing > 1`, exp: false},
+		{cond: `!(user == "bob" || (claims.level == 3 && !claims.on_call))`, exp: true},
+	}
+	for i, tc := range testcases {
+		t.Run(fmt.Sprintf("TestEval case %v", i), func(t *testing.T) {
+			e, err := condition.Compile(tc.cond)
+			require.NoError(t, err)
+			res, err := e.Eval(env)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.exp, res)
+		})
+	}
+}
+
+func TestEvalErrors(t *testing.T) {
+	env := map[string]interface{}{
+		"user": "alice",
+	}
+
+	testcases := []string{
+		`user`,
+		`user == "alice" && 5`,
+		`user in "alice"`,
+		`cidr(user)`,
+	}
+	for i, cond := range testcases {
+		t.Run(fmt.Sprintf("TestEvalErrors case %v", i), func(t *testing.T) {
+			e, err := condition.Compile(cond)
+			require.NoError(t, err)
+			_, err = e.Eval(env)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	testcases := []string{
+		``,
+		`user ==`,
+		`user == "alice`,
+		`(user == "alice"`,
+		`user == "alice")`,
+		`exec("rm -rf /")`,
+		`user = "alice"`,
+		`user == "alice" user`,
+		`[1, 2`,
+	}
+	for i, cond := range testcases {
+		t.Run(fmt.Sprintf("TestCompileErrors case %v", i), func(t *testing.T) {
+			_, err := condition.Compile(cond)
+			assert.Error(t, err)
+		})
+	}
+}
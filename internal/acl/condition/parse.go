@@ -0,0 +1,245 @@
+package condition
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	maxLength = 1024
+	maxDepth  = 32
+)
+
+type node interface{}
+
+type literal struct {
+	val interface{}
+}
+
+// ident is a dotted path into the evaluation environment, e.g. claims.team.
+type ident struct {
+	path []string
+}
+
+type list struct {
+	elems []node
+}
+
+type not struct {
+	operand node
+}
+
+type binary struct {
+	op          string
+	left, right node
+}
+
+type call struct {
+	name string
+	args []node
+}
+
+type parser struct {
+	toks  []token
+	pos   int
+	depth int
+}
+
+func parse(src string) (node, error) {
+	if len(src) > maxLength {
+		return nil, fmt.Errorf("condition longer than %d characters", maxLength)
+	}
+	toks, err := lex(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{toks: toks}
+	n, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokEOF {
+		return nil, fmt.Errorf("at %d: unexpected %q", t.pos, t.val)
+	}
+	return n, nil
+}
+
+func (p *parser) peek() token {
+	return p.toks[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.toks[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) accept(op string) bool {
+	if t := p.peek(); t.kind == tokOp && t.val == op {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) expect(op string) error {
+	if !p.accept(op) {
+		t := p.peek()
+		return fmt.Errorf("at %d: expected %q", t.pos, op)
+	}
+	return nil
+}
+
+func (p *parser) parseOr() (node, error) {
+	p.depth++
+	defer func() { p.depth-- }()
+	if p.depth > maxDepth {
+		return nil, fmt.Errorf("condition nested deeper than %d", maxDepth)
+	}
+
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("||") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &binary{op: "||", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseAnd() (node, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("&&") {
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = &binary{op: "&&", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseNot() (node, error) {
+	if p.accept("!") {
+		operand, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &not{operand: operand}, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *parser) parseComparison() (node, error) {
+	left, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	t := p.peek()
+	switch {
+	case t.kind == tokOp && (t.val == "==" || t.val == "!=" || t.val == "<" || t.val == "<=" || t.val == ">" || t.val == ">="):
+	case t.kind == tokIdent && t.val == "in":
+	default:
+		return left, nil
+	}
+	p.next()
+	right, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	return &binary{op: t.val, left: left, right: right}, nil
+}
+
+func (p *parser) parseOperand() (node, error) {
+	t := p.next()
+	switch t.kind {
+	case tokString:
+		return &literal{val: t.val}, nil
+	case tokNumber:
+		f, err := strconv.ParseFloat(t.val, 64)
+		if err != nil {
+			return nil, fmt.Errorf("at %d: bad number %q", t.pos, t.val)
+		}
+		return &literal{val: f}, nil
+	case tokIdent:
+		switch t.val {
+		case "true":
+			return &literal{val: true}, nil
+		case "false":
+			return &literal{val: false}, nil
+		case "null":
+			return &literal{val: nil}, nil
+		}
+		if p.accept("(") {
+			return p.parseCall(t)
+		}
+		return &ident{path: strings.Split(t.val, ".")}, nil
+	case tokOp:
+		switch t.val {
+		case "(":
+			n, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			return n, p.expect(")")
+		case "[":
+			return p.parseList()
+		}
+	case tokEOF:
+		return nil, fmt.Errorf("unexpected end of condition")
+	}
+	return nil, fmt.Errorf("at %d: unexpected %q", t.pos, t.val)
+}
+
+func (p *parser) parseCall(name token) (node, error) {
+	if _, ok := functions[name.val]; !ok {
+		return nil, fmt.Errorf("at %d: unknown function %q", name.pos, name.val)
+	}
+	c := &call{name: name.val}
+	if p.accept(")") {
+		return c, nil
+	}
+	for {
+		arg, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		c.args = append(c.args, arg)
+		if p.accept(")") {
+			return c, nil
+		}
+		if err := p.expect(","); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (p *parser) parseList() (node, error) {
+	l := &list{}
+	if p.accept("]") {
+		return l, nil
+	}
+	for {
+		elem, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		l.elems = append(l.elems, elem)
+		if p.accept("]") {
+			return l, nil
+		}
+		if err := p.expect(","); err != nil {
+			return nil, err
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package acl
+
+import (
+	"fmt"
+	"time"
+
+	"chroma1/internal/acl/condition"
+	"chroma1/model/identity"
+	"chroma1/model/permissions"
+)
+
+// applies returns a filter selecting the permissions that are in effect for the caller at time now: those inside their
+// validity window whose condition, if any, holds for the request.
+// Must be called with acl.mu held.
+func (acl *ACLManager) applies(caller *identity.Identity, now time.Time) func(*permissions.Permission) bool {
+	return appliesWith(caller, now, acl.compileCondition)
+}
+
+// appliesWith is applies, getting compiled conditions from compile.
+func appliesWith(caller *identity.Identity, now time.Time, compile func(src string) (*condition.Expr, error)) func(*permissions.Permission) bool {
+	var env map[string]interface{}
+	return func(p *permissions.Permission) bool {
+		if !p.ActiveAt(now) {
+			return false
+		}
+		if p.Condition == "" {
+			return true
+		}
+		if env == nil {
+			env = conditionEnv(caller, now)
+		}
+		expr, err := compile(p.Condition)
+		if err != nil {
+			return false
+		}
+		ok, err := expr.Eval(env)
+		return err == nil && ok // conditions that cannot be evaluated deny access
+	}
+}
+
+// compileCondition compiles src, caching the result. An empty condition compiles to nil.
+// Must be called with acl.mu held.
+func (acl *ACLManager) compileCondition(src string) (*condition.Expr, error) {
+	if src == "" {
+		return nil, nil
+	}
+	if expr, ok := acl.conditions[src]; ok {
+		return expr, nil
+	}
+	expr, err := condition.Compile(src)
+	if err != nil {
+		return nil, err
+	}
+	acl.conditions[src] = expr
+	return expr, nil
+}
+
+// compiledConditions compiles the conditions of perms ahead of time, returning a compile function for appliesWith that
+// can be used once acl.mu is released. Conditions that do not compile, and any not in perms, deny access.
+// Must be called with acl.mu held.
+func (acl *ACLManager) compiledConditions(perms []*permissions.Permission) func(src string) (*condition.Expr, error) {
+	compiled := make(map[string]*condition.Expr)
+	for _, p := range perms {
+		if expr, err := acl.compileCondition(p.Condition); err == nil && expr != nil {
+			compiled[p.Condition] = expr
+		}
+	}
+	return func(src string) (*condition.Expr, error) {
+		if expr, ok := compiled[src]; ok {
+			return expr, nil
+		}
+		return nil, fmt.Errorf("condition %q is not compiled", src)
+	}
+}
+
+// conditionEnv builds the environment conditions are evaluated against. Times are in UTC.
+func conditionEnv(caller *identity.Identity, now time.Time) map[string]interface{} {
+	now = now.UTC()
+	claims := caller.Claims
+	if claims == nil {
+		claims = make(map[string]interface{})
+	}
+	return map[string]interface{}{
+		"user":      caller.User,
+		"admin":     caller.Admin,
+		"method":    caller.Method,
+		"source_ip": caller.SourceAddr,
+		"claims":    claims,
+		"time": map[string]interface{}{
+			"hour":    now.Hour(),
+			"minute":  now.Minute(),
+			"weekday": now.Weekday().String(),
+			"unix":    now.Unix(),
+		},
+	}
+}
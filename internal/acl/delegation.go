@@ -0,0 +1,126 @@
+package acl
+
+import (
+	"context"
+	"time"
+
+	"chroma1/model/identity"
+	"chroma1/model/permissions"
+
+	"golang.org/x/exp/slices"
+)
+
+// authorizeGrant checks that the caller may confer every permission in toAdd. Superadmins may grant anything. Other
+// callers may grant permissions on tables they administer, inheritable ones only if they also administer every table
+// the permission would extend to, or any subset of a permission they hold with the grant option. A delegated grant may
+// not outlive the grant it derives from.
+// Must be called with acl.mu held.
+func (acl *ACLManager) authorizeGrant(ctx context.Context, caller *identity.Identity, toAdd []*permissions.Permission) error {
+	if acl.isAdmin(caller) {
+		return nil
+	}
+	user, err := acl.callerUser(caller)
+	if err != nil {
+		return NotAdminError
+	}
+	held, err := acl.getPerms(ctx, user)
+	if err != nil {
+		return err
+	}
+	now := acl.now()
+	for _, ta := range toAdd {
+		if acl.administersTable(user, ta.Table) && (!ta.Inherit || acl.administersDescendants(user, ta.Table)) {
+			continue
+		}
+		if !grantCovered(ta, held, now) {
+			return NotAdminError
+		}
+	}
+	return nil
+}
+
+// authorizeRevoke checks that the caller may revoke every permission in toRem. Since grants do not record who issued
+// them, holding the grant option is not enough: only superadmins and admins of the affected tables may revoke.
+// Must be called with acl.mu held.
+func (acl *ACLManager) authorizeRevoke(caller *identity.Identity, toRem []*permissions.Permission) error {
+	if acl.isAdmin(caller) {
+		return nil
+	}
+	user, err := acl.callerUser(caller)
+	if err != nil {
+		return NotAdminError
+	}
+	for _, tr := range toRem {
+		if !acl.administersTable(user, tr.Table) {
+			return NotAdminError
+		}
+	}
+	return nil
+}
+
+func (acl *ACLManager) administersTable(user, table string) bool {
+	_, ok := acl.tableAdmins[user][table]
+	return ok
+}
+
+// administersDescendants reports whether user administers every table that inherits permissions from table through
+// foreign keys, directly or through other tables.
+// Must be called with acl.mu held.
+func (acl *ACLManager) administersDescendants(user, table string) bool {
+	seen := map[string]struct{}{table: {}}
+	parents := []string{table}
+	for depth := 0; depth < maxInheritanceDepth && len(parents) > 0; depth++ {
+		var children []string
+		for child, fks := range acl.foreignKeys {
+			if _, ok := seen[child]; ok {
+				continue
+			}
+			for _, fk := range fks {
+				if slices.Contains(parents, fk.Table) {
+					if !acl.administersTable(user, child) {
+						return false
+					}
+					seen[child] = struct{}{}
+					children = append(children, child)
+					break
+				}
+			}
+		}
+		parents = children
+	}
+	return true
+}
+
+// grantCovered reports whether one of held carries the grant option and is at least as broad as want.
+func grantCovered(want *permissions.Permission, held []*permissions.Permission, now time.Time) bool {
+	for _, h := range held {
+		if !h.GrantOption || !h.ActiveAt(now) || h.Table != want.Table || h.Type != want.Type {
+			continue
+		}
+		if want.Inherit && !h.Inherit {
+			continue // an inheritable grant reaches child tables the held one does not
+		}
+		if h.Condition != "" && h.Condition != want.Condition {
+			continue // a conditional grant can only be passed on with the same condition
+		}
+		if h.ExpiresAt != nil && (want.ExpiresAt == nil || want.ExpiresAt.After(*h.ExpiresAt)) {
+			continue
+		}
+		if h.CoversRows(want) {
+			return true
+		}
+	}
+	return false
+}
+
+func tableSets(byUser map[string][]string) map[string]map[string]struct{} {
+	sets := make(map[string]map[string]struct{}, len(byUser))
+	for user, tables := range byUser {
+		set := make(map[string]struct{}, len(tables))
+		for _, t := range tables {
+			set[t] = struct{}{}
+		}
+		sets[user] = set
+	}
+	return sets
+}
@@ -0,0 +1,61 @@
+package acl_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"chroma1/internal/acl"
+	"chroma1/internal/acl/storage/storagetest"
+	"chroma1/internal/db"
+	"chroma1/model/identity"
+	"chroma1/model/permissions"
+)
+
+func TestDelegatedInherit(t *testing.T) {
+	ctx := context.Background()
+	fks := map[string][]db.ForeignKey{
+		"orders": {{Table: "accounts", From: []string{"account_id"}, To: []string{"id"}}},
+		"items":  {{Table: "orders", From: []string{"order_id"}, To: []string{"id"}}},
+	}
+	inherit := acl.WithForeignKeyInheritance(fks, rowTable{})
+	man, s, _ := newManager(t, []*permissions.Permission{
+		{Type: permissions.Read, Table: "accounts", GrantOption: true},
+		{Type: permissions.Read, Table: "orders", GrantOption: true, Inherit: true},
+	}, inherit)
+	assert.NoError(t, s.CreateUser(ctx, "carol", storagetest.NewKey("carol"), false))
+	carol := &identity.Identity{User: "carol"}
+	// restart makes carol admin of tables and starts a new manager over the store
+	restart := func(tables ...string) {
+		for _, table := range tables {
+			assert.NoError(t, s.SetTableAdmin("carol", table, true))
+		}
+		var err error
+		man, err = acl.NewACLManager(ctx, s, map[string][]string{"accounts": {"id"}, "orders": {"id"}}, acl.WithKeySecret([]byte("secret")), inherit)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+	}
+	restart("accounts")
+
+	grant := func(caller *identity.Identity, table string, inherit bool) error {
+		return man.AddPermissions(ctx, caller, "root", []*permissions.Permission{
+			{Type: permissions.Read, Table: table, Inherit: inherit},
+		})
+	}
+
+	// the grant option only passes on inheritance along with it
+	assert.NoError(t, grant(alice, "accounts", false))
+	assert.ErrorIs(t, grant(alice, "accounts", true), acl.NotAdminError)
+	assert.NoError(t, grant(alice, "orders", true))
+
+	// a table admin's inheritable grants need every descendant table
+	assert.NoError(t, grant(carol, "accounts", false))
+	assert.ErrorIs(t, grant(carol, "accounts", true), acl.NotAdminError)
+	assert.ErrorIs(t, grant(carol, "orders", false), acl.NotAdminError)
+	restart("accounts", "orders")
+	assert.ErrorIs(t, grant(carol, "accounts", true), acl.NotAdminError)
+	restart("accounts", "orders", "items")
+	assert.NoError(t, grant(carol, "accounts", true))
+}
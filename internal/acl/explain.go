@@ -0,0 +1,174 @@
+package acl
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"chroma1/internal/parsing"
+	"chroma1/model/identity"
+	"chroma1/model/permissions"
+)
+
+// Explanation is the outcome of a permission check, requirement by requirement.
+type Explanation struct {
+	User    string `json:"user"`
+	SQL     string `json:"sql"`
+	Allowed bool   `json:"allowed"`
+	// Disabled users are rejected before any requirement is checked.
+	Disabled     bool                      `json:"disabled,omitempty"`
+	Elevation    *Elevation                `json:"elevation,omitempty"`
+	Requirements []*RequirementExplanation `json:"requirements"`
+}
+
+// RequirementExplanation explains how a single permission required by a query was or was not satisfied.
+type RequirementExplanation struct {
+	Table     string                 `json:"table"`
+	Type      string                 `json:"type"`
+	AllRows   bool                   `json:"all_rows,omitempty"`
+	RowKeys   [][]string             `json:"row_keys,omitempty"`
+	RowRanges []permissions.KeyRange `json:"row_ranges,omitempty"`
+	// the statement the requirement was derived from
+	Fragment  string `json:"fragment"`
+	Satisfied bool   `json:"satisfied"`
+	// how the requirement was satisfied, as in Access
+	Source string                  `json:"source,omitempty"`
+	Grant  *permissions.Permission `json:"grant,omitempty"`
+	Via    []string                `json:"via,omitempty"`
+	// why each grant on the table falls short, when none satisfies the requirement
+	Reasons []string `json:"reasons,omitempty"`
+}
+
+// Explain checks sql against user's permissions like CheckPermissions, without recording anything, and reports which
+// grant satisfied each requirement or why none did. Users may explain their own queries, and admins anyone's; an
+// empty user means the caller. Conditions on another user's grants are evaluated without the caller's claims or
+// source address, which belong to the caller rather than the user.
+func (acl *ACLManager) Explain(ctx context.Context, caller *identity.Identity, user string, sql string) (*Explanation, error) {
+	acl.mu.Lock()
+	user, subject, err := acl.explainSubject(caller, user)
+	now := acl.now()
+	var elevation *Elevation
+	_, disabled := acl.disabledUsers[user]
+	if err == nil {
+		elevation = acl.activeElevation(user, now)
+	}
+	acl.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	reqs, err := parsing.Parse(sql, acl.tablePKs, acl.numericPKs)
+	if err != nil {
+		return nil, err
+	}
+	perms, err := acl.perms.Get(ctx, user)
+	if err != nil {
+		acl.mu.Lock()
+		acl.forgetIfDeleted(user, err)
+		acl.mu.Unlock()
+		return nil, err
+	}
+
+	acl.mu.Lock()
+	// the cache may have loaded or refreshed them, unless a write replaced them meanwhile
+	if cached, ok := acl.perms.Peek(user); ok && sameSlice(cached, perms) {
+		acl.index(user, perms)
+	}
+	applies := appliesWith(subject, now, acl.compiledConditions(perms))
+	acl.mu.Unlock()
+
+	ex := &Explanation{
+		User:         user,
+		SQL:          sql,
+		Allowed:      !disabled,
+		Disabled:     disabled,
+		Elevation:    elevation,
+		Requirements: make([]*RequirementExplanation, 0, len(reqs)),
+	}
+	for _, req := range reqs {
+		re, err := acl.explainRequirement(ctx, req, perms, applies, elevation != nil, now)
+		if err != nil {
+			return nil, err
+		}
+		ex.Allowed = ex.Allowed && re.Satisfied
+		ex.Requirements = append(ex.Requirements, re)
+	}
+	return ex, nil
+}
+
+// explainSubject resolves the user whose query caller asks to explain, and the identity their grants' conditions are
+// evaluated against. Must be called with acl.mu held.
+func (acl *ACLManager) explainSubject(caller *identity.Identity, user string) (string, *identity.Identity, error) {
+	callerName, err := acl.callerUser(caller)
+	if err != nil {
+		return "", nil, err
+	}
+	if user == "" || user == callerName {
+		return callerName, caller, nil
+	}
+	if !acl.isAdmin(caller) {
+		return "", nil, NotAdminError
+	}
+	if !acl.userExists(user) {
+		return "", nil, NoSuchUserError
+	}
+	_, admin := acl.admins[user]
+	return user, &identity.Identity{User: user, Admin: admin}, nil
+}
+
+// explainRequirement explains how req is satisfied by perms, selected by applies. Like failingRequirements, it only
+// reads the manager's configuration, so acl.mu need not be held.
+func (acl *ACLManager) explainRequirement(ctx context.Context, req *parsing.RequiredPermission, perms []*permissions.Permission, applies func(*permissions.Permission) bool, elevated bool, now time.Time) (*RequirementExplanation, error) {
+	re := &RequirementExplanation{
+		Table:     req.Perm.Table,
+		Type:      req.Perm.Type.String(),
+		AllRows:   req.Perm.Blanket(),
+		RowKeys:   req.Perm.RowKeys,
+		RowRanges: req.Perm.RowRanges,
+		Fragment:  req.SQL(),
+	}
+	if elevated && req.Perm.Type == permissions.Read {
+		re.Satisfied, re.Source = true, AccessBreakGlass
+		return re, nil
+	}
+	if grant := satisfyingGrant(req.Perm, perms, applies); grant != nil {
+		re.Satisfied, re.Source, re.Grant = true, grantSource(grant), grant
+		return re, nil
+	}
+	grant, via, err := acl.inheritedGrant(ctx, req.Perm, req.Assigned, req.Inserted, perms, applies, 0)
+	if err != nil {
+		return nil, err
+	}
+	if grant != nil {
+		re.Satisfied, re.Source, re.Grant, re.Via = true, AccessInherited, grant, via
+		return re, nil
+	}
+	re.Reasons = unmetReasons(req.Perm, perms, applies, now)
+	return re, nil
+}
+
+// unmetReasons describes why each of perms on req's table and type fails to satisfy req.
+func unmetReasons(req permissions.Permission, perms []*permissions.Permission, applies func(*permissions.Permission) bool, now time.Time) []string {
+	reasons := make([]string, 0)
+	for _, p := range perms {
+		if p.Table != req.Table || p.Type != req.Type {
+			continue
+		}
+		switch {
+		case p.ExpiredAt(now):
+			reasons = append(reasons, fmt.Sprintf("grant expired at %s", p.ExpiresAt.Format(time.RFC3339)))
+		case !p.ActiveAt(now):
+			reasons = append(reasons, fmt.Sprintf("grant is not active until %s", p.NotBefore.Format(time.RFC3339)))
+		case !applies(p):
+			reasons = append(reasons, fmt.Sprintf("condition %q does not hold", p.Condition))
+		case req.Blanket():
+			reasons = append(reasons, "all rows are required, but the grant covers only some")
+		default:
+			reasons = append(reasons, "grant does not cover every required row")
+		}
+	}
+	if len(reasons) == 0 {
+		reasons = append(reasons, fmt.Sprintf("no %s grant on %s", req.Type, req.Table))
+	}
+	return reasons
+}
@@ -0,0 +1,138 @@
+package acl_test
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"chroma1/internal/acl"
+	"chroma1/model/identity"
+	"chroma1/model/permissions"
+)
+
+func TestExplain(t *testing.T) {
+	ctx := context.Background()
+	man, _, _ := newManager(t, []*permissions.Permission{
+		{Type: permissions.Read, Table: "accounts", RowKeys: [][]string{{"1"}}},
+		{Type: permissions.Read, Table: "accounts", ExpiresAt: at(-time.Hour)},
+		{Type: permissions.Read, Table: "accounts", Condition: `claims.team == "x"`},
+		{Type: permissions.Write, Table: "orders", RowKeys: [][]string{{"1"}}, Role: "ops"},
+	})
+
+	_, err := man.Explain(ctx, alice, "root", "SELECT * FROM accounts")
+	assert.ErrorIs(t, err, acl.NotAdminError)
+	_, err = man.Explain(ctx, root, "nobody", "SELECT * FROM accounts")
+	assert.ErrorIs(t, err, acl.NoSuchUserError)
+
+	// each requirement names the grant that satisfies it
+	ex, err := man.Explain(ctx, alice, "", "SELECT * FROM accounts WHERE id = 1")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "alice", ex.User)
+		assert.True(t, ex.Allowed)
+		if assert.Len(t, ex.Requirements, 1) {
+			re := ex.Requirements[0]
+			assert.True(t, re.Satisfied)
+			assert.Equal(t, "accounts", re.Table)
+			assert.Equal(t, "READ", re.Type)
+			assert.Equal(t, [][]string{{"1"}}, re.RowKeys)
+			assert.Equal(t, acl.AccessDirect, re.Source)
+			if assert.NotNil(t, re.Grant) {
+				assert.Equal(t, [][]string{{"1"}}, re.Grant.RowKeys)
+			}
+			assert.Empty(t, re.Reasons)
+		}
+	}
+	ex, err = man.Explain(ctx, alice, "", "DELETE FROM orders WHERE id = 1")
+	if assert.NoError(t, err) && assert.Len(t, ex.Requirements, 1) {
+		assert.True(t, ex.Allowed)
+		assert.Equal(t, acl.AccessRole, ex.Requirements[0].Source)
+		assert.Equal(t, "ops", ex.Requirements[0].Grant.Role)
+	}
+
+	// and unsatisfied ones say why each grant on the table falls short
+	for _, tc := range []struct {
+		sql     string
+		reasons []string
+	}{
+		{
+			sql: "SELECT * FROM accounts WHERE id = 2",
+			reasons: []string{
+				"grant does not cover every required row",
+				"grant expired at 2022-12-31T23:00:00Z",
+				`condition "claims.team == \"x\"" does not hold`,
+			},
+		},
+		{
+			sql: "SELECT * FROM accounts",
+			reasons: []string{
+				"all rows are required, but the grant covers only some",
+				"grant expired at 2022-12-31T23:00:00Z",
+				`condition "claims.team == \"x\"" does not hold`,
+			},
+		},
+		{
+			sql:     "DELETE FROM accounts WHERE id = 1",
+			reasons: []string{"no WRITE grant on accounts"},
+		},
+	} {
+		ex, err := man.Explain(ctx, alice, "", tc.sql)
+		if !assert.NoError(t, err, tc.sql) || !assert.Len(t, ex.Requirements, 1, tc.sql) {
+			continue
+		}
+		re := ex.Requirements[0]
+		assert.False(t, ex.Allowed, tc.sql)
+		assert.False(t, re.Satisfied, tc.sql)
+		assert.Empty(t, re.Source, tc.sql)
+		assert.Nil(t, re.Grant, tc.sql)
+		assert.ElementsMatch(t, tc.reasons, re.Reasons, tc.sql)
+	}
+
+	// conditions hold for the caller's own claims, but not for an admin's explaining on their behalf
+	team := &identity.Identity{User: "alice", Claims: map[string]interface{}{"team": "x"}}
+	ex, err = man.Explain(ctx, team, "", "SELECT * FROM accounts")
+	if assert.NoError(t, err) && assert.Len(t, ex.Requirements, 1) {
+		assert.True(t, ex.Allowed)
+		assert.Equal(t, `claims.team == "x"`, ex.Requirements[0].Grant.Condition)
+	}
+	ex, err = man.Explain(ctx, &identity.Identity{User: "root", Claims: team.Claims}, "alice", "SELECT * FROM accounts")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "alice", ex.User)
+		assert.False(t, ex.Allowed)
+	}
+
+	// the explanation is reported as JSON
+	ex, err = man.Explain(ctx, alice, "", "DELETE FROM accounts WHERE id = 1")
+	assert.NoError(t, err)
+	b, err := json.Marshal(ex)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{
+		"user": "alice",
+		"sql": "DELETE FROM accounts WHERE id = 1",
+		"allowed": false,
+		"requirements": [{
+			"table": "accounts",
+			"type": "WRITE",
+			"row_keys": [["1"]],
+			"fragment": "`+ex.Requirements[0].Fragment+`",
+			"satisfied": false,
+			"reasons": ["no WRITE grant on accounts"]
+		}]
+	}`, string(b))
+}
+
+func TestExplainDisabled(t *testing.T) {
+	ctx := context.Background()
+	man, _, _ := newManager(t, []*permissions.Permission{{Type: permissions.Read, Table: "accounts"}})
+	assert.NoError(t, man.SetUserDisabled(ctx, root, "alice", true))
+
+	// disabled users are denied even where their grants would satisfy every requirement
+	ex, err := man.Explain(ctx, root, "alice", "SELECT * FROM accounts")
+	if assert.NoError(t, err) && assert.Len(t, ex.Requirements, 1) {
+		assert.True(t, ex.Disabled)
+		assert.False(t, ex.Allowed)
+		assert.True(t, ex.Requirements[0].Satisfied)
+	}
+}
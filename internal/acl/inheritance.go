@@ -0,0 +1,164 @@
+package acl
+
+import (
+	"context"
+	"fmt"
+
+	"chroma1/internal/db"
+	"chroma1/model/permissions"
+
+	"golang.org/x/exp/slices"
+)
+
+const (
+	// Bounds how many foreign key hops are followed, which also protects against reference cycles.
+	maxInheritanceDepth = 8
+)
+
+// RowResolver looks up column values of existing rows, so that foreign keys can be followed from child rows to the
+// parent rows they reference.
+type RowResolver interface {
+	LookupColumns(ctx context.Context, table string, keyCols, key, cols []string) ([]*string, bool, error)
+}
+
+// WithForeignKeyInheritance enables permissions marked Inherit to extend to child tables, following the given foreign
+// keys (keyed by child table). rows is used to find the parent rows referenced by specific child rows.
+func WithForeignKeyInheritance(fks map[string][]db.ForeignKey, rows RowResolver) Option {
+	return func(acl *ACLManager) {
+		acl.foreignKeys = fks
+		acl.rows = rows
+	}
+}
+
+// inheritedPasses reports whether req is satisfied through an inheritable permission on a parent table. A blanket
+// requirement on a child table needs a blanket inheritable permission on the parent; a requirement on specific child
+// rows needs the parent rows they reference, so it fails if one of them does not exist. assigned holds the columns an
+// UPDATE sets and inserted the rows an INSERT adds, as parsing.RequiredPermission does; an UPDATE that moves rows to
+// another parent also needs the new parent, and an INSERT needs the parents of the rows it adds. Like the other
+// inheritance functions, it only reads the manager's configuration, so acl.mu need not be held unless applies requires
+// it.
+func (acl *ACLManager) inheritedPasses(ctx context.Context, req permissions.Permission, assigned map[string]*string, inserted []map[string]*string, perms []*permissions.Permission, applies func(*permissions.Permission) bool, depth int) (bool, error) {
+	grant, _, err := acl.inheritedGrant(ctx, req, assigned, inserted, perms, applies, depth)
+	return grant != nil, err
+}
+
+// inheritedGrant is inheritedPasses, also returning the satisfying grant and the tables followed to reach it.
+func (acl *ACLManager) inheritedGrant(ctx context.Context, req permissions.Permission, assigned map[string]*string, inserted []map[string]*string, perms []*permissions.Permission, applies func(*permissions.Permission) bool, depth int) (*permissions.Permission, []string, error) {
+	if depth >= maxInheritanceDepth {
+		return nil, nil, nil
+	}
+	inheritable := func(p *permissions.Permission) bool {
+		return p.Inherit && applies(p)
+	}
+	for _, fk := range acl.foreignKeys[req.Table] {
+		parentReq, ok, err := acl.parentRequirement(ctx, req, assigned, inserted, fk)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !ok {
+			continue
+		}
+		if grant := satisfyingGrant(parentReq, perms, inheritable); grant != nil {
+			return grant, []string{fk.Table}, nil
+		}
+		// parent rows are only read through, never updated
+		grant, via, err := acl.inheritedGrant(ctx, parentReq, nil, nil, perms, applies, depth+1)
+		if err != nil {
+			return nil, nil, err
+		}
+		if grant != nil {
+			return grant, append([]string{fk.Table}, via...), nil
+		}
+	}
+	return nil, nil, nil
+}
+
+// parentRequirement translates a requirement on a child table into the equivalent requirement on the parent table
+// referenced by fk: the parent rows the child rows reference, and those they will reference once assigned is applied.
+// If inserted is set, the child rows do not exist yet, and the parent rows are those the inserted values reference.
+// Returns false if the translation is impossible, e.g. because fk does not reference the parent's primary key, or a
+// child row does not exist or does not reference any parent row.
+func (acl *ACLManager) parentRequirement(ctx context.Context, req permissions.Permission, assigned map[string]*string, inserted []map[string]*string, fk db.ForeignKey) (permissions.Permission, bool, error) {
+	parentReq := permissions.Permission{
+		Type:  req.Type,
+		Table: fk.Table,
+	}
+	parentPK := acl.tablePKs[fk.Table]
+	// position of each parent PK column among the foreign key's columns
+	fkIdx := make([]int, len(parentPK))
+	for i, col := range parentPK {
+		fkIdx[i] = -1
+		for j, to := range fk.To {
+			if to == col {
+				fkIdx[i] = j
+			}
+		}
+		if fkIdx[i] < 0 {
+			return parentReq, false, nil
+		}
+	}
+	moved := false
+	for _, col := range fk.From {
+		if val, ok := assigned[col]; ok {
+			if val == nil {
+				return parentReq, true, nil // the new parent is unknown, so it could be any
+			}
+			moved = true
+		}
+	}
+	if inserted == nil {
+		if req.Blanket() {
+			return parentReq, true, nil
+		}
+		if acl.rows == nil || len(req.RowRanges) > 0 {
+			return parentReq, false, nil // a key range has no single parent row to follow
+		}
+	}
+
+	parentReq.RowKeys = make([][]string, 0, len(req.RowKeys)+len(inserted))
+	addParent := func(vals []*string) bool {
+		parentKey := make([]string, len(parentPK))
+		for i, j := range fkIdx {
+			if vals[j] == nil {
+				return false // references no parent row
+			}
+			parentKey[i] = *vals[j]
+		}
+		if idx, ok := slices.BinarySearchFunc(parentReq.RowKeys, parentKey, permissions.CompareKeys); !ok {
+			parentReq.RowKeys = slices.Insert(parentReq.RowKeys, idx, parentKey)
+		}
+		return true
+	}
+	for _, row := range inserted {
+		vals := make([]*string, len(fk.From))
+		for j, col := range fk.From {
+			vals[j] = row[col]
+		}
+		if !addParent(vals) {
+			return parentReq, false, nil
+		}
+	}
+
+	childPK := acl.tablePKs[req.Table]
+	for _, childKey := range req.RowKeys {
+		vals, found, err := acl.rows.LookupColumns(ctx, req.Table, childPK, childKey, fk.From)
+		if err != nil {
+			return parentReq, false, fmt.Errorf("error following foreign key from %s to %s: %w", req.Table, fk.Table, err)
+		}
+		if !found || !addParent(vals) {
+			return parentReq, false, nil
+		}
+		if !moved {
+			continue
+		}
+		for j, col := range fk.From {
+			if val, ok := assigned[col]; ok {
+				vals[j] = val
+			}
+		}
+		if !addParent(vals) {
+			return parentReq, false, nil
+		}
+	}
+	return parentReq, true, nil
+}
@@ -0,0 +1,75 @@
+package acl_test
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"chroma1/internal/acl"
+	"chroma1/internal/db"
+	"chroma1/model/permissions"
+)
+
+// rowTable resolves rows from table to the comma-joined key to column values.
+type rowTable map[string]map[string]map[string]string
+
+func (rt rowTable) LookupColumns(ctx context.Context, table string, keyCols, key, cols []string) ([]*string, bool, error) {
+	row, ok := rt[table][strings.Join(key, ",")]
+	if !ok {
+		return nil, false, nil
+	}
+	vals := make([]*string, len(cols))
+	for i, c := range cols {
+		if v, ok := row[c]; ok {
+			vals[i] = &v
+		}
+	}
+	return vals, true, nil
+}
+
+func TestInheritance(t *testing.T) {
+	fks := map[string][]db.ForeignKey{
+		"orders": {{Table: "accounts", From: []string{"account_id"}, To: []string{"id"}}},
+	}
+	rows := rowTable{"orders": {
+		"10": {"account_id": "1"},
+		"20": {"account_id": "2"},
+	}}
+	man, _, _ := newManager(t, []*permissions.Permission{
+		{Type: permissions.Write, Table: "accounts", RowKeys: [][]string{{"1"}}, Inherit: true},
+	}, acl.WithForeignKeyInheritance(fks, rows))
+
+	testcases := []struct {
+		sql     string
+		allowed bool
+	}{
+		{sql: "UPDATE orders SET note = 'x' WHERE id = 10", allowed: true},
+		{sql: "UPDATE orders SET note = 'x' WHERE id = 20", allowed: false},
+		// a missing row references no parent, so nothing covers it
+		{sql: "UPDATE orders SET note = 'x' WHERE id = 99", allowed: false},
+		{sql: "DELETE FROM orders WHERE id = 10 OR id = 99", allowed: false},
+		// moving a row needs its new parent too
+		{sql: "UPDATE orders SET account_id = 1 WHERE id = 10", allowed: true},
+		{sql: "UPDATE orders SET account_id = 2 WHERE id = 10", allowed: false},
+		{sql: "UPDATE orders SET account_id = account_id + 1 WHERE id = 10", allowed: false},
+		// a new row needs the parent its values reference
+		{sql: "INSERT INTO orders (id, account_id) VALUES (30, 1)", allowed: true},
+		{sql: "INSERT INTO orders (id, account_id) VALUES (30, 1), (31, 2)", allowed: false},
+		{sql: "INSERT INTO orders (id, account_id) VALUES (30, NULL)", allowed: false},
+		{sql: "INSERT INTO orders (id) VALUES (30)", allowed: false},
+		{sql: "INSERT INTO orders VALUES (30, 1)", allowed: false},
+	}
+	for i, tc := range testcases {
+		t.Run(fmt.Sprintf("TestInheritance case %v", i), func(t *testing.T) {
+			_, err := man.CheckPermissions(context.Background(), alice, tc.sql)
+			if tc.allowed {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorAs(t, err, &acl.InsufficientPermissionsError{})
+			}
+		})
+	}
+}
@@ -0,0 +1,154 @@
+package acl
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"chroma1/model/identity"
+	"chroma1/model/keys"
+)
+
+var (
+	NoSuchKeyIDError      = fmt.Errorf("no such key id for user")
+	MissingKeySecretError = fmt.Errorf("a key secret is required to hash API keys")
+)
+
+// MintKey issues an additional key for user. Users may mint keys for themselves; admins may mint keys for anyone.
+// The returned key is the only place the secret is exposed.
+func (acl *ACLManager) MintKey(ctx context.Context, caller *identity.Identity, user, label string, expiresAt *time.Time) (*keys.APIKey, error) {
+	acl.mu.Lock()
+	defer acl.mu.Unlock()
+
+	if err := acl.checkKeyOwner(caller, user); err != nil {
+		return nil, err
+	}
+	k, err := acl.newAPIKey(user, label, expiresAt)
+	if err != nil {
+		return nil, err
+	}
+	if err := acl.storage.StoreKey(ctx, k); err != nil {
+		return nil, fmt.Errorf("error storing key for %s: %w", user, err)
+	}
+	acl.keys[k.ID] = k
+	return k, nil
+}
+
+// RevokeKey schedules the key with the given id to stop working after grace has elapsed, so clients have time to
+// switch to a newly minted key. A zero grace revokes the key immediately. Revoking never extends an earlier expiry.
+func (acl *ACLManager) RevokeKey(ctx context.Context, caller *identity.Identity, user, keyID string, grace time.Duration) error {
+	acl.mu.Lock()
+	defer acl.mu.Unlock()
+
+	if err := acl.checkKeyOwner(caller, user); err != nil {
+		return err
+	}
+	target, ok := acl.keys[keyID]
+	if !ok || target.User != user {
+		return NoSuchKeyIDError
+	}
+
+	expiresAt := acl.now().Add(grace)
+	if target.ExpiresAt != nil && target.ExpiresAt.Before(expiresAt) {
+		return nil
+	}
+	if err := acl.storage.SetKeyExpiry(ctx, keyID, expiresAt); err != nil {
+		return fmt.Errorf("error revoking key %s: %w", keyID, err)
+	}
+	target.ExpiresAt = &expiresAt
+	return nil
+}
+
+// ListKeys returns metadata for the user's keys, without their secrets.
+func (acl *ACLManager) ListKeys(ctx context.Context, caller *identity.Identity, user string) ([]*keys.APIKey, error) {
+	acl.mu.Lock()
+	defer acl.mu.Unlock()
+
+	if err := acl.checkKeyOwner(caller, user); err != nil {
+		return nil, err
+	}
+	res := make([]*keys.APIKey, 0)
+	for _, k := range acl.keys {
+		if k.User == user {
+			c := *k
+			c.Secret = ""
+			res = append(res, &c)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].CreatedAt.Before(res[j].CreatedAt)
+	})
+	return res, nil
+}
+
+// WithKeySecret sets the server secret used to HMAC API keys at rest. Required.
+func WithKeySecret(secret []byte) Option {
+	return func(acl *ACLManager) {
+		acl.keySecret = secret
+	}
+}
+
+// lookupKey finds the key matching a client token, comparing hashes in constant time. Tokens have the form
+// "<id>.<secret>"; legacy tokens issued before keys had ids are bare secrets, and are only matched against legacy keys.
+// Must be called with acl.mu held.
+func (acl *ACLManager) lookupKey(token string) (*keys.APIKey, bool) {
+	if id, secret, ok := strings.Cut(token, "."); ok {
+		if k, ok := acl.keys[id]; ok && hmac.Equal(k.Hash, acl.hashSecret(secret)) {
+			return k, true
+		}
+		return nil, false
+	}
+	hash := acl.hashSecret(token)
+	for _, k := range acl.keys {
+		if k.Legacy() && hmac.Equal(k.Hash, hash) {
+			return k, true
+		}
+	}
+	return nil, false
+}
+
+func (acl *ACLManager) hashSecret(secret string) []byte {
+	mac := hmac.New(sha256.New, acl.keySecret)
+	mac.Write([]byte(secret))
+	return mac.Sum(nil)
+}
+
+// hashPlaintextKeys hashes any keys the storage still holds in plaintext, and clears the plaintext. Clients keep
+// presenting the same bare token, which lookupKey still accepts.
+func (acl *ACLManager) hashPlaintextKeys(ctx context.Context) error {
+	for id, k := range acl.keys {
+		if k.Secret == "" {
+			continue
+		}
+		hash := acl.hashSecret(k.Secret)
+		if err := acl.storage.SetKeyHash(ctx, id, hash); err != nil {
+			return fmt.Errorf("error hashing key %s: %w", id, err)
+		}
+		k.Hash = hash
+		k.Secret = ""
+	}
+	return nil
+}
+
+// checkKeyOwner verifies that the caller is user or an admin.
+// Must be called with acl.mu held.
+func (acl *ACLManager) checkKeyOwner(caller *identity.Identity, user string) error {
+	callerUser, err := acl.callerUser(caller)
+	if err != nil {
+		return err
+	}
+	if callerUser == user {
+		return nil
+	}
+	if !acl.isAdmin(caller) {
+		return NotAdminError
+	}
+	if !acl.userExists(user) {
+		return NoSuchUserError
+	}
+	return nil
+}
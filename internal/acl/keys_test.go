@@ -0,0 +1,169 @@
+package acl_test
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"chroma1/internal/acl"
+	"chroma1/internal/acl/storage/memory"
+	"chroma1/internal/auth"
+	"chroma1/model/identity"
+	"chroma1/model/keys"
+)
+
+// storedKey returns the key s holds for token, or nil if there is none.
+func storedKey(t *testing.T, s *memory.MemoryACLStorage, token string) *keys.APIKey {
+	t.Helper()
+	id, _, _ := strings.Cut(token, ".")
+	all, err := s.GetAllKeys(context.Background())
+	assert.NoError(t, err)
+	for _, k := range all {
+		if k.ID == id {
+			return k
+		}
+	}
+	return nil
+}
+
+// hashOf hashes secret as the managers built by newManager do.
+func hashOf(secret string) []byte {
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write([]byte(secret))
+	return mac.Sum(nil)
+}
+
+func TestLegacyKeys(t *testing.T) {
+	ctx := context.Background()
+	man, s, _ := newManager(t, nil)
+	for _, k := range []*keys.APIKey{
+		{ID: keys.LegacyIDPrefix + "alice", User: "alice", Hash: hashOf("legacytoken")},
+		{ID: keys.LegacyIDPrefix + "root", User: "root", Hash: hashOf("dotted.token")},
+		{ID: "plain", User: "root", Hash: hashOf("baretoken")},
+	} {
+		assert.NoError(t, s.StoreKey(ctx, k))
+	}
+	assert.NoError(t, man.Reload(ctx))
+
+	minted, err := man.MintKey(ctx, alice, "alice", "", nil)
+	assert.NoError(t, err)
+	_, secret, _ := strings.Cut(minted.Secret, ".")
+
+	for token, user := range map[string]string{
+		minted.Secret: "alice",
+		"legacytoken": "alice",
+		// the secret half of a token is not a legacy token
+		secret: "",
+		// only legacy keys are matched by bare secrets
+		"baretoken": "",
+		// and bare secrets have no id
+		"dotted.token": "",
+	} {
+		id, err := man.AuthenticateKey(token)
+		if user == "" {
+			assert.ErrorIs(t, err, acl.NoSuchKeyError, token)
+			continue
+		}
+		if assert.NoError(t, err, token) {
+			assert.Equal(t, user, id.User)
+		}
+	}
+}
+
+func TestMintKey(t *testing.T) {
+	ctx := context.Background()
+	man, s, c := newManager(t, nil)
+
+	_, err := man.MintKey(ctx, alice, "root", "ci", nil)
+	assert.ErrorIs(t, err, acl.NotAdminError, "users only mint keys for themselves")
+	_, err = man.MintKey(ctx, root, "bob", "ci", nil)
+	assert.ErrorIs(t, err, acl.NoSuchUserError)
+
+	own, err := man.MintKey(ctx, alice, "alice", "laptop", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "alice", own.User)
+	assert.Equal(t, "laptop", own.Label)
+	assert.NotEmpty(t, own.Secret)
+	if k := storedKey(t, s, own.Secret); assert.NotNil(t, k) {
+		assert.Equal(t, "alice", k.User)
+		assert.Empty(t, k.Secret, "only the hash is stored")
+	}
+	id, err := man.AuthenticateKey(own.Secret)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "alice", id.User)
+		assert.Equal(t, auth.MethodAPIKey, id.Method)
+	}
+
+	temp, err := man.MintKey(ctx, root, "alice", "ci", at(time.Hour))
+	assert.NoError(t, err)
+	_, err = man.AuthenticateKey(temp.Secret)
+	assert.NoError(t, err)
+	_, err = man.AuthenticateKey(own.Secret)
+	assert.NoError(t, err, "earlier keys keep working")
+	c.Set(t0.Add(time.Hour))
+	_, err = man.AuthenticateKey(temp.Secret)
+	assert.ErrorIs(t, err, acl.NoSuchKeyError, "a key stops working once it expires")
+}
+
+func TestRevokeKey(t *testing.T) {
+	ctx := context.Background()
+	man, s, c := newManager(t, nil)
+	old, err := man.MintKey(ctx, alice, "alice", "old", nil)
+	assert.NoError(t, err)
+
+	assert.ErrorIs(t, man.RevokeKey(ctx, alice, "alice", "id-root", 0), acl.NoSuchKeyIDError, "the key belongs to another user")
+	assert.ErrorIs(t, man.RevokeKey(ctx, alice, "alice", "missing", 0), acl.NoSuchKeyIDError)
+	assert.ErrorIs(t, man.RevokeKey(ctx, alice, "root", "id-root", 0), acl.NotAdminError)
+
+	// the old key keeps working through the grace period
+	assert.NoError(t, man.RevokeKey(ctx, alice, "alice", old.ID, time.Hour))
+	if k := storedKey(t, s, old.Secret); assert.NotNil(t, k.ExpiresAt) {
+		assert.Equal(t, t0.Add(time.Hour), *k.ExpiresAt)
+	}
+	c.Set(t0.Add(59 * time.Minute))
+	_, err = man.AuthenticateKey(old.Secret)
+	assert.NoError(t, err)
+	c.Set(t0.Add(time.Hour))
+	_, err = man.AuthenticateKey(old.Secret)
+	assert.ErrorIs(t, err, acl.NoSuchKeyError)
+
+	// revoking again never extends the expiry
+	assert.NoError(t, man.RevokeKey(ctx, alice, "alice", old.ID, time.Hour))
+	assert.Equal(t, t0.Add(time.Hour), *storedKey(t, s, old.Secret).ExpiresAt)
+
+	// without a grace period the key stops working at once, here revoked by an admin
+	next, err := man.MintKey(ctx, alice, "alice", "next", nil)
+	assert.NoError(t, err)
+	assert.NoError(t, man.RevokeKey(ctx, root, "alice", next.ID, 0))
+	_, err = man.AuthenticateKey(next.Secret)
+	assert.ErrorIs(t, err, acl.NoSuchKeyError)
+}
+
+func TestListKeys(t *testing.T) {
+	ctx := context.Background()
+	man, _, c := newManager(t, nil)
+	c.Set(t0.Add(time.Hour))
+	laptop, err := man.MintKey(ctx, alice, "alice", "laptop", nil)
+	assert.NoError(t, err)
+	c.Set(t0.Add(2 * time.Hour))
+	ci, err := man.MintKey(ctx, alice, "alice", "ci", at(3*time.Hour))
+	assert.NoError(t, err)
+
+	_, err = man.ListKeys(ctx, alice, "root")
+	assert.ErrorIs(t, err, acl.NotAdminError)
+	for _, caller := range []*identity.Identity{alice, root} {
+		listed, err := man.ListKeys(ctx, caller, "alice")
+		assert.NoError(t, err)
+		ids := make([]string, 0, len(listed))
+		for _, k := range listed {
+			assert.Empty(t, k.Secret, "secrets are never listed")
+			ids = append(ids, k.ID)
+		}
+		assert.Equal(t, []string{"id-alice", laptop.ID, ci.ID}, ids, "oldest first")
+	}
+}
@@ -0,0 +1,140 @@
+package acl
+
+import (
+	"context"
+
+	"chroma1/internal/parsing"
+	"chroma1/model/identity"
+	"chroma1/model/permissions"
+)
+
+// PolicyChange is a proposed grant and/or revoke for one user. Removals are applied after additions.
+type PolicyChange struct {
+	User   string                    `json:"user"`
+	Add    []*permissions.Permission `json:"add,omitempty"`
+	Remove []*permissions.Permission `json:"remove,omitempty"`
+}
+
+// HistoricalQuery is a query a user ran, e.g. taken from a query log.
+type HistoricalQuery struct {
+	User string `json:"user"`
+	SQL  string `json:"sql"`
+}
+
+// QueryOutcome is a historical query whose result would change, or that could not be evaluated.
+type QueryOutcome struct {
+	User string `json:"user"`
+	SQL  string `json:"sql"`
+	// requirements failing under the new policy, for newly denied queries, or the old one, for newly allowed ones
+	Failing []string `json:"failing,omitempty"`
+	Error   string   `json:"error,omitempty"`
+}
+
+// SimulationResult reports how a set of policy changes would affect a corpus of queries.
+type SimulationResult struct {
+	NewlyAllowed []*QueryOutcome `json:"newly_allowed"`
+	NewlyDenied  []*QueryOutcome `json:"newly_denied"`
+	Unchanged    int             `json:"unchanged"`
+	Errors       []*QueryOutcome `json:"errors,omitempty"`
+}
+
+// Simulate applies changes to an in-memory copy of the policy and checks each query against both the current and the
+// changed policy, reporting the queries whose outcome differs. Nothing is stored. Queries are evaluated as of now,
+// without claims, source addresses or break-glass elevations. Only admins may call it.
+func (acl *ACLManager) Simulate(ctx context.Context, caller *identity.Identity, changes []*PolicyChange, queries []*HistoricalQuery) (*SimulationResult, error) {
+	acl.mu.Lock()
+	defer acl.mu.Unlock()
+
+	if !acl.isAdmin(caller) {
+		return nil, NotAdminError
+	}
+	return acl.simulate(ctx, changes, queries)
+}
+
+// SimulateTrusted is Simulate without a caller, for tools such as the command line that open the stores directly and
+// so are trusted as they are.
+func (acl *ACLManager) SimulateTrusted(ctx context.Context, changes []*PolicyChange, queries []*HistoricalQuery) (*SimulationResult, error) {
+	acl.mu.Lock()
+	defer acl.mu.Unlock()
+
+	return acl.simulate(ctx, changes, queries)
+}
+
+// Must be called with acl.mu held.
+func (acl *ACLManager) simulate(ctx context.Context, changes []*PolicyChange, queries []*HistoricalQuery) (*SimulationResult, error) {
+	proposed := make(map[string][]*permissions.Permission, len(changes))
+	for _, c := range changes {
+		for _, p := range c.Add {
+			if _, err := acl.compileCondition(p.Condition); err != nil {
+				return nil, err
+			}
+		}
+		perms, ok := proposed[c.User]
+		if !ok {
+			var err error
+			if perms, err = acl.currentPerms(ctx, c.User); err != nil {
+				return nil, err
+			}
+		}
+		proposed[c.User] = withRemoved(withAdded(perms, c.Add), c.Remove)
+	}
+
+	now := acl.now()
+	res := &SimulationResult{
+		NewlyAllowed: make([]*QueryOutcome, 0),
+		NewlyDenied:  make([]*QueryOutcome, 0),
+	}
+	for _, q := range queries {
+		after, changed := proposed[q.User]
+		if !changed {
+			res.Unchanged++
+			continue
+		}
+		reqs, err := parsing.Parse(q.SQL, acl.tablePKs, acl.numericPKs)
+		if err != nil {
+			res.Errors = append(res.Errors, &QueryOutcome{User: q.User, SQL: q.SQL, Error: err.Error()})
+			continue
+		}
+		_, admin := acl.admins[q.User]
+		subject := &identity.Identity{User: q.User, Admin: admin}
+		before, err := acl.currentPerms(ctx, q.User)
+		if err != nil {
+			return nil, err
+		}
+		applies := acl.applies(subject, now)
+		failingBefore, err := acl.failingRequirements(ctx, reqs, before, applies, false)
+		if err != nil {
+			return nil, err
+		}
+		failingAfter, err := acl.failingRequirements(ctx, reqs, after, applies, false)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case len(failingBefore) > 0 && len(failingAfter) == 0:
+			res.NewlyAllowed = append(res.NewlyAllowed, &QueryOutcome{User: q.User, SQL: q.SQL, Failing: debugStrings(failingBefore)})
+		case len(failingBefore) == 0 && len(failingAfter) > 0:
+			res.NewlyDenied = append(res.NewlyDenied, &QueryOutcome{User: q.User, SQL: q.SQL, Failing: debugStrings(failingAfter)})
+		default:
+			res.Unchanged++
+		}
+	}
+	return res, nil
+}
+
+// currentPerms returns user's permissions, or none if the user does not exist yet.
+// Must be called with acl.mu held.
+func (acl *ACLManager) currentPerms(ctx context.Context, user string) ([]*permissions.Permission, error) {
+	if !acl.userExists(user) {
+		return nil, nil
+	}
+	return acl.getPerms(ctx, user)
+}
+
+func debugStrings(reqs []*parsing.RequiredPermission) []string {
+	strs := make([]string, len(reqs))
+	for i, r := range reqs {
+		strs[i] = r.DebugString()
+	}
+	return strs
+}
@@ -0,0 +1,69 @@
+package acl_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"chroma1/internal/acl"
+	"chroma1/model/permissions"
+)
+
+func TestSimulate(t *testing.T) {
+	ctx := context.Background()
+	man, s, _ := newManager(t, []*permissions.Permission{
+		{Type: permissions.Read, Table: "accounts", RowKeys: [][]string{{"1"}}},
+	})
+	changes := []*acl.PolicyChange{
+		{User: "alice", Add: []*permissions.Permission{{Type: permissions.Read, Table: "accounts", RowKeys: [][]string{{"2"}}}}},
+		{User: "alice", Remove: []*permissions.Permission{{Type: permissions.Read, Table: "accounts", RowKeys: [][]string{{"1"}}}}},
+		{User: "bob", Add: []*permissions.Permission{{Type: permissions.Read, Table: "orders"}}},
+	}
+	queries := []*acl.HistoricalQuery{
+		{User: "alice", SQL: "SELECT * FROM accounts WHERE id = 1"},
+		{User: "alice", SQL: "SELECT * FROM accounts WHERE id = 2"},
+		{User: "alice", SQL: "SELECT * FROM accounts WHERE id = 3"},
+		{User: "root", SQL: "SELECT * FROM orders WHERE id = 1"},
+		{User: "bob", SQL: "SELECT * FROM orders WHERE id = 1"},
+		{User: "alice", SQL: "SELECT FROM"},
+	}
+
+	_, err := man.Simulate(ctx, alice, changes, queries)
+	assert.ErrorIs(t, err, acl.NotAdminError)
+
+	res, err := man.Simulate(ctx, root, changes, queries)
+	if !assert.NoError(t, err) {
+		return
+	}
+	sqls := func(outcomes []*acl.QueryOutcome) []string {
+		s := make([]string, len(outcomes))
+		for i, o := range outcomes {
+			s[i] = o.User + ": " + o.SQL
+			assert.NotEmpty(t, o.Failing)
+		}
+		return s
+	}
+	assert.Equal(t, []string{
+		"alice: SELECT * FROM accounts WHERE id = 2",
+		"bob: SELECT * FROM orders WHERE id = 1",
+	}, sqls(res.NewlyAllowed), "users that do not exist yet start without permissions")
+	assert.Equal(t, []string{"alice: SELECT * FROM accounts WHERE id = 1"}, sqls(res.NewlyDenied))
+	assert.Equal(t, 2, res.Unchanged)
+	if assert.Len(t, res.Errors, 1) {
+		assert.Equal(t, "SELECT FROM", res.Errors[0].SQL)
+	}
+
+	// nothing is stored
+	perms, err := s.GetUserPerms(ctx, "alice")
+	assert.NoError(t, err)
+	if assert.Len(t, perms, 1) {
+		assert.Equal(t, [][]string{{"1"}}, perms[0].RowKeys)
+	}
+	users, _, _ := storedUsers(t, s)
+	assert.NotContains(t, users, "bob")
+
+	trusted, err := man.SimulateTrusted(ctx, changes, queries)
+	assert.NoError(t, err)
+	assert.Equal(t, res, trusted, "a trusted simulation needs no caller")
+}
@@ -0,0 +1,126 @@
+package storage
+
+import (
+	"context"
+	"sync"
+)
+
+// ChangeKind says which of a user's ACLs changed.
+type ChangeKind int
+
+const (
+	// The user's grants changed.
+	GrantsChanged ChangeKind = iota + 1
+	// The user was created or deleted, or their admin rights, table admin rights, disabled or break-glass status or
+	// keys changed. Their grants may have changed too.
+	UserChanged
+	// Changes may have been missed, e.g. because the store's change log was pruned, so everything should be treated as
+	// changed. User is empty.
+	AllChanged
+)
+
+func (k ChangeKind) String() string {
+	switch k {
+	case GrantsChanged:
+		return "grants"
+	case UserChanged:
+		return "user"
+	case AllChanged:
+		return "all"
+	}
+	return "unknown"
+}
+
+// Change is one change to a store. Every change has a higher version than the changes before it, so a watcher can
+// resume from the last version it saw.
+type Change struct {
+	Version uint64
+	User    string
+	Kind    ChangeKind
+}
+
+// ChangeLog keeps recent changes in memory and serves Watch from them, for stores whose changes are only made in this
+// process. It is safe for concurrent use.
+type ChangeLog struct {
+	mu      sync.Mutex
+	changes []Change // the most recent changes, oldest first
+	version uint64
+	limit   int
+	changed chan struct{} // closed and replaced on each change
+	closed  bool
+}
+
+// NewChangeLog returns an empty log keeping up to limit changes. Watchers that fall further behind get an AllChanged
+// change instead of those they missed.
+func NewChangeLog(limit int) *ChangeLog {
+	return &ChangeLog{limit: limit, changed: make(chan struct{})}
+}
+
+// Record adds a change to user and wakes any watchers.
+func (l *ChangeLog) Record(user string, kind ChangeKind) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.version++
+	l.changes = append(l.changes, Change{Version: l.version, User: user, Kind: kind})
+	if len(l.changes) > l.limit {
+		l.changes = append(l.changes[:0:0], l.changes[len(l.changes)-l.limit:]...)
+	}
+	if !l.closed {
+		close(l.changed)
+		l.changed = make(chan struct{})
+	}
+}
+
+// Version returns the version of the latest change.
+func (l *ChangeLog) Version() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.version
+}
+
+// Watch implements ACLStorage.Watch. It returns ClosedError once the log is closed.
+func (l *ChangeLog) Watch(ctx context.Context, since uint64, fn func(Change)) error {
+	for {
+		l.mu.Lock()
+		if l.closed {
+			l.mu.Unlock()
+			return ClosedError
+		}
+		pending := l.since(since)
+		wait := l.changed
+		l.mu.Unlock()
+
+		for _, c := range pending {
+			fn(c)
+			since = c.Version
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-wait:
+		}
+	}
+}
+
+// since returns the changes after version, or an AllChanged change if some of them are no longer kept. Must be called
+// with l.mu held.
+func (l *ChangeLog) since(version uint64) []Change {
+	if version >= l.version {
+		return nil
+	}
+	if len(l.changes) == 0 || l.changes[0].Version > version+1 {
+		return []Change{{Version: l.version, Kind: AllChanged}}
+	}
+	return append([]Change(nil), l.changes[version+1-l.changes[0].Version:]...)
+}
+
+// Close stops every watcher.
+func (l *ChangeLog) Close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.closed {
+		l.closed = true
+		close(l.changed)
+	}
+}
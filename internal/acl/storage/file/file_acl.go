@@ -0,0 +1,729 @@
+// Package file implements ACLStorage backed by a declarative YAML or JSON policy file, so policy can be managed in git.
+// The file is validated on load and can be watched for changes. Writes are either rejected or written back atomically.
+package file
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+
+	"chroma1/internal/acl/storage"
+	"chroma1/internal/acl/storage/memory"
+	"chroma1/model/keys"
+	"chroma1/model/permissions"
+)
+
+var (
+	ReadOnlyError   = fmt.Errorf("policy file is read-only")
+	NoSuchUserError = storage.NoSuchUserError
+	RoleGrantError  = fmt.Errorf("grant comes from a role and can only be changed in the policy file")
+)
+
+const (
+	defaultReloadDelay = 100 * time.Millisecond
+	// changes kept for watchers that fall behind
+	changeLogLimit = 10000
+)
+
+// FileACLStorage stores ACLs in a policy file. Reads are served from an index of the last valid policy loaded or
+// written. Break-glass elevations are not policy, so they are appended to a separate audit log instead.
+type FileACLStorage struct {
+	path        string
+	auditPath   string
+	readOnly    bool
+	reloadDelay time.Duration
+
+	mu      sync.Mutex
+	policy  *Policy
+	index   *memory.MemoryACLStorage
+	digest  [sha256.Size]byte // of the file contents policy was loaded from or written as
+	stop    context.CancelFunc
+	changes *storage.ChangeLog
+}
+
+// Option configures optional FileACLStorage behaviour.
+type Option func(*FileACLStorage)
+
+// ReadOnly makes every write fail with ReadOnlyError, for policy that is only changed through git. Elevations are still
+// recorded in the audit log.
+func ReadOnly() Option {
+	return func(s *FileACLStorage) {
+		s.readOnly = true
+	}
+}
+
+// WithAuditLog sets where break-glass elevations and elevated queries are appended, as JSON lines. Defaults to the
+// policy path with ".audit.jsonl" appended.
+func WithAuditLog(path string) Option {
+	return func(s *FileACLStorage) {
+		s.auditPath = path
+	}
+}
+
+// WithReloadDelay sets how long StartWatching waits after the last change to the file before reloading it, so that a
+// file written in several steps is read once complete. Defaults to 100ms.
+func WithReloadDelay(d time.Duration) Option {
+	return func(s *FileACLStorage) {
+		s.reloadDelay = d
+	}
+}
+
+// NewFileACLStorage loads the policy at path, whose format is given by its extension (.yaml, .yml or .json). Unless
+// read-only, a missing file is created holding an empty policy.
+func NewFileACLStorage(ctx context.Context, path string, opts ...Option) (*FileACLStorage, error) {
+	s := &FileACLStorage{
+		path:        path,
+		auditPath:   path + ".audit.jsonl",
+		reloadDelay: defaultReloadDelay,
+		changes:     storage.NewChangeLog(changeLogLimit),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) && !s.readOnly {
+		empty := &Policy{Users: make(map[string]*User)}
+		raw, err := encodePolicy(path, empty)
+		if err != nil {
+			return nil, err
+		}
+		if err := writeFileAtomic(path, raw); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := s.Reload(ctx); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Reload reads the policy file again, replacing the loaded policy if the file changed and is valid. It reports whether
+// the policy was replaced. An invalid file leaves the loaded policy in place.
+func (s *FileACLStorage) Reload(ctx context.Context) (bool, error) {
+	raw, err := os.ReadFile(s.path)
+	if err != nil {
+		return false, err
+	}
+	digest := sha256.Sum256(raw)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.policy != nil && digest == s.digest {
+		return false, nil
+	}
+	p, err := decodePolicy(s.path, raw)
+	if err != nil {
+		return false, fmt.Errorf("error loading policy %s: %w", s.path, err)
+	}
+	if err := p.Validate(); err != nil {
+		return false, fmt.Errorf("error loading policy %s: %w", s.path, err)
+	}
+	index, err := p.index(ctx)
+	if err != nil {
+		return false, err
+	}
+	p.settleGrantsVersions(s.policy)
+	if s.policy != nil {
+		// edited outside this process, so which users changed is not known
+		s.changes.Record("", storage.AllChanged)
+	}
+	s.policy, s.index, s.digest = p, index, digest
+	return true, nil
+}
+
+// StartWatching reloads the policy whenever the file changes, until ctx is done or the storage is closed. onReload is
+// called after each reload that replaced the policy, and onErr with errors reloading or watching; either may be nil.
+// Watchers of the storage, such as an ACLManager, see each reload as an AllChanged change. The file's directory is
+// watched, so files replaced by a rename, as by editors and git, are picked up.
+func (s *FileACLStorage) StartWatching(ctx context.Context, onReload func(), onErr func(error)) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	if err := watcher.Add(filepath.Dir(s.path)); err != nil {
+		watcher.Close()
+		return err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	s.mu.Lock()
+	if s.stop != nil {
+		s.stop()
+	}
+	s.stop = cancel
+	s.mu.Unlock()
+
+	report := func(err error) {
+		if onErr != nil {
+			onErr(err)
+		}
+	}
+	target := filepath.Clean(s.path)
+	go func() {
+		defer watcher.Close()
+		// stopped timer, reset on each change to the file
+		timer := time.NewTimer(time.Hour)
+		timer.Stop()
+		defer timer.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case ev, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(ev.Name) == target && ev.Op&(fsnotify.Write|fsnotify.Create) != 0 {
+					timer.Reset(s.reloadDelay)
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				report(err)
+			case <-timer.C:
+				changed, err := s.Reload(ctx)
+				if err != nil {
+					report(err)
+				} else if changed && onReload != nil {
+					onReload()
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// Policy returns a copy of the loaded policy.
+func (s *FileACLStorage) Policy() (*Policy, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.policy.clone()
+}
+
+// current returns the index of the loaded policy. The index is never modified once built, so it may be read without
+// holding s.mu.
+func (s *FileACLStorage) current() *memory.MemoryACLStorage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.index
+}
+
+// update applies change to a copy of the loaded policy, then validates the result and writes it to the file before
+// replacing the loaded policy with it and recording the change it reports. Nothing changes if any step fails, or
+// if change returns no change.
+func (s *FileACLStorage) update(ctx context.Context, change func(p *Policy) (*storage.Change, error)) error {
+	if s.readOnly {
+		return ReadOnlyError
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p, err := s.policy.clone()
+	if err != nil {
+		return err
+	}
+	c, err := change(p)
+	if err != nil || c == nil {
+		return err
+	}
+	if err := p.Validate(); err != nil {
+		return err
+	}
+	index, err := p.index(ctx)
+	if err != nil {
+		return err
+	}
+	raw, err := encodePolicy(s.path, p)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(s.path, raw); err != nil {
+		return fmt.Errorf("error writing policy %s: %w", s.path, err)
+	}
+	s.policy, s.index, s.digest = p, index, sha256.Sum256(raw)
+	s.changes.Record(c.User, c.Kind)
+	return nil
+}
+
+// writeFileAtomic replaces the file at path with raw, so readers see either the old or the new contents in full.
+func writeFileAtomic(path string, raw []byte) error {
+	mode := os.FileMode(0o644)
+	if info, err := os.Stat(path); err == nil {
+		mode = info.Mode().Perm()
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // fails harmlessly once renamed
+	if _, err := tmp.Write(raw); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), mode); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// ownGrants splits perms, the complete new set of user's grants, into the user's own grants and those from roles, which
+// must be unchanged. Own grants without an id are assigned one.
+func ownGrants(p *Policy, user string, perms []*permissions.Permission) ([]*Grant, error) {
+	fromRoles := p.roleGrants(user)
+	own := make([]*permissions.Permission, 0, len(perms))
+	for _, perm := range perms {
+		if r, ok := fromRoles[perm.ID]; ok {
+			if !samePermission(r, perm) {
+				return nil, fmt.Errorf("%w: %s", RoleGrantError, perm.ID)
+			}
+			delete(fromRoles, perm.ID)
+			continue
+		}
+		if perm.ID == "" {
+			id, err := newGrantID()
+			if err != nil {
+				return nil, err
+			}
+			perm.ID = id
+		}
+		own = append(own, perm)
+	}
+	for id := range fromRoles {
+		return nil, fmt.Errorf("%w: %s", RoleGrantError, id)
+	}
+	return grantsFromPermissions(user, own), nil
+}
+
+// samePermission reports whether a and b grant the same rows under the same terms, ignoring the order of rows and the
+// location of times.
+func samePermission(a, b *permissions.Permission) bool {
+	a, b = a.Clone(), b.Clone()
+	permissions.Normalize(a)
+	permissions.Normalize(b)
+	if !sameTime(a.NotBefore, b.NotBefore) || !sameTime(a.ExpiresAt, b.ExpiresAt) {
+		return false
+	}
+	a.NotBefore, a.ExpiresAt, b.NotBefore, b.ExpiresAt = nil, nil, nil, nil
+	return reflect.DeepEqual(a, b)
+}
+
+func sameTime(a, b *time.Time) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Equal(*b)
+}
+
+func grantsFromPermissions(user string, perms []*permissions.Permission) []*Grant {
+	grants := make([]*Grant, len(perms))
+	for i, perm := range perms {
+		grants[i] = grantFromPermission(perm, grantID(user, "", i))
+	}
+	return grants
+}
+
+// grantOwner returns the user holding the grant with id, if any.
+func grantOwner(p *Policy, id string) (string, bool) {
+	for name := range p.Users {
+		for _, g := range p.effectiveGrants(name) {
+			if g.ID == id {
+				return name, true
+			}
+		}
+	}
+	return "", false
+}
+
+// ensureUser returns the user, creating them as a regular user if missing.
+func ensureUser(p *Policy, user string) *User {
+	u := p.Users[user]
+	if u == nil {
+		u = &User{}
+		p.Users[user] = u
+		p.grantsChanged(user)
+	}
+	return u
+}
+
+func (s *FileACLStorage) StoreUserPerms(ctx context.Context, user string, perms []*permissions.Permission) error {
+	return s.update(ctx, func(p *Policy) (*storage.Change, error) {
+		for _, perm := range perms {
+			if owner, ok := grantOwner(p, perm.ID); ok && owner != user {
+				return nil, fmt.Errorf("grant %s belongs to another user", perm.ID)
+			}
+		}
+		u := ensureUser(p, user)
+		grants, err := ownGrants(p, user, perms)
+		if err != nil {
+			return nil, err
+		}
+		u.Grants = grants
+		p.grantsChanged(user)
+		return &storage.Change{User: user, Kind: storage.GrantsChanged}, nil
+	})
+}
+
+func (s *FileACLStorage) GetUserPerms(ctx context.Context, user string) ([]*permissions.Permission, error) {
+	return s.current().GetUserPerms(ctx, user)
+}
+
+func (s *FileACLStorage) UpdateGrants(ctx context.Context, user string, store []*permissions.Permission, remove []string) error {
+	return s.update(ctx, func(p *Policy) (*storage.Change, error) {
+		if err := updateGrants(p, user, store, remove); err != nil {
+			return nil, err
+		}
+		return &storage.Change{User: user, Kind: storage.GrantsChanged}, nil
+	})
+}
+
+func (s *FileACLStorage) GetUserPermsVersion(ctx context.Context, user string) ([]*permissions.Permission, string, error) {
+	s.mu.Lock()
+	p, index := s.policy, s.index
+	s.mu.Unlock()
+	perms, err := index.GetUserPerms(ctx, user)
+	if err != nil {
+		return nil, "", err
+	}
+	return perms, grantsVersion(p, user), nil
+}
+
+// UpdateGrantsIf versions a user's grants including those from roles, so editing a user's roles in the file also
+// conflicts once the file is reloaded.
+func (s *FileACLStorage) UpdateGrantsIf(ctx context.Context, user, version string, store []*permissions.Permission, remove []string) (string, error) {
+	var newVersion string
+	err := s.update(ctx, func(p *Policy) (*storage.Change, error) {
+		if current := grantsVersion(p, user); current != version {
+			return nil, fmt.Errorf("%w: %s is at version %q, not %q", storage.VersionConflictError, user, current, version)
+		}
+		if err := updateGrants(p, user, store, remove); err != nil {
+			return nil, err
+		}
+		newVersion = grantsVersion(p, user)
+		return &storage.Change{User: user, Kind: storage.GrantsChanged}, nil
+	})
+	return newVersion, err
+}
+
+// grantsVersion returns the version of user's grants in p.
+func grantsVersion(p *Policy, user string) string {
+	u, ok := p.Users[user]
+	if !ok {
+		return ""
+	}
+	return storage.GrantsVersion(u.grantsVersion())
+}
+
+// updateGrants applies UpdateGrants to p.
+func updateGrants(p *Policy, user string, store []*permissions.Permission, remove []string) error {
+	for _, perm := range store {
+		if perm.ID == "" {
+			return fmt.Errorf("grant on %s for %s has no id", perm.Table, user)
+		}
+		if owner, ok := grantOwner(p, perm.ID); ok && owner != user {
+			return fmt.Errorf("grant %s belongs to another user", perm.ID)
+		}
+	}
+	fromRoles := p.roleGrants(user)
+	for _, id := range remove {
+		if _, ok := fromRoles[id]; ok {
+			return fmt.Errorf("%w: %s", RoleGrantError, id)
+		}
+	}
+
+	u := ensureUser(p, user)
+	perms := p.effectiveGrants(user)
+	for _, perm := range store {
+		replaced := false
+		for i, existing := range perms {
+			if existing.ID == perm.ID {
+				perms[i] = perm
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			perms = append(perms, perm)
+		}
+	}
+	removed := make(map[string]struct{}, len(remove))
+	for _, id := range remove {
+		removed[id] = struct{}{}
+	}
+	kept := make([]*permissions.Permission, 0, len(perms))
+	for _, perm := range perms {
+		if _, ok := removed[perm.ID]; !ok {
+			kept = append(kept, perm)
+		}
+	}
+	grants, err := ownGrants(p, user, kept)
+	if err != nil {
+		return err
+	}
+	u.Grants = grants
+	p.grantsChanged(user)
+	return nil
+}
+
+func (s *FileACLStorage) GetTableGrants(ctx context.Context, table string) (map[string][]*permissions.Permission, error) {
+	return s.current().GetTableGrants(ctx, table)
+}
+
+func (s *FileACLStorage) GetAllUserInfo(ctx context.Context) (map[string][]*permissions.Permission, map[string]struct{}, error) {
+	return s.current().GetAllUserInfo(ctx)
+}
+
+func (s *FileACLStorage) GetAllKeys(ctx context.Context) ([]*keys.APIKey, error) {
+	return s.current().GetAllKeys(ctx)
+}
+
+func (s *FileACLStorage) StoreKey(ctx context.Context, key *keys.APIKey) error {
+	return s.update(ctx, func(p *Policy) (*storage.Change, error) {
+		u := p.Users[key.User]
+		if u == nil {
+			return nil, fmt.Errorf("%w %s", NoSuchUserError, key.User)
+		}
+		u.Keys = append(u.Keys, keyFromAPIKey(key))
+		return &storage.Change{User: key.User, Kind: storage.UserChanged}, nil
+	})
+}
+
+// updateKey applies change to the key with id, if there is one.
+func (s *FileACLStorage) updateKey(ctx context.Context, id string, change func(u *User, i int)) error {
+	return s.update(ctx, func(p *Policy) (*storage.Change, error) {
+		for name, u := range p.Users {
+			for i, k := range u.Keys {
+				if k.ID == id {
+					change(u, i)
+					return &storage.Change{User: name, Kind: storage.UserChanged}, nil
+				}
+			}
+		}
+		return nil, nil
+	})
+}
+
+func (s *FileACLStorage) SetKeyHash(ctx context.Context, id string, hash []byte) error {
+	return s.updateKey(ctx, id, func(u *User, i int) {
+		u.Keys[i].Hash = hex.EncodeToString(hash)
+	})
+}
+
+func (s *FileACLStorage) SetKeyExpiry(ctx context.Context, id string, expiresAt time.Time) error {
+	return s.updateKey(ctx, id, func(u *User, i int) {
+		t := expiresAt.UTC()
+		u.Keys[i].ExpiresAt = &t
+	})
+}
+
+func (s *FileACLStorage) DeleteKey(ctx context.Context, id string) error {
+	return s.updateKey(ctx, id, func(u *User, i int) {
+		u.Keys = append(u.Keys[:i], u.Keys[i+1:]...)
+	})
+}
+
+func (s *FileACLStorage) GetDisabledUsers(ctx context.Context) (map[string]struct{}, error) {
+	return s.current().GetDisabledUsers(ctx)
+}
+
+func (s *FileACLStorage) CreateUser(ctx context.Context, user string, key *keys.APIKey, isAdmin bool) error {
+	return s.update(ctx, func(p *Policy) (*storage.Change, error) {
+		if _, ok := p.Users[user]; ok {
+			return nil, fmt.Errorf("user %s already exists", user)
+		}
+		u := ensureUser(p, user)
+		u.Admin, u.Keys = isAdmin, []*Key{keyFromAPIKey(key)}
+		return &storage.Change{User: user, Kind: storage.UserChanged}, nil
+	})
+}
+
+// updateUser applies change to an existing user.
+func (s *FileACLStorage) updateUser(ctx context.Context, user string, change func(u *User)) error {
+	return s.update(ctx, func(p *Policy) (*storage.Change, error) {
+		u := p.Users[user]
+		if u == nil {
+			return nil, fmt.Errorf("%w %s", NoSuchUserError, user)
+		}
+		change(u)
+		return &storage.Change{User: user, Kind: storage.UserChanged}, nil
+	})
+}
+
+func (s *FileACLStorage) SetUserDisabled(ctx context.Context, user string, disabled bool) error {
+	return s.updateUser(ctx, user, func(u *User) {
+		u.Disabled = disabled
+	})
+}
+
+func (s *FileACLStorage) SetUserAdmin(ctx context.Context, user string, isAdmin bool) error {
+	return s.updateUser(ctx, user, func(u *User) {
+		u.Admin = isAdmin
+	})
+}
+
+// SetBreakGlass allows or disallows user to self-elevate via break-glass. The ACLStorage interface has no way to change
+// this, which is otherwise only set in the policy file.
+func (s *FileACLStorage) SetBreakGlass(ctx context.Context, user string, allowed bool) error {
+	return s.updateUser(ctx, user, func(u *User) {
+		u.BreakGlass = allowed
+	})
+}
+
+// SetTableAdmin makes user an administrator of table, or stops them being one. Like break-glass, this is otherwise only
+// set in the policy file.
+func (s *FileACLStorage) SetTableAdmin(ctx context.Context, user, table string, isAdmin bool) error {
+	return s.updateUser(ctx, user, func(u *User) {
+		tables := make([]string, 0, len(u.TableAdmin)+1)
+		for _, t := range u.TableAdmin {
+			if t != table {
+				tables = append(tables, t)
+			}
+		}
+		if isAdmin {
+			tables = append(tables, table)
+			sort.Strings(tables)
+		}
+		u.TableAdmin = tables
+	})
+}
+
+func (s *FileACLStorage) DeleteUser(ctx context.Context, user string) error {
+	return s.update(ctx, func(p *Policy) (*storage.Change, error) {
+		if _, ok := p.Users[user]; !ok {
+			return nil, nil
+		}
+		delete(p.Users, user)
+		return &storage.Change{User: user, Kind: storage.UserChanged}, nil
+	})
+}
+
+func (s *FileACLStorage) GetTableAdmins(ctx context.Context) (map[string][]string, error) {
+	return s.current().GetTableAdmins(ctx)
+}
+
+func (s *FileACLStorage) GetBreakGlassUsers(ctx context.Context) (map[string]struct{}, error) {
+	return s.current().GetBreakGlassUsers(ctx)
+}
+
+// auditRecord is one line of the audit log.
+type auditRecord struct {
+	Event       string     `json:"event"` // "elevation" or "query"
+	ElevationID string     `json:"elevation_id"`
+	User        string     `json:"user,omitempty"`
+	Reason      string     `json:"reason,omitempty"`
+	StartedAt   *time.Time `json:"started_at,omitempty"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+	SQL         string     `json:"sql,omitempty"`
+	ExecutedAt  *time.Time `json:"executed_at,omitempty"`
+}
+
+func (s *FileACLStorage) RecordElevation(ctx context.Context, id, user, reason string, start, end time.Time) error {
+	return s.audit(&auditRecord{Event: "elevation", ElevationID: id, User: user, Reason: reason, StartedAt: &start, ExpiresAt: &end})
+}
+
+func (s *FileACLStorage) RecordElevatedQuery(ctx context.Context, elevationID, sql string, at time.Time) error {
+	return s.audit(&auditRecord{Event: "query", ElevationID: elevationID, SQL: sql, ExecutedAt: &at})
+}
+
+// GetActiveElevations reads the elevations back from the audit log.
+func (s *FileACLStorage) GetActiveElevations(ctx context.Context, at time.Time) ([]*storage.Elevation, error) {
+	s.mu.Lock()
+	data, err := os.ReadFile(s.auditPath)
+	s.mu.Unlock()
+	if errors.Is(err, os.ErrNotExist) {
+		return []*storage.Elevation{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading audit log %s: %w", s.auditPath, err)
+	}
+
+	res := make([]*storage.Elevation, 0)
+	dec := json.NewDecoder(bytes.NewReader(data))
+	for dec.More() {
+		var rec auditRecord
+		if err := dec.Decode(&rec); err != nil {
+			return nil, fmt.Errorf("error reading audit log %s: %w", s.auditPath, err)
+		}
+		if rec.Event != "elevation" || rec.StartedAt == nil || rec.ExpiresAt == nil || !at.Before(*rec.ExpiresAt) {
+			continue
+		}
+		res = append(res, &storage.Elevation{
+			ID:     rec.ElevationID,
+			User:   rec.User,
+			Reason: rec.Reason,
+			Start:  *rec.StartedAt,
+			End:    *rec.ExpiresAt,
+		})
+	}
+	sort.SliceStable(res, func(i, j int) bool {
+		return res[i].Start.Before(res[j].Start)
+	})
+	return res, nil
+}
+
+func (s *FileACLStorage) audit(rec *auditRecord) error {
+	var b bytes.Buffer
+	if err := json.NewEncoder(&b).Encode(rec); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, err := os.OpenFile(s.auditPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("error opening audit log %s: %w", s.auditPath, err)
+	}
+	if _, err := f.Write(b.Bytes()); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (s *FileACLStorage) ChangeVersion(ctx context.Context) (uint64, error) {
+	return s.changes.Version(), nil
+}
+
+// Watch reports changes written through this storage as they are made. Changes to the file from outside are reported
+// as AllChanged once reloaded, by Reload or StartWatching.
+func (s *FileACLStorage) Watch(ctx context.Context, since uint64, fn func(storage.Change)) error {
+	return s.changes.Watch(ctx, since, fn)
+}
+
+// Close stops watching the file, and stops watchers.
+func (s *FileACLStorage) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stop != nil {
+		s.stop()
+		s.stop = nil
+	}
+	s.changes.Close()
+	return nil
+}
+
+func newGrantID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,334 @@
+package file_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"chroma1/internal/acl/storage"
+	"chroma1/internal/acl/storage/file"
+	"chroma1/internal/acl/storage/storagetest"
+	"chroma1/model/permissions"
+)
+
+const examplePolicy = `
+roles:
+  analyst:
+    grants:
+      - type: read
+        table: orders
+        except: [["7"]]
+users:
+  alice:
+    admin: true
+    keys:
+      - id: k1
+        hash: 0a0b
+        created_at: 2023-01-01T00:00:00Z
+  bob:
+    disabled: true
+    break_glass: true
+    table_admin: [orders]
+    roles: [analyst]
+    grants:
+      - id: bob-items
+        type: write
+        table: items
+        rows: [["1", "a"], ["2", "b"]]
+        ranges:
+          - start: ["5"]
+            end: ["9"]
+            end_after: true
+        expires_at: 2030-01-01T00:00:00Z
+        condition: 'claims.team == "x"'
+        inherit: true
+      - type: read
+        table: items
+        rows: []
+`
+
+func writePolicy(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if !assert.NoError(t, os.WriteFile(path, []byte(content), 0o644)) {
+		t.FailNow()
+	}
+	return path
+}
+
+func TestConformance(t *testing.T) {
+	for _, name := range []string{"policy.yaml", "policy.json"} {
+		t.Run(name, func(t *testing.T) {
+			storagetest.Run(t, func(t *testing.T) storage.ACLStorage {
+				s, err := file.NewFileACLStorage(context.Background(), filepath.Join(t.TempDir(), name))
+				if !assert.NoError(t, err) {
+					t.FailNow()
+				}
+				return s
+			})
+		})
+	}
+}
+
+func TestLoadPolicy(t *testing.T) {
+	ctx := context.Background()
+	s, err := file.NewFileACLStorage(ctx, writePolicy(t, "policy.yaml", examplePolicy), file.ReadOnly())
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer s.Close()
+
+	expires := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	all, admins, err := s.GetAllUserInfo(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]struct{}{"alice": {}}, admins)
+	assert.Empty(t, all["alice"])
+	assert.Equal(t, []*permissions.Permission{
+		{ID: "bob-items", Type: permissions.Write, Table: "items", RowKeys: [][]string{{"1", "a"}, {"2", "b"}},
+			RowRanges: []permissions.KeyRange{{Start: []string{"5"}, End: []string{"9"}, EndAfter: true}},
+			ExpiresAt: &expires, Condition: `claims.team == "x"`, Inherit: true},
+		{ID: "bob#1", Type: permissions.Read, Table: "items", RowKeys: [][]string{}},
+		{ID: "bob@analyst#0", Type: permissions.Read, Table: "orders", ExceptKeys: [][]string{{"7"}}, Role: "analyst"},
+	}, all["bob"])
+
+	disabled, err := s.GetDisabledUsers(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]struct{}{"bob": {}}, disabled)
+	breakGlass, err := s.GetBreakGlassUsers(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]struct{}{"bob": {}}, breakGlass)
+	tableAdmins, err := s.GetTableAdmins(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]string{"bob": {"orders"}}, tableAdmins)
+	allKeys, err := s.GetAllKeys(ctx)
+	assert.NoError(t, err)
+	if assert.Len(t, allKeys, 1) {
+		assert.Equal(t, "alice", allKeys[0].User)
+		assert.Equal(t, []byte{0x0a, 0x0b}, allKeys[0].Hash)
+	}
+}
+
+func TestInvalidPolicy(t *testing.T) {
+	testcases := []struct {
+		name    string
+		content string
+		problem string
+	}{
+		{"policy.yaml", "users: {alice: {admn: true}}", "admn"},
+		{"policy.json", `{"users": {"alice": {"grants": [{"type": "read", "table": "t", "row": [["1"]]}]}}}`, "row"},
+		{"policy.yaml", "users: {alice: {roles: [missing]}}", `unknown role "missing"`},
+		{"policy.yaml", "users: {alice: {grants: [{type: delete, table: t}]}}", "unknown permission type"},
+		{"policy.yaml", "roles: {r: {grants: [{type: read}]}}\nusers: {}", "has no table"},
+		{"policy.yaml", "users: {alice: {grants: [{type: read, table: t, condition: 'claims.x =='}]}}", "invalid condition"},
+		{"policy.yaml", "users: {alice: {grants: [{type: read, table: t, rows: [], except: []}]}}", "both rows and except"},
+		{"policy.yaml", "users: {alice: {grants: [{type: read, table: t, not_before: 2030-01-01T00:00:00Z, expires_at: 2020-01-01T00:00:00Z}]}}", "expires before it starts"},
+		{"policy.yaml", "users: {alice: {grants: [{id: g, type: read, table: t}]}, bob: {grants: [{id: g, type: read, table: t}]}}", `grant id "g"`},
+		{"policy.yaml", "users: {alice: {keys: [{id: k, hash: 01}]}, bob: {keys: [{id: k, hash: 02}]}}", `key id "k"`},
+		{"policy.yaml", "users: {alice: {keys: [{id: k, hash: xyz}]}}", "valid hex hash"},
+		{"policy.toml", "", "unsupported"},
+	}
+	for i, tc := range testcases {
+		t.Run(fmt.Sprintf("TestInvalidPolicy case %v", i), func(t *testing.T) {
+			_, err := file.NewFileACLStorage(context.Background(), writePolicy(t, tc.name, tc.content))
+			if assert.Error(t, err) {
+				assert.Contains(t, err.Error(), tc.problem)
+			}
+		})
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	ctx := context.Background()
+	path := writePolicy(t, "policy.yaml", examplePolicy)
+	audit := filepath.Join(t.TempDir(), "audit.jsonl")
+	s, err := file.NewFileACLStorage(ctx, path, file.ReadOnly(), file.WithAuditLog(audit))
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer s.Close()
+
+	assert.ErrorIs(t, s.StoreUserPerms(ctx, "alice", []*permissions.Permission{{Type: permissions.Read, Table: "t"}}), file.ReadOnlyError)
+	assert.ErrorIs(t, s.CreateUser(ctx, "carol", storagetest.NewKey("carol"), false), file.ReadOnlyError)
+	assert.ErrorIs(t, s.DeleteKey(ctx, "k1"), file.ReadOnlyError)
+	raw, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, examplePolicy, string(raw))
+
+	// elevations are still audited
+	now := time.Now()
+	assert.NoError(t, s.RecordElevation(ctx, "e1", "bob", "incident", now, now.Add(time.Hour)))
+	assert.NoError(t, s.RecordElevatedQuery(ctx, "e1", "SELECT * FROM orders", now))
+	raw, err = os.ReadFile(audit)
+	assert.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(raw)), "\n")
+	if assert.Len(t, lines, 2) {
+		assert.Contains(t, lines[0], `"event":"elevation"`)
+		assert.Contains(t, lines[1], `"sql":"SELECT * FROM orders"`)
+	}
+
+	// a missing file is not created
+	_, err = file.NewFileACLStorage(ctx, filepath.Join(t.TempDir(), "missing.yaml"), file.ReadOnly())
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestWriteBack(t *testing.T) {
+	ctx := context.Background()
+	for _, name := range []string{"policy.yaml", "policy.json"} {
+		t.Run(name, func(t *testing.T) {
+			path := writePolicy(t, "policy.yaml", examplePolicy)
+			if name == "policy.json" {
+				// convert the example by loading it and writing it back as JSON
+				src, err := file.NewFileACLStorage(ctx, path, file.ReadOnly())
+				if !assert.NoError(t, err) {
+					t.FailNow()
+				}
+				all, _, err := src.GetAllUserInfo(ctx)
+				assert.NoError(t, err)
+				path = filepath.Join(t.TempDir(), name)
+				dst, err := file.NewFileACLStorage(ctx, path)
+				if !assert.NoError(t, err) {
+					t.FailNow()
+				}
+				assert.NoError(t, dst.StoreUserPerms(ctx, "bob", all["bob"][:2]))
+			}
+
+			s, err := file.NewFileACLStorage(ctx, path)
+			if !assert.NoError(t, err) {
+				t.FailNow()
+			}
+			defer s.Close()
+			bob, err := s.GetUserPerms(ctx, "bob")
+			assert.NoError(t, err)
+			added := &permissions.Permission{Type: permissions.Read, Table: "customers"}
+			assert.NoError(t, s.StoreUserPerms(ctx, "bob", append(bob, added)))
+			// the user's own grants come before those of their roles
+			var expected, roles []*permissions.Permission
+			for _, p := range bob {
+				if strings.Contains(p.ID, "@") {
+					roles = append(roles, p)
+				} else {
+					expected = append(expected, p)
+				}
+			}
+			expected = append(append(expected, added), roles...)
+
+			reopened, err := file.NewFileACLStorage(ctx, path)
+			if !assert.NoError(t, err) {
+				t.FailNow()
+			}
+			defer reopened.Close()
+			got, err := reopened.GetUserPerms(ctx, "bob")
+			assert.NoError(t, err)
+			assert.Equal(t, expected, got)
+
+			// ids derived from positions are not written out
+			raw, err := os.ReadFile(path)
+			assert.NoError(t, err)
+			assert.NotContains(t, string(raw), "bob#")
+			entries, err := os.ReadDir(filepath.Dir(path))
+			assert.NoError(t, err)
+			for _, e := range entries {
+				assert.NotContains(t, e.Name(), ".tmp-", "temporary files are cleaned up")
+			}
+		})
+	}
+}
+
+func TestRoleGrants(t *testing.T) {
+	ctx := context.Background()
+	s, err := file.NewFileACLStorage(ctx, writePolicy(t, "policy.yaml", examplePolicy))
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer s.Close()
+	bob, err := s.GetUserPerms(ctx, "bob")
+	if !assert.NoError(t, err) || !assert.Len(t, bob, 3) {
+		t.FailNow()
+	}
+	role := bob[2]
+	assert.Empty(t, bob[0].Role)
+	assert.NotEmpty(t, role.Role, "grants from roles name their role")
+
+	// role grants may be passed back unchanged, even normalized differently
+	same := role.Clone()
+	same.ExceptKeys = [][]string{{"7"}, {"7"}}
+	assert.NoError(t, s.StoreUserPerms(ctx, "bob", []*permissions.Permission{bob[0], same}))
+
+	changed := role.Clone()
+	changed.ExceptKeys = [][]string{{"8"}}
+	assert.ErrorIs(t, s.StoreUserPerms(ctx, "bob", []*permissions.Permission{changed}), file.RoleGrantError)
+	assert.ErrorIs(t, s.StoreUserPerms(ctx, "bob", nil), file.RoleGrantError)
+	assert.ErrorIs(t, s.UpdateGrants(ctx, "bob", []*permissions.Permission{changed}, nil), file.RoleGrantError)
+	assert.ErrorIs(t, s.UpdateGrants(ctx, "bob", nil, []string{role.ID}), file.RoleGrantError)
+	assert.NoError(t, s.UpdateGrants(ctx, "bob", nil, []string{bob[0].ID}))
+
+	got, err := s.GetUserPerms(ctx, "bob")
+	assert.NoError(t, err)
+	assert.Equal(t, []*permissions.Permission{role}, got)
+}
+
+func TestStartWatching(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	path := writePolicy(t, "policy.yaml", "users: {alice: {}}")
+	s, err := file.NewFileACLStorage(ctx, path, file.ReadOnly(), file.WithReloadDelay(10*time.Millisecond))
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer s.Close()
+	reloads := make(chan struct{}, 10)
+	errs := make(chan error, 10)
+	assert.NoError(t, s.StartWatching(ctx, func() { reloads <- struct{}{} }, func(err error) { errs <- err }))
+
+	users := func() []string {
+		all, _, err := s.GetAllUserInfo(ctx)
+		assert.NoError(t, err)
+		res := make([]string, 0, len(all))
+		for u := range all {
+			res = append(res, u)
+		}
+		return res
+	}
+
+	// written in place
+	assert.NoError(t, os.WriteFile(path, []byte("users: {bob: {}}"), 0o644))
+	select {
+	case <-reloads:
+	case err := <-errs:
+		t.Fatal(err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no reload after writing the file")
+	}
+	assert.Equal(t, []string{"bob"}, users())
+
+	// an invalid file is reported and the loaded policy kept
+	assert.NoError(t, os.WriteFile(path, []byte("users: {bob: {roles: [missing]}}"), 0o644))
+	select {
+	case err := <-errs:
+		assert.ErrorIs(t, err, file.InvalidPolicyError)
+	case <-reloads:
+		t.Fatal("reloaded an invalid policy")
+	case <-time.After(5 * time.Second):
+		t.Fatal("no error after writing an invalid file")
+	}
+	assert.Equal(t, []string{"bob"}, users())
+
+	// replaced by a rename
+	tmp := filepath.Join(filepath.Dir(path), "new.yaml.tmp")
+	assert.NoError(t, os.WriteFile(tmp, []byte("users: {carol: {}}"), 0o644))
+	assert.NoError(t, os.Rename(tmp, path))
+	select {
+	case <-reloads:
+	case err := <-errs:
+		t.Fatal(err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no reload after replacing the file")
+	}
+	assert.Equal(t, []string{"carol"}, users())
+}
@@ -0,0 +1,489 @@
+package file
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"chroma1/internal/acl/condition"
+	"chroma1/internal/acl/storage/memory"
+	"chroma1/model/keys"
+	"chroma1/model/permissions"
+)
+
+var (
+	InvalidPolicyError     = fmt.Errorf("invalid policy")
+	UnsupportedFormatError = fmt.Errorf("unsupported policy file format, expected .yaml, .yml or .json")
+)
+
+// Policy is the declarative form of the ACLs kept in a policy file.
+type Policy struct {
+	// named sets of grants users can be given together
+	Roles map[string]*Role `yaml:"roles,omitempty" json:"roles,omitempty"`
+	Users map[string]*User `yaml:"users" json:"users"`
+	// last grants version given to a user, kept by the store so that versions are never reused
+	GrantsCounter uint64 `yaml:"grants_counter,omitempty" json:"grants_counter,omitempty"`
+}
+
+type Role struct {
+	Grants []*Grant `yaml:"grants" json:"grants"`
+}
+
+type User struct {
+	Admin      bool `yaml:"admin,omitempty" json:"admin,omitempty"`
+	Disabled   bool `yaml:"disabled,omitempty" json:"disabled,omitempty"`
+	BreakGlass bool `yaml:"break_glass,omitempty" json:"break_glass,omitempty"`
+	// tables the user administers
+	TableAdmin []string `yaml:"table_admin,omitempty" json:"table_admin,omitempty"`
+	// roles whose grants the user holds, in addition to their own
+	Roles  []string `yaml:"roles,omitempty" json:"roles,omitempty"`
+	Grants []*Grant `yaml:"grants,omitempty" json:"grants,omitempty"`
+	Keys   []*Key   `yaml:"keys,omitempty" json:"keys,omitempty"`
+	// version of the user's grants, moved on by the store with every change to them
+	GrantsVersion uint64 `yaml:"grants_version,omitempty" json:"grants_version,omitempty"`
+}
+
+// Grant is a permission as written in a policy file. A grant without rows, ranges or except covers all rows of the
+// table; `rows: []` covers none.
+type Grant struct {
+	// Optional. Grants without one are identified by their user, role and position.
+	ID          string      `yaml:"id,omitempty" json:"id,omitempty"`
+	Type        string      `yaml:"type" json:"type"` // read or write
+	Table       string      `yaml:"table" json:"table"`
+	Rows        *[][]string `yaml:"rows,omitempty" json:"rows,omitempty"`
+	Ranges      []*Range    `yaml:"ranges,omitempty" json:"ranges,omitempty"`
+	Except      [][]string  `yaml:"except,omitempty" json:"except,omitempty"`
+	NotBefore   *time.Time  `yaml:"not_before,omitempty" json:"not_before,omitempty"`
+	ExpiresAt   *time.Time  `yaml:"expires_at,omitempty" json:"expires_at,omitempty"`
+	Condition   string      `yaml:"condition,omitempty" json:"condition,omitempty"`
+	Inherit     bool        `yaml:"inherit,omitempty" json:"inherit,omitempty"`
+	GrantOption bool        `yaml:"grant_option,omitempty" json:"grant_option,omitempty"`
+}
+
+// Range is a permissions.KeyRange as written in a policy file.
+type Range struct {
+	Start      []string `yaml:"start,omitempty" json:"start,omitempty"`
+	StartAfter bool     `yaml:"start_after,omitempty" json:"start_after,omitempty"`
+	End        []string `yaml:"end,omitempty" json:"end,omitempty"`
+	EndAfter   bool     `yaml:"end_after,omitempty" json:"end_after,omitempty"`
+}
+
+// Key is an API key as written in a policy file. Only the hash of the secret is kept.
+type Key struct {
+	ID        string     `yaml:"id" json:"id"`
+	Hash      string     `yaml:"hash" json:"hash"` // hex
+	Label     string     `yaml:"label,omitempty" json:"label,omitempty"`
+	CreatedAt time.Time  `yaml:"created_at" json:"created_at"`
+	ExpiresAt *time.Time `yaml:"expires_at,omitempty" json:"expires_at,omitempty"`
+}
+
+// decodePolicy parses a policy in the format given by the extension of path. Unknown fields are rejected, so typos do
+// not silently drop grants.
+func decodePolicy(path string, raw []byte) (*Policy, error) {
+	p := &Policy{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		dec := json.NewDecoder(bytes.NewReader(raw))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(p); err != nil {
+			return nil, fmt.Errorf("%w: %s", InvalidPolicyError, err)
+		}
+	case ".yaml", ".yml":
+		dec := yaml.NewDecoder(bytes.NewReader(raw))
+		dec.KnownFields(true)
+		// an empty document is an empty policy
+		if err := dec.Decode(p); err != nil && !errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("%w: %s", InvalidPolicyError, err)
+		}
+	default:
+		return nil, UnsupportedFormatError
+	}
+	if p.Users == nil {
+		p.Users = make(map[string]*User)
+	}
+	return p, nil
+}
+
+// encodePolicy formats p in the format given by the extension of path.
+func encodePolicy(path string, p *Policy) ([]byte, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		raw, err := json.MarshalIndent(p, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		return append(raw, '\n'), nil
+	case ".yaml", ".yml":
+		var b bytes.Buffer
+		enc := yaml.NewEncoder(&b)
+		enc.SetIndent(2)
+		if err := enc.Encode(p); err != nil {
+			return nil, err
+		}
+		if err := enc.Close(); err != nil {
+			return nil, err
+		}
+		return b.Bytes(), nil
+	}
+	return nil, UnsupportedFormatError
+}
+
+// clone returns a deep copy of p.
+func (p *Policy) clone() (*Policy, error) {
+	raw, err := json.Marshal(p)
+	if err != nil {
+		return nil, err
+	}
+	c := &Policy{}
+	if err := json.Unmarshal(raw, c); err != nil {
+		return nil, err
+	}
+	if c.Users == nil {
+		c.Users = make(map[string]*User)
+	}
+	return c, nil
+}
+
+// Validate reports every problem with p, wrapped in InvalidPolicyError.
+func (p *Policy) Validate() error {
+	var problems []string
+	problemf := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+	for _, name := range sortedKeys(p.Roles) {
+		if p.Roles[name] == nil {
+			problemf("role %q is empty", name)
+			continue
+		}
+		for i, g := range p.Roles[name].Grants {
+			validateGrant(g, fmt.Sprintf("role %q grant %d", name, i), problemf)
+		}
+	}
+
+	grantIDs := make(map[string]string)
+	keyIDs := make(map[string]string)
+	for _, name := range sortedKeys(p.Users) {
+		u := p.Users[name]
+		if name == "" {
+			problemf("user with empty name")
+		}
+		if u == nil {
+			continue
+		}
+		for _, r := range u.Roles {
+			if _, ok := p.Roles[r]; !ok {
+				problemf("user %q has unknown role %q", name, r)
+			}
+		}
+		for _, t := range u.TableAdmin {
+			if t == "" {
+				problemf("user %q administers a table with an empty name", name)
+			}
+		}
+		for i, g := range u.Grants {
+			validateGrant(g, fmt.Sprintf("user %q grant %d", name, i), problemf)
+		}
+		for _, g := range p.effectiveGrants(name) {
+			if other, ok := grantIDs[g.ID]; ok {
+				problemf("grant id %q is used by both %q and %q", g.ID, other, name)
+			}
+			grantIDs[g.ID] = name
+		}
+		for i, k := range u.Keys {
+			if k == nil || k.ID == "" {
+				problemf("user %q key %d has no id", name, i)
+				continue
+			}
+			if other, ok := keyIDs[k.ID]; ok {
+				problemf("key id %q is used by both %q and %q", k.ID, other, name)
+			}
+			keyIDs[k.ID] = name
+			if h, err := hex.DecodeString(k.Hash); err != nil || len(h) == 0 {
+				problemf("user %q key %q has no valid hex hash", name, k.ID)
+			}
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%w: %s", InvalidPolicyError, strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+func validateGrant(g *Grant, where string, problemf func(format string, args ...interface{})) {
+	if g == nil {
+		problemf("%s is empty", where)
+		return
+	}
+	if _, err := parseType(g.Type); err != nil {
+		problemf("%s: %s", where, err)
+	}
+	if g.Table == "" {
+		problemf("%s has no table", where)
+	}
+	if g.Rows != nil && g.Except != nil {
+		problemf("%s has both rows and except", where)
+	}
+	if g.NotBefore != nil && g.ExpiresAt != nil && !g.NotBefore.Before(*g.ExpiresAt) {
+		problemf("%s expires before it starts", where)
+	}
+	if g.Condition != "" {
+		if _, err := condition.Compile(g.Condition); err != nil {
+			problemf("%s has an invalid condition: %s", where, err)
+		}
+	}
+}
+
+func parseType(t string) (permissions.PermissionType, error) {
+	switch strings.ToLower(t) {
+	case "read":
+		return permissions.Read, nil
+	case "write":
+		return permissions.Write, nil
+	}
+	return 0, fmt.Errorf("unknown permission type %q, expected read or write", t)
+}
+
+// grantID identifies the i'th grant of a user, or of a role as held by a user, when the policy gives it no id.
+func grantID(user, role string, i int) string {
+	if role == "" {
+		return fmt.Sprintf("%s#%d", user, i)
+	}
+	return fmt.Sprintf("%s@%s#%d", user, role, i)
+}
+
+// effectiveGrants returns user's own grants followed by those of their roles, as permissions with ids.
+func (p *Policy) effectiveGrants(user string) []*permissions.Permission {
+	u := p.Users[user]
+	perms := make([]*permissions.Permission, 0)
+	if u == nil {
+		return perms
+	}
+	for i, g := range u.Grants {
+		if g != nil {
+			perms = append(perms, g.permission(grantID(user, "", i)))
+		}
+	}
+	for _, r := range u.Roles {
+		if role := p.Roles[r]; role != nil {
+			for i, g := range role.Grants {
+				if g != nil {
+					perm := g.permission(grantID(user, r, i))
+					perm.Role = r
+					perms = append(perms, perm)
+				}
+			}
+		}
+	}
+	return perms
+}
+
+// grantsChanged moves user's grants on to a new version. The user must exist.
+func (p *Policy) grantsChanged(user string) {
+	p.GrantsCounter++
+	p.Users[user].GrantsVersion = p.GrantsCounter
+}
+
+// settleGrantsVersions moves on the version of each user whose grants differ from those in prev, the policy loaded
+// before p, unless the file already did, so that edits made to the file outside the store also conflict with writes
+// based on earlier versions. The versions reach the file with the next write through the store.
+func (p *Policy) settleGrantsVersions(prev *Policy) {
+	for _, u := range p.Users {
+		if u != nil && u.GrantsVersion > p.GrantsCounter {
+			p.GrantsCounter = u.GrantsVersion
+		}
+	}
+	if prev == nil {
+		return
+	}
+	if prev.GrantsCounter > p.GrantsCounter {
+		p.GrantsCounter = prev.GrantsCounter
+	}
+	names := make([]string, 0, len(p.Users))
+	for name := range p.Users {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		version, oldVersion := p.Users[name].grantsVersion(), prev.Users[name].grantsVersion()
+		if _, existed := prev.Users[name]; existed {
+			if version > oldVersion {
+				continue
+			}
+			if version == oldVersion && sameGrants(p.effectiveGrants(name), prev.effectiveGrants(name)) {
+				continue
+			}
+		}
+		if p.Users[name] == nil {
+			p.Users[name] = &User{}
+		}
+		p.grantsChanged(name)
+	}
+}
+
+func (u *User) grantsVersion() uint64 {
+	if u == nil {
+		return 0
+	}
+	return u.GrantsVersion
+}
+
+func sameGrants(a, b []*permissions.Permission) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].ID != b[i].ID || !samePermission(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// roleGrants returns the grants user holds through roles, by id.
+func (p *Policy) roleGrants(user string) map[string]*permissions.Permission {
+	res := make(map[string]*permissions.Permission)
+	u := p.Users[user]
+	if u == nil {
+		return res
+	}
+	for _, r := range u.Roles {
+		if role := p.Roles[r]; role != nil {
+			for i, g := range role.Grants {
+				if g == nil {
+					continue
+				}
+				id := grantID(user, r, i)
+				res[id] = g.permission(id)
+				res[id].Role = r
+			}
+		}
+	}
+	return res
+}
+
+// permission converts g, which must be valid, using defaultID if g has no id.
+func (g *Grant) permission(defaultID string) *permissions.Permission {
+	t, _ := parseType(g.Type)
+	p := &permissions.Permission{
+		ID:          g.ID,
+		Type:        t,
+		Table:       g.Table,
+		ExceptKeys:  g.Except,
+		NotBefore:   g.NotBefore,
+		ExpiresAt:   g.ExpiresAt,
+		Condition:   g.Condition,
+		Inherit:     g.Inherit,
+		GrantOption: g.GrantOption,
+	}
+	if p.ID == "" {
+		p.ID = defaultID
+	}
+	if g.Rows != nil {
+		p.RowKeys = *g.Rows
+	}
+	for _, r := range g.Ranges {
+		p.RowRanges = append(p.RowRanges, permissions.KeyRange{Start: r.Start, StartAfter: r.StartAfter, End: r.End, EndAfter: r.EndAfter})
+	}
+	return p
+}
+
+// grantFromPermission converts p, omitting its id if it is defaultID.
+func grantFromPermission(p *permissions.Permission, defaultID string) *Grant {
+	g := &Grant{
+		Type:        strings.ToLower(p.Type.String()),
+		Table:       p.Table,
+		Except:      p.ExceptKeys,
+		NotBefore:   p.NotBefore,
+		ExpiresAt:   p.ExpiresAt,
+		Condition:   p.Condition,
+		Inherit:     p.Inherit,
+		GrantOption: p.GrantOption,
+	}
+	if p.ID != defaultID {
+		g.ID = p.ID
+	}
+	if p.RowKeys != nil {
+		rows := p.RowKeys
+		g.Rows = &rows
+	}
+	for _, r := range p.RowRanges {
+		g.Ranges = append(g.Ranges, &Range{Start: r.Start, StartAfter: r.StartAfter, End: r.End, EndAfter: r.EndAfter})
+	}
+	return g
+}
+
+func (k *Key) apiKey(user string) *keys.APIKey {
+	hash, _ := hex.DecodeString(k.Hash)
+	return &keys.APIKey{
+		ID:        k.ID,
+		User:      user,
+		Hash:      hash,
+		Label:     k.Label,
+		CreatedAt: k.CreatedAt,
+		ExpiresAt: k.ExpiresAt,
+	}
+}
+
+func keyFromAPIKey(k *keys.APIKey) *Key {
+	return &Key{
+		ID:        k.ID,
+		Hash:      hex.EncodeToString(k.Hash),
+		Label:     k.Label,
+		CreatedAt: k.CreatedAt.UTC(),
+		ExpiresAt: k.ExpiresAt,
+	}
+}
+
+// index builds an in-memory store holding p, which must be valid, to serve reads from.
+func (p *Policy) index(ctx context.Context) (*memory.MemoryACLStorage, error) {
+	idx := memory.NewMemoryACLStorage()
+	for _, name := range sortedKeys(p.Users) {
+		u := p.Users[name]
+		if u == nil {
+			u = &User{}
+			p.Users[name] = u
+		}
+		if err := idx.StoreUserPerms(ctx, name, p.effectiveGrants(name)); err != nil {
+			return nil, err
+		}
+		if err := idx.SetUserAdmin(ctx, name, u.Admin); err != nil {
+			return nil, err
+		}
+		if err := idx.SetUserDisabled(ctx, name, u.Disabled); err != nil {
+			return nil, err
+		}
+		if err := idx.SetBreakGlass(name, u.BreakGlass); err != nil {
+			return nil, err
+		}
+		for _, t := range u.TableAdmin {
+			if err := idx.SetTableAdmin(name, t, true); err != nil {
+				return nil, err
+			}
+		}
+		for _, k := range u.Keys {
+			if err := idx.StoreKey(ctx, k.apiKey(name)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return idx, nil
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	res := make([]string, 0, len(m))
+	for k := range m {
+		res = append(res, k)
+	}
+	sort.Strings(res)
+	return res
+}
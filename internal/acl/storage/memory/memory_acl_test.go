@@ -0,0 +1,139 @@
+package memory_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"chroma1/internal/acl/storage"
+	"chroma1/internal/acl/storage/memory"
+	"chroma1/internal/acl/storage/storagetest"
+	"chroma1/model/permissions"
+)
+
+func TestConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.ACLStorage {
+		return memory.NewMemoryACLStorage()
+	})
+}
+
+func TestFaults(t *testing.T) {
+	injected := fmt.Errorf("injected")
+	testcases := []struct {
+		faults []memory.Fault
+		// outcome of successive StoreUserPerms calls, nil for success
+		stores []error
+	}{
+		{
+			faults: nil,
+			stores: []error{nil, nil},
+		},
+		{
+			faults: []memory.Fault{{Err: injected}},
+			stores: []error{injected, injected, injected},
+		},
+		{
+			faults: []memory.Fault{{Ops: []string{"StoreUserPerms"}, Err: injected, Times: 2}},
+			stores: []error{injected, injected, nil},
+		},
+		{
+			faults: []memory.Fault{{Ops: []string{"GetUserPerms", "DeleteKey"}, Err: injected}},
+			stores: []error{nil, nil},
+		},
+		{
+			// the earliest matching fault applies, and only counts when it does
+			faults: []memory.Fault{{Err: injected, Times: 1}, {Err: context.Canceled, Times: 1}},
+			stores: []error{injected, context.Canceled, nil},
+		},
+	}
+	ctx := context.Background()
+	for i, tc := range testcases {
+		t.Run(fmt.Sprintf("TestFaults case %v", i), func(t *testing.T) {
+			s := memory.NewMemoryACLStorage()
+			for _, f := range tc.faults {
+				s.InjectFault(f)
+			}
+			perms := []*permissions.Permission{{Type: permissions.Read, Table: "t1"}}
+			for j, want := range tc.stores {
+				err := s.StoreUserPerms(ctx, "alice", perms)
+				if want == nil {
+					assert.NoError(t, err, "store %v", j)
+				} else {
+					assert.ErrorIs(t, err, want, "store %v", j)
+				}
+			}
+
+			s.ClearFaults()
+			assert.NoError(t, s.StoreUserPerms(ctx, "alice", perms))
+		})
+	}
+}
+
+func TestFaultsLeaveStateUnchanged(t *testing.T) {
+	ctx := context.Background()
+	s := memory.NewMemoryACLStorage()
+	assert.NoError(t, s.CreateUser(ctx, "alice", storagetest.NewKey("alice"), false))
+	s.InjectFault(memory.Fault{Ops: []string{"StoreUserPerms", "SetUserAdmin"}, Err: fmt.Errorf("injected")})
+
+	assert.Error(t, s.StoreUserPerms(ctx, "alice", []*permissions.Permission{{Type: permissions.Read, Table: "t1"}}))
+	assert.Error(t, s.SetUserAdmin(ctx, "alice", true))
+	all, admins, err := s.GetAllUserInfo(ctx)
+	assert.NoError(t, err)
+	assert.Empty(t, all["alice"])
+	assert.Empty(t, admins)
+}
+
+func TestLatency(t *testing.T) {
+	s := memory.NewMemoryACLStorage()
+	s.InjectFault(memory.Fault{Ops: []string{"GetAllKeys"}, Latency: 20 * time.Millisecond})
+
+	start := time.Now()
+	_, err := s.GetAllKeys(context.Background())
+	assert.NoError(t, err)
+	assert.GreaterOrEqual(t, time.Since(start), 20*time.Millisecond)
+
+	// slow operations give up when the context is done
+	s.InjectFault(memory.Fault{Ops: []string{"GetDisabledUsers"}, Latency: time.Hour})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = s.GetDisabledUsers(ctx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestSeeding(t *testing.T) {
+	ctx := context.Background()
+	s := memory.NewMemoryACLStorage()
+	assert.NoError(t, s.CreateUser(ctx, "alice", storagetest.NewKey("alice"), false))
+	assert.Error(t, s.SetTableAdmin("bob", "t1", true))
+
+	assert.NoError(t, s.SetTableAdmin("alice", "t2", true))
+	assert.NoError(t, s.SetTableAdmin("alice", "t1", true))
+	assert.NoError(t, s.SetTableAdmin("alice", "t1", true))
+	assert.NoError(t, s.SetBreakGlass("alice", true))
+	tableAdmins, err := s.GetTableAdmins(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]string{"alice": {"t1", "t2"}}, tableAdmins)
+	breakGlass, err := s.GetBreakGlassUsers(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]struct{}{"alice": {}}, breakGlass)
+
+	assert.NoError(t, s.SetTableAdmin("alice", "t1", false))
+	tableAdmins, err = s.GetTableAdmins(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]string{"alice": {"t2"}}, tableAdmins)
+
+	now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	assert.NoError(t, s.RecordElevation(ctx, "e1", "alice", "incident", now, now.Add(time.Hour)))
+	assert.NoError(t, s.RecordElevatedQuery(ctx, "e1", "SELECT 1", now))
+	assert.Equal(t, []*memory.Elevation{{
+		ID: "e1", User: "alice", Reason: "incident", StartedAt: now, ExpiresAt: now.Add(time.Hour),
+		Queries: []memory.ElevatedQuery{{SQL: "SELECT 1", ExecutedAt: now}},
+	}}, s.Elevations())
+
+	assert.NoError(t, s.Close())
+	_, _, err = s.GetAllUserInfo(ctx)
+	assert.ErrorIs(t, err, memory.ClosedError)
+}
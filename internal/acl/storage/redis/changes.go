@@ -0,0 +1,148 @@
+package redis
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"chroma1/internal/acl/storage"
+)
+
+// changeRecord is an entry in the change log. Its version is implied by its position.
+type changeRecord struct {
+	User string `json:"user"`
+	Kind string `json:"kind"`
+}
+
+var changeKinds = map[string]storage.ChangeKind{
+	storage.GrantsChanged.String(): storage.GrantsChanged,
+	storage.UserChanged.String():   storage.UserChanged,
+}
+
+// changeCommand returns the command logging a change to user, to run in the transaction making it.
+func (s *RedisACLStorage) changeCommand(user string, kind storage.ChangeKind) ([]string, error) {
+	encoded, err := json.Marshal(&changeRecord{User: user, Kind: kind.String()})
+	if err != nil {
+		return nil, err
+	}
+	return []string{"RPUSH", s.changesKey(), string(encoded)}, nil
+}
+
+// ChangeVersion returns the version of the latest change, including trimmed ones.
+func (s *RedisACLStorage) ChangeVersion(ctx context.Context) (uint64, error) {
+	replies, err := s.read(ctx, []string{"GET", s.changesTrimmedKey()}, []string{"LLEN", s.changesKey()})
+	if err != nil {
+		return 0, err
+	}
+	trimmed, err := trimmedReply(replies[0])
+	if err != nil {
+		return 0, err
+	}
+	n, _ := replies[1].(int64)
+	return trimmed + uint64(n), nil
+}
+
+// Watch polls the change log, so it sees changes made by every client of the store.
+func (s *RedisACLStorage) Watch(ctx context.Context, since uint64, fn func(storage.Change)) error {
+	ticker := time.NewTicker(s.pollInterval)
+	defer ticker.Stop()
+	for {
+		changes, err := s.changesSince(ctx, since)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return fmt.Errorf("error reading changes: %w", err)
+		}
+		for _, c := range changes {
+			fn(c)
+			since = c.Version
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// changesSince returns the changes after version, or an AllChanged change if some of them have been trimmed.
+func (s *RedisACLStorage) changesSince(ctx context.Context, version uint64) ([]storage.Change, error) {
+	var trimmed uint64
+	var behind bool
+	replies, err := s.txn(ctx, []string{s.changesTrimmedKey()}, func(c *conn) ([][]string, error) {
+		v, err := c.do("GET", s.changesTrimmedKey())
+		if err != nil {
+			return nil, err
+		}
+		if trimmed, err = trimmedReply(v); err != nil {
+			return nil, err
+		}
+		if behind = version < trimmed; behind {
+			return [][]string{{"LLEN", s.changesKey()}}, nil
+		}
+		return [][]string{{"LRANGE", s.changesKey(), strconv.FormatUint(version-trimmed, 10), "-1"}}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if behind {
+		n, _ := replies[0].(int64)
+		return []storage.Change{{Version: trimmed + uint64(n), Kind: storage.AllChanged}}, nil
+	}
+
+	records, err := stringsReply(replies[0])
+	if err != nil {
+		return nil, err
+	}
+	changes := make([]storage.Change, len(records))
+	for i, raw := range records {
+		c := storage.Change{Version: version + uint64(i) + 1}
+		var r changeRecord
+		if err := json.Unmarshal([]byte(raw), &r); err != nil {
+			return nil, fmt.Errorf("%w: change %d: %v", CorruptValueError, c.Version, err)
+		}
+		if c.Kind = changeKinds[r.Kind]; c.Kind == 0 {
+			return nil, fmt.Errorf("%w: change %d has unknown kind %q", CorruptValueError, c.Version, r.Kind)
+		}
+		c.User = r.User
+		changes[i] = c
+	}
+	return changes, nil
+}
+
+// TrimChanges drops all but the latest keep changes from the change log, returning how many were dropped. Watchers that
+// have not yet seen them get an AllChanged change instead.
+func (s *RedisACLStorage) TrimChanges(ctx context.Context, keep int64) (int64, error) {
+	var dropped int64
+	_, err := s.txn(ctx, []string{s.changesKey()}, func(c *conn) ([][]string, error) {
+		v, err := c.do("LLEN", s.changesKey())
+		if err != nil {
+			return nil, err
+		}
+		n, _ := v.(int64)
+		if dropped = n - keep; dropped <= 0 {
+			dropped = 0
+			return nil, nil
+		}
+		return [][]string{
+			{"LTRIM", s.changesKey(), strconv.FormatInt(dropped, 10), "-1"},
+			{"INCRBY", s.changesTrimmedKey(), strconv.FormatInt(dropped, 10)},
+		}, nil
+	})
+	return dropped, err
+}
+
+func trimmedReply(v interface{}) (uint64, error) {
+	if v == nil {
+		return 0, nil
+	}
+	str, _ := v.(string)
+	n, err := strconv.ParseUint(str, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%w: changes-trimmed %q", CorruptValueError, str)
+	}
+	return n, nil
+}
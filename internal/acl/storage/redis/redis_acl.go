@@ -0,0 +1,1109 @@
+// Package redis implements ACLStorage on a Redis-compatible server, so that several ACL servers can share one store.
+// It speaks RESP itself rather than depending on a client library.
+//
+// Keys are laid out as follows, under a configurable prefix ("acl:" by default):
+//
+//	layout                  string  version of this layout, "2"
+//	users                   set     user ids
+//	user:<user>             hash    admin, disabled, break_glass ("1" or "0"), table_admin (JSON array of tables)
+//	grants:<user>           string  JSON array of the user's grants, in order
+//	grants-version:<user>   string  version of the user's grants, INCR'd with each change to them and kept when the
+//	                                user is deleted, so that versions are never reused
+//	grant-owners            hash    grant id -> user id
+//	table-users:<table>     set     users holding a grant on table
+//	keys                    hash    key id -> JSON key, including its user and hash
+//	elevations              set     elevation ids
+//	elevation:<id>          hash    user, reason, started_at, expires_at
+//	elevated-queries:<id>   list    JSON {sql, executed_at}, in order run
+//	changes                 list    JSON {user, kind}, one per change to ACLs, oldest first
+//	changes-trimmed         string  number of changes trimmed from the front of changes
+//
+// Every change is made in one MULTI/EXEC transaction, guarded by WATCH on the keys it was computed from and retried if
+// another client changed them first. Each transaction changing ACLs also appends to changes, so a change's version is
+// its position in the list, counting trimmed changes.
+//
+// Layout 2 added the change log, and layout 3 grants versions. Opening a store with an older layout upgrades it in
+// place.
+package redis
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"chroma1/internal/acl/storage"
+	"chroma1/model/keys"
+	"chroma1/model/permissions"
+)
+
+var (
+	NoSuchUserError   = storage.NoSuchUserError
+	ClosedError       = storage.ClosedError
+	ConflictError     = fmt.Errorf("too many concurrent changes to the ACL store")
+	NewerLayoutError  = fmt.Errorf("ACL store key layout is newer than this version supports")
+	CorruptValueError = fmt.Errorf("ACL store holds a malformed value")
+)
+
+const (
+	layoutVersion       = 3
+	defaultKeyPrefix    = "acl:"
+	defaultMaxIdle      = 8
+	defaultPollInterval = time.Second
+	// attempts at a transaction before giving up with ConflictError
+	maxTxnAttempts = 10
+)
+
+// RedisACLStorage stores ACLs in a Redis-compatible server.
+type RedisACLStorage struct {
+	prefix       string
+	pool         *pool
+	pollInterval time.Duration
+}
+
+// Option configures optional RedisACLStorage behaviour.
+type Option func(*RedisACLStorage)
+
+// WithKeyPrefix sets the prefix of every key the store uses, so that several stores can share a server. Defaults to
+// "acl:".
+func WithKeyPrefix(prefix string) Option {
+	return func(s *RedisACLStorage) {
+		s.prefix = prefix
+	}
+}
+
+// WithAuth authenticates each connection. username may be empty for servers with only a default user.
+func WithAuth(username, password string) Option {
+	return func(s *RedisACLStorage) {
+		s.pool.username = username
+		s.pool.password = password
+	}
+}
+
+// WithDB selects a numbered database on each connection.
+func WithDB(db int) Option {
+	return func(s *RedisACLStorage) {
+		s.pool.db = db
+	}
+}
+
+// WithTLS connects over TLS with config.
+func WithTLS(config *tls.Config) Option {
+	return func(s *RedisACLStorage) {
+		s.pool.tls = config
+	}
+}
+
+// WithMaxIdleConns sets how many idle connections are kept for reuse. Defaults to 8.
+func WithMaxIdleConns(n int) Option {
+	return func(s *RedisACLStorage) {
+		s.pool.maxIdle = n
+	}
+}
+
+// WithPollInterval sets how often Watch checks the change log for changes. Defaults to 1s.
+func WithPollInterval(d time.Duration) Option {
+	return func(s *RedisACLStorage) {
+		s.pollInterval = d
+	}
+}
+
+// NewRedisACLStorage connects to the server at addr (host:port). An empty store is stamped with the current key layout;
+// a store with a newer layout is refused.
+func NewRedisACLStorage(ctx context.Context, addr string, opts ...Option) (*RedisACLStorage, error) {
+	s := &RedisACLStorage{
+		prefix:       defaultKeyPrefix,
+		pool:         &pool{addr: addr, maxIdle: defaultMaxIdle},
+		pollInterval: defaultPollInterval,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	err := s.pool.with(ctx, func(c *conn) error {
+		if _, err := c.do("SETNX", s.layoutKey(), strconv.Itoa(layoutVersion)); err != nil {
+			return err
+		}
+		v, err := c.do("GET", s.layoutKey())
+		if err != nil {
+			return err
+		}
+		str, _ := v.(string)
+		version, err := strconv.Atoi(str)
+		if err != nil {
+			return fmt.Errorf("%w: layout %q", CorruptValueError, str)
+		}
+		if version > layoutVersion {
+			return fmt.Errorf("%w: store has layout %d, latest known is %d", NewerLayoutError, version, layoutVersion)
+		}
+		if version < layoutVersion {
+			// the change log starts empty and missing grants versions count as 0, so there is nothing to convert
+			_, err = c.do("SET", s.layoutKey(), strconv.Itoa(layoutVersion))
+		}
+		return err
+	})
+	if err != nil {
+		s.Close()
+		return nil, fmt.Errorf("error opening ACL store at %s: %w", addr, err)
+	}
+	return s, nil
+}
+
+func (s *RedisACLStorage) layoutKey() string {
+	return s.prefix + "layout"
+}
+
+func (s *RedisACLStorage) usersKey() string {
+	return s.prefix + "users"
+}
+
+func (s *RedisACLStorage) userKey(u string) string {
+	return s.prefix + "user:" + u
+}
+
+func (s *RedisACLStorage) grantsKey(u string) string {
+	return s.prefix + "grants:" + u
+}
+
+func (s *RedisACLStorage) grantsVersionKey(u string) string {
+	return s.prefix + "grants-version:" + u
+}
+
+func (s *RedisACLStorage) grantOwnersKey() string {
+	return s.prefix + "grant-owners"
+}
+
+func (s *RedisACLStorage) tableUsersKey(table string) string {
+	return s.prefix + "table-users:" + table
+}
+
+func (s *RedisACLStorage) keysKey() string {
+	return s.prefix + "keys"
+}
+
+func (s *RedisACLStorage) elevationsKey() string {
+	return s.prefix + "elevations"
+}
+
+func (s *RedisACLStorage) elevationKey(id string) string {
+	return s.prefix + "elevation:" + id
+}
+
+func (s *RedisACLStorage) elevatedQueriesKey(id string) string {
+	return s.prefix + "elevated-queries:" + id
+}
+
+func (s *RedisACLStorage) changesKey() string {
+	return s.prefix + "changes"
+}
+
+func (s *RedisACLStorage) changesTrimmedKey() string {
+	return s.prefix + "changes-trimmed"
+}
+
+// txn runs prepare on one connection with the watch keys watched, then runs the commands it returns in MULTI/EXEC,
+// starting over if a watched key changed in between. prepare reads what the commands are computed from through c. It
+// returns the commands' replies.
+func (s *RedisACLStorage) txn(ctx context.Context, watch []string, prepare func(c *conn) ([][]string, error)) ([]interface{}, error) {
+	for attempt := 0; attempt < maxTxnAttempts; attempt++ {
+		var replies []interface{}
+		var committed bool
+		err := s.pool.with(ctx, func(c *conn) error {
+			if len(watch) > 0 {
+				if _, err := c.do(append([]string{"WATCH"}, watch...)...); err != nil {
+					return err
+				}
+			}
+			cmds, err := prepare(c)
+			if err != nil {
+				if len(watch) > 0 {
+					if _, unwatchErr := c.do("UNWATCH"); unwatchErr != nil {
+						c.broken = true
+					}
+				}
+				return err
+			}
+			replies, committed, err = c.exec(cmds)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		if committed {
+			return replies, nil
+		}
+	}
+	return nil, ConflictError
+}
+
+// read runs cmds atomically and returns their replies.
+func (s *RedisACLStorage) read(ctx context.Context, cmds ...[]string) ([]interface{}, error) {
+	return s.txn(ctx, nil, func(c *conn) ([][]string, error) {
+		return cmds, nil
+	})
+}
+
+func (s *RedisACLStorage) StoreUserPerms(ctx context.Context, user string, perms []*permissions.Permission) error {
+	for _, p := range perms {
+		if p.ID == "" {
+			id, err := newGrantID()
+			if err != nil {
+				return err
+			}
+			p.ID = id
+		}
+	}
+	if perms == nil {
+		perms = []*permissions.Permission{}
+	}
+
+	_, err := s.txn(ctx, []string{s.grantsKey(user), s.grantOwnersKey()}, func(c *conn) ([][]string, error) {
+		old, err := s.getGrants(c, user)
+		if err != nil {
+			return nil, err
+		}
+		if err := s.checkOwners(c, user, perms); err != nil {
+			return nil, err
+		}
+		return s.grantCommands(user, old, perms)
+	})
+	return err
+}
+
+func (s *RedisACLStorage) GetUserPerms(ctx context.Context, user string) ([]*permissions.Permission, error) {
+	replies, err := s.read(ctx, []string{"SISMEMBER", s.usersKey(), user}, []string{"GET", s.grantsKey(user)})
+	if err != nil {
+		return nil, err
+	}
+	if replies[0] != int64(1) {
+		return nil, fmt.Errorf("%w %s", NoSuchUserError, user)
+	}
+	return decodeGrants(replies[1])
+}
+
+func (s *RedisACLStorage) UpdateGrants(ctx context.Context, user string, store []*permissions.Permission, remove []string) error {
+	_, err := s.updateGrants(ctx, user, nil, store, remove)
+	return err
+}
+
+func (s *RedisACLStorage) GetUserPermsVersion(ctx context.Context, user string) ([]*permissions.Permission, string, error) {
+	replies, err := s.read(ctx, []string{"SISMEMBER", s.usersKey(), user}, []string{"GET", s.grantsKey(user)},
+		[]string{"GET", s.grantsVersionKey(user)})
+	if err != nil {
+		return nil, "", err
+	}
+	if replies[0] != int64(1) {
+		return nil, "", fmt.Errorf("%w %s", NoSuchUserError, user)
+	}
+	perms, err := decodeGrants(replies[1])
+	if err != nil {
+		return nil, "", err
+	}
+	counter, err := decodeCounter(replies[2])
+	if err != nil {
+		return nil, "", err
+	}
+	return perms, storage.GrantsVersion(counter), nil
+}
+
+func (s *RedisACLStorage) UpdateGrantsIf(ctx context.Context, user, version string, store []*permissions.Permission, remove []string) (string, error) {
+	return s.updateGrants(ctx, user, &version, store, remove)
+}
+
+// updateGrants does UpdateGrants, first checking that the user's grants are at version unless it is nil, and returns
+// their new version.
+func (s *RedisACLStorage) updateGrants(ctx context.Context, user string, version *string, store []*permissions.Permission, remove []string) (string, error) {
+	for _, p := range store {
+		if p.ID == "" {
+			return "", fmt.Errorf("grant on %s for %s has no id", p.Table, user)
+		}
+	}
+
+	watch := []string{s.grantsKey(user), s.grantOwnersKey(), s.grantsVersionKey(user)}
+	if version != nil {
+		// whether the user exists decides their version
+		watch = append(watch, s.usersKey())
+	}
+	var newVersion string
+	_, err := s.txn(ctx, watch, func(c *conn) ([][]string, error) {
+		old, err := s.getGrants(c, user)
+		if err != nil {
+			return nil, err
+		}
+		v, err := c.do("GET", s.grantsVersionKey(user))
+		if err != nil {
+			return nil, err
+		}
+		counter, err := decodeCounter(v)
+		if err != nil {
+			return nil, err
+		}
+		if version != nil {
+			exists, err := c.do("SISMEMBER", s.usersKey(), user)
+			if err != nil {
+				return nil, err
+			}
+			current := ""
+			if exists == int64(1) {
+				current = storage.GrantsVersion(counter)
+			}
+			if current != *version {
+				return nil, fmt.Errorf("%w: %s is at version %q, not %q", storage.VersionConflictError, user, current, *version)
+			}
+		}
+		if err := s.checkOwners(c, user, store); err != nil {
+			return nil, err
+		}
+
+		grants := make([]*permissions.Permission, 0, len(old)+len(store))
+		stored := make(map[string]*permissions.Permission, len(store))
+		for _, p := range store {
+			stored[p.ID] = p
+		}
+		for _, g := range old {
+			if p, ok := stored[g.ID]; ok {
+				g = p
+				delete(stored, g.ID)
+			}
+			grants = append(grants, g)
+		}
+		for _, p := range store {
+			if _, ok := stored[p.ID]; ok {
+				grants = append(grants, p)
+			}
+		}
+		removed := make(map[string]struct{}, len(remove))
+		for _, id := range remove {
+			removed[id] = struct{}{}
+		}
+		kept := grants[:0]
+		for _, g := range grants {
+			if _, ok := removed[g.ID]; !ok {
+				kept = append(kept, g)
+			}
+		}
+		// grantCommands INCRs the counter, which WATCH keeps from moving meanwhile
+		newVersion = storage.GrantsVersion(counter + 1)
+		return s.grantCommands(user, old, kept)
+	})
+	if err != nil {
+		return "", err
+	}
+	return newVersion, nil
+}
+
+func (s *RedisACLStorage) getGrants(c *conn, user string) ([]*permissions.Permission, error) {
+	v, err := c.do("GET", s.grantsKey(user))
+	if err != nil {
+		return nil, err
+	}
+	return decodeGrants(v)
+}
+
+// checkOwners fails if any of perms is a grant held by a user other than user.
+func (s *RedisACLStorage) checkOwners(c *conn, user string, perms []*permissions.Permission) error {
+	if len(perms) == 0 {
+		return nil
+	}
+	args := []string{"HMGET", s.grantOwnersKey()}
+	for _, p := range perms {
+		args = append(args, p.ID)
+	}
+	v, err := c.do(args...)
+	if err != nil {
+		return err
+	}
+	owners, err := stringsReply(v)
+	if err != nil {
+		return err
+	}
+	for i, owner := range owners {
+		if owner != "" && owner != user {
+			return fmt.Errorf("grant %s belongs to another user", perms[i].ID)
+		}
+	}
+	return nil
+}
+
+// grantCommands returns the commands replacing the user's grants old with grants, creating the user if needed.
+func (s *RedisACLStorage) grantCommands(user string, old, grants []*permissions.Permission) ([][]string, error) {
+	encoded, err := json.Marshal(grants)
+	if err != nil {
+		return nil, err
+	}
+	changed, err := s.changeCommand(user, storage.GrantsChanged)
+	if err != nil {
+		return nil, err
+	}
+	cmds := [][]string{
+		{"SADD", s.usersKey(), user},
+		{"SET", s.grantsKey(user), string(encoded)},
+		{"INCR", s.grantsVersionKey(user)},
+		changed,
+	}
+
+	kept := make(map[string]struct{}, len(grants))
+	tables := make(map[string]struct{})
+	owners := []string{"HSET", s.grantOwnersKey()}
+	for _, g := range grants {
+		kept[g.ID] = struct{}{}
+		tables[g.Table] = struct{}{}
+		owners = append(owners, g.ID, user)
+	}
+	if len(grants) > 0 {
+		cmds = append(cmds, owners)
+	}
+	for _, table := range sortedSet(tables) {
+		cmds = append(cmds, []string{"SADD", s.tableUsersKey(table), user})
+	}
+
+	dropped := []string{"HDEL", s.grantOwnersKey()}
+	oldTables := make(map[string]struct{})
+	for _, g := range old {
+		if _, ok := kept[g.ID]; !ok {
+			dropped = append(dropped, g.ID)
+		}
+		if _, ok := tables[g.Table]; !ok {
+			oldTables[g.Table] = struct{}{}
+		}
+	}
+	if len(dropped) > 2 {
+		cmds = append(cmds, dropped)
+	}
+	for _, table := range sortedSet(oldTables) {
+		cmds = append(cmds, []string{"SREM", s.tableUsersKey(table), user})
+	}
+	return cmds, nil
+}
+
+func (s *RedisACLStorage) GetTableGrants(ctx context.Context, table string) (map[string][]*permissions.Permission, error) {
+	var users []string
+	replies, err := s.txn(ctx, []string{s.tableUsersKey(table)}, func(c *conn) ([][]string, error) {
+		v, err := c.do("SMEMBERS", s.tableUsersKey(table))
+		if err != nil {
+			return nil, err
+		}
+		if users, err = stringsReply(v); err != nil {
+			return nil, err
+		}
+		cmds := make([][]string, len(users))
+		for i, u := range users {
+			cmds[i] = []string{"GET", s.grantsKey(u)}
+		}
+		return cmds, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	res := make(map[string][]*permissions.Permission)
+	for i, u := range users {
+		grants, err := decodeGrants(replies[i])
+		if err != nil {
+			return nil, err
+		}
+		for _, g := range grants {
+			if g.Table == table {
+				res[u] = append(res[u], g)
+			}
+		}
+	}
+	return res, nil
+}
+
+// userInfo is what is stored about each user.
+type userInfo struct {
+	admin      bool
+	disabled   bool
+	breakGlass bool
+	tables     []string
+	grants     []*permissions.Permission
+}
+
+// getUsers reads every user, with their grants if withGrants is set, as of one point in time.
+func (s *RedisACLStorage) getUsers(ctx context.Context, withGrants bool) (map[string]*userInfo, error) {
+	var users []string
+	replies, err := s.txn(ctx, []string{s.usersKey()}, func(c *conn) ([][]string, error) {
+		v, err := c.do("SMEMBERS", s.usersKey())
+		if err != nil {
+			return nil, err
+		}
+		if users, err = stringsReply(v); err != nil {
+			return nil, err
+		}
+		cmds := make([][]string, 0, 2*len(users))
+		for _, u := range users {
+			cmds = append(cmds, []string{"HGETALL", s.userKey(u)})
+			if withGrants {
+				cmds = append(cmds, []string{"GET", s.grantsKey(u)})
+			}
+		}
+		return cmds, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	res := make(map[string]*userInfo, len(users))
+	for _, u := range users {
+		fields, err := hashReply(replies[0])
+		if err != nil {
+			return nil, err
+		}
+		replies = replies[1:]
+		info := &userInfo{
+			admin:      fields["admin"] == "1",
+			disabled:   fields["disabled"] == "1",
+			breakGlass: fields["break_glass"] == "1",
+		}
+		if t := fields["table_admin"]; t != "" {
+			if err := json.Unmarshal([]byte(t), &info.tables); err != nil {
+				return nil, fmt.Errorf("%w: table_admin of %s: %v", CorruptValueError, u, err)
+			}
+		}
+		if withGrants {
+			if info.grants, err = decodeGrants(replies[0]); err != nil {
+				return nil, err
+			}
+			replies = replies[1:]
+		}
+		res[u] = info
+	}
+	return res, nil
+}
+
+// userSet returns the ids of the users matching pred.
+func (s *RedisACLStorage) userSet(ctx context.Context, pred func(u *userInfo) bool) (map[string]struct{}, error) {
+	users, err := s.getUsers(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+	res := make(map[string]struct{})
+	for id, u := range users {
+		if pred(u) {
+			res[id] = struct{}{}
+		}
+	}
+	return res, nil
+}
+
+func (s *RedisACLStorage) GetAllUserInfo(ctx context.Context) (map[string][]*permissions.Permission, map[string]struct{}, error) {
+	users, err := s.getUsers(ctx, true)
+	if err != nil {
+		return nil, nil, err
+	}
+	perms := make(map[string][]*permissions.Permission, len(users))
+	admins := make(map[string]struct{})
+	for id, u := range users {
+		perms[id] = u.grants
+		if u.admin {
+			admins[id] = struct{}{}
+		}
+	}
+	return perms, admins, nil
+}
+
+func (s *RedisACLStorage) GetDisabledUsers(ctx context.Context) (map[string]struct{}, error) {
+	return s.userSet(ctx, func(u *userInfo) bool { return u.disabled })
+}
+
+func (s *RedisACLStorage) GetBreakGlassUsers(ctx context.Context) (map[string]struct{}, error) {
+	return s.userSet(ctx, func(u *userInfo) bool { return u.breakGlass })
+}
+
+func (s *RedisACLStorage) GetTableAdmins(ctx context.Context) (map[string][]string, error) {
+	users, err := s.getUsers(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+	admins := make(map[string][]string)
+	for id, u := range users {
+		if len(u.tables) > 0 {
+			admins[id] = u.tables
+		}
+	}
+	return admins, nil
+}
+
+func (s *RedisACLStorage) CreateUser(ctx context.Context, user string, key *keys.APIKey, isAdmin bool) error {
+	_, err := s.txn(ctx, []string{s.usersKey(), s.keysKey()}, func(c *conn) ([][]string, error) {
+		exists, err := c.do("SISMEMBER", s.usersKey(), user)
+		if err != nil {
+			return nil, err
+		}
+		if exists == int64(1) {
+			return nil, fmt.Errorf("user %s already exists", user)
+		}
+		storeKey, err := s.storeKeyCommand(c, key)
+		if err != nil {
+			return nil, err
+		}
+		changed, err := s.changeCommand(user, storage.UserChanged)
+		if err != nil {
+			return nil, err
+		}
+		return [][]string{
+			{"SADD", s.usersKey(), user},
+			{"HSET", s.userKey(user), "admin", flag(isAdmin), "disabled", "0", "break_glass", "0"},
+			{"SET", s.grantsKey(user), "[]"},
+			storeKey,
+			changed,
+		}, nil
+	})
+	return err
+}
+
+func (s *RedisACLStorage) SetUserDisabled(ctx context.Context, user string, disabled bool) error {
+	return s.setUserField(ctx, user, "disabled", flag(disabled))
+}
+
+func (s *RedisACLStorage) SetUserAdmin(ctx context.Context, user string, isAdmin bool) error {
+	return s.setUserField(ctx, user, "admin", flag(isAdmin))
+}
+
+// SetBreakGlass allows or disallows user to self-elevate via break-glass. The ACLStorage interface has no way to
+// change this, so stores are seeded out of band, with this or with e.g. redis-cli.
+func (s *RedisACLStorage) SetBreakGlass(ctx context.Context, user string, allowed bool) error {
+	return s.setUserField(ctx, user, "break_glass", flag(allowed))
+}
+
+// SetTableAdmin makes user an administrator of table, or stops them being one. Like break-glass, this is seeded out of
+// band.
+func (s *RedisACLStorage) SetTableAdmin(ctx context.Context, user, table string, isAdmin bool) error {
+	_, err := s.txn(ctx, []string{s.usersKey(), s.userKey(user)}, func(c *conn) ([][]string, error) {
+		if err := s.checkUser(c, user); err != nil {
+			return nil, err
+		}
+		v, err := c.do("HGET", s.userKey(user), "table_admin")
+		if err != nil {
+			return nil, err
+		}
+		var tables []string
+		if str, _ := v.(string); str != "" {
+			if err := json.Unmarshal([]byte(str), &tables); err != nil {
+				return nil, fmt.Errorf("%w: table_admin of %s: %v", CorruptValueError, user, err)
+			}
+		}
+		set := make(map[string]struct{}, len(tables)+1)
+		for _, t := range tables {
+			set[t] = struct{}{}
+		}
+		if isAdmin {
+			set[table] = struct{}{}
+		} else {
+			delete(set, table)
+		}
+		encoded, err := json.Marshal(sortedSet(set))
+		if err != nil {
+			return nil, err
+		}
+		changed, err := s.changeCommand(user, storage.UserChanged)
+		if err != nil {
+			return nil, err
+		}
+		return [][]string{{"HSET", s.userKey(user), "table_admin", string(encoded)}, changed}, nil
+	})
+	return err
+}
+
+func (s *RedisACLStorage) setUserField(ctx context.Context, user, field, value string) error {
+	_, err := s.txn(ctx, []string{s.usersKey()}, func(c *conn) ([][]string, error) {
+		if err := s.checkUser(c, user); err != nil {
+			return nil, err
+		}
+		changed, err := s.changeCommand(user, storage.UserChanged)
+		if err != nil {
+			return nil, err
+		}
+		return [][]string{{"HSET", s.userKey(user), field, value}, changed}, nil
+	})
+	return err
+}
+
+func (s *RedisACLStorage) checkUser(c *conn, user string) error {
+	exists, err := c.do("SISMEMBER", s.usersKey(), user)
+	if err != nil {
+		return err
+	}
+	if exists != int64(1) {
+		return fmt.Errorf("%w %s", NoSuchUserError, user)
+	}
+	return nil
+}
+
+func (s *RedisACLStorage) DeleteUser(ctx context.Context, user string) error {
+	_, err := s.txn(ctx, []string{s.usersKey(), s.grantsKey(user), s.keysKey()}, func(c *conn) ([][]string, error) {
+		exists, err := c.do("SISMEMBER", s.usersKey(), user)
+		if err != nil || exists != int64(1) {
+			return nil, err
+		}
+		grants, err := s.getGrants(c, user)
+		if err != nil {
+			return nil, err
+		}
+		allKeys, err := s.getKeys(c)
+		if err != nil {
+			return nil, err
+		}
+		changed, err := s.changeCommand(user, storage.UserChanged)
+		if err != nil {
+			return nil, err
+		}
+
+		cmds := [][]string{
+			{"SREM", s.usersKey(), user},
+			{"DEL", s.userKey(user), s.grantsKey(user)},
+			// a user created again must not reuse versions
+			{"INCR", s.grantsVersionKey(user)},
+			changed,
+		}
+		if len(grants) > 0 {
+			ids := []string{"HDEL", s.grantOwnersKey()}
+			tables := make(map[string]struct{})
+			for _, g := range grants {
+				ids = append(ids, g.ID)
+				tables[g.Table] = struct{}{}
+			}
+			cmds = append(cmds, ids)
+			for _, table := range sortedSet(tables) {
+				cmds = append(cmds, []string{"SREM", s.tableUsersKey(table), user})
+			}
+		}
+		keyIDs := []string{"HDEL", s.keysKey()}
+		for _, k := range allKeys {
+			if k.User == user {
+				keyIDs = append(keyIDs, k.ID)
+			}
+		}
+		if len(keyIDs) > 2 {
+			cmds = append(cmds, keyIDs)
+		}
+		return cmds, nil
+	})
+	return err
+}
+
+// keyRecord is an API key as stored, with its hash, which APIKey does not serialize.
+type keyRecord struct {
+	ID        string     `json:"id"`
+	User      string     `json:"user"`
+	Hash      []byte     `json:"hash"`
+	Label     string     `json:"label,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+func (r *keyRecord) apiKey() *keys.APIKey {
+	return &keys.APIKey{ID: r.ID, User: r.User, Hash: r.Hash, Label: r.Label, CreatedAt: r.CreatedAt, ExpiresAt: r.ExpiresAt}
+}
+
+func (s *RedisACLStorage) GetAllKeys(ctx context.Context) ([]*keys.APIKey, error) {
+	var res []*keys.APIKey
+	err := s.pool.with(ctx, func(c *conn) error {
+		var err error
+		res, err = s.getKeys(c)
+		return err
+	})
+	return res, err
+}
+
+// getKeys reads every key, ordered by id.
+func (s *RedisACLStorage) getKeys(c *conn) ([]*keys.APIKey, error) {
+	v, err := c.do("HGETALL", s.keysKey())
+	if err != nil {
+		return nil, err
+	}
+	records, err := hashReply(v)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]*keys.APIKey, 0, len(records))
+	for id, raw := range records {
+		var r keyRecord
+		if err := json.Unmarshal([]byte(raw), &r); err != nil {
+			return nil, fmt.Errorf("%w: key %s: %v", CorruptValueError, id, err)
+		}
+		res = append(res, r.apiKey())
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].ID < res[j].ID
+	})
+	return res, nil
+}
+
+func (s *RedisACLStorage) StoreKey(ctx context.Context, key *keys.APIKey) error {
+	_, err := s.txn(ctx, []string{s.keysKey()}, func(c *conn) ([][]string, error) {
+		cmd, err := s.storeKeyCommand(c, key)
+		if err != nil {
+			return nil, err
+		}
+		changed, err := s.changeCommand(key.User, storage.UserChanged)
+		if err != nil {
+			return nil, err
+		}
+		return [][]string{cmd, changed}, nil
+	})
+	return err
+}
+
+// storeKeyCommand returns the command storing key, failing if a key with its id exists.
+func (s *RedisACLStorage) storeKeyCommand(c *conn, key *keys.APIKey) ([]string, error) {
+	exists, err := c.do("HEXISTS", s.keysKey(), key.ID)
+	if err != nil {
+		return nil, err
+	}
+	if exists == int64(1) {
+		return nil, fmt.Errorf("key %s already exists", key.ID)
+	}
+	encoded, err := json.Marshal(&keyRecord{
+		ID:        key.ID,
+		User:      key.User,
+		Hash:      key.Hash,
+		Label:     key.Label,
+		CreatedAt: key.CreatedAt,
+		ExpiresAt: key.ExpiresAt,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return []string{"HSET", s.keysKey(), key.ID, string(encoded)}, nil
+}
+
+func (s *RedisACLStorage) SetKeyHash(ctx context.Context, id string, hash []byte) error {
+	return s.updateKey(ctx, id, func(r *keyRecord) {
+		r.Hash = hash
+	})
+}
+
+func (s *RedisACLStorage) SetKeyExpiry(ctx context.Context, id string, expiresAt time.Time) error {
+	return s.updateKey(ctx, id, func(r *keyRecord) {
+		r.ExpiresAt = &expiresAt
+	})
+}
+
+// updateKey applies change to the key with id, if there is one.
+func (s *RedisACLStorage) updateKey(ctx context.Context, id string, change func(r *keyRecord)) error {
+	_, err := s.txn(ctx, []string{s.keysKey()}, func(c *conn) ([][]string, error) {
+		r, err := s.getKey(c, id)
+		if err != nil || r == nil {
+			return nil, err
+		}
+		change(r)
+		encoded, err := json.Marshal(r)
+		if err != nil {
+			return nil, err
+		}
+		changed, err := s.changeCommand(r.User, storage.UserChanged)
+		if err != nil {
+			return nil, err
+		}
+		return [][]string{{"HSET", s.keysKey(), id, string(encoded)}, changed}, nil
+	})
+	return err
+}
+
+// getKey reads the key with id, returning nil if there is none.
+func (s *RedisACLStorage) getKey(c *conn, id string) (*keyRecord, error) {
+	v, err := c.do("HGET", s.keysKey(), id)
+	if err != nil || v == nil {
+		return nil, err
+	}
+	raw, _ := v.(string)
+	var r keyRecord
+	if err := json.Unmarshal([]byte(raw), &r); err != nil {
+		return nil, fmt.Errorf("%w: key %s: %v", CorruptValueError, id, err)
+	}
+	return &r, nil
+}
+
+func (s *RedisACLStorage) DeleteKey(ctx context.Context, id string) error {
+	_, err := s.txn(ctx, []string{s.keysKey()}, func(c *conn) ([][]string, error) {
+		r, err := s.getKey(c, id)
+		if err != nil || r == nil {
+			return nil, err
+		}
+		changed, err := s.changeCommand(r.User, storage.UserChanged)
+		if err != nil {
+			return nil, err
+		}
+		return [][]string{{"HDEL", s.keysKey(), id}, changed}, nil
+	})
+	return err
+}
+
+func (s *RedisACLStorage) RecordElevation(ctx context.Context, id, user, reason string, start, end time.Time) error {
+	_, err := s.txn(ctx, []string{s.elevationsKey()}, func(c *conn) ([][]string, error) {
+		exists, err := c.do("SISMEMBER", s.elevationsKey(), id)
+		if err != nil {
+			return nil, err
+		}
+		if exists == int64(1) {
+			return nil, fmt.Errorf("elevation %s already exists", id)
+		}
+		return [][]string{
+			{"SADD", s.elevationsKey(), id},
+			{"HSET", s.elevationKey(id), "user", user, "reason", reason,
+				"started_at", start.UTC().Format(time.RFC3339Nano), "expires_at", end.UTC().Format(time.RFC3339Nano)},
+		}, nil
+	})
+	return err
+}
+
+type elevatedQuery struct {
+	SQL        string    `json:"sql"`
+	ExecutedAt time.Time `json:"executed_at"`
+}
+
+func (s *RedisACLStorage) RecordElevatedQuery(ctx context.Context, elevationID, sql string, at time.Time) error {
+	encoded, err := json.Marshal(&elevatedQuery{SQL: sql, ExecutedAt: at.UTC()})
+	if err != nil {
+		return err
+	}
+	_, err = s.read(ctx, []string{"RPUSH", s.elevatedQueriesKey(elevationID), string(encoded)})
+	return err
+}
+
+func (s *RedisACLStorage) GetActiveElevations(ctx context.Context, at time.Time) ([]*storage.Elevation, error) {
+	var ids []string
+	replies, err := s.txn(ctx, []string{s.elevationsKey()}, func(c *conn) ([][]string, error) {
+		v, err := c.do("SMEMBERS", s.elevationsKey())
+		if err != nil {
+			return nil, err
+		}
+		if ids, err = stringsReply(v); err != nil {
+			return nil, err
+		}
+		cmds := make([][]string, len(ids))
+		for i, id := range ids {
+			cmds[i] = []string{"HGETALL", s.elevationKey(id)}
+		}
+		return cmds, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]*storage.Elevation, 0)
+	for i, id := range ids {
+		fields, err := hashReply(replies[i])
+		if err != nil {
+			return nil, err
+		}
+		e := &storage.Elevation{ID: id, User: fields["user"], Reason: fields["reason"]}
+		if e.Start, err = time.Parse(time.RFC3339Nano, fields["started_at"]); err != nil {
+			return nil, fmt.Errorf("%w: started_at of elevation %s: %v", CorruptValueError, id, err)
+		}
+		if e.End, err = time.Parse(time.RFC3339Nano, fields["expires_at"]); err != nil {
+			return nil, fmt.Errorf("%w: expires_at of elevation %s: %v", CorruptValueError, id, err)
+		}
+		if at.Before(e.End) {
+			res = append(res, e)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Start.Before(res[j].Start)
+	})
+	return res, nil
+}
+
+func (s *RedisACLStorage) Close() error {
+	return s.pool.close()
+}
+
+func decodeGrants(v interface{}) ([]*permissions.Permission, error) {
+	if v == nil {
+		return []*permissions.Permission{}, nil
+	}
+	raw, ok := v.(string)
+	if !ok {
+		return nil, fmt.Errorf("%w: expected grants, got %v", CorruptValueError, v)
+	}
+	var grants []*permissions.Permission
+	if err := json.Unmarshal([]byte(raw), &grants); err != nil {
+		return nil, fmt.Errorf("%w: grants: %v", CorruptValueError, err)
+	}
+	if grants == nil {
+		grants = []*permissions.Permission{}
+	}
+	return grants, nil
+}
+
+// decodeCounter decodes a counter set by INCR, which is 0 while missing.
+func decodeCounter(v interface{}) (uint64, error) {
+	if v == nil {
+		return 0, nil
+	}
+	raw, ok := v.(string)
+	if !ok {
+		return 0, fmt.Errorf("%w: expected a counter, got %v", CorruptValueError, v)
+	}
+	n, err := strconv.ParseUint(raw, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%w: counter %q", CorruptValueError, raw)
+	}
+	return n, nil
+}
+
+// stringsReply converts an array reply, mapping nil items to "".
+func stringsReply(v interface{}) ([]string, error) {
+	items, ok := v.([]interface{})
+	if !ok && v != nil {
+		return nil, fmt.Errorf("%w: expected array, got %v", ProtocolError, v)
+	}
+	res := make([]string, len(items))
+	for i, item := range items {
+		switch item := item.(type) {
+		case string:
+			res[i] = item
+		case nil:
+		default:
+			return nil, fmt.Errorf("%w: expected string, got %v", ProtocolError, item)
+		}
+	}
+	return res, nil
+}
+
+// hashReply converts an HGETALL reply.
+func hashReply(v interface{}) (map[string]string, error) {
+	items, err := stringsReply(v)
+	if err != nil {
+		return nil, err
+	}
+	if len(items)%2 != 0 {
+		return nil, fmt.Errorf("%w: odd number of hash fields", ProtocolError)
+	}
+	res := make(map[string]string, len(items)/2)
+	for i := 0; i < len(items); i += 2 {
+		res[items[i]] = items[i+1]
+	}
+	return res, nil
+}
+
+func sortedSet(set map[string]struct{}) []string {
+	res := make([]string, 0, len(set))
+	for k := range set {
+		res = append(res, k)
+	}
+	sort.Strings(res)
+	return res
+}
+
+func flag(b bool) string {
+	if b {
+		return "1"
+	}
+	return "0"
+}
+
+func newGrantID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
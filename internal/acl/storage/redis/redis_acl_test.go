@@ -0,0 +1,257 @@
+package redis_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"chroma1/internal/acl/storage"
+	"chroma1/internal/acl/storage/redis"
+	"chroma1/internal/acl/storage/redis/redistest"
+	"chroma1/internal/acl/storage/storagetest"
+	"chroma1/model/permissions"
+)
+
+func open(t *testing.T, server *redistest.Server, opts ...redis.Option) *redis.RedisACLStorage {
+	t.Helper()
+	opts = append([]redis.Option{redis.WithPollInterval(10 * time.Millisecond)}, opts...)
+	s, err := redis.NewRedisACLStorage(context.Background(), server.Addr(), opts...)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.ACLStorage {
+		s, err := redis.NewRedisACLStorage(context.Background(), redistest.NewServer(t).Addr(), redis.WithPollInterval(10*time.Millisecond))
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		return s
+	})
+}
+
+// TestConformanceRealServer runs the conformance tests against the Redis server at $REDIS_ADDR, to check the stand-in
+// server does not hide differences from a real one. Each test uses keys under a fresh prefix, which are left behind, so
+// point it at a scratch server.
+func TestConformanceRealServer(t *testing.T) {
+	addr := os.Getenv("REDIS_ADDR")
+	if addr == "" {
+		t.Skip("REDIS_ADDR is not set")
+	}
+	run := time.Now().UnixNano()
+	storagetest.Run(t, func(t *testing.T) storage.ACLStorage {
+		prefix := fmt.Sprintf("acltest:%d:%s:", run, t.Name())
+		s, err := redis.NewRedisACLStorage(context.Background(), addr, redis.WithKeyPrefix(prefix), redis.WithPollInterval(10*time.Millisecond))
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		return s
+	})
+}
+
+func TestKeyLayout(t *testing.T) {
+	ctx := context.Background()
+	server := redistest.NewServer(t)
+	s := open(t, server, redis.WithKeyPrefix("team1:"))
+
+	assert.NoError(t, s.CreateUser(ctx, "alice", storagetest.NewKey("alice"), true))
+	now := time.Now()
+	perms := []*permissions.Permission{{ID: "g1", Type: permissions.Read, Table: "orders"}}
+	assert.NoError(t, s.StoreUserPerms(ctx, "alice", perms))
+	assert.NoError(t, s.SetTableAdmin(ctx, "alice", "orders", true))
+	assert.NoError(t, s.SetBreakGlass(ctx, "alice", true))
+	assert.NoError(t, s.RecordElevation(ctx, "e1", "alice", "incident", now, now.Add(time.Hour)))
+	assert.NoError(t, s.RecordElevatedQuery(ctx, "e1", "SELECT 1", now))
+
+	assert.Equal(t, []string{
+		"team1:changes",
+		"team1:elevated-queries:e1",
+		"team1:elevation:e1",
+		"team1:elevations",
+		"team1:grant-owners",
+		"team1:grants-version:alice",
+		"team1:grants:alice",
+		"team1:keys",
+		"team1:layout",
+		"team1:table-users:orders",
+		"team1:user:alice",
+		"team1:users",
+	}, server.Keys())
+	user, err := server.Do("HGETALL", "team1:user:alice")
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{"admin", "1", "break_glass", "1", "disabled", "0", "table_admin", `["orders"]`}, user)
+	owner, err := server.Do("HGET", "team1:grant-owners", "g1")
+	assert.NoError(t, err)
+	assert.Equal(t, "alice", owner)
+
+	// moving the grant to another table moves the index entry
+	perms[0].Table = "items"
+	assert.NoError(t, s.StoreUserPerms(ctx, "alice", perms))
+	assert.NotContains(t, server.Keys(), "team1:table-users:orders")
+	assert.Contains(t, server.Keys(), "team1:table-users:items")
+
+	// deleting the user leaves only the audit trail, the change log and the grants version
+	assert.NoError(t, s.DeleteUser(ctx, "alice"))
+	assert.Equal(t, []string{
+		"team1:changes", "team1:elevated-queries:e1", "team1:elevation:e1", "team1:elevations", "team1:grants-version:alice", "team1:layout",
+	}, server.Keys())
+}
+
+func TestNewerLayout(t *testing.T) {
+	server := redistest.NewServer(t)
+	_, err := server.Do("SET", "acl:layout", "4")
+	assert.NoError(t, err)
+	_, err = redis.NewRedisACLStorage(context.Background(), server.Addr())
+	assert.ErrorIs(t, err, redis.NewerLayoutError)
+
+	// an older layout is upgraded
+	_, err = server.Do("SET", "acl:layout", "1")
+	assert.NoError(t, err)
+	open(t, server)
+	layout, err := server.Do("GET", "acl:layout")
+	assert.NoError(t, err)
+	assert.Equal(t, "3", layout)
+
+	// another prefix is a separate store
+	_, err = redis.NewRedisACLStorage(context.Background(), server.Addr(), redis.WithKeyPrefix("other:"))
+	assert.NoError(t, err)
+}
+
+func TestAuth(t *testing.T) {
+	ctx := context.Background()
+	server := redistest.NewServer(t)
+	server.RequirePassword("secret")
+
+	_, err := redis.NewRedisACLStorage(ctx, server.Addr())
+	assert.Error(t, err)
+	_, err = redis.NewRedisACLStorage(ctx, server.Addr(), redis.WithAuth("", "wrong"))
+	assert.Error(t, err)
+	s := open(t, server, redis.WithAuth("default", "secret"))
+	assert.NoError(t, s.StoreUserPerms(ctx, "alice", nil))
+}
+
+func TestRetriesOnConflict(t *testing.T) {
+	ctx := context.Background()
+	server := redistest.NewServer(t)
+	s := open(t, server)
+	other := open(t, server)
+	assert.NoError(t, s.StoreUserPerms(ctx, "alice", []*permissions.Permission{{ID: "g1", Type: permissions.Read, Table: "t1"}}))
+
+	// another server adds a grant between s reading alice's grants and committing its change
+	var raced atomic.Bool
+	server.BeforeExec(func() {
+		if raced.CompareAndSwap(false, true) {
+			assert.NoError(t, other.UpdateGrants(ctx, "alice", []*permissions.Permission{{ID: "g2", Type: permissions.Read, Table: "t2"}}, nil))
+		}
+	})
+	assert.NoError(t, s.UpdateGrants(ctx, "alice", []*permissions.Permission{{ID: "g3", Type: permissions.Write, Table: "t1"}}, []string{"g1"}))
+	got, err := s.GetUserPerms(ctx, "alice")
+	assert.NoError(t, err)
+	assert.Equal(t, []*permissions.Permission{
+		{ID: "g2", Type: permissions.Read, Table: "t2"},
+		{ID: "g3", Type: permissions.Write, Table: "t1"},
+	}, got)
+
+	// a key that keeps changing eventually fails the write
+	server.BeforeExec(func() {
+		v, err := server.Do("GET", "acl:grants:alice")
+		assert.NoError(t, err)
+		_, err = server.Do("SET", "acl:grants:alice", v.(string))
+		assert.NoError(t, err)
+	})
+	assert.ErrorIs(t, s.StoreUserPerms(ctx, "alice", nil), redis.ConflictError)
+	server.BeforeExec(nil)
+	got, err = s.GetUserPerms(ctx, "alice")
+	assert.NoError(t, err)
+	assert.Len(t, got, 2)
+}
+
+func TestConcurrentUpdates(t *testing.T) {
+	ctx := context.Background()
+	server := redistest.NewServer(t)
+	const writers = 8
+	stores := make([]*redis.RedisACLStorage, writers)
+	for i := range stores {
+		stores[i] = open(t, server)
+	}
+
+	var wg sync.WaitGroup
+	for i, s := range stores {
+		wg.Add(1)
+		go func(i int, s *redis.RedisACLStorage) {
+			defer wg.Done()
+			p := &permissions.Permission{ID: fmt.Sprintf("g%d", i), Type: permissions.Read, Table: fmt.Sprintf("t%d", i)}
+			assert.NoError(t, s.UpdateGrants(ctx, "alice", []*permissions.Permission{p}, nil))
+		}(i, s)
+	}
+	wg.Wait()
+
+	got, err := stores[0].GetUserPerms(ctx, "alice")
+	assert.NoError(t, err)
+	assert.Len(t, got, writers)
+	for i := 0; i < writers; i++ {
+		grants, err := stores[0].GetTableGrants(ctx, fmt.Sprintf("t%d", i))
+		assert.NoError(t, err)
+		assert.Len(t, grants["alice"], 1)
+	}
+}
+
+func TestTrimChanges(t *testing.T) {
+	ctx := context.Background()
+	server := redistest.NewServer(t)
+	s := open(t, server)
+	for i := 0; i < 5; i++ {
+		assert.NoError(t, s.StoreUserPerms(ctx, fmt.Sprintf("user%d", i), nil))
+	}
+
+	dropped, err := s.TrimChanges(ctx, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), dropped)
+	version, err := s.ChangeVersion(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(5), version, "trimming keeps versions")
+	dropped, err = s.TrimChanges(ctx, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), dropped)
+
+	// a watcher that missed trimmed changes is told everything changed, then gets later changes as usual
+	changes := make(chan storage.Change, 10)
+	watchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go s.Watch(watchCtx, 1, func(c storage.Change) { changes <- c })
+	assert.Equal(t, storage.Change{Version: 5, Kind: storage.AllChanged}, <-changes)
+	assert.NoError(t, s.StoreUserPerms(ctx, "user0", nil))
+	assert.Equal(t, storage.Change{Version: 6, User: "user0", Kind: storage.GrantsChanged}, <-changes)
+
+	// one that is up to date is not
+	changes2 := make(chan storage.Change, 10)
+	go s.Watch(watchCtx, 4, func(c storage.Change) { changes2 <- c })
+	assert.Equal(t, storage.Change{Version: 5, User: "user4", Kind: storage.GrantsChanged}, <-changes2)
+}
+
+func TestConnectionErrors(t *testing.T) {
+	server := redistest.NewServer(t)
+	s := open(t, server)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.ErrorIs(t, s.StoreUserPerms(ctx, "alice", nil), context.Canceled)
+	assert.NoError(t, s.StoreUserPerms(context.Background(), "alice", nil), "later calls use a new connection")
+
+	server.Close()
+	_, err := s.GetUserPerms(context.Background(), "alice")
+	assert.Error(t, err)
+
+	s.Close()
+	_, err = s.GetUserPerms(context.Background(), "alice")
+	assert.ErrorIs(t, err, redis.ClosedError)
+}
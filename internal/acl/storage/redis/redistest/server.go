@@ -0,0 +1,806 @@
+// Package redistest provides an in-process stand-in for a Redis server, so Redis-backed code can be tested without an
+// external service. It implements the subset of commands the ACL store uses, with Redis's semantics for WATCH and
+// MULTI/EXEC, over RESP2 on a local TCP port.
+package redistest
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// status is a simple string reply, e.g. OK.
+type status string
+
+// errReply is an error reply.
+type errReply string
+
+// nilArray is a null array reply, as EXEC gives for an aborted transaction.
+type nilArray struct{}
+
+const wrongType = errReply("WRONGTYPE Operation against a key holding the wrong kind of value")
+
+// Server holds string, hash, set and list values in a single database.
+type Server struct {
+	ln net.Listener
+	wg sync.WaitGroup
+
+	mu         sync.Mutex
+	data       map[string]interface{} // string, map[string]string, map[string]struct{} or []string
+	versions   map[string]uint64      // bumped on every write to a key, for WATCH
+	password   string
+	beforeExec func()
+	conns      map[net.Conn]struct{}
+	closed     bool
+}
+
+// NewServer starts a server on a free local port. It is closed when the test finishes.
+func NewServer(t testing.TB) *Server {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error starting redis stand-in: %v", err)
+	}
+	s := &Server{
+		ln:       ln,
+		data:     make(map[string]interface{}),
+		versions: make(map[string]uint64),
+		conns:    make(map[net.Conn]struct{}),
+	}
+	s.wg.Add(1)
+	go s.serve()
+	t.Cleanup(s.Close)
+	return s
+}
+
+// Addr returns the host:port the server listens on.
+func (s *Server) Addr() string {
+	return s.ln.Addr().String()
+}
+
+// RequirePassword makes connections authenticate with AUTH before running other commands.
+func (s *Server) RequirePassword(password string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.password = password
+}
+
+// BeforeExec sets a function called whenever a client sends EXEC, before the transaction is checked and run. Changing
+// a watched key from it, e.g. with Do, makes the transaction abort as if another client had raced it.
+func (s *Server) BeforeExec(fn func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.beforeExec = fn
+}
+
+// Do runs a command as if sent by a client, for seeding and inspecting data. Error replies are returned as errors.
+// Replies are string, int64, nil or []interface{} of those.
+func (s *Server) Do(args ...string) (interface{}, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return plain(s.run(args))
+}
+
+// Keys returns every key, sorted.
+func (s *Server) Keys() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	res := make([]string, 0, len(s.data))
+	for k := range s.data {
+		res = append(res, k)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// Close stops the server and drops its connections.
+func (s *Server) Close() {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.closed = true
+	s.ln.Close()
+	for c := range s.conns {
+		c.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		nc, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			nc.Close()
+			return
+		}
+		s.conns[nc] = struct{}{}
+		s.mu.Unlock()
+		s.wg.Add(1)
+		go s.handle(nc)
+	}
+}
+
+// session is the per-connection state.
+type session struct {
+	authed  bool
+	watched map[string]uint64
+	inMulti bool
+	queued  [][]string
+	// set when a command was rejected while queueing, which aborts the transaction
+	queueFailed bool
+}
+
+func (s *Server) handle(nc net.Conn) {
+	defer s.wg.Done()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, nc)
+		s.mu.Unlock()
+		nc.Close()
+	}()
+
+	r := bufio.NewReader(nc)
+	w := bufio.NewWriter(nc)
+	sess := &session{}
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			if err != io.EOF {
+				writeReply(w, errReply("ERR Protocol error: "+err.Error()))
+				w.Flush()
+			}
+			return
+		}
+		writeReply(w, s.dispatch(sess, args))
+		if r.Buffered() == 0 {
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// dispatch handles connection and transaction commands, and runs or queues the rest.
+func (s *Server) dispatch(sess *session, args []string) interface{} {
+	if len(args) == 0 {
+		return errReply("ERR empty command")
+	}
+	name := strings.ToUpper(args[0])
+
+	if name == "EXEC" {
+		return s.exec(sess)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.password != "" && !sess.authed && name != "AUTH" {
+		return errReply("NOAUTH Authentication required.")
+	}
+	switch name {
+	case "AUTH":
+		if len(args) < 2 || len(args) > 3 {
+			return arity(name)
+		}
+		if s.password == "" {
+			return errReply("ERR AUTH called without any password configured")
+		}
+		if args[len(args)-1] != s.password {
+			return errReply("WRONGPASS invalid username-password pair")
+		}
+		sess.authed = true
+		return status("OK")
+	case "MULTI":
+		if sess.inMulti {
+			return errReply("ERR MULTI calls can not be nested")
+		}
+		sess.inMulti = true
+		return status("OK")
+	case "DISCARD":
+		if !sess.inMulti {
+			return errReply("ERR DISCARD without MULTI")
+		}
+		sess.reset()
+		return status("OK")
+	case "WATCH":
+		if sess.inMulti {
+			return errReply("ERR WATCH inside MULTI is not allowed")
+		}
+		if len(args) < 2 {
+			return arity(name)
+		}
+		if sess.watched == nil {
+			sess.watched = make(map[string]uint64)
+		}
+		for _, k := range args[1:] {
+			if _, ok := sess.watched[k]; !ok {
+				sess.watched[k] = s.versions[k]
+			}
+		}
+		return status("OK")
+	case "UNWATCH":
+		sess.watched = nil
+		return status("OK")
+	}
+
+	if sess.inMulti {
+		// like Redis, reject unknown commands and wrong argument counts when queueing rather than when run
+		cmd, ok := commands[name]
+		if !ok {
+			sess.queueFailed = true
+			return unknown(args[0])
+		}
+		if len(args) < cmd.minArgs {
+			sess.queueFailed = true
+			return arity(name)
+		}
+		sess.queued = append(sess.queued, args)
+		return status("QUEUED")
+	}
+	return s.run(args)
+}
+
+func (s *Server) exec(sess *session) interface{} {
+	s.mu.Lock()
+	hook := s.beforeExec
+	s.mu.Unlock()
+	if hook != nil && sess.inMulti {
+		hook()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !sess.inMulti {
+		return errReply("ERR EXEC without MULTI")
+	}
+	defer sess.reset()
+	if sess.queueFailed {
+		return errReply("EXECABORT Transaction discarded because of previous errors.")
+	}
+	for k, v := range sess.watched {
+		if s.versions[k] != v {
+			return nilArray{}
+		}
+	}
+	replies := make([]interface{}, len(sess.queued))
+	for i, args := range sess.queued {
+		replies[i] = s.run(args)
+	}
+	return replies
+}
+
+func (sess *session) reset() {
+	sess.inMulti = false
+	sess.queued = nil
+	sess.queueFailed = false
+	sess.watched = nil
+}
+
+// commands are the data commands by name, with their minimum argument count including the name.
+var commands = map[string]struct {
+	minArgs int
+	run     func(s *Server, args []string) interface{}
+}{
+	"PING":      {1, func(s *Server, args []string) interface{} { return status("PONG") }},
+	"SELECT":    {2, (*Server).selectDB},
+	"GET":       {2, (*Server).get},
+	"SET":       {3, (*Server).set},
+	"SETNX":     {3, (*Server).setnx},
+	"DEL":       {2, (*Server).del},
+	"EXISTS":    {2, (*Server).exists},
+	"HGET":      {3, (*Server).hget},
+	"HSET":      {4, (*Server).hset},
+	"HDEL":      {3, (*Server).hdel},
+	"HGETALL":   {2, (*Server).hgetall},
+	"HMGET":     {3, (*Server).hmget},
+	"HEXISTS":   {3, (*Server).hexists},
+	"SADD":      {3, (*Server).sadd},
+	"SREM":      {3, (*Server).srem},
+	"SMEMBERS":  {2, (*Server).smembers},
+	"SISMEMBER": {3, (*Server).sismember},
+	"RPUSH":     {3, (*Server).rpush},
+	"LRANGE":    {4, (*Server).lrange},
+	"LLEN":      {2, (*Server).llen},
+	"LTRIM":     {4, (*Server).ltrim},
+	"INCR":      {2, (*Server).incr},
+	"INCRBY":    {3, (*Server).incrby},
+}
+
+// run runs a data command. Must be called with s.mu held.
+func (s *Server) run(args []string) interface{} {
+	name := strings.ToUpper(args[0])
+	cmd, ok := commands[name]
+	if !ok {
+		return unknown(args[0])
+	}
+	if len(args) < cmd.minArgs {
+		return arity(name)
+	}
+	return cmd.run(s, args)
+}
+
+func (s *Server) touch(key string) {
+	s.versions[key]++
+}
+
+func (s *Server) selectDB(args []string) interface{} {
+	if args[1] != "0" {
+		return errReply("ERR the stand-in server only has database 0")
+	}
+	return status("OK")
+}
+
+func (s *Server) get(args []string) interface{} {
+	switch v := s.data[args[1]].(type) {
+	case nil:
+		return nil
+	case string:
+		return v
+	default:
+		return wrongType
+	}
+}
+
+func (s *Server) set(args []string) interface{} {
+	if len(args) != 3 {
+		return errReply("ERR the stand-in server does not support SET options")
+	}
+	s.data[args[1]] = args[2]
+	s.touch(args[1])
+	return status("OK")
+}
+
+func (s *Server) setnx(args []string) interface{} {
+	if _, ok := s.data[args[1]]; ok {
+		return int64(0)
+	}
+	s.data[args[1]] = args[2]
+	s.touch(args[1])
+	return int64(1)
+}
+
+func (s *Server) del(args []string) interface{} {
+	n := int64(0)
+	for _, k := range args[1:] {
+		if _, ok := s.data[k]; ok {
+			delete(s.data, k)
+			s.touch(k)
+			n++
+		}
+	}
+	return n
+}
+
+func (s *Server) exists(args []string) interface{} {
+	n := int64(0)
+	for _, k := range args[1:] {
+		if _, ok := s.data[k]; ok {
+			n++
+		}
+	}
+	return n
+}
+
+// hash returns the hash at key, creating it if create is set. It returns an error reply if key holds another type.
+func (s *Server) hash(key string, create bool) (map[string]string, interface{}) {
+	switch v := s.data[key].(type) {
+	case nil:
+		if !create {
+			return nil, nil
+		}
+		h := make(map[string]string)
+		s.data[key] = h
+		return h, nil
+	case map[string]string:
+		return v, nil
+	default:
+		return nil, wrongType
+	}
+}
+
+func (s *Server) hget(args []string) interface{} {
+	h, errR := s.hash(args[1], false)
+	if errR != nil {
+		return errR
+	}
+	if v, ok := h[args[2]]; ok {
+		return v
+	}
+	return nil
+}
+
+func (s *Server) hset(args []string) interface{} {
+	if len(args)%2 != 0 {
+		return arity("HSET")
+	}
+	h, errR := s.hash(args[1], true)
+	if errR != nil {
+		return errR
+	}
+	n := int64(0)
+	for i := 2; i < len(args); i += 2 {
+		if _, ok := h[args[i]]; !ok {
+			n++
+		}
+		h[args[i]] = args[i+1]
+	}
+	s.touch(args[1])
+	return n
+}
+
+func (s *Server) hdel(args []string) interface{} {
+	h, errR := s.hash(args[1], false)
+	if errR != nil {
+		return errR
+	}
+	n := int64(0)
+	for _, f := range args[2:] {
+		if _, ok := h[f]; ok {
+			delete(h, f)
+			n++
+		}
+	}
+	if n > 0 {
+		if len(h) == 0 {
+			delete(s.data, args[1])
+		}
+		s.touch(args[1])
+	}
+	return n
+}
+
+func (s *Server) hgetall(args []string) interface{} {
+	h, errR := s.hash(args[1], false)
+	if errR != nil {
+		return errR
+	}
+	fields := make([]string, 0, len(h))
+	for f := range h {
+		fields = append(fields, f)
+	}
+	sort.Strings(fields)
+	res := make([]interface{}, 0, 2*len(h))
+	for _, f := range fields {
+		res = append(res, f, h[f])
+	}
+	return res
+}
+
+func (s *Server) hmget(args []string) interface{} {
+	h, errR := s.hash(args[1], false)
+	if errR != nil {
+		return errR
+	}
+	res := make([]interface{}, len(args)-2)
+	for i, f := range args[2:] {
+		if v, ok := h[f]; ok {
+			res[i] = v
+		}
+	}
+	return res
+}
+
+func (s *Server) hexists(args []string) interface{} {
+	h, errR := s.hash(args[1], false)
+	if errR != nil {
+		return errR
+	}
+	if _, ok := h[args[2]]; ok {
+		return int64(1)
+	}
+	return int64(0)
+}
+
+// setAt returns the set at key, creating it if create is set. It returns an error reply if key holds another type.
+func (s *Server) setAt(key string, create bool) (map[string]struct{}, interface{}) {
+	switch v := s.data[key].(type) {
+	case nil:
+		if !create {
+			return nil, nil
+		}
+		m := make(map[string]struct{})
+		s.data[key] = m
+		return m, nil
+	case map[string]struct{}:
+		return v, nil
+	default:
+		return nil, wrongType
+	}
+}
+
+func (s *Server) sadd(args []string) interface{} {
+	m, errR := s.setAt(args[1], true)
+	if errR != nil {
+		return errR
+	}
+	n := int64(0)
+	for _, member := range args[2:] {
+		if _, ok := m[member]; !ok {
+			m[member] = struct{}{}
+			n++
+		}
+	}
+	if n > 0 {
+		s.touch(args[1])
+	}
+	return n
+}
+
+func (s *Server) srem(args []string) interface{} {
+	m, errR := s.setAt(args[1], false)
+	if errR != nil {
+		return errR
+	}
+	n := int64(0)
+	for _, member := range args[2:] {
+		if _, ok := m[member]; ok {
+			delete(m, member)
+			n++
+		}
+	}
+	if n > 0 {
+		if len(m) == 0 {
+			delete(s.data, args[1])
+		}
+		s.touch(args[1])
+	}
+	return n
+}
+
+func (s *Server) smembers(args []string) interface{} {
+	m, errR := s.setAt(args[1], false)
+	if errR != nil {
+		return errR
+	}
+	members := make([]string, 0, len(m))
+	for member := range m {
+		members = append(members, member)
+	}
+	sort.Strings(members)
+	res := make([]interface{}, len(members))
+	for i, member := range members {
+		res[i] = member
+	}
+	return res
+}
+
+func (s *Server) sismember(args []string) interface{} {
+	m, errR := s.setAt(args[1], false)
+	if errR != nil {
+		return errR
+	}
+	if _, ok := m[args[2]]; ok {
+		return int64(1)
+	}
+	return int64(0)
+}
+
+func (s *Server) rpush(args []string) interface{} {
+	var l []string
+	switch v := s.data[args[1]].(type) {
+	case nil:
+	case []string:
+		l = v
+	default:
+		return wrongType
+	}
+	l = append(l, args[2:]...)
+	s.data[args[1]] = l
+	s.touch(args[1])
+	return int64(len(l))
+}
+
+func (s *Server) lrange(args []string) interface{} {
+	var l []string
+	switch v := s.data[args[1]].(type) {
+	case nil:
+	case []string:
+		l = v
+	default:
+		return wrongType
+	}
+	start, err1 := strconv.Atoi(args[2])
+	stop, err2 := strconv.Atoi(args[3])
+	if err1 != nil || err2 != nil {
+		return errReply("ERR value is not an integer or out of range")
+	}
+	if start < 0 {
+		start += len(l)
+	}
+	if stop < 0 {
+		stop += len(l)
+	}
+	if start < 0 {
+		start = 0
+	}
+	if stop >= len(l) {
+		stop = len(l) - 1
+	}
+	res := []interface{}{}
+	for i := start; i <= stop; i++ {
+		res = append(res, l[i])
+	}
+	return res
+}
+
+func (s *Server) llen(args []string) interface{} {
+	switch v := s.data[args[1]].(type) {
+	case nil:
+		return int64(0)
+	case []string:
+		return int64(len(v))
+	default:
+		return wrongType
+	}
+}
+
+func (s *Server) ltrim(args []string) interface{} {
+	var l []string
+	switch v := s.data[args[1]].(type) {
+	case nil:
+		return status("OK")
+	case []string:
+		l = v
+	default:
+		return wrongType
+	}
+	start, err1 := strconv.Atoi(args[2])
+	stop, err2 := strconv.Atoi(args[3])
+	if err1 != nil || err2 != nil {
+		return errReply("ERR value is not an integer or out of range")
+	}
+	if start < 0 {
+		start += len(l)
+	}
+	if stop < 0 {
+		stop += len(l)
+	}
+	if start < 0 {
+		start = 0
+	}
+	if stop >= len(l) {
+		stop = len(l) - 1
+	}
+	if start > stop {
+		delete(s.data, args[1])
+	} else {
+		s.data[args[1]] = append([]string(nil), l[start:stop+1]...)
+	}
+	s.touch(args[1])
+	return status("OK")
+}
+
+func (s *Server) incr(args []string) interface{} {
+	return s.incrby([]string{args[0], args[1], "1"})
+}
+
+func (s *Server) incrby(args []string) interface{} {
+	by, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil {
+		return errReply("ERR value is not an integer or out of range")
+	}
+	var n int64
+	switch v := s.data[args[1]].(type) {
+	case nil:
+	case string:
+		if n, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return errReply("ERR value is not an integer or out of range")
+		}
+	default:
+		return wrongType
+	}
+	n += by
+	s.data[args[1]] = strconv.FormatInt(n, 10)
+	s.touch(args[1])
+	return n
+}
+
+func arity(name string) errReply {
+	return errReply(fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(name)))
+}
+
+func unknown(name string) errReply {
+	return errReply(fmt.Sprintf("ERR unknown command '%s'", name))
+}
+
+// readCommand reads a command sent as an array of bulk strings.
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "*") {
+		return nil, fmt.Errorf("expected '*', got %q", line)
+	}
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("invalid multibulk length")
+	}
+	args := make([]string, n)
+	for i := range args {
+		line, err := readLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(line, "$") {
+			return nil, fmt.Errorf("expected '$', got %q", line)
+		}
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 {
+			return nil, fmt.Errorf("invalid bulk length")
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+	return args, nil
+}
+
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func writeReply(w *bufio.Writer, v interface{}) {
+	switch v := v.(type) {
+	case status:
+		fmt.Fprintf(w, "+%s\r\n", v)
+	case errReply:
+		fmt.Fprintf(w, "-%s\r\n", v)
+	case int64:
+		fmt.Fprintf(w, ":%d\r\n", v)
+	case string:
+		fmt.Fprintf(w, "$%d\r\n%s\r\n", len(v), v)
+	case nil:
+		w.WriteString("$-1\r\n")
+	case nilArray:
+		w.WriteString("*-1\r\n")
+	case []interface{}:
+		fmt.Fprintf(w, "*%d\r\n", len(v))
+		for _, item := range v {
+			writeReply(w, item)
+		}
+	default:
+		panic(fmt.Sprintf("unknown reply type %T", v))
+	}
+}
+
+// plain converts a reply for Do.
+func plain(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case status:
+		return string(v), nil
+	case errReply:
+		return nil, fmt.Errorf("%s", string(v))
+	case []interface{}:
+		res := make([]interface{}, len(v))
+		for i, item := range v {
+			var err error
+			if res[i], err = plain(item); err != nil {
+				return nil, err
+			}
+		}
+		return res, nil
+	default:
+		return v, nil
+	}
+}
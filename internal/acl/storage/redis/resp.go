@@ -0,0 +1,337 @@
+package redis
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ProtocolError is returned when the server sends something that is not a RESP reply.
+var ProtocolError = fmt.Errorf("malformed reply from server")
+
+// Error is an error reply from the server, e.g. WRONGTYPE.
+type Error string
+
+func (e Error) Error() string {
+	return "redis: " + string(e)
+}
+
+// conn is one connection speaking RESP2. Replies are decoded as string (simple and bulk strings), nil (null bulk
+// strings and arrays), int64, Error, or []interface{} of those.
+type conn struct {
+	nc net.Conn
+	r  *bufio.Reader
+	w  *bufio.Writer
+	// set after a network or protocol error, after which the connection must not be reused
+	broken bool
+}
+
+func newConn(nc net.Conn) *conn {
+	return &conn{nc: nc, r: bufio.NewReader(nc), w: bufio.NewWriter(nc)}
+}
+
+// send buffers a command. Write errors surface when the buffer is flushed.
+func (c *conn) send(args ...string) {
+	c.w.WriteString("*")
+	c.w.WriteString(strconv.Itoa(len(args)))
+	c.w.WriteString("\r\n")
+	for _, a := range args {
+		c.w.WriteString("$")
+		c.w.WriteString(strconv.Itoa(len(a)))
+		c.w.WriteString("\r\n")
+		c.w.WriteString(a)
+		c.w.WriteString("\r\n")
+	}
+}
+
+func (c *conn) flush() error {
+	if err := c.w.Flush(); err != nil {
+		c.broken = true
+		return err
+	}
+	return nil
+}
+
+// do sends one command and reads its reply. An error reply is returned as an Error.
+func (c *conn) do(args ...string) (interface{}, error) {
+	c.send(args...)
+	if err := c.flush(); err != nil {
+		return nil, err
+	}
+	v, err := c.receive()
+	if err != nil {
+		return nil, err
+	}
+	if e, ok := v.(Error); ok {
+		return nil, e
+	}
+	return v, nil
+}
+
+// exec runs cmds in a MULTI/EXEC transaction and returns their replies. It reports false, running nothing, if a key
+// watched on the connection changed since the WATCH. Redis does not roll back commands that fail inside EXEC, so the
+// first such failure is returned along with the replies.
+func (c *conn) exec(cmds [][]string) ([]interface{}, bool, error) {
+	c.send("MULTI")
+	for _, cmd := range cmds {
+		c.send(cmd...)
+	}
+	c.send("EXEC")
+	if err := c.flush(); err != nil {
+		return nil, false, err
+	}
+
+	// MULTI and each queued command reply before EXEC does; a command rejected when queued aborts the transaction
+	var queueErr error
+	for i := 0; i < len(cmds)+1; i++ {
+		v, err := c.receive()
+		if err != nil {
+			return nil, false, err
+		}
+		if e, ok := v.(Error); ok && queueErr == nil {
+			queueErr = e
+		}
+	}
+	v, err := c.receive()
+	if err != nil {
+		return nil, false, err
+	}
+	if queueErr != nil {
+		return nil, false, queueErr
+	}
+	switch v := v.(type) {
+	case nil:
+		return nil, false, nil
+	case Error:
+		return nil, false, v
+	case []interface{}:
+		if len(v) != len(cmds) {
+			c.broken = true
+			return nil, false, fmt.Errorf("%w: %d replies to %d commands", ProtocolError, len(v), len(cmds))
+		}
+		for i, r := range v {
+			if e, ok := r.(Error); ok {
+				return v, true, fmt.Errorf("error running %s: %w", cmds[i][0], e)
+			}
+		}
+		return v, true, nil
+	default:
+		c.broken = true
+		return nil, false, fmt.Errorf("%w: unexpected EXEC reply %v", ProtocolError, v)
+	}
+}
+
+// receive reads one reply.
+func (c *conn) receive() (interface{}, error) {
+	v, err := c.readReply()
+	if err != nil {
+		c.broken = true
+	}
+	return v, err
+}
+
+func (c *conn) readReply() (interface{}, error) {
+	line, err := c.readLine()
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, fmt.Errorf("%w: empty line", ProtocolError)
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return Error(line[1:]), nil
+	case ':':
+		n, err := strconv.ParseInt(line[1:], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%w: bad integer %q", ProtocolError, line)
+		}
+		return n, nil
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < -1 {
+			return nil, fmt.Errorf("%w: bad bulk length %q", ProtocolError, line)
+		}
+		if n == -1 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, buf); err != nil {
+			return nil, err
+		}
+		if buf[n] != '\r' || buf[n+1] != '\n' {
+			return nil, fmt.Errorf("%w: unterminated bulk string", ProtocolError)
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < -1 {
+			return nil, fmt.Errorf("%w: bad array length %q", ProtocolError, line)
+		}
+		if n == -1 {
+			return nil, nil
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			if items[i], err = c.readReply(); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	default:
+		return nil, fmt.Errorf("%w: unknown reply type %q", ProtocolError, line[0])
+	}
+}
+
+func (c *conn) readLine() (string, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return "", fmt.Errorf("%w: line not terminated by CRLF", ProtocolError)
+	}
+	return line[:len(line)-2], nil
+}
+
+// pool hands out connections, keeping up to maxIdle idle ones for reuse.
+type pool struct {
+	addr     string
+	username string
+	password string
+	db       int
+	tls      *tls.Config
+	maxIdle  int
+
+	mu     sync.Mutex
+	idle   []*conn
+	closed bool
+}
+
+func (p *pool) get(ctx context.Context) (*conn, error) {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil, ClosedError
+	}
+	if n := len(p.idle); n > 0 {
+		c := p.idle[n-1]
+		p.idle = p.idle[:n-1]
+		p.mu.Unlock()
+		return c, nil
+	}
+	p.mu.Unlock()
+	return p.dial(ctx)
+}
+
+func (p *pool) put(c *conn) {
+	if c.broken {
+		c.nc.Close()
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed || len(p.idle) >= p.maxIdle {
+		c.nc.Close()
+		return
+	}
+	p.idle = append(p.idle, c)
+}
+
+func (p *pool) dial(ctx context.Context) (*conn, error) {
+	var nc net.Conn
+	var err error
+	if p.tls != nil {
+		d := &tls.Dialer{Config: p.tls}
+		nc, err = d.DialContext(ctx, "tcp", p.addr)
+	} else {
+		d := &net.Dialer{}
+		nc, err = d.DialContext(ctx, "tcp", p.addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c := newConn(nc)
+	if deadline, ok := ctx.Deadline(); ok {
+		nc.SetDeadline(deadline)
+	}
+	if p.password != "" {
+		args := []string{"AUTH", p.password}
+		if p.username != "" {
+			args = []string{"AUTH", p.username, p.password}
+		}
+		if _, err := c.do(args...); err != nil {
+			nc.Close()
+			return nil, fmt.Errorf("error authenticating to %s: %w", p.addr, err)
+		}
+	}
+	if p.db != 0 {
+		if _, err := c.do("SELECT", strconv.Itoa(p.db)); err != nil {
+			nc.Close()
+			return nil, fmt.Errorf("error selecting database %d: %w", p.db, err)
+		}
+	}
+	nc.SetDeadline(time.Time{})
+	return c, nil
+}
+
+// with runs fn on a pooled connection. The connection's deadline follows ctx, and it is closed rather than reused if
+// fn hit a network error or ctx ended while it ran.
+func (p *pool) with(ctx context.Context, fn func(c *conn) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	c, err := p.get(ctx)
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		c.nc.SetDeadline(deadline)
+	}
+	done := make(chan struct{})
+	interrupted := make(chan bool)
+	go func() {
+		select {
+		case <-ctx.Done():
+			// unblocks any read or write in progress
+			c.nc.SetDeadline(time.Unix(1, 0))
+			<-done
+			interrupted <- true
+		case <-done:
+			interrupted <- false
+		}
+	}()
+
+	err = fn(c)
+	close(done)
+	if <-interrupted {
+		c.broken = true
+		if err != nil {
+			err = ctx.Err()
+		}
+	}
+	if !c.broken {
+		c.nc.SetDeadline(time.Time{})
+	}
+	p.put(c)
+	return err
+}
+
+func (p *pool) close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	for _, c := range p.idle {
+		c.nc.Close()
+	}
+	p.idle = nil
+	return nil
+}
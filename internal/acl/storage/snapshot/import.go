@@ -0,0 +1,384 @@
+package snapshot
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"chroma1/internal/acl/storage"
+	"chroma1/model/permissions"
+)
+
+var ConflictError = fmt.Errorf("snapshot conflicts with the store")
+
+// Mode selects what an import does with ACLs the store holds but the snapshot does not.
+type Mode int
+
+const (
+	// Merge adds and updates what the snapshot holds, and leaves everything else in the store as it is.
+	Merge Mode = iota
+	// Replace also deletes the users, grants, keys and table admin rights the snapshot does not hold, so that the store
+	// ends up holding exactly the snapshot.
+	Replace
+)
+
+// FlagSetter is implemented by stores that can change break-glass users and table admins, which the ACLStorage
+// interface cannot.
+type FlagSetter interface {
+	SetBreakGlass(ctx context.Context, user string, allowed bool) error
+	SetTableAdmin(ctx context.Context, user, table string, isAdmin bool) error
+}
+
+// Op is the kind of change a Step makes.
+type Op string
+
+const (
+	CreateUser    Op = "create user"
+	DeleteUser    Op = "delete user"
+	SetAdmin      Op = "set admin"
+	SetDisabled   Op = "set disabled"
+	SetBreakGlass Op = "set break-glass"
+	SetTableAdmin Op = "set table admin"
+	StoreGrant    Op = "store grant"
+	RemoveGrant   Op = "remove grant"
+	StoreKey      Op = "store key"
+	ReplaceKey    Op = "replace key"
+	DeleteKey     Op = "delete key"
+)
+
+// Step is one change an import makes to the store.
+type Step struct {
+	Op   Op
+	User string
+	// for CreateUser, whether the user is an admin; for the Set ops, the new value
+	Value bool
+	// for SetTableAdmin
+	Table string
+	// for StoreGrant; RemoveGrant only sets the ID
+	Grant *permissions.Permission
+	// for CreateUser, the user's first key, if they have any; for the key ops, the key (DeleteKey only sets the ID)
+	Key *Key
+}
+
+func (st *Step) String() string {
+	switch st.Op {
+	case CreateUser:
+		s := fmt.Sprintf("%s %s", st.Op, st.User)
+		if st.Value {
+			s += " as admin"
+		}
+		if st.Key != nil {
+			s += " with key " + st.Key.ID
+		}
+		return s
+	case DeleteUser:
+		return fmt.Sprintf("%s %s", st.Op, st.User)
+	case SetAdmin, SetDisabled, SetBreakGlass:
+		return fmt.Sprintf("%s of %s to %t", st.Op, st.User, st.Value)
+	case SetTableAdmin:
+		return fmt.Sprintf("%s of %s on %s to %t", st.Op, st.User, st.Table, st.Value)
+	case StoreGrant:
+		return fmt.Sprintf("%s %s of %s: %s on %s", st.Op, st.Grant.ID, st.User, st.Grant.Type, st.Grant.Table)
+	case RemoveGrant:
+		return fmt.Sprintf("%s %s of %s", st.Op, st.Grant.ID, st.User)
+	}
+	return fmt.Sprintf("%s %s of %s", st.Op, st.Key.ID, st.User)
+}
+
+// Plan is the changes importing a snapshot makes to a store.
+type Plan struct {
+	Steps []*Step
+	// Changes to break-glass users and table admins the store cannot make, as it does not implement FlagSetter. They are
+	// left to be made out of band.
+	Unsupported []*Step
+}
+
+// Empty reports whether the store already matches the snapshot.
+func (p *Plan) Empty() bool {
+	return len(p.Steps) == 0 && len(p.Unsupported) == 0
+}
+
+// Import brings s in line with snap, and returns the changes it made.
+func Import(ctx context.Context, s storage.ACLStorage, snap *Snapshot, mode Mode) (*Plan, error) {
+	p, err := Diff(ctx, s, snap, mode)
+	if err != nil {
+		return nil, err
+	}
+	return p, p.Apply(ctx, s)
+}
+
+// Diff plans the changes importing snap into s would make, without making them. In Merge mode, it fails with
+// ConflictError if a grant or key in the snapshot belongs to a different user in the store.
+func Diff(ctx context.Context, s storage.ACLStorage, snap *Snapshot, mode Mode) (*Plan, error) {
+	if err := snap.Validate(); err != nil {
+		return nil, err
+	}
+	cur, err := read(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+	if mode == Merge {
+		if err := checkOwners(cur, snap); err != nil {
+			return nil, err
+		}
+	}
+
+	// Removals come first, so that in Replace mode the IDs of grants and keys moving to another user are free before
+	// they are reused.
+	var removals, additions []*Step
+	names := sortedUsers(cur.Users)
+	for _, name := range sortedUsers(snap.Users) {
+		if _, ok := cur.Users[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		have, want := cur.Users[name], snap.Users[name]
+		switch {
+		case want == nil:
+			if mode == Replace {
+				removals = append(removals, &Step{Op: DeleteUser, User: name})
+			}
+		case have == nil:
+			additions = append(additions, createSteps(name, want)...)
+		default:
+			r, a := diffUser(name, have, want, mode)
+			removals, additions = append(removals, r...), append(additions, a...)
+		}
+	}
+
+	p := &Plan{}
+	_, canSetFlags := s.(FlagSetter)
+	for _, st := range append(removals, additions...) {
+		if !canSetFlags && (st.Op == SetBreakGlass || st.Op == SetTableAdmin) {
+			p.Unsupported = append(p.Unsupported, st)
+		} else {
+			p.Steps = append(p.Steps, st)
+		}
+	}
+	return p, nil
+}
+
+// checkOwners reports the grants and keys of snap that belong to a different user in cur.
+func checkOwners(cur, snap *Snapshot) error {
+	grantOwners := make(map[string]string)
+	keyOwners := make(map[string]string)
+	for name, u := range cur.Users {
+		for _, g := range u.Grants {
+			grantOwners[g.ID] = name
+		}
+		for _, k := range u.Keys {
+			keyOwners[k.ID] = name
+		}
+	}
+	var problems []string
+	for _, name := range sortedUsers(snap.Users) {
+		u := snap.Users[name]
+		for _, g := range u.Grants {
+			if owner, ok := grantOwners[g.ID]; ok && owner != name {
+				problems = append(problems, fmt.Sprintf("grant %s of %s belongs to %s in the store", g.ID, name, owner))
+			}
+		}
+		for _, k := range u.Keys {
+			if owner, ok := keyOwners[k.ID]; ok && owner != name {
+				problems = append(problems, fmt.Sprintf("key %s of %s belongs to %s in the store", k.ID, name, owner))
+			}
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%w: %s", ConflictError, strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// createSteps returns the steps creating user name as want.
+func createSteps(name string, want *User) []*Step {
+	create := &Step{Op: CreateUser, User: name, Value: want.Admin}
+	steps := []*Step{create}
+	for i, k := range want.Keys {
+		if i == 0 {
+			create.Key = k
+		} else {
+			steps = append(steps, &Step{Op: StoreKey, User: name, Key: k})
+		}
+	}
+	if want.Disabled {
+		steps = append(steps, &Step{Op: SetDisabled, User: name, Value: true})
+	}
+	if want.BreakGlass {
+		steps = append(steps, &Step{Op: SetBreakGlass, User: name, Value: true})
+	}
+	for _, t := range want.TableAdmin {
+		steps = append(steps, &Step{Op: SetTableAdmin, User: name, Table: t, Value: true})
+	}
+	for _, g := range want.Grants {
+		steps = append(steps, &Step{Op: StoreGrant, User: name, Grant: g})
+	}
+	return steps
+}
+
+// diffUser returns the steps changing user name from have to want.
+func diffUser(name string, have, want *User, mode Mode) (removals, additions []*Step) {
+	if have.Admin != want.Admin {
+		additions = append(additions, &Step{Op: SetAdmin, User: name, Value: want.Admin})
+	}
+	if have.Disabled != want.Disabled {
+		additions = append(additions, &Step{Op: SetDisabled, User: name, Value: want.Disabled})
+	}
+	if have.BreakGlass != want.BreakGlass {
+		additions = append(additions, &Step{Op: SetBreakGlass, User: name, Value: want.BreakGlass})
+	}
+
+	haveTables := make(map[string]struct{}, len(have.TableAdmin))
+	for _, t := range have.TableAdmin {
+		haveTables[t] = struct{}{}
+	}
+	wantTables := make(map[string]struct{}, len(want.TableAdmin))
+	for _, t := range want.TableAdmin {
+		wantTables[t] = struct{}{}
+		if _, ok := haveTables[t]; !ok {
+			additions = append(additions, &Step{Op: SetTableAdmin, User: name, Table: t, Value: true})
+		}
+	}
+
+	haveGrants := make(map[string]*permissions.Permission, len(have.Grants))
+	for _, g := range have.Grants {
+		haveGrants[g.ID] = g
+	}
+	wantGrants := make(map[string]struct{}, len(want.Grants))
+	for _, g := range want.Grants {
+		wantGrants[g.ID] = struct{}{}
+		if old, ok := haveGrants[g.ID]; !ok || !sameGrant(old, g) {
+			additions = append(additions, &Step{Op: StoreGrant, User: name, Grant: g})
+		}
+	}
+
+	haveKeys := make(map[string]*Key, len(have.Keys))
+	for _, k := range have.Keys {
+		haveKeys[k.ID] = k
+	}
+	wantKeys := make(map[string]struct{}, len(want.Keys))
+	for _, k := range want.Keys {
+		wantKeys[k.ID] = struct{}{}
+		if old, ok := haveKeys[k.ID]; !ok {
+			additions = append(additions, &Step{Op: StoreKey, User: name, Key: k})
+		} else if !sameKey(old, k) {
+			additions = append(additions, &Step{Op: ReplaceKey, User: name, Key: k})
+		}
+	}
+
+	if mode == Replace {
+		for _, t := range have.TableAdmin {
+			if _, ok := wantTables[t]; !ok {
+				removals = append(removals, &Step{Op: SetTableAdmin, User: name, Table: t, Value: false})
+			}
+		}
+		for _, g := range have.Grants {
+			if _, ok := wantGrants[g.ID]; !ok {
+				removals = append(removals, &Step{Op: RemoveGrant, User: name, Grant: &permissions.Permission{ID: g.ID}})
+			}
+		}
+		for _, k := range have.Keys {
+			if _, ok := wantKeys[k.ID]; !ok {
+				removals = append(removals, &Step{Op: DeleteKey, User: name, Key: &Key{ID: k.ID}})
+			}
+		}
+	}
+	return removals, additions
+}
+
+// sameGrant compares grants by their JSON form, which keeps the difference between nil and empty row lists.
+func sameGrant(a, b *permissions.Permission) bool {
+	ra, errA := json.Marshal(normalizeGrant(a))
+	rb, errB := json.Marshal(normalizeGrant(b))
+	return errA == nil && errB == nil && bytes.Equal(ra, rb)
+}
+
+func sameKey(a, b *Key) bool {
+	sameExpiry := (a.ExpiresAt == nil) == (b.ExpiresAt == nil) && (a.ExpiresAt == nil || a.ExpiresAt.Equal(*b.ExpiresAt))
+	return a.Hash == b.Hash && a.Label == b.Label && a.CreatedAt.Equal(b.CreatedAt) && sameExpiry
+}
+
+// Apply makes the plan's changes to s, in order. Changes to a user's grants are made together, with one UpdateGrants.
+// Apply is not atomic: if a change fails, those before it stay made, and diffing again plans the rest.
+func (p *Plan) Apply(ctx context.Context, s storage.ACLStorage) error {
+	var user string
+	var store []*permissions.Permission
+	var remove []string
+	flush := func() error {
+		if len(store) == 0 && len(remove) == 0 {
+			return nil
+		}
+		err := s.UpdateGrants(ctx, user, store, remove)
+		store, remove = nil, nil
+		if err != nil {
+			return fmt.Errorf("error updating grants of %s: %w", user, err)
+		}
+		return nil
+	}
+	for _, st := range p.Steps {
+		if st.Op == StoreGrant || st.Op == RemoveGrant {
+			if st.User != user {
+				if err := flush(); err != nil {
+					return err
+				}
+				user = st.User
+			}
+			if st.Op == StoreGrant {
+				store = append(store, st.Grant)
+			} else {
+				remove = append(remove, st.Grant.ID)
+			}
+			continue
+		}
+		if err := flush(); err != nil {
+			return err
+		}
+		if err := st.apply(ctx, s); err != nil {
+			return fmt.Errorf("error applying %s: %w", st, err)
+		}
+	}
+	return flush()
+}
+
+// apply makes any change but the grant ones, which Apply batches.
+func (st *Step) apply(ctx context.Context, s storage.ACLStorage) error {
+	switch st.Op {
+	case CreateUser:
+		if st.Key != nil {
+			return s.CreateUser(ctx, st.User, st.Key.apiKey(st.User), st.Value)
+		}
+		// CreateUser needs a key, but storing grants creates a user too
+		if err := s.UpdateGrants(ctx, st.User, []*permissions.Permission{}, []string{}); err != nil {
+			return err
+		}
+		if st.Value {
+			return s.SetUserAdmin(ctx, st.User, true)
+		}
+		return nil
+	case DeleteUser:
+		return s.DeleteUser(ctx, st.User)
+	case SetAdmin:
+		return s.SetUserAdmin(ctx, st.User, st.Value)
+	case SetDisabled:
+		return s.SetUserDisabled(ctx, st.User, st.Value)
+	case SetBreakGlass:
+		return s.(FlagSetter).SetBreakGlass(ctx, st.User, st.Value)
+	case SetTableAdmin:
+		return s.(FlagSetter).SetTableAdmin(ctx, st.User, st.Table, st.Value)
+	case StoreKey:
+		return s.StoreKey(ctx, st.Key.apiKey(st.User))
+	case ReplaceKey:
+		if err := s.DeleteKey(ctx, st.Key.ID); err != nil {
+			return err
+		}
+		return s.StoreKey(ctx, st.Key.apiKey(st.User))
+	case DeleteKey:
+		return s.DeleteKey(ctx, st.Key.ID)
+	}
+	return fmt.Errorf("unknown step %q", st.Op)
+}
@@ -0,0 +1,302 @@
+// Package snapshot exports the ACLs held in a store as a versioned JSON document, and imports such a document into any
+// store, so ACLs can be backed up before a risky change or moved from one backend to another. It only uses the
+// ACLStorage interface, and the optional setters in FlagSetter.
+package snapshot
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"chroma1/internal/acl/storage"
+	"chroma1/model/keys"
+	"chroma1/model/permissions"
+)
+
+// FormatVersion is the version of the snapshot format written by this package. It is bumped whenever the format changes
+// in a way older readers would misread; Read rejects snapshots with a newer version.
+const FormatVersion = 1
+
+var (
+	InvalidSnapshotError    = fmt.Errorf("invalid snapshot")
+	UnsupportedVersionError = fmt.Errorf("unsupported snapshot format version")
+	PlaintextKeyError       = fmt.Errorf("key has not been hashed yet; start the server once so it hashes stored keys")
+)
+
+// Snapshot is the exported form of a store's ACLs. As JSON, format version 1 looks like:
+//
+//	{
+//	  "format_version": 1,
+//	  "exported_at": "2023-01-01T00:00:00Z",
+//	  "users": {
+//	    "alice": {
+//	      "admin": true,
+//	      "disabled": true,
+//	      "break_glass": true,
+//	      "table_admin": ["accounts"],
+//	      "grants": [{"ID": "g1", "Type": 1, "Table": "accounts", "RowKeys": [["7"]]}],
+//	      "keys": [{"id": "k1", "hash": "9f86d0…", "label": "ci", "created_at": "2023-01-01T00:00:00Z"}]
+//	    }
+//	  }
+//	}
+//
+// Every user field but grants and keys may be omitted when false or empty. Grants are permissions.Permission as the API
+// returns them (Type 1 is read, 2 is write), and must have an ID. Keys hold the hex HMAC of their secret, which only
+// authenticates against servers sharing the key secret it was made with. Break-glass elevation records are audit
+// history rather than ACLs, and are not included.
+type Snapshot struct {
+	FormatVersion int              `json:"format_version"`
+	ExportedAt    time.Time        `json:"exported_at"`
+	Users         map[string]*User `json:"users"`
+}
+
+type User struct {
+	Admin      bool     `json:"admin,omitempty"`
+	Disabled   bool     `json:"disabled,omitempty"`
+	BreakGlass bool     `json:"break_glass,omitempty"`
+	TableAdmin []string `json:"table_admin,omitempty"` // sorted
+	// sorted by ID
+	Grants []*permissions.Permission `json:"grants"`
+	// sorted by ID
+	Keys []*Key `json:"keys"`
+}
+
+// Key is an API key's metadata and hash. The secret itself is never stored.
+type Key struct {
+	ID        string     `json:"id"`
+	Hash      string     `json:"hash"` // hex
+	Label     string     `json:"label,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// Export reads every user, with their flags, grants and keys, from s. It fails with PlaintextKeyError if s still holds
+// a legacy plaintext key, since only hashes are exported.
+func Export(ctx context.Context, s storage.ACLStorage) (*Snapshot, error) {
+	snap, err := read(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range sortedUsers(snap.Users) {
+		for _, k := range snap.Users[name].Keys {
+			if k.Hash == "" {
+				return nil, fmt.Errorf("%w: key %s of %s", PlaintextKeyError, k.ID, name)
+			}
+		}
+	}
+	return snap, nil
+}
+
+// read reads the contents of s as a snapshot. Legacy plaintext keys are included with an empty hash.
+func read(ctx context.Context, s storage.ACLStorage) (*Snapshot, error) {
+	perms, admins, err := s.GetAllUserInfo(ctx)
+	if err != nil {
+		return nil, err
+	}
+	disabled, err := s.GetDisabledUsers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	breakGlass, err := s.GetBreakGlassUsers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	tableAdmins, err := s.GetTableAdmins(ctx)
+	if err != nil {
+		return nil, err
+	}
+	allKeys, err := s.GetAllKeys(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	snap := &Snapshot{FormatVersion: FormatVersion, ExportedAt: time.Now().UTC(), Users: make(map[string]*User)}
+	user := func(name string) *User {
+		u, ok := snap.Users[name]
+		if !ok {
+			u = &User{Grants: make([]*permissions.Permission, 0), Keys: make([]*Key, 0)}
+			snap.Users[name] = u
+		}
+		return u
+	}
+	for name, grants := range perms {
+		u := user(name)
+		for _, p := range grants {
+			u.Grants = append(u.Grants, normalizeGrant(p))
+		}
+		sort.Slice(u.Grants, func(i, j int) bool { return u.Grants[i].ID < u.Grants[j].ID })
+	}
+	for name := range admins {
+		user(name).Admin = true
+	}
+	for name := range disabled {
+		user(name).Disabled = true
+	}
+	for name := range breakGlass {
+		user(name).BreakGlass = true
+	}
+	for name, tables := range tableAdmins {
+		u := user(name)
+		u.TableAdmin = append([]string(nil), tables...)
+		sort.Strings(u.TableAdmin)
+	}
+	for _, k := range allKeys {
+		u := user(k.User)
+		u.Keys = append(u.Keys, keyFromAPIKey(k))
+	}
+	for _, u := range snap.Users {
+		sort.Slice(u.Keys, func(i, j int) bool { return u.Keys[i].ID < u.Keys[j].ID })
+	}
+	return snap, nil
+}
+
+// normalizeGrant returns a copy of p with its times in UTC, so grants read from different stores compare equal.
+func normalizeGrant(p *permissions.Permission) *permissions.Permission {
+	c := *p
+	c.NotBefore = utc(p.NotBefore)
+	c.ExpiresAt = utc(p.ExpiresAt)
+	return &c
+}
+
+func utc(t *time.Time) *time.Time {
+	if t == nil {
+		return nil
+	}
+	u := t.UTC()
+	return &u
+}
+
+func keyFromAPIKey(k *keys.APIKey) *Key {
+	return &Key{
+		ID:        k.ID,
+		Hash:      hex.EncodeToString(k.Hash),
+		Label:     k.Label,
+		CreatedAt: k.CreatedAt.UTC(),
+		ExpiresAt: utc(k.ExpiresAt),
+	}
+}
+
+// apiKey returns k as an APIKey of user. k's hash must have been validated.
+func (k *Key) apiKey(user string) *keys.APIKey {
+	hash, _ := hex.DecodeString(k.Hash)
+	return &keys.APIKey{
+		ID:        k.ID,
+		User:      user,
+		Hash:      hash,
+		Label:     k.Label,
+		CreatedAt: k.CreatedAt,
+		ExpiresAt: k.ExpiresAt,
+	}
+}
+
+// Read parses and validates a snapshot. Unknown fields are rejected, so a snapshot from a newer version that forgot to
+// bump FormatVersion is not silently imported in part.
+func Read(r io.Reader) (*Snapshot, error) {
+	raw, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	var header struct {
+		FormatVersion int `json:"format_version"`
+	}
+	if err := json.Unmarshal(raw, &header); err != nil {
+		return nil, fmt.Errorf("%w: %s", InvalidSnapshotError, err)
+	}
+	if header.FormatVersion < 1 || header.FormatVersion > FormatVersion {
+		return nil, fmt.Errorf("%w %d, expected at most %d", UnsupportedVersionError, header.FormatVersion, FormatVersion)
+	}
+
+	snap := &Snapshot{}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(snap); err != nil {
+		return nil, fmt.Errorf("%w: %s", InvalidSnapshotError, err)
+	}
+	if snap.Users == nil {
+		snap.Users = make(map[string]*User)
+	}
+	if err := snap.Validate(); err != nil {
+		return nil, err
+	}
+	return snap, nil
+}
+
+// Write formats the snapshot as indented JSON.
+func (snap *Snapshot) Write(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(snap)
+}
+
+// Validate reports every problem with the snapshot, wrapped in InvalidSnapshotError.
+func (snap *Snapshot) Validate() error {
+	var problems []string
+	problemf := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+	grantIDs := make(map[string]string)
+	keyIDs := make(map[string]string)
+	for _, name := range sortedUsers(snap.Users) {
+		u := snap.Users[name]
+		if name == "" {
+			problemf("user with empty name")
+		}
+		if u == nil {
+			problemf("user %q is empty", name)
+			continue
+		}
+		for i, p := range u.Grants {
+			switch {
+			case p == nil:
+				problemf("user %q grant %d is empty", name, i)
+				continue
+			case p.ID == "":
+				problemf("user %q grant %d has no id", name, i)
+			case grantIDs[p.ID] != "":
+				problemf("grant id %q is used by both %q and %q", p.ID, grantIDs[p.ID], name)
+			}
+			if p.Type != permissions.Read && p.Type != permissions.Write {
+				problemf("user %q grant %q has unknown type %d", name, p.ID, int(p.Type))
+			}
+			if p.Table == "" {
+				problemf("user %q grant %q has no table", name, p.ID)
+			}
+			if p.ID != "" && grantIDs[p.ID] == "" {
+				grantIDs[p.ID] = name
+			}
+		}
+		for i, k := range u.Keys {
+			switch {
+			case k == nil || k.ID == "":
+				problemf("user %q key %d has no id", name, i)
+				continue
+			case keyIDs[k.ID] != "":
+				problemf("key id %q is used by both %q and %q", k.ID, keyIDs[k.ID], name)
+			default:
+				keyIDs[k.ID] = name
+			}
+			if hash, err := hex.DecodeString(k.Hash); err != nil || len(hash) == 0 {
+				problemf("user %q key %q has an invalid hash", name, k.ID)
+			}
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%w: %s", InvalidSnapshotError, strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+func sortedUsers(users map[string]*User) []string {
+	names := make([]string, 0, len(users))
+	for name := range users {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
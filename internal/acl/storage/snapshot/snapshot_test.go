@@ -0,0 +1,238 @@
+package snapshot_test
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"chroma1/internal/acl/storage"
+	"chroma1/internal/acl/storage/file"
+	"chroma1/internal/acl/storage/memory"
+	"chroma1/internal/acl/storage/snapshot"
+	"chroma1/internal/acl/storage/sqlite"
+	"chroma1/internal/acl/storage/storagetest"
+	"chroma1/model/permissions"
+)
+
+// source returns a store holding a bit of everything a snapshot covers.
+func source(t *testing.T) *memory.MemoryACLStorage {
+	ctx := context.Background()
+	s := memory.NewMemoryACLStorage()
+	t.Cleanup(func() { s.Close() })
+	expires := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	assert.NoError(t, s.CreateUser(ctx, "alice", storagetest.NewKey("alice"), true))
+	second := storagetest.NewKey("alice")
+	second.ID, second.Label, second.ExpiresAt = "id-alice-2", "ci", &expires
+	assert.NoError(t, s.StoreKey(ctx, second))
+	assert.NoError(t, s.SetTableAdmin("alice", "accounts", true))
+	assert.NoError(t, s.SetBreakGlass("alice", true))
+	assert.NoError(t, s.StoreUserPerms(ctx, "alice", []*permissions.Permission{
+		{ID: "g1", Type: permissions.Read, Table: "accounts", RowKeys: [][]string{{"1"}, {"2"}}},
+		{ID: "g2", Type: permissions.Write, Table: "accounts", RowKeys: [][]string{}},
+	}))
+
+	assert.NoError(t, s.CreateUser(ctx, "bob", storagetest.NewKey("bob"), false))
+	assert.NoError(t, s.SetUserDisabled(ctx, "bob", true))
+	assert.NoError(t, s.StoreUserPerms(ctx, "bob", []*permissions.Permission{
+		{ID: "g3", Type: permissions.Read, Table: "orders", ExceptKeys: [][]string{{"9"}}, ExpiresAt: &expires, Inherit: true},
+	}))
+
+	// a user without keys
+	assert.NoError(t, s.StoreUserPerms(ctx, "carol", []*permissions.Permission{
+		{ID: "g4", Type: permissions.Read, Table: "orders", Condition: `request.ip == "10.0.0.1"`},
+	}))
+	return s
+}
+
+func export(t *testing.T, s storage.ACLStorage) *snapshot.Snapshot {
+	t.Helper()
+	snap, err := snapshot.Export(context.Background(), s)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	return snap
+}
+
+func diff(t *testing.T, s storage.ACLStorage, snap *snapshot.Snapshot, mode snapshot.Mode) []string {
+	t.Helper()
+	plan, err := snapshot.Diff(context.Background(), s, snap, mode)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	steps := make([]string, 0, len(plan.Steps))
+	for _, st := range plan.Steps {
+		steps = append(steps, st.String())
+	}
+	return steps
+}
+
+func TestMigrate(t *testing.T) {
+	ctx := context.Background()
+	snap := export(t, source(t))
+	assert.Equal(t, snapshot.FormatVersion, snap.FormatVersion)
+	assert.Equal(t, []string{"accounts"}, snap.Users["alice"].TableAdmin)
+	assert.Len(t, snap.Users["alice"].Keys, 2)
+	assert.Empty(t, snap.Users["carol"].Keys)
+
+	var b bytes.Buffer
+	assert.NoError(t, snap.Write(&b))
+	read, err := snapshot.Read(&b)
+	assert.NoError(t, err)
+	assert.Equal(t, snap.Users, read.Users)
+
+	targets := map[string]func(t *testing.T) storage.ACLStorage{
+		"sqlite": func(t *testing.T) storage.ACLStorage {
+			s, err := sqlite.NewSQLiteACLStorage(ctx, filepath.Join(t.TempDir(), "acl.db"))
+			assert.NoError(t, err)
+			return s
+		},
+		"file": func(t *testing.T) storage.ACLStorage {
+			s, err := file.NewFileACLStorage(ctx, filepath.Join(t.TempDir(), "policy.yaml"))
+			assert.NoError(t, err)
+			return s
+		},
+	}
+	for name, open := range targets {
+		t.Run(name, func(t *testing.T) {
+			s := open(t)
+			defer s.Close()
+			assert.Equal(t, []string{
+				"create user alice as admin with key id-alice",
+				"store key id-alice-2 of alice",
+				"set break-glass of alice to true",
+				"set table admin of alice on accounts to true",
+				"store grant g1 of alice: READ on accounts",
+				"store grant g2 of alice: WRITE on accounts",
+				"create user bob with key id-bob",
+				"set disabled of bob to true",
+				"store grant g3 of bob: READ on orders",
+				"create user carol",
+				"store grant g4 of carol: READ on orders",
+			}, diff(t, s, read, snapshot.Replace), "a dry run plans the import")
+			assert.Empty(t, export(t, s).Users, "without changing the store")
+
+			plan, err := snapshot.Import(ctx, s, read, snapshot.Replace)
+			assert.NoError(t, err)
+			assert.Empty(t, plan.Unsupported)
+			assert.Equal(t, snap.Users, export(t, s).Users)
+			assert.Empty(t, diff(t, s, read, snapshot.Replace), "importing again changes nothing")
+		})
+	}
+}
+
+func TestModes(t *testing.T) {
+	ctx := context.Background()
+	snap := export(t, source(t))
+
+	path := filepath.Join(t.TempDir(), "acl.db")
+	s, err := sqlite.NewSQLiteACLStorage(ctx, path)
+	assert.NoError(t, err)
+	defer s.Close()
+	_, err = snapshot.Import(ctx, s, snap, snapshot.Replace)
+	assert.NoError(t, err)
+
+	// drift from the snapshot
+	assert.NoError(t, s.CreateUser(ctx, "dave", storagetest.NewKey("dave"), false))
+	assert.NoError(t, s.UpdateGrants(ctx, "alice", []*permissions.Permission{
+		{ID: "g1", Type: permissions.Read, Table: "accounts", RowKeys: [][]string{{"1"}}},
+		{ID: "g5", Type: permissions.Read, Table: "orders"},
+	}, nil))
+	assert.NoError(t, s.SetUserAdmin(ctx, "alice", false))
+	assert.NoError(t, s.SetTableAdmin(ctx, "bob", "orders", true))
+	assert.NoError(t, s.DeleteKey(ctx, "id-alice-2"))
+
+	assert.Equal(t, []string{
+		"set admin of alice to true",
+		"store grant g1 of alice: READ on accounts",
+		"store key id-alice-2 of alice",
+	}, diff(t, s, snap, snapshot.Merge), "merging keeps what the snapshot does not hold")
+	assert.Equal(t, []string{
+		"remove grant g5 of alice",
+		"set table admin of bob on orders to false",
+		"delete user dave",
+		"set admin of alice to true",
+		"store grant g1 of alice: READ on accounts",
+		"store key id-alice-2 of alice",
+	}, diff(t, s, snap, snapshot.Replace))
+
+	_, err = snapshot.Import(ctx, s, snap, snapshot.Merge)
+	assert.NoError(t, err)
+	merged := export(t, s)
+	assert.Contains(t, merged.Users, "dave")
+	assert.Len(t, merged.Users["alice"].Grants, 3)
+
+	_, err = snapshot.Import(ctx, s, snap, snapshot.Replace)
+	assert.NoError(t, err)
+	assert.Equal(t, snap.Users, export(t, s).Users)
+
+	// a grant moving to another user is a conflict when merging, but not when replacing
+	moved := export(t, s)
+	moved.Users["carol"].Grants = append(moved.Users["bob"].Grants, moved.Users["carol"].Grants...)
+	moved.Users["bob"].Grants = moved.Users["bob"].Grants[:0]
+	_, err = snapshot.Diff(ctx, s, moved, snapshot.Merge)
+	assert.ErrorIs(t, err, snapshot.ConflictError)
+	_, err = snapshot.Import(ctx, s, moved, snapshot.Replace)
+	assert.NoError(t, err)
+	assert.Equal(t, moved.Users, export(t, s).Users)
+}
+
+func TestUnsupportedFlags(t *testing.T) {
+	ctx := context.Background()
+	snap := export(t, source(t))
+
+	// the memory store cannot set table admins or break-glass through a context-taking setter
+	s := memory.NewMemoryACLStorage()
+	defer s.Close()
+	plan, err := snapshot.Import(ctx, s, snap, snapshot.Replace)
+	assert.NoError(t, err)
+	unsupported := make([]string, 0, len(plan.Unsupported))
+	for _, st := range plan.Unsupported {
+		unsupported = append(unsupported, st.String())
+	}
+	assert.Equal(t, []string{
+		"set break-glass of alice to true",
+		"set table admin of alice on accounts to true",
+	}, unsupported)
+	imported := export(t, s)
+	assert.False(t, imported.Users["alice"].BreakGlass)
+	assert.Equal(t, snap.Users["bob"], imported.Users["bob"])
+}
+
+func TestRead(t *testing.T) {
+	_, err := snapshot.Read(strings.NewReader(`{"format_version": 2, "users": {}}`))
+	assert.ErrorIs(t, err, snapshot.UnsupportedVersionError)
+	_, err = snapshot.Read(strings.NewReader(`{"users": {}}`))
+	assert.ErrorIs(t, err, snapshot.UnsupportedVersionError)
+	_, err = snapshot.Read(strings.NewReader(`{"format_version": 1, "users": {}, "roles": {}}`))
+	assert.ErrorIs(t, err, snapshot.InvalidSnapshotError)
+
+	_, err = snapshot.Read(strings.NewReader(`{"format_version": 1, "users": {
+		"alice": {"grants": [{"ID": "g1", "Type": 1, "Table": "t"}], "keys": [{"id": "k1", "hash": "zz"}]},
+		"bob": {"grants": [{"ID": "g1", "Type": 3, "Table": "t"}], "keys": []}
+	}}`))
+	assert.ErrorIs(t, err, snapshot.InvalidSnapshotError)
+	for _, problem := range []string{`user "alice" key "k1" has an invalid hash`, `grant id "g1" is used by both "alice" and "bob"`, `user "bob" grant "g1" has unknown type 3`} {
+		assert.Contains(t, err.Error(), problem)
+	}
+
+	snap, err := snapshot.Read(strings.NewReader(`{"format_version": 1, "users": {"alice": {"admin": true, "grants": [], "keys": []}}}`))
+	assert.NoError(t, err)
+	assert.True(t, snap.Users["alice"].Admin)
+}
+
+func TestPlaintextKeys(t *testing.T) {
+	ctx := context.Background()
+	s := memory.NewMemoryACLStorage()
+	defer s.Close()
+	key := storagetest.NewKey("alice")
+	key.Hash, key.Secret = nil, "id-alice.secret"
+	assert.NoError(t, s.CreateUser(ctx, "alice", key, false))
+	_, err := snapshot.Export(ctx, s)
+	assert.ErrorIs(t, err, snapshot.PlaintextKeyError)
+}
@@ -0,0 +1,103 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"chroma1/internal/acl/storage"
+)
+
+// changedAtFormat matches the fixed-width timestamps the change log triggers write, so that they compare as strings.
+const changedAtFormat = "2006-01-02T15:04:05.000Z"
+
+var changeKinds = map[string]storage.ChangeKind{
+	"grants": storage.GrantsChanged,
+	"user":   storage.UserChanged,
+}
+
+// ChangeVersion returns the version of the latest change, including pruned ones.
+func (s *SQLiteACLStorage) ChangeVersion(ctx context.Context) (uint64, error) {
+	return latestVersion(ctx, s.db)
+}
+
+func latestVersion(ctx context.Context, q queryer) (uint64, error) {
+	var version uint64
+	err := q.QueryRowContext(ctx, "SELECT COALESCE((SELECT seq FROM sqlite_sequence WHERE name = ?), 0)", changesTable).Scan(&version)
+	return version, err
+}
+
+// Watch polls the change log, so it sees changes made by every process sharing the database, including changes made
+// with plain SQL. Several rows written by one operation are passed on as separate changes.
+func (s *SQLiteACLStorage) Watch(ctx context.Context, since uint64, fn func(storage.Change)) error {
+	ticker := time.NewTicker(s.pollInterval)
+	defer ticker.Stop()
+	for {
+		changes, err := s.changesSince(ctx, since)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return fmt.Errorf("error reading changes: %w", err)
+		}
+		for _, c := range changes {
+			fn(c)
+			since = c.Version
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// changesSince returns the changes after version, or an AllChanged change if some of them have been pruned.
+func (s *SQLiteACLStorage) changesSince(ctx context.Context, version uint64) ([]storage.Change, error) {
+	// one snapshot, so that the latest version and the rows agree
+	tx, err := s.db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	latest, err := latestVersion(ctx, tx)
+	if err != nil || latest <= version {
+		return nil, err
+	}
+	rows, err := tx.QueryContext(ctx, fmt.Sprintf("SELECT version, userid, kind FROM %s WHERE version > ? ORDER BY version", changesTable), version)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var changes []storage.Change
+	for rows.Next() {
+		var c storage.Change
+		var kind string
+		if err := rows.Scan(&c.Version, &c.User, &kind); err != nil {
+			return nil, err
+		}
+		if c.Kind = changeKinds[kind]; c.Kind == 0 {
+			return nil, fmt.Errorf("unknown change kind %q at version %d", kind, c.Version)
+		}
+		changes = append(changes, c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(changes) == 0 || changes[0].Version > version+1 {
+		return []storage.Change{{Version: latest, Kind: storage.AllChanged}}, nil
+	}
+	return changes, nil
+}
+
+// PruneChanges deletes the change log entries made before the given time. Watchers that have not yet seen them get an
+// AllChanged change instead.
+func (s *SQLiteACLStorage) PruneChanges(ctx context.Context, before time.Time) (int64, error) {
+	res, err := s.db.ExecContext(ctx, fmt.Sprintf("DELETE FROM %s WHERE changed_at < ?", changesTable), before.UTC().Format(changedAtFormat))
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
@@ -0,0 +1,533 @@
+package sqlite
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"chroma1/internal/acl/storage"
+	"chroma1/model/permissions"
+)
+
+// grantQueries holds the prepared statements loading the grants, row keys and row ranges matching one filter.
+type grantQueries struct {
+	stmts []*sql.Stmt
+}
+
+// grantSelects returns the statements loading grants, their row keys and their row ranges, restricted by filter, a
+// condition on the grants table aliased as g.
+func grantSelects(filter string) []string {
+	return []string{
+		fmt.Sprintf("SELECT g.id, g.userid, g.table_name, g.perm_type, g.all_rows, g.not_before, g.expires_at, g.condition_src, g.inherit, g.grant_option "+
+			"FROM %s g WHERE %s ORDER BY g.rowid", grantsTable, filter),
+		fmt.Sprintf("SELECT k.grant_id, k.is_except, k.key_json FROM %s k JOIN %s g ON g.id = k.grant_id WHERE %s ORDER BY k.grant_id, k.is_except, k.pos",
+			grantKeysTable, grantsTable, filter),
+		fmt.Sprintf("SELECT r.grant_id, r.range_json FROM %s r JOIN %s g ON g.id = r.grant_id WHERE %s ORDER BY r.grant_id, r.pos",
+			grantRangesTable, grantsTable, filter),
+	}
+}
+
+func prepareGrantQueries(ctx context.Context, db *sql.DB, filter string) (*grantQueries, error) {
+	q := &grantQueries{}
+	for _, query := range grantSelects(filter) {
+		stmt, err := db.PrepareContext(ctx, query)
+		if err != nil {
+			q.close()
+			return nil, err
+		}
+		q.stmts = append(q.stmts, stmt)
+	}
+	return q, nil
+}
+
+// load returns the matching grants by user id.
+func (q *grantQueries) load(ctx context.Context, args ...interface{}) (map[string][]*permissions.Permission, error) {
+	return scanGrants(func(i int) (*sql.Rows, error) {
+		return q.stmts[i].QueryContext(ctx, args...)
+	})
+}
+
+func (q *grantQueries) close() {
+	for _, stmt := range q.stmts {
+		stmt.Close()
+	}
+}
+
+// loadGrants returns the grants matching filter by user id, without preparing the statements.
+func loadGrants(ctx context.Context, db queryer, filter string, args ...interface{}) (map[string][]*permissions.Permission, error) {
+	queries := grantSelects(filter)
+	return scanGrants(func(i int) (*sql.Rows, error) {
+		return db.QueryContext(ctx, queries[i], args...)
+	})
+}
+
+// scanGrants reassembles grants from the results of the statements of grantSelects, as returned by query.
+func scanGrants(query func(i int) (*sql.Rows, error)) (map[string][]*permissions.Permission, error) {
+	byUser := make(map[string][]*permissions.Permission)
+	byID := make(map[string]*permissions.Permission)
+	allRows := make(map[string]bool)
+
+	rows, err := query(0)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var p permissions.Permission
+		var user string
+		var all bool
+		var notBefore, expiresAt sql.NullString
+		err := rows.Scan(&p.ID, &user, &p.Table, &p.Type, &all, &notBefore, &expiresAt, &p.Condition, &p.Inherit, &p.GrantOption)
+		if err != nil {
+			return nil, err
+		}
+		if p.NotBefore, err = parseNullTime(notBefore); err != nil {
+			return nil, err
+		}
+		if p.ExpiresAt, err = parseNullTime(expiresAt); err != nil {
+			return nil, err
+		}
+		byUser[user] = append(byUser[user], &p)
+		byID[p.ID] = &p
+		allRows[p.ID] = all
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	rows, err = query(1)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id, jKey string
+		var except bool
+		if err := rows.Scan(&id, &except, &jKey); err != nil {
+			return nil, err
+		}
+		var key []string
+		if err := json.Unmarshal([]byte(jKey), &key); err != nil {
+			return nil, err
+		}
+		if p, ok := byID[id]; ok && except {
+			p.ExceptKeys = append(p.ExceptKeys, key)
+		} else if ok {
+			p.RowKeys = append(p.RowKeys, key)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	rows, err = query(2)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id, jRange string
+		if err := rows.Scan(&id, &jRange); err != nil {
+			return nil, err
+		}
+		var r permissions.KeyRange
+		if err := json.Unmarshal([]byte(jRange), &r); err != nil {
+			return nil, err
+		}
+		if p, ok := byID[id]; ok {
+			p.RowRanges = append(p.RowRanges, r)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// A grant limited to listed rows but without any covers no rows, which must not read back as all rows.
+	for id, p := range byID {
+		if !allRows[id] && p.Blanket() {
+			p.RowKeys = make([][]string, 0)
+		}
+	}
+	return byUser, nil
+}
+
+func (s *SQLiteACLStorage) StoreUserPerms(ctx context.Context, user string, perms []*permissions.Permission) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := ensureUser(ctx, tx, user); err != nil {
+		return err
+	}
+	kept := make([]interface{}, 0, len(perms)+1)
+	kept = append(kept, user)
+	for _, p := range perms {
+		if p.ID == "" {
+			if p.ID, err = newGrantID(); err != nil {
+				return err
+			}
+		}
+		kept = append(kept, p.ID)
+	}
+	// Grants kept by id are rewritten in place, so that only what changed is written.
+	filter := "userid = ?"
+	if len(perms) > 0 {
+		filter += " AND id NOT IN (?" + strings.Repeat(", ?", len(perms)-1) + ")"
+	}
+	if err := deleteGrants(ctx, tx, filter, kept...); err != nil {
+		return err
+	}
+	for _, p := range perms {
+		if err := writeGrant(ctx, tx, user, p); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *SQLiteACLStorage) UpdateGrants(ctx context.Context, user string, store []*permissions.Permission, remove []string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := ensureUser(ctx, tx, user); err != nil {
+		return err
+	}
+	if err := updateGrants(ctx, tx, user, store, remove); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *SQLiteACLStorage) GetUserPermsVersion(ctx context.Context, user string) ([]*permissions.Permission, string, error) {
+	tx, err := s.db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return nil, "", err
+	}
+	defer tx.Rollback()
+
+	perms, exists, err := userGrants(ctx, tx, user)
+	if err != nil {
+		return nil, "", err
+	}
+	if !exists {
+		return nil, "", fmt.Errorf("%w %s", storage.NoSuchUserError, user)
+	}
+	version, err := grantsVersion(ctx, tx, user)
+	if err != nil {
+		return nil, "", err
+	}
+	return perms, version, nil
+}
+
+func (s *SQLiteACLStorage) UpdateGrantsIf(ctx context.Context, user, version string, store []*permissions.Permission, remove []string) (string, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	current, err := grantsVersion(ctx, tx, user)
+	if err != nil {
+		return "", err
+	}
+	if current != version {
+		return "", fmt.Errorf("%w: %s is at version %q, not %q", storage.VersionConflictError, user, current, version)
+	}
+	if err := ensureUser(ctx, tx, user); err != nil {
+		return "", err
+	}
+	if err := updateGrants(ctx, tx, user, store, remove); err != nil {
+		return "", err
+	}
+	newVersion, err := grantsVersion(ctx, tx, user)
+	if err != nil {
+		return "", err
+	}
+	if err := tx.Commit(); err != nil {
+		return "", err
+	}
+	return newVersion, nil
+}
+
+// grantsVersion reads the version of user's grants, which triggers move on with each change to them, or "" if the user
+// does not exist.
+func grantsVersion(ctx context.Context, q queryer, user string) (string, error) {
+	var counter sql.NullInt64
+	err := q.QueryRowContext(ctx, fmt.Sprintf("SELECT v.version FROM %s u LEFT JOIN %s v ON v.userid = u.userid WHERE u.userid = ?",
+		usersTable, grantsVersionTable), user).Scan(&counter)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return storage.GrantsVersion(uint64(counter.Int64)), nil
+}
+
+// updateGrants stores and removes grants as UpdateGrants does, as part of tx.
+func updateGrants(ctx context.Context, tx *sql.Tx, user string, store []*permissions.Permission, remove []string) error {
+	for _, p := range store {
+		if p.ID == "" {
+			return fmt.Errorf("grant on %s for %s has no id", p.Table, user)
+		}
+		if err := writeGrant(ctx, tx, user, p); err != nil {
+			return err
+		}
+	}
+	for _, id := range remove {
+		if err := deleteGrants(ctx, tx, "userid = ? AND id = ?", user, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// userGrants reads user's grants, reporting whether the user exists.
+func userGrants(ctx context.Context, q queryer, user string) ([]*permissions.Permission, bool, error) {
+	var exists int
+	err := q.QueryRowContext(ctx, fmt.Sprintf("SELECT 1 FROM %s WHERE userid = ?", usersTable), user).Scan(&exists)
+	if err == sql.ErrNoRows {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	byUser, err := loadGrants(ctx, q, "g.userid = ?", user)
+	if err != nil {
+		return nil, false, err
+	}
+	if perms, ok := byUser[user]; ok {
+		return perms, true, nil
+	}
+	return make([]*permissions.Permission, 0), true, nil
+}
+
+// ensureUser creates the user row for user if it is missing, so grants can be stored for users created elsewhere.
+func ensureUser(ctx context.Context, e execer, user string) error {
+	_, err := e.ExecContext(ctx, fmt.Sprintf("INSERT OR IGNORE INTO %s (userid) VALUES (?)", usersTable), user)
+	return err
+}
+
+// grantRow is the row of a grant in the grants table, as written.
+type grantRow struct {
+	user, table          string
+	permType             permissions.PermissionType
+	all                  bool
+	notBefore, expiresAt sql.NullString
+	condition            string
+	inherit, grantOption bool
+}
+
+// rowValue is a row key or range of a grant, as stored. Ranges are never excepted.
+type rowValue struct {
+	except bool
+	json   string
+}
+
+// writeGrant inserts p, or replaces the grant with the same id, along with its row keys and ranges. Only what differs
+// from the stored grant is written, so storing an unchanged grant writes nothing and logs no change. Row keys and ranges
+// are sets: those kept keep their place, and those added are stored after them.
+func writeGrant(ctx context.Context, tx *sql.Tx, user string, p *permissions.Permission) error {
+	// Excepting no rows leaves all of them.
+	all := p.Blanket() || (p.HasExceptions() && len(p.ExceptKeys) == 0)
+	want := grantRow{user: user, table: p.Table, permType: p.Type, all: all, notBefore: nullTime(p.NotBefore),
+		expiresAt: nullTime(p.ExpiresAt), condition: p.Condition, inherit: p.Inherit, grantOption: p.GrantOption}
+	var wantKeys, wantRanges []rowValue
+	if !all {
+		keySets := []struct {
+			except bool
+			keys   [][]string
+		}{{false, p.RowKeys}, {true, p.ExceptKeys}}
+		for _, ks := range keySets {
+			for _, k := range ks.keys {
+				jKey, err := json.Marshal(k)
+				if err != nil {
+					return err
+				}
+				wantKeys = append(wantKeys, rowValue{ks.except, string(jKey)})
+			}
+		}
+		for _, r := range p.RowRanges {
+			jRange, err := json.Marshal(r)
+			if err != nil {
+				return err
+			}
+			wantRanges = append(wantRanges, rowValue{false, string(jRange)})
+		}
+	}
+
+	var have grantRow
+	err := tx.QueryRowContext(ctx, fmt.Sprintf("SELECT userid, table_name, perm_type, all_rows, not_before, expires_at, condition_src, inherit, grant_option "+
+		"FROM %s WHERE id = ?", grantsTable), p.ID).Scan(&have.user, &have.table, &have.permType, &have.all, &have.notBefore, &have.expiresAt,
+		&have.condition, &have.inherit, &have.grantOption)
+	exists := err == nil
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	if exists && have.user != user {
+		return fmt.Errorf("grant %s belongs to another user", p.ID)
+	}
+	haveKeys, haveRanges := make(map[rowValue]int), make(map[rowValue]int)
+	if exists {
+		if err := scanRowValues(ctx, tx, fmt.Sprintf("SELECT is_except, key_json, pos FROM %s WHERE grant_id = ?", grantKeysTable), p.ID, haveKeys); err != nil {
+			return err
+		}
+		if err := scanRowValues(ctx, tx, fmt.Sprintf("SELECT 0, range_json, pos FROM %s WHERE grant_id = ?", grantRangesTable), p.ID, haveRanges); err != nil {
+			return err
+		}
+	}
+	addedKeys, removedKeys := diffRowValues(haveKeys, wantKeys)
+	addedRanges, removedRanges := diffRowValues(haveRanges, wantRanges)
+	if exists && have == want && len(addedKeys)+len(removedKeys)+len(addedRanges)+len(removedRanges) == 0 {
+		return nil
+	}
+
+	// The grant's own row is written whenever anything about it changed, as that is what logs the change.
+	_, err = tx.ExecContext(ctx, fmt.Sprintf("INSERT INTO %s (id, userid, table_name, perm_type, all_rows, not_before, expires_at, condition_src, inherit, grant_option) "+
+		"VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?) ON CONFLICT(id) DO UPDATE SET table_name = excluded.table_name, perm_type = excluded.perm_type, "+
+		"all_rows = excluded.all_rows, not_before = excluded.not_before, expires_at = excluded.expires_at, condition_src = excluded.condition_src, "+
+		"inherit = excluded.inherit, grant_option = excluded.grant_option", grantsTable),
+		p.ID, user, p.Table, p.Type, boolToInt(all), want.notBefore, want.expiresAt, p.Condition,
+		boolToInt(p.Inherit), boolToInt(p.GrantOption))
+	if err != nil {
+		return err
+	}
+
+	for _, v := range removedKeys {
+		_, err := tx.ExecContext(ctx, fmt.Sprintf("DELETE FROM %s WHERE grant_id = ? AND is_except = ? AND key_json = ?", grantKeysTable),
+			p.ID, boolToInt(v.except), v.json)
+		if err != nil {
+			return err
+		}
+	}
+	pos := nextPos(haveKeys)
+	for _, v := range addedKeys {
+		_, err := tx.ExecContext(ctx, fmt.Sprintf("INSERT INTO %s (grant_id, is_except, key_json, pos) VALUES (?, ?, ?, ?)", grantKeysTable),
+			p.ID, boolToInt(v.except), v.json, pos)
+		if err != nil {
+			return err
+		}
+		pos++
+	}
+	for _, v := range removedRanges {
+		_, err := tx.ExecContext(ctx, fmt.Sprintf("DELETE FROM %s WHERE grant_id = ? AND range_json = ?", grantRangesTable), p.ID, v.json)
+		if err != nil {
+			return err
+		}
+	}
+	pos = nextPos(haveRanges)
+	for _, v := range addedRanges {
+		_, err := tx.ExecContext(ctx, fmt.Sprintf("INSERT INTO %s (grant_id, range_json, pos) VALUES (?, ?, ?)", grantRangesTable),
+			p.ID, v.json, pos)
+		if err != nil {
+			return err
+		}
+		pos++
+	}
+	return nil
+}
+
+// scanRowValues reads the row keys or ranges returned by query, as (is_except, json, pos) rows, into values by position.
+func scanRowValues(ctx context.Context, q queryer, query, id string, values map[rowValue]int) error {
+	rows, err := q.QueryContext(ctx, query, id)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var v rowValue
+		var pos int
+		if err := rows.Scan(&v.except, &v.json, &pos); err != nil {
+			return err
+		}
+		values[v] = pos
+	}
+	return rows.Err()
+}
+
+// diffRowValues returns the values of want missing from have, in order and without repeats, and those of have missing
+// from want.
+func diffRowValues(have map[rowValue]int, want []rowValue) (added, removed []rowValue) {
+	wanted := make(map[rowValue]bool, len(want))
+	for _, v := range want {
+		if _, ok := have[v]; !ok && !wanted[v] {
+			added = append(added, v)
+		}
+		wanted[v] = true
+	}
+	for v := range have {
+		if !wanted[v] {
+			removed = append(removed, v)
+		}
+	}
+	return added, removed
+}
+
+// nextPos returns the position after the last of values.
+func nextPos(values map[rowValue]int) int {
+	next := 0
+	for _, pos := range values {
+		if pos >= next {
+			next = pos + 1
+		}
+	}
+	return next
+}
+
+// deleteGrants deletes the grants matching filter, a condition on the grants table, with their row keys and ranges.
+func deleteGrants(ctx context.Context, e execer, filter string, args ...interface{}) error {
+	if err := deleteGrantRows(ctx, e, filter, args...); err != nil {
+		return err
+	}
+	_, err := e.ExecContext(ctx, fmt.Sprintf("DELETE FROM %s WHERE %s", grantsTable, filter), args...)
+	return err
+}
+
+// deleteGrantRows deletes the row keys and ranges of the grants matching filter.
+func deleteGrantRows(ctx context.Context, e execer, filter string, args ...interface{}) error {
+	for _, table := range []string{grantKeysTable, grantRangesTable} {
+		_, err := e.ExecContext(ctx, fmt.Sprintf("DELETE FROM %s WHERE grant_id IN (SELECT id FROM %s WHERE %s)", table, grantsTable, filter), args...)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func newGrantID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func nullTime(t *time.Time) sql.NullString {
+	if t == nil {
+		return sql.NullString{}
+	}
+	return sql.NullString{String: formatTime(*t), Valid: true}
+}
+
+func parseNullTime(s sql.NullString) (*time.Time, error) {
+	if !s.Valid {
+		return nil, nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, s.String)
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
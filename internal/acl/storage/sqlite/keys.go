@@ -0,0 +1,89 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"chroma1/model/keys"
+)
+
+// execer is satisfied by both *sql.DB and *sql.Tx.
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// queryer is a *sql.DB or *sql.Tx, for reads that may be part of a transaction.
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+func (s *SQLiteACLStorage) GetAllKeys(ctx context.Context) ([]*keys.APIKey, error) {
+	rows, err := s.db.QueryContext(ctx, fmt.Sprintf("SELECT id, userid, api_key, key_hash, label, created_at, expires_at FROM %s", keyTable))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	res := make([]*keys.APIKey, 0)
+	for rows.Next() {
+		var k keys.APIKey
+		var plaintext *string
+		var createdAt string
+		var expiresAt *string
+		if err := rows.Scan(&k.ID, &k.User, &plaintext, &k.Hash, &k.Label, &createdAt, &expiresAt); err != nil {
+			return nil, err
+		}
+		if plaintext != nil {
+			k.Secret = *plaintext // not yet hashed
+		}
+		if k.CreatedAt, err = time.Parse(time.RFC3339Nano, createdAt); err != nil {
+			return nil, err
+		}
+		if expiresAt != nil {
+			t, err := time.Parse(time.RFC3339Nano, *expiresAt)
+			if err != nil {
+				return nil, err
+			}
+			k.ExpiresAt = &t
+		}
+		res = append(res, &k)
+	}
+	return res, rows.Err()
+}
+
+func (s *SQLiteACLStorage) StoreKey(ctx context.Context, key *keys.APIKey) error {
+	return insertKey(ctx, s.db, key)
+}
+
+func (s *SQLiteACLStorage) SetKeyHash(ctx context.Context, id string, hash []byte) error {
+	_, err := s.db.ExecContext(ctx, fmt.Sprintf("UPDATE %s SET key_hash = ?, api_key = NULL WHERE id = ?", keyTable), hash, id)
+	return err
+}
+
+func (s *SQLiteACLStorage) SetKeyExpiry(ctx context.Context, id string, expiresAt time.Time) error {
+	_, err := s.db.ExecContext(ctx, fmt.Sprintf("UPDATE %s SET expires_at = ? WHERE id = ?", keyTable), formatTime(expiresAt), id)
+	return err
+}
+
+func (s *SQLiteACLStorage) DeleteKey(ctx context.Context, id string) error {
+	_, err := s.db.ExecContext(ctx, fmt.Sprintf("DELETE FROM %s WHERE id = ?", keyTable), id)
+	return err
+}
+
+func insertKey(ctx context.Context, e execer, key *keys.APIKey) error {
+	var expiresAt *string
+	if key.ExpiresAt != nil {
+		t := formatTime(*key.ExpiresAt)
+		expiresAt = &t
+	}
+	_, err := e.ExecContext(ctx, fmt.Sprintf("INSERT INTO %s (id, userid, key_hash, label, created_at, expires_at) VALUES (?, ?, ?, ?, ?, ?)", keyTable),
+		key.ID, key.User, key.Hash, key.Label, formatTime(key.CreatedAt), expiresAt)
+	return err
+}
+
+func formatTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339Nano)
+}
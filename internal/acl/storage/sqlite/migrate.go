@@ -0,0 +1,312 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	NewerSchemaError     = fmt.Errorf("ACL store schema is newer than this version supports")
+	NoSuchMigrationError = fmt.Errorf("no such migration")
+)
+
+// Migrations are named <version>_<name>.up.sql and <version>_<name>.down.sql, with versions numbered from 1 without
+// gaps. Append only: released migrations must not change.
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// migration upgrades the schema from version-1 to version, or downgrades it back.
+type migration struct {
+	version int
+	name    string
+	up      string
+	down    string
+	// optionally run before up, in the same transaction
+	before func(ctx context.Context, tx *sql.Tx) error
+}
+
+var migrations = mustLoadMigrations()
+
+// beforeMigration holds the steps that cannot be expressed in SQL, by version.
+var beforeMigration = map[int]func(ctx context.Context, tx *sql.Tx) error{
+	1: adoptUnversioned,
+}
+
+func mustLoadMigrations() []migration {
+	ms, err := loadMigrations()
+	if err != nil {
+		panic(err)
+	}
+	return ms
+}
+
+func loadMigrations() ([]migration, error) {
+	entries, err := migrationFiles.ReadDir("migrations")
+	if err != nil {
+		return nil, err
+	}
+	byVersion := make(map[int]*migration)
+	for _, e := range entries {
+		base := strings.TrimSuffix(e.Name(), ".sql")
+		direction := path.Ext(base)
+		prefix, name, ok := strings.Cut(strings.TrimSuffix(base, direction), "_")
+		version, err := strconv.Atoi(prefix)
+		if !ok || err != nil || (direction != ".up" && direction != ".down") {
+			return nil, fmt.Errorf("malformed migration file name %s", e.Name())
+		}
+		content, err := migrationFiles.ReadFile("migrations/" + e.Name())
+		if err != nil {
+			return nil, err
+		}
+		m, ok := byVersion[version]
+		if !ok {
+			m = &migration{version: version, name: strings.ReplaceAll(name, "_", " "), before: beforeMigration[version]}
+			byVersion[version] = m
+		}
+		if direction == ".up" {
+			m.up = string(content)
+		} else {
+			m.down = string(content)
+		}
+	}
+
+	ms := make([]migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		ms = append(ms, *m)
+	}
+	sort.Slice(ms, func(i, j int) bool {
+		return ms[i].version < ms[j].version
+	})
+	for i, m := range ms {
+		if m.version != i+1 {
+			return nil, fmt.Errorf("missing migration %d", i+1)
+		}
+		if m.up == "" || m.down == "" {
+			return nil, fmt.Errorf("migration %d needs both an up and a down file", m.version)
+		}
+	}
+	return ms, nil
+}
+
+// LatestSchemaVersion is the schema version this package reads and writes.
+func LatestSchemaVersion() int {
+	return len(migrations)
+}
+
+// MigrationStatus describes one migration, known to this package or recorded as applied to the store.
+type MigrationStatus struct {
+	Version int    `json:"version"`
+	Name    string `json:"name"`
+	// nil if the migration has not been applied
+	AppliedAt *time.Time `json:"applied_at,omitempty"`
+	// set for applied migrations from a newer version of this package
+	Unknown bool `json:"unknown,omitempty"`
+}
+
+// Migrator applies and reverts schema migrations on a SQLite ACL store.
+type Migrator struct {
+	db *sql.DB
+}
+
+// NewMigrator opens the ACL store at connectionStr without migrating it.
+func NewMigrator(ctx context.Context, connectionStr string) (*Migrator, error) {
+	db, err := sql.Open("sqlite3", connectionStr)
+	if err != nil {
+		return nil, err
+	}
+	m := &Migrator{db: db}
+	if err := m.init(ctx); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *Migrator) init(ctx context.Context) error {
+	_, err := m.db.ExecContext(ctx, fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (version INTEGER PRIMARY KEY, name TEXT NOT NULL, applied_at TEXT NOT NULL)", versionTable))
+	return err
+}
+
+func (m *Migrator) Close() error {
+	return m.db.Close()
+}
+
+// Version returns the version of the latest applied migration, or 0 if none was.
+func (m *Migrator) Version(ctx context.Context) (int, error) {
+	var v sql.NullInt64
+	if err := m.db.QueryRowContext(ctx, fmt.Sprintf("SELECT MAX(version) FROM %s", versionTable)).Scan(&v); err != nil {
+		return 0, err
+	}
+	return int(v.Int64), nil
+}
+
+// Status lists the known migrations and any applied ones this package does not know, by version.
+func (m *Migrator) Status(ctx context.Context) ([]*MigrationStatus, error) {
+	statuses := make([]*MigrationStatus, 0, len(migrations))
+	for _, mig := range migrations {
+		statuses = append(statuses, &MigrationStatus{Version: mig.version, Name: mig.name})
+	}
+
+	rows, err := m.db.QueryContext(ctx, fmt.Sprintf("SELECT version, name, applied_at FROM %s ORDER BY version", versionTable))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var version int
+		var name, appliedAt string
+		if err := rows.Scan(&version, &name, &appliedAt); err != nil {
+			return nil, err
+		}
+		t, err := time.Parse(time.RFC3339Nano, appliedAt)
+		if err != nil {
+			return nil, err
+		}
+		if version <= len(migrations) {
+			statuses[version-1].AppliedAt = &t
+		} else {
+			statuses = append(statuses, &MigrationStatus{Version: version, Name: name, AppliedAt: &t, Unknown: true})
+		}
+	}
+	return statuses, rows.Err()
+}
+
+// Up applies the pending migrations up to and including target, or all of them if target is 0. It fails with
+// NewerSchemaError if the store has a migration this package does not know.
+func (m *Migrator) Up(ctx context.Context, target int) error {
+	if target == 0 {
+		target = len(migrations)
+	}
+	if target < 0 || target > len(migrations) {
+		return fmt.Errorf("%w %d", NoSuchMigrationError, target)
+	}
+	current, err := m.Version(ctx)
+	if err != nil {
+		return err
+	}
+	if current > len(migrations) {
+		return fmt.Errorf("%w: store is at version %d, latest known is %d", NewerSchemaError, current, len(migrations))
+	}
+	if target <= current {
+		return nil
+	}
+	for _, mig := range migrations[current:target] {
+		if err := m.apply(ctx, mig, true); err != nil {
+			return fmt.Errorf("error applying migration %d (%s): %w", mig.version, mig.name, err)
+		}
+	}
+	return nil
+}
+
+// Down reverts the applied migrations after target, latest first, leaving the store at version target.
+func (m *Migrator) Down(ctx context.Context, target int) error {
+	current, err := m.Version(ctx)
+	if err != nil {
+		return err
+	}
+	if current > len(migrations) {
+		return fmt.Errorf("%w: store is at version %d, latest known is %d", NewerSchemaError, current, len(migrations))
+	}
+	if target < 0 || target > current {
+		return fmt.Errorf("%w %d", NoSuchMigrationError, target)
+	}
+	for i := current - 1; i >= target; i-- {
+		mig := migrations[i]
+		if err := m.apply(ctx, mig, false); err != nil {
+			return fmt.Errorf("error reverting migration %d (%s): %w", mig.version, mig.name, err)
+		}
+	}
+	return nil
+}
+
+// apply runs mig's up or down script and records the new version, in one transaction.
+func (m *Migrator) apply(ctx context.Context, mig migration, up bool) error {
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if up {
+		if mig.before != nil {
+			if err := mig.before(ctx, tx); err != nil {
+				return err
+			}
+		}
+		if _, err := tx.ExecContext(ctx, mig.up); err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, fmt.Sprintf("INSERT INTO %s (version, name, applied_at) VALUES (?, ?, ?)", versionTable),
+			mig.version, mig.name, formatTime(time.Now()))
+	} else {
+		if _, err := tx.ExecContext(ctx, mig.down); err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, fmt.Sprintf("DELETE FROM %s WHERE version = ?", versionTable), mig.version)
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// adoptUnversioned adds the columns that databases created before schema versioning may lack to their tables, so the
+// initial migration can treat them like its own. Tables that do not exist yet are left to the migration.
+func adoptUnversioned(ctx context.Context, tx *sql.Tx) error {
+	columns := []struct{ table, column, definition string }{
+		{legacyACLTable, "can_break_glass", "INTEGER NOT NULL DEFAULT 0"},
+		{legacyACLTable, "admin_tables_json", "STRING"},
+		{legacyACLTable, "disabled", "INTEGER NOT NULL DEFAULT 0"},
+		{keyTable, "key_hash", "BLOB"},
+	}
+	for _, c := range columns {
+		if err := addColumnIfMissing(ctx, tx, c.table, c.column, c.definition); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addColumnIfMissing adds column to table if the table exists without it.
+func addColumnIfMissing(ctx context.Context, tx *sql.Tx, table, column, definition string) error {
+	rows, err := tx.QueryContext(ctx, fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var cid int
+	var name string
+	var ttype string
+	var notnull int
+	var dflt_value *string
+	var pk int
+	exists := false
+	for rows.Next() {
+		if err := rows.Scan(&cid, &name, &ttype, &notnull, &dflt_value, &pk); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+		exists = true
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+	if !exists {
+		return nil
+	}
+
+	_, err = tx.ExecContext(ctx, fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	return err
+}
@@ -0,0 +1,138 @@
+package sqlite_test
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"chroma1/internal/acl/storage/sqlite"
+	"chroma1/internal/acl/storage/storagetest"
+	"chroma1/model/permissions"
+)
+
+func TestMigrateDownAndUp(t *testing.T) {
+	ctx := context.Background()
+	s, path := newStorage(t)
+	expires := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	perms := []*permissions.Permission{
+		{Type: permissions.Read, Table: "t1"},
+		{Type: permissions.Write, Table: "t1", RowKeys: [][]string{{"1"}, {"2"}}, ExpiresAt: &expires, GrantOption: true},
+		{Type: permissions.Read, Table: "t2", ExceptKeys: [][]string{{"7"}}, Condition: `claims.team == "x"`},
+		{Type: permissions.Read, Table: "t3", RowRanges: []permissions.KeyRange{{Start: []string{"5"}}}},
+		{Type: permissions.Write, Table: "t3", RowKeys: [][]string{}},
+	}
+	assert.NoError(t, s.CreateUser(ctx, "alice", storagetest.NewKey("alice"), true))
+	assert.NoError(t, s.StoreUserPerms(ctx, "alice", perms))
+	assert.NoError(t, s.Close())
+
+	m, err := sqlite.NewMigrator(ctx, path)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer m.Close()
+	for target := sqlite.LatestSchemaVersion() - 1; target >= 1; target-- {
+		assert.NoError(t, m.Down(ctx, target))
+		v, err := m.Version(ctx)
+		assert.NoError(t, err)
+		assert.Equal(t, target, v)
+	}
+	assert.NoError(t, m.Up(ctx, 0))
+	v, err := m.Version(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, sqlite.LatestSchemaVersion(), v)
+
+	s, err = sqlite.NewSQLiteACLStorage(ctx, path)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer s.Close()
+	got, err := s.GetUserPerms(ctx, "alice")
+	assert.NoError(t, err)
+	assert.Equal(t, perms, got)
+	_, admins, err := s.GetAllUserInfo(ctx)
+	assert.NoError(t, err)
+	assert.Contains(t, admins, "alice")
+
+	// reverting everything leaves only the version table
+	assert.NoError(t, m.Down(ctx, 0))
+	status, err := m.Status(ctx)
+	assert.NoError(t, err)
+	for _, st := range status {
+		assert.Nil(t, st.AppliedAt)
+	}
+}
+
+func TestMigrateTargets(t *testing.T) {
+	testcases := []struct {
+		up, down int
+		fails    bool
+	}{
+		{up: 1, down: 0},
+		{up: 1, down: 1},
+		{up: sqlite.LatestSchemaVersion(), down: 1},
+		{up: sqlite.LatestSchemaVersion() + 1, fails: true},
+		{up: -1, fails: true},
+		{up: 1, down: 2, fails: true},
+	}
+	ctx := context.Background()
+	for i, tc := range testcases {
+		t.Run(fmt.Sprintf("TestMigrateTargets case %v", i), func(t *testing.T) {
+			m, err := sqlite.NewMigrator(ctx, filepath.Join(t.TempDir(), "acl.db"))
+			if !assert.NoError(t, err) {
+				t.FailNow()
+			}
+			defer m.Close()
+			err = m.Up(ctx, tc.up)
+			if err == nil {
+				err = m.Down(ctx, tc.down)
+			}
+			if tc.fails {
+				assert.ErrorIs(t, err, sqlite.NoSuchMigrationError)
+				return
+			}
+			assert.NoError(t, err)
+			v, err := m.Version(ctx)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.down, v)
+		})
+	}
+}
+
+func TestNewerSchema(t *testing.T) {
+	ctx := context.Background()
+	_, path := newStorage(t)
+	db, err := sql.Open("sqlite3", path)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	_, err = db.Exec("INSERT INTO ACL_SCHEMA_VERSION (version, name, applied_at) VALUES (?, 'from the future', ?)",
+		sqlite.LatestSchemaVersion()+1, time.Now().UTC().Format(time.RFC3339Nano))
+	assert.NoError(t, err)
+	assert.NoError(t, db.Close())
+
+	_, err = sqlite.NewSQLiteACLStorage(ctx, path)
+	assert.ErrorIs(t, err, sqlite.NewerSchemaError)
+
+	m, err := sqlite.NewMigrator(ctx, path)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer m.Close()
+	assert.ErrorIs(t, m.Up(ctx, 0), sqlite.NewerSchemaError)
+	assert.ErrorIs(t, m.Down(ctx, 1), sqlite.NewerSchemaError)
+	status, err := m.Status(ctx)
+	assert.NoError(t, err)
+	if assert.Len(t, status, sqlite.LatestSchemaVersion()+1) {
+		last := status[len(status)-1]
+		assert.True(t, last.Unknown)
+		assert.Equal(t, "from the future", last.Name)
+		for _, st := range status {
+			assert.NotNil(t, st.AppliedAt)
+		}
+	}
+}
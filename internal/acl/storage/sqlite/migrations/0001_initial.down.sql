@@ -0,0 +1,4 @@
+DROP TABLE ACLS;
+DROP TABLE ACL_ELEVATIONS;
+DROP TABLE ACL_ELEVATED_QUERIES;
+DROP TABLE ACL_KEYS;
@@ -0,0 +1,23 @@
+-- The original schema, with permissions stored as a JSON blob per user. Databases created before schema versioning
+-- already have some of it; missing columns are added to their tables before this runs.
+CREATE TABLE IF NOT EXISTS ACLS (
+    userid STRING PRIMARY KEY,
+    api_key STRING,
+    is_admin INTEGER,
+    permissions_json STRING,
+    can_break_glass INTEGER NOT NULL DEFAULT 0,
+    admin_tables_json STRING,
+    disabled INTEGER NOT NULL DEFAULT 0
+);
+CREATE TABLE IF NOT EXISTS ACL_ELEVATIONS (id STRING PRIMARY KEY, userid STRING, reason STRING, started_at STRING, expires_at STRING);
+CREATE TABLE IF NOT EXISTS ACL_ELEVATED_QUERIES (elevation_id STRING, sql STRING, executed_at STRING);
+-- api_key only holds legacy plaintext keys awaiting hashing.
+CREATE TABLE IF NOT EXISTS ACL_KEYS (id STRING PRIMARY KEY, userid STRING, api_key STRING UNIQUE, label STRING, created_at STRING, expires_at STRING, key_hash BLOB);
+
+-- Copy the single per-user api_key into the key table, for databases created before multiple keys were supported. The
+-- legacy key keeps working and can be rotated like any other. It is copied in plaintext; the ACLManager hashes it via
+-- SetKeyHash on startup.
+INSERT INTO ACL_KEYS (id, userid, api_key, label, created_at)
+    SELECT 'legacy-' || userid, userid, api_key, 'legacy', strftime('%Y-%m-%dT%H:%M:%fZ', 'now') FROM ACLS
+    WHERE api_key IS NOT NULL AND 'legacy-' || userid NOT IN (SELECT id FROM ACL_KEYS);
+UPDATE ACLS SET api_key = NULL;
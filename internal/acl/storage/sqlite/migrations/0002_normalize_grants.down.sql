@@ -0,0 +1,59 @@
+-- Fold users and grants back into one JSON blob per user. Grant ids are kept in the blobs. The key and elevation tables
+-- keep their TEXT columns, which the blob-era code reads unchanged.
+
+CREATE TABLE ACLS (
+    userid STRING PRIMARY KEY,
+    api_key STRING,
+    is_admin INTEGER,
+    permissions_json STRING,
+    can_break_glass INTEGER NOT NULL DEFAULT 0,
+    admin_tables_json STRING,
+    disabled INTEGER NOT NULL DEFAULT 0
+);
+
+CREATE TEMPORARY TABLE FOLDED_GRANTS AS
+    SELECT g.rowid AS grant_order, g.userid AS userid, json_object(
+        'ID', g.id,
+        'Type', g.perm_type,
+        'Table', g.table_name,
+        'RowKeys', CASE
+            WHEN g.all_rows OR EXISTS (SELECT 1 FROM ACL_GRANT_ROW_KEYS WHERE grant_id = g.id AND is_except = 1) THEN NULL
+            WHEN NOT EXISTS (SELECT 1 FROM ACL_GRANT_ROW_KEYS WHERE grant_id = g.id AND is_except = 0)
+                AND EXISTS (SELECT 1 FROM ACL_GRANT_ROW_RANGES WHERE grant_id = g.id) THEN NULL
+            ELSE (SELECT json_group_array(json(key_json)) FROM
+                (SELECT key_json FROM ACL_GRANT_ROW_KEYS WHERE grant_id = g.id AND is_except = 0 ORDER BY pos))
+            END,
+        'RowRanges', CASE WHEN EXISTS (SELECT 1 FROM ACL_GRANT_ROW_RANGES WHERE grant_id = g.id)
+            THEN (SELECT json_group_array(json(range_json)) FROM
+                (SELECT range_json FROM ACL_GRANT_ROW_RANGES WHERE grant_id = g.id ORDER BY pos))
+            END,
+        'ExceptKeys', CASE WHEN EXISTS (SELECT 1 FROM ACL_GRANT_ROW_KEYS WHERE grant_id = g.id AND is_except = 1)
+            THEN (SELECT json_group_array(json(key_json)) FROM
+                (SELECT key_json FROM ACL_GRANT_ROW_KEYS WHERE grant_id = g.id AND is_except = 1 ORDER BY pos))
+            END,
+        'NotBefore', g.not_before,
+        'ExpiresAt', g.expires_at,
+        'Condition', g.condition_src,
+        'Inherit', json(CASE WHEN g.inherit THEN 'true' ELSE 'false' END),
+        'GrantOption', json(CASE WHEN g.grant_option THEN 'true' ELSE 'false' END)
+    ) AS grant_json
+    FROM ACL_GRANTS g;
+
+INSERT INTO ACLS (userid, is_admin, permissions_json, can_break_glass, admin_tables_json, disabled)
+    SELECT u.userid, u.is_admin,
+        (SELECT json_group_array(json(grant_json)) FROM
+            (SELECT grant_json FROM FOLDED_GRANTS WHERE userid = u.userid ORDER BY grant_order)),
+        u.can_break_glass,
+        (SELECT json_group_array(table_name) FROM
+            (SELECT table_name FROM ACL_TABLE_ADMINS WHERE userid = u.userid ORDER BY table_name)),
+        u.disabled
+    FROM ACL_USERS u;
+
+DROP TABLE FOLDED_GRANTS;
+DROP TABLE ACL_GRANT_ROW_RANGES;
+DROP TABLE ACL_GRANT_ROW_KEYS;
+DROP TABLE ACL_GRANTS;
+DROP TABLE ACL_TABLE_ADMINS;
+DROP TABLE ACL_USERS;
+DROP INDEX ACL_KEYS_USER;
+DROP INDEX ACL_ELEVATED_QUERIES_ELEVATION;
@@ -0,0 +1,89 @@
+-- Move users and their grants out of the per-user JSON blobs into one row per user, grant, row key and key range.
+-- Grants keep the id stored in the blob, if any, and are otherwise given one derived from their user and position.
+
+CREATE TABLE ACL_USERS (
+    userid TEXT PRIMARY KEY,
+    is_admin INTEGER NOT NULL DEFAULT 0,
+    disabled INTEGER NOT NULL DEFAULT 0,
+    can_break_glass INTEGER NOT NULL DEFAULT 0
+);
+INSERT INTO ACL_USERS (userid, is_admin, disabled, can_break_glass)
+    SELECT userid, COALESCE(is_admin, 0), COALESCE(disabled, 0), COALESCE(can_break_glass, 0) FROM ACLS;
+
+CREATE TABLE ACL_TABLE_ADMINS (userid TEXT NOT NULL, table_name TEXT NOT NULL, PRIMARY KEY (userid, table_name));
+INSERT OR IGNORE INTO ACL_TABLE_ADMINS (userid, table_name)
+    SELECT a.userid, t.value FROM ACLS a, json_each(a.admin_tables_json) t;
+
+-- Grants on all rows have all_rows set and no row keys or ranges; grants on all rows but some have except row keys.
+CREATE TABLE ACL_GRANTS (
+    id TEXT PRIMARY KEY,
+    userid TEXT NOT NULL,
+    table_name TEXT NOT NULL,
+    perm_type INTEGER NOT NULL,
+    all_rows INTEGER NOT NULL,
+    not_before TEXT,
+    expires_at TEXT,
+    condition_src TEXT NOT NULL DEFAULT '',
+    inherit INTEGER NOT NULL DEFAULT 0,
+    grant_option INTEGER NOT NULL DEFAULT 0
+);
+CREATE INDEX ACL_GRANTS_USER ON ACL_GRANTS (userid);
+CREATE INDEX ACL_GRANTS_TABLE ON ACL_GRANTS (table_name, perm_type);
+
+CREATE TEMPORARY TABLE MIGRATED_GRANTS AS
+    SELECT COALESCE(json_extract(p.value, '$.ID'), 'migrated-' || lower(hex(a.userid)) || '-' || p.key) AS id,
+        a.userid AS userid, p.value AS grant_json
+    FROM ACLS a, json_each(a.permissions_json) p;
+
+INSERT INTO ACL_GRANTS (id, userid, table_name, perm_type, all_rows, not_before, expires_at, condition_src, inherit, grant_option)
+    SELECT id, userid, json_extract(grant_json, '$.Table'), json_extract(grant_json, '$.Type'),
+        json_type(grant_json, '$.RowKeys') IS NOT 'array' AND json_type(grant_json, '$.RowRanges') IS NOT 'array'
+            AND COALESCE(json_array_length(grant_json, '$.ExceptKeys'), 0) = 0,
+        json_extract(grant_json, '$.NotBefore'), json_extract(grant_json, '$.ExpiresAt'),
+        COALESCE(json_extract(grant_json, '$.Condition'), ''),
+        COALESCE(json_extract(grant_json, '$.Inherit'), 0), COALESCE(json_extract(grant_json, '$.GrantOption'), 0)
+    FROM MIGRATED_GRANTS;
+
+CREATE TABLE ACL_GRANT_ROW_KEYS (
+    grant_id TEXT NOT NULL,
+    is_except INTEGER NOT NULL,
+    pos INTEGER NOT NULL,
+    key_json TEXT NOT NULL,
+    PRIMARY KEY (grant_id, is_except, pos)
+);
+INSERT INTO ACL_GRANT_ROW_KEYS (grant_id, is_except, pos, key_json)
+    SELECT g.id, 0, k.key, k.value FROM MIGRATED_GRANTS g, json_each(g.grant_json, '$.RowKeys') k
+    WHERE json_type(g.grant_json, '$.RowKeys') = 'array';
+INSERT INTO ACL_GRANT_ROW_KEYS (grant_id, is_except, pos, key_json)
+    SELECT g.id, 1, k.key, k.value FROM MIGRATED_GRANTS g, json_each(g.grant_json, '$.ExceptKeys') k
+    WHERE json_type(g.grant_json, '$.ExceptKeys') = 'array';
+
+CREATE TABLE ACL_GRANT_ROW_RANGES (grant_id TEXT NOT NULL, pos INTEGER NOT NULL, range_json TEXT NOT NULL, PRIMARY KEY (grant_id, pos));
+INSERT INTO ACL_GRANT_ROW_RANGES (grant_id, pos, range_json)
+    SELECT g.id, r.key, r.value FROM MIGRATED_GRANTS g, json_each(g.grant_json, '$.RowRanges') r
+    WHERE json_type(g.grant_json, '$.RowRanges') = 'array';
+
+DROP TABLE MIGRATED_GRANTS;
+DROP TABLE ACLS;
+
+-- The remaining tables were declared with STRING columns, which SQLite gives numeric affinity, turning ids such as
+-- "007" into numbers. Rebuild them with TEXT columns.
+CREATE TABLE ACL_KEYS_NEW (id TEXT PRIMARY KEY, userid TEXT NOT NULL, api_key TEXT UNIQUE, key_hash BLOB, label TEXT, created_at TEXT, expires_at TEXT);
+INSERT INTO ACL_KEYS_NEW (id, userid, api_key, key_hash, label, created_at, expires_at)
+    SELECT id, userid, api_key, key_hash, label, created_at, expires_at FROM ACL_KEYS;
+DROP TABLE ACL_KEYS;
+ALTER TABLE ACL_KEYS_NEW RENAME TO ACL_KEYS;
+CREATE INDEX ACL_KEYS_USER ON ACL_KEYS (userid);
+
+CREATE TABLE ACL_ELEVATIONS_NEW (id TEXT PRIMARY KEY, userid TEXT NOT NULL, reason TEXT, started_at TEXT, expires_at TEXT);
+INSERT INTO ACL_ELEVATIONS_NEW (id, userid, reason, started_at, expires_at)
+    SELECT id, userid, reason, started_at, expires_at FROM ACL_ELEVATIONS;
+DROP TABLE ACL_ELEVATIONS;
+ALTER TABLE ACL_ELEVATIONS_NEW RENAME TO ACL_ELEVATIONS;
+
+CREATE TABLE ACL_ELEVATED_QUERIES_NEW (elevation_id TEXT NOT NULL, sql TEXT, executed_at TEXT);
+INSERT INTO ACL_ELEVATED_QUERIES_NEW (elevation_id, sql, executed_at)
+    SELECT elevation_id, sql, executed_at FROM ACL_ELEVATED_QUERIES;
+DROP TABLE ACL_ELEVATED_QUERIES;
+ALTER TABLE ACL_ELEVATED_QUERIES_NEW RENAME TO ACL_ELEVATED_QUERIES;
+CREATE INDEX ACL_ELEVATED_QUERIES_ELEVATION ON ACL_ELEVATED_QUERIES (elevation_id);
@@ -0,0 +1,12 @@
+DROP TRIGGER ACL_GRANTS_INSERT_LOG;
+DROP TRIGGER ACL_GRANTS_UPDATE_LOG;
+DROP TRIGGER ACL_GRANTS_DELETE_LOG;
+DROP TRIGGER ACL_USERS_INSERT_LOG;
+DROP TRIGGER ACL_USERS_UPDATE_LOG;
+DROP TRIGGER ACL_USERS_DELETE_LOG;
+DROP TRIGGER ACL_TABLE_ADMINS_INSERT_LOG;
+DROP TRIGGER ACL_TABLE_ADMINS_DELETE_LOG;
+DROP TRIGGER ACL_KEYS_INSERT_LOG;
+DROP TRIGGER ACL_KEYS_UPDATE_LOG;
+DROP TRIGGER ACL_KEYS_DELETE_LOG;
+DROP TABLE ACL_CHANGES;
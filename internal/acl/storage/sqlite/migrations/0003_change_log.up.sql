@@ -0,0 +1,49 @@
+-- Log every change to a user's ACLs, so that other processes sharing the store can follow them. Triggers write the log,
+-- so changes made with plain SQL are logged too. Grant row keys and ranges are only ever written along with their
+-- grant's row, which logs the change.
+-- AUTOINCREMENT keeps versions increasing even after the log is pruned.
+CREATE TABLE ACL_CHANGES (
+    version INTEGER PRIMARY KEY AUTOINCREMENT,
+    userid TEXT NOT NULL,
+    kind TEXT NOT NULL, -- 'grants' or 'user'
+    changed_at TEXT NOT NULL DEFAULT (strftime('%Y-%m-%dT%H:%M:%fZ', 'now'))
+);
+CREATE INDEX ACL_CHANGES_TIME ON ACL_CHANGES (changed_at);
+
+CREATE TRIGGER ACL_GRANTS_INSERT_LOG AFTER INSERT ON ACL_GRANTS BEGIN
+    INSERT INTO ACL_CHANGES (userid, kind) VALUES (NEW.userid, 'grants');
+END;
+CREATE TRIGGER ACL_GRANTS_UPDATE_LOG AFTER UPDATE ON ACL_GRANTS BEGIN
+    INSERT INTO ACL_CHANGES (userid, kind) VALUES (NEW.userid, 'grants');
+END;
+CREATE TRIGGER ACL_GRANTS_DELETE_LOG AFTER DELETE ON ACL_GRANTS BEGIN
+    INSERT INTO ACL_CHANGES (userid, kind) VALUES (OLD.userid, 'grants');
+END;
+
+CREATE TRIGGER ACL_USERS_INSERT_LOG AFTER INSERT ON ACL_USERS BEGIN
+    INSERT INTO ACL_CHANGES (userid, kind) VALUES (NEW.userid, 'user');
+END;
+CREATE TRIGGER ACL_USERS_UPDATE_LOG AFTER UPDATE ON ACL_USERS BEGIN
+    INSERT INTO ACL_CHANGES (userid, kind) VALUES (NEW.userid, 'user');
+END;
+CREATE TRIGGER ACL_USERS_DELETE_LOG AFTER DELETE ON ACL_USERS BEGIN
+    INSERT INTO ACL_CHANGES (userid, kind) VALUES (OLD.userid, 'user');
+END;
+
+CREATE TRIGGER ACL_TABLE_ADMINS_INSERT_LOG AFTER INSERT ON ACL_TABLE_ADMINS BEGIN
+    INSERT INTO ACL_CHANGES (userid, kind) VALUES (NEW.userid, 'user');
+END;
+CREATE TRIGGER ACL_TABLE_ADMINS_DELETE_LOG AFTER DELETE ON ACL_TABLE_ADMINS BEGIN
+    INSERT INTO ACL_CHANGES (userid, kind) VALUES (OLD.userid, 'user');
+END;
+
+-- keys from before schema versioning may lack a user
+CREATE TRIGGER ACL_KEYS_INSERT_LOG AFTER INSERT ON ACL_KEYS BEGIN
+    INSERT INTO ACL_CHANGES (userid, kind) VALUES (COALESCE(NEW.userid, ''), 'user');
+END;
+CREATE TRIGGER ACL_KEYS_UPDATE_LOG AFTER UPDATE ON ACL_KEYS BEGIN
+    INSERT INTO ACL_CHANGES (userid, kind) VALUES (COALESCE(NEW.userid, ''), 'user');
+END;
+CREATE TRIGGER ACL_KEYS_DELETE_LOG AFTER DELETE ON ACL_KEYS BEGIN
+    INSERT INTO ACL_CHANGES (userid, kind) VALUES (COALESCE(OLD.userid, ''), 'user');
+END;
@@ -0,0 +1,5 @@
+DROP TRIGGER ACL_GRANTS_INSERT_VERSION;
+DROP TRIGGER ACL_GRANTS_UPDATE_VERSION;
+DROP TRIGGER ACL_GRANTS_DELETE_VERSION;
+DROP TRIGGER ACL_USERS_DELETE_VERSION;
+DROP TABLE ACL_GRANTS_VERSIONS;
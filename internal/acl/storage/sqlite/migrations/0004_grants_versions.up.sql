@@ -0,0 +1,31 @@
+-- Version each user's grants with a counter that every change to them moves on. Unlike a hash of the grants, a counter
+-- never returns to an earlier value, so grants changed and changed back are not mistaken for unchanged ones. Triggers
+-- keep the counters, so changes made with plain SQL count too. Rows outlive their user, so that a user deleted and
+-- created again does not reuse versions.
+-- The triggers insert missing rows with WHERE NOT EXISTS rather than INSERT OR IGNORE, as the conflict handling of the
+-- statement firing a trigger overrides that of the statements in it.
+CREATE TABLE ACL_GRANTS_VERSIONS (userid TEXT PRIMARY KEY, version INTEGER NOT NULL);
+
+CREATE TRIGGER ACL_GRANTS_INSERT_VERSION AFTER INSERT ON ACL_GRANTS BEGIN
+    INSERT INTO ACL_GRANTS_VERSIONS (userid, version)
+        SELECT NEW.userid, 0 WHERE NOT EXISTS (SELECT 1 FROM ACL_GRANTS_VERSIONS WHERE userid = NEW.userid);
+    UPDATE ACL_GRANTS_VERSIONS SET version = version + 1 WHERE userid = NEW.userid;
+END;
+CREATE TRIGGER ACL_GRANTS_UPDATE_VERSION AFTER UPDATE ON ACL_GRANTS BEGIN
+    INSERT INTO ACL_GRANTS_VERSIONS (userid, version)
+        SELECT OLD.userid, 0 WHERE NOT EXISTS (SELECT 1 FROM ACL_GRANTS_VERSIONS WHERE userid = OLD.userid);
+    INSERT INTO ACL_GRANTS_VERSIONS (userid, version)
+        SELECT NEW.userid, 0 WHERE NOT EXISTS (SELECT 1 FROM ACL_GRANTS_VERSIONS WHERE userid = NEW.userid);
+    UPDATE ACL_GRANTS_VERSIONS SET version = version + 1 WHERE userid IN (OLD.userid, NEW.userid);
+END;
+CREATE TRIGGER ACL_GRANTS_DELETE_VERSION AFTER DELETE ON ACL_GRANTS BEGIN
+    INSERT INTO ACL_GRANTS_VERSIONS (userid, version)
+        SELECT OLD.userid, 0 WHERE NOT EXISTS (SELECT 1 FROM ACL_GRANTS_VERSIONS WHERE userid = OLD.userid);
+    UPDATE ACL_GRANTS_VERSIONS SET version = version + 1 WHERE userid = OLD.userid;
+END;
+-- a user without grants has a version too
+CREATE TRIGGER ACL_USERS_DELETE_VERSION AFTER DELETE ON ACL_USERS BEGIN
+    INSERT INTO ACL_GRANTS_VERSIONS (userid, version)
+        SELECT OLD.userid, 0 WHERE NOT EXISTS (SELECT 1 FROM ACL_GRANTS_VERSIONS WHERE userid = OLD.userid);
+    UPDATE ACL_GRANTS_VERSIONS SET version = version + 1 WHERE userid = OLD.userid;
+END;
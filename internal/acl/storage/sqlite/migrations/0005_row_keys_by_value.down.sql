@@ -0,0 +1,18 @@
+-- Positions are unique within a grant under either key, so rows are copied back unchanged.
+CREATE TABLE ACL_GRANT_ROW_KEYS_OLD (
+    grant_id TEXT NOT NULL,
+    is_except INTEGER NOT NULL,
+    pos INTEGER NOT NULL,
+    key_json TEXT NOT NULL,
+    PRIMARY KEY (grant_id, is_except, pos)
+);
+INSERT INTO ACL_GRANT_ROW_KEYS_OLD (grant_id, is_except, pos, key_json)
+    SELECT grant_id, is_except, pos, key_json FROM ACL_GRANT_ROW_KEYS;
+DROP TABLE ACL_GRANT_ROW_KEYS;
+ALTER TABLE ACL_GRANT_ROW_KEYS_OLD RENAME TO ACL_GRANT_ROW_KEYS;
+
+CREATE TABLE ACL_GRANT_ROW_RANGES_OLD (grant_id TEXT NOT NULL, pos INTEGER NOT NULL, range_json TEXT NOT NULL, PRIMARY KEY (grant_id, pos));
+INSERT INTO ACL_GRANT_ROW_RANGES_OLD (grant_id, pos, range_json)
+    SELECT grant_id, pos, range_json FROM ACL_GRANT_ROW_RANGES;
+DROP TABLE ACL_GRANT_ROW_RANGES;
+ALTER TABLE ACL_GRANT_ROW_RANGES_OLD RENAME TO ACL_GRANT_ROW_RANGES;
@@ -0,0 +1,25 @@
+-- Key grant row keys and ranges by value rather than by position, so that changing a grant's rows only inserts and
+-- deletes the rows added and removed. pos still orders them: rows keep theirs, and added rows come after the rest.
+-- Keys or ranges listed twice in a grant are kept once.
+CREATE TABLE ACL_GRANT_ROW_KEYS_NEW (
+    grant_id TEXT NOT NULL,
+    is_except INTEGER NOT NULL,
+    key_json TEXT NOT NULL,
+    pos INTEGER NOT NULL,
+    PRIMARY KEY (grant_id, is_except, key_json)
+);
+INSERT OR IGNORE INTO ACL_GRANT_ROW_KEYS_NEW (grant_id, is_except, key_json, pos)
+    SELECT grant_id, is_except, key_json, pos FROM ACL_GRANT_ROW_KEYS ORDER BY grant_id, is_except, pos;
+DROP TABLE ACL_GRANT_ROW_KEYS;
+ALTER TABLE ACL_GRANT_ROW_KEYS_NEW RENAME TO ACL_GRANT_ROW_KEYS;
+
+CREATE TABLE ACL_GRANT_ROW_RANGES_NEW (
+    grant_id TEXT NOT NULL,
+    range_json TEXT NOT NULL,
+    pos INTEGER NOT NULL,
+    PRIMARY KEY (grant_id, range_json)
+);
+INSERT OR IGNORE INTO ACL_GRANT_ROW_RANGES_NEW (grant_id, range_json, pos)
+    SELECT grant_id, range_json, pos FROM ACL_GRANT_ROW_RANGES ORDER BY grant_id, pos;
+DROP TABLE ACL_GRANT_ROW_RANGES;
+ALTER TABLE ACL_GRANT_ROW_RANGES_NEW RENAME TO ACL_GRANT_ROW_RANGES;
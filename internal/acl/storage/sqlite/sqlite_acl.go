@@ -3,99 +3,357 @@ package sqlite
 import (
 	"context"
 	"database/sql"
-	"encoding/json"
 	"fmt"
+	"sort"
+	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 
+	"chroma1/internal/acl/storage"
+	"chroma1/model/keys"
 	"chroma1/model/permissions"
 )
 
+// SQLite reserves names starting with "sqlite_", so the tables cannot carry that prefix.
 const (
-	aclTable = "SQLITE_ACLS"
+	usersTable         = "ACL_USERS"
+	tableAdminsTable   = "ACL_TABLE_ADMINS"
+	grantsTable        = "ACL_GRANTS"
+	grantKeysTable     = "ACL_GRANT_ROW_KEYS"
+	grantRangesTable   = "ACL_GRANT_ROW_RANGES"
+	elevationTable     = "ACL_ELEVATIONS"
+	elevatedQueryTable = "ACL_ELEVATED_QUERIES"
+	keyTable           = "ACL_KEYS"
+	versionTable       = "ACL_SCHEMA_VERSION"
+	changesTable       = "ACL_CHANGES"
+	grantsVersionTable = "ACL_GRANTS_VERSIONS"
+	// permissions as one JSON blob per user, before schema version 2
+	legacyACLTable = "ACLS"
 )
 
+// SQLiteACLStorage stores ACLs in SQLite. All values are passed as bound parameters; only the constant table and
+// column names above are formatted into statements.
 type SQLiteACLStorage struct {
 	db *sql.DB
+
+	// prepared statements for the per-user operations on the query path
+	userGrants  *grantQueries
+	tableGrants *grantQueries
+
+	pollInterval time.Duration
 }
 
-func NewSQLiteACLStorage(ctx context.Context, connectionStr string) (*SQLiteACLStorage, error) {
+// Option configures optional SQLiteACLStorage behaviour.
+type Option func(*SQLiteACLStorage)
+
+// WithPollInterval sets how often Watch checks the change log for changes. Defaults to 1s.
+func WithPollInterval(d time.Duration) Option {
+	return func(s *SQLiteACLStorage) {
+		s.pollInterval = d
+	}
+}
+
+func NewSQLiteACLStorage(ctx context.Context, connectionStr string, opts ...Option) (*SQLiteACLStorage, error) {
 	backing, err := sql.Open("sqlite3", connectionStr)
 	if err != nil {
 		return nil, err
 	}
 
 	s := &SQLiteACLStorage{
-		db: backing,
+		db:           backing,
+		pollInterval: time.Second,
+	}
+	for _, opt := range opts {
+		opt(s)
 	}
 
-	if err := s.createTableIfMissing(ctx); err != nil {
+	migrator := &Migrator{db: backing}
+	if err := migrator.init(ctx); err != nil {
+		backing.Close()
+		return nil, err
+	}
+	if err := migrator.Up(ctx, 0); err != nil {
+		backing.Close()
+		return nil, err
+	}
+	if err := s.prepareStatements(ctx); err != nil {
+		s.Close()
 		return nil, err
 	}
 
 	return s, nil
 }
 
-func (s *SQLiteACLStorage) StoreUserPerms(ctx context.Context, user string, perms []*permissions.Permission) error {
-	b, err := json.Marshal(perms)
-	if err != nil {
+func (s *SQLiteACLStorage) prepareStatements(ctx context.Context) error {
+	var err error
+	if s.userGrants, err = prepareGrantQueries(ctx, s.db, "g.userid = ?"); err != nil {
 		return err
 	}
-	_, err = s.db.ExecContext(ctx, fmt.Sprintf("UPDATE %s SET permissions_json = %s WHERE userid = %s", aclTable, string(b), user))
+	s.tableGrants, err = prepareGrantQueries(ctx, s.db, "g.table_name = ?")
 	return err
 }
 
 func (s *SQLiteACLStorage) GetUserPerms(ctx context.Context, user string) ([]*permissions.Permission, error) {
-	row := s.db.QueryRowContext(ctx, fmt.Sprintf("SELECT permissions_json FROM %s WHERE userid = %s", aclTable, user))
-	var jPerms string
-	if err := row.Scan(&jPerms); err != nil {
+	var exists int
+	err := s.db.QueryRowContext(ctx, fmt.Sprintf("SELECT 1 FROM %s WHERE userid = ?", usersTable), user).Scan(&exists)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("%w %s", storage.NoSuchUserError, user)
+	}
+	if err != nil {
+		return nil, err
+	}
+	byUser, err := s.userGrants.load(ctx, user)
+	if err != nil {
 		return nil, err
 	}
-	var perms []*permissions.Permission
-	err := json.Unmarshal([]byte(jPerms), &perms)
-	return perms, err
+	if perms, ok := byUser[user]; ok {
+		return perms, nil
+	}
+	return make([]*permissions.Permission, 0), nil
 }
 
-func (s *SQLiteACLStorage) GetAllUserInfo(ctx context.Context) (map[string][]*permissions.Permission, map[string]struct{}, map[string]string, error) {
-	rows, err := s.db.QueryContext(ctx, fmt.Sprintf("SELECT userid, api_key, is_admin, permissions_json FROM %s", aclTable))
-	defer rows.Close()
+func (s *SQLiteACLStorage) GetTableGrants(ctx context.Context, table string) (map[string][]*permissions.Permission, error) {
+	return s.tableGrants.load(ctx, table)
+}
+
+func (s *SQLiteACLStorage) GetAllUserInfo(ctx context.Context) (map[string][]*permissions.Permission, map[string]struct{}, error) {
+	rows, err := s.db.QueryContext(ctx, fmt.Sprintf("SELECT userid, is_admin FROM %s", usersTable))
 	if err != nil {
-		return nil, nil, nil, err
+		return nil, nil, err
 	}
+	defer rows.Close()
 	userPerms := make(map[string][]*permissions.Permission)
-	adminKeys := make(map[string]struct{})
-	keyToUser := make(map[string]string)
+	admins := make(map[string]struct{})
 	for rows.Next() {
 		var userid string
-		var key string
 		var isAdmin int
-		var jPerms string
-		if err := rows.Scan(&userid, &key, &isAdmin, &jPerms); err != nil {
-			return nil, nil, nil, err
+		if err := rows.Scan(&userid, &isAdmin); err != nil {
+			return nil, nil, err
 		}
-		keyToUser[key] = userid
 		if isAdmin == 1 {
-			adminKeys[key] = struct{}{}
+			admins[userid] = struct{}{}
 		}
+		userPerms[userid] = make([]*permissions.Permission, 0)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
 
-		var perms []*permissions.Permission
-		err := json.Unmarshal([]byte(jPerms), &perms)
-		if err != nil {
-			return nil, nil, nil, err
+	grants, err := loadGrants(ctx, s.db, "1 = 1")
+	if err != nil {
+		return nil, nil, err
+	}
+	for user, perms := range grants {
+		userPerms[user] = perms
+	}
+	return userPerms, admins, nil
+}
+
+func (s *SQLiteACLStorage) GetDisabledUsers(ctx context.Context) (map[string]struct{}, error) {
+	rows, err := s.db.QueryContext(ctx, fmt.Sprintf("SELECT userid FROM %s WHERE disabled = 1", usersTable))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	users := make(map[string]struct{})
+	for rows.Next() {
+		var userid string
+		if err := rows.Scan(&userid); err != nil {
+			return nil, err
 		}
-		userPerms[userid] = perms
+		users[userid] = struct{}{}
 	}
-	if err := rows.Err(); err != nil {
-		return nil, nil, nil, err
+	return users, rows.Err()
+}
+
+func (s *SQLiteACLStorage) CreateUser(ctx context.Context, user string, key *keys.APIKey, isAdmin bool) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
 	}
-	return userPerms, adminKeys, keyToUser, nil
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, fmt.Sprintf("INSERT INTO %s (userid, is_admin) VALUES (?, ?)", usersTable),
+		user, boolToInt(isAdmin))
+	if err != nil {
+		return err
+	}
+	if err := insertKey(ctx, tx, key); err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
-func (s *SQLiteACLStorage) Close() error {
-	return s.db.Close()
+func (s *SQLiteACLStorage) SetUserDisabled(ctx context.Context, user string, disabled bool) error {
+	return s.updateUserColumn(ctx, user, "disabled", boolToInt(disabled))
+}
+
+func (s *SQLiteACLStorage) SetUserAdmin(ctx context.Context, user string, isAdmin bool) error {
+	return s.updateUserColumn(ctx, user, "is_admin", boolToInt(isAdmin))
 }
 
-func (s *SQLiteACLStorage) createTableIfMissing(ctx context.Context) error {
-	_, err := s.db.ExecContext(ctx, fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (userid STRING PRIMARY KEY, api_key STRING, is_admin INTEGER, permissions_json STRING);"))
+// SetBreakGlass allows or disallows user to self-elevate via break-glass. The ACLStorage interface has no way to change
+// this, so stores are seeded out of band, with this or by importing a snapshot.
+func (s *SQLiteACLStorage) SetBreakGlass(ctx context.Context, user string, allowed bool) error {
+	return s.updateUserColumn(ctx, user, "can_break_glass", boolToInt(allowed))
+}
+
+// SetTableAdmin makes user an administrator of table, or stops them being one. Like break-glass, this is seeded out of
+// band.
+func (s *SQLiteACLStorage) SetTableAdmin(ctx context.Context, user, table string, isAdmin bool) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var exists int
+	err = tx.QueryRowContext(ctx, fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE userid = ?", usersTable), user).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if exists == 0 {
+		return fmt.Errorf("%w %s", storage.NoSuchUserError, user)
+	}
+	query := "INSERT OR IGNORE INTO %s (userid, table_name) VALUES (?, ?)"
+	if !isAdmin {
+		query = "DELETE FROM %s WHERE userid = ? AND table_name = ?"
+	}
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf(query, tableAdminsTable), user, table); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *SQLiteACLStorage) DeleteUser(ctx context.Context, user string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := deleteGrants(ctx, tx, "userid = ?", user); err != nil {
+		return err
+	}
+	for _, table := range []string{keyTable, tableAdminsTable, usersTable} {
+		if _, err := tx.ExecContext(ctx, fmt.Sprintf("DELETE FROM %s WHERE userid = ?", table), user); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *SQLiteACLStorage) updateUserColumn(ctx context.Context, user, column string, value interface{}) error {
+	res, err := s.db.ExecContext(ctx, fmt.Sprintf("UPDATE %s SET %s = ? WHERE userid = ?", usersTable, column), value, user)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return fmt.Errorf("%w %s", storage.NoSuchUserError, user)
+	}
+	return nil
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func (s *SQLiteACLStorage) GetTableAdmins(ctx context.Context) (map[string][]string, error) {
+	rows, err := s.db.QueryContext(ctx, fmt.Sprintf("SELECT userid, table_name FROM %s ORDER BY userid, table_name", tableAdminsTable))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	admins := make(map[string][]string)
+	for rows.Next() {
+		var userid, table string
+		if err := rows.Scan(&userid, &table); err != nil {
+			return nil, err
+		}
+		admins[userid] = append(admins[userid], table)
+	}
+	return admins, rows.Err()
+}
+
+func (s *SQLiteACLStorage) GetBreakGlassUsers(ctx context.Context) (map[string]struct{}, error) {
+	rows, err := s.db.QueryContext(ctx, fmt.Sprintf("SELECT userid FROM %s WHERE can_break_glass = 1", usersTable))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	users := make(map[string]struct{})
+	for rows.Next() {
+		var userid string
+		if err := rows.Scan(&userid); err != nil {
+			return nil, err
+		}
+		users[userid] = struct{}{}
+	}
+	return users, rows.Err()
+}
+
+func (s *SQLiteACLStorage) RecordElevation(ctx context.Context, id, user, reason string, start, end time.Time) error {
+	_, err := s.db.ExecContext(ctx, fmt.Sprintf("INSERT INTO %s (id, userid, reason, started_at, expires_at) VALUES (?, ?, ?, ?, ?)", elevationTable),
+		id, user, reason, formatTime(start), formatTime(end))
 	return err
 }
+
+func (s *SQLiteACLStorage) RecordElevatedQuery(ctx context.Context, elevationID, sql string, at time.Time) error {
+	_, err := s.db.ExecContext(ctx, fmt.Sprintf("INSERT INTO %s (elevation_id, sql, executed_at) VALUES (?, ?, ?)", elevatedQueryTable),
+		elevationID, sql, formatTime(at))
+	return err
+}
+
+func (s *SQLiteACLStorage) GetActiveElevations(ctx context.Context, at time.Time) ([]*storage.Elevation, error) {
+	rows, err := s.db.QueryContext(ctx, fmt.Sprintf("SELECT id, userid, reason, started_at, expires_at FROM %s", elevationTable))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	res := make([]*storage.Elevation, 0)
+	for rows.Next() {
+		var e storage.Elevation
+		var reason *string
+		var start, end string
+		if err := rows.Scan(&e.ID, &e.User, &reason, &start, &end); err != nil {
+			return nil, err
+		}
+		if reason != nil {
+			e.Reason = *reason
+		}
+		// parsed to be compared, as RFC 3339 strings with trimmed fractions do not sort
+		if e.Start, err = time.Parse(time.RFC3339Nano, start); err != nil {
+			return nil, err
+		}
+		if e.End, err = time.Parse(time.RFC3339Nano, end); err != nil {
+			return nil, err
+		}
+		if at.Before(e.End) {
+			res = append(res, &e)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Start.Before(res[j].Start)
+	})
+	return res, nil
+}
+
+func (s *SQLiteACLStorage) Close() error {
+	for _, q := range []*grantQueries{s.userGrants, s.tableGrants} {
+		if q != nil {
+			q.close()
+		}
+	}
+	return s.db.Close()
+}
@@ -0,0 +1,276 @@
+package sqlite_test
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"chroma1/internal/acl/storage"
+	"chroma1/internal/acl/storage/sqlite"
+	"chroma1/internal/acl/storage/storagetest"
+	"chroma1/model/permissions"
+)
+
+// newStorage opens a storage backed by a fresh SQLite file in a temporary directory.
+func newStorage(t *testing.T) (*sqlite.SQLiteACLStorage, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "acl.db")
+	s, err := sqlite.NewSQLiteACLStorage(context.Background(), path, sqlite.WithPollInterval(10*time.Millisecond))
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	t.Cleanup(func() { s.Close() })
+	return s, path
+}
+
+func TestConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.ACLStorage {
+		s, _ := newStorage(t)
+		return s
+	})
+}
+
+func TestReopen(t *testing.T) {
+	ctx := context.Background()
+	s, path := newStorage(t)
+	user := "eve'; --"
+	perms := []*permissions.Permission{{Type: permissions.Read, Table: "t1", RowKeys: [][]string{{"1"}}}}
+
+	assert.NoError(t, s.CreateUser(ctx, user, storagetest.NewKey(user), true))
+	assert.NoError(t, s.StoreUserPerms(ctx, user, perms))
+	assert.NoError(t, s.SetUserDisabled(ctx, user, true))
+
+	// everything survives reopening the file
+	assert.NoError(t, s.Close())
+	s, err := sqlite.NewSQLiteACLStorage(ctx, path)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer s.Close()
+	all, admins, err := s.GetAllUserInfo(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]struct{}{user: {}}, admins)
+	assert.Equal(t, perms, all[user])
+	disabled, err := s.GetDisabledUsers(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]struct{}{user: {}}, disabled)
+	allKeys, err := s.GetAllKeys(ctx)
+	assert.NoError(t, err)
+	if assert.Len(t, allKeys, 1) {
+		assert.Equal(t, []byte("hash-"+user), allKeys[0].Hash)
+	}
+}
+
+// TestMigrateBlobSchema opens a database in the schema used before grants were normalized, with permissions stored as
+// a JSON blob per user.
+func TestMigrateBlobSchema(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "acl.db")
+	db, err := sql.Open("sqlite3", path)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	stmts := []string{
+		"CREATE TABLE ACLS (userid STRING PRIMARY KEY, api_key STRING, is_admin INTEGER, permissions_json STRING, " +
+			"can_break_glass INTEGER NOT NULL DEFAULT 0, admin_tables_json STRING, disabled INTEGER NOT NULL DEFAULT 0)",
+		"CREATE TABLE ACL_ELEVATIONS (id STRING PRIMARY KEY, userid STRING, reason STRING, started_at STRING, expires_at STRING)",
+		"CREATE TABLE ACL_ELEVATED_QUERIES (elevation_id STRING, sql STRING, executed_at STRING)",
+		"CREATE TABLE ACL_KEYS (id STRING PRIMARY KEY, userid STRING, api_key STRING UNIQUE, label STRING, created_at STRING, expires_at STRING, key_hash BLOB)",
+		`INSERT INTO ACLS VALUES ('alice', 'secret', 1, '[{"Type":1,"Table":"t1","RowKeys":null},` +
+			`{"Type":2,"Table":"t1","RowKeys":[["1"],["2"]],"ExpiresAt":"2030-01-01T00:00:00Z","Inherit":true},` +
+			`{"Type":1,"Table":"t2","RowKeys":null,"ExceptKeys":[["7"]],"Condition":"claims.team == \"x\""},` +
+			`{"Type":1,"Table":"t3","RowKeys":[],"RowRanges":[{"Start":["5"]}]}]', 1, '["t1"]', 0)`,
+		"INSERT INTO ACLS VALUES ('bob', NULL, 0, '[]', 0, NULL, 1)",
+		"INSERT INTO ACL_ELEVATIONS VALUES ('007', 'alice', 'incident', '2023-01-01T00:00:00Z', '2023-01-01T01:00:00Z')",
+	}
+	for _, stmt := range stmts {
+		_, err := db.Exec(stmt)
+		assert.NoError(t, err, stmt)
+	}
+	assert.NoError(t, db.Close())
+
+	s, err := sqlite.NewSQLiteACLStorage(ctx, path)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer s.Close()
+
+	expires := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	all, admins, err := s.GetAllUserInfo(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]struct{}{"alice": {}}, admins)
+	assert.Empty(t, all["bob"])
+	perms := all["alice"]
+	if assert.Len(t, perms, 4) {
+		for _, p := range perms {
+			assert.NotEmpty(t, p.ID)
+			p.ID = ""
+		}
+		assert.Equal(t, []*permissions.Permission{
+			{Type: permissions.Read, Table: "t1"},
+			{Type: permissions.Write, Table: "t1", RowKeys: [][]string{{"1"}, {"2"}}, ExpiresAt: &expires, Inherit: true},
+			{Type: permissions.Read, Table: "t2", ExceptKeys: [][]string{{"7"}}, Condition: `claims.team == "x"`},
+			{Type: permissions.Read, Table: "t3", RowRanges: []permissions.KeyRange{{Start: []string{"5"}}}},
+		}, perms)
+	}
+
+	disabled, err := s.GetDisabledUsers(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]struct{}{"bob": {}}, disabled)
+	breakGlass, err := s.GetBreakGlassUsers(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]struct{}{"alice": {}}, breakGlass)
+	tableAdmins, err := s.GetTableAdmins(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]string{"alice": {"t1"}}, tableAdmins)
+	allKeys, err := s.GetAllKeys(ctx)
+	assert.NoError(t, err)
+	if assert.Len(t, allKeys, 1) {
+		assert.Equal(t, "secret", allKeys[0].Secret)
+	}
+
+	// a migrated database opens unchanged
+	assert.NoError(t, s.Close())
+	s, err = sqlite.NewSQLiteACLStorage(ctx, path)
+	assert.NoError(t, err)
+	defer s.Close()
+	again, _, err := s.GetAllUserInfo(ctx)
+	assert.NoError(t, err)
+	assert.Len(t, again["alice"], 4)
+}
+
+// TestChangeLog checks that changes made by another process, here with plain SQL, are watched, and that a watcher
+// behind pruned changes is told everything changed.
+func TestChangeLog(t *testing.T) {
+	ctx := context.Background()
+	s, path := newStorage(t)
+	assert.NoError(t, s.CreateUser(ctx, "alice", storagetest.NewKey("alice"), false))
+	assert.NoError(t, s.StoreUserPerms(ctx, "alice", []*permissions.Permission{{ID: "g1", Type: permissions.Read, Table: "t1"}}))
+	version, err := s.ChangeVersion(ctx)
+	assert.NoError(t, err)
+
+	db, err := sql.Open("sqlite3", path)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer db.Close()
+	_, err = db.Exec("UPDATE ACL_GRANTS SET table_name = 't2' WHERE id = 'g1'")
+	assert.NoError(t, err)
+
+	changes := make(chan storage.Change, 10)
+	watchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go s.Watch(watchCtx, version, func(c storage.Change) { changes <- c })
+	select {
+	case c := <-changes:
+		assert.Equal(t, storage.Change{Version: version + 1, User: "alice", Kind: storage.GrantsChanged}, c)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no change seen")
+	}
+
+	pruned, err := s.PruneChanges(ctx, time.Now().Add(time.Minute))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(version+1), pruned)
+	latest, err := s.ChangeVersion(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, version+1, latest, "pruning keeps versions")
+	go s.Watch(watchCtx, 0, func(c storage.Change) { changes <- c })
+	select {
+	case c := <-changes:
+		assert.Equal(t, storage.Change{Version: latest, Kind: storage.AllChanged}, c)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no change seen")
+	}
+}
+
+// TestRewriteGrants checks that storing grants again writes only what changed.
+func TestRewriteGrants(t *testing.T) {
+	ctx := context.Background()
+	s, _ := newStorage(t)
+	perms := []*permissions.Permission{
+		{ID: "g1", Type: permissions.Read, Table: "t1", RowKeys: [][]string{{"1"}, {"2"}, {"3"}}},
+		{ID: "g2", Type: permissions.Write, Table: "t1", RowRanges: []permissions.KeyRange{{Start: []string{"1"}, End: []string{"5"}}}},
+	}
+	assert.NoError(t, s.StoreUserPerms(ctx, "alice", perms))
+	version, err := s.ChangeVersion(ctx)
+	assert.NoError(t, err)
+
+	assert.NoError(t, s.StoreUserPerms(ctx, "alice", perms))
+	latest, err := s.ChangeVersion(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, version, latest, "storing the same grants changes nothing")
+
+	perms[0].RowKeys = [][]string{{"1"}, {"4"}}
+	assert.NoError(t, s.StoreUserPerms(ctx, "alice", perms))
+	latest, err = s.ChangeVersion(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, version+1, latest, "only the changed grant is logged")
+	stored, err := s.GetUserPerms(ctx, "alice")
+	assert.NoError(t, err)
+	assert.Equal(t, perms, stored)
+
+	assert.NoError(t, s.StoreUserPerms(ctx, "alice", perms[1:]))
+	stored, err = s.GetUserPerms(ctx, "alice")
+	assert.NoError(t, err)
+	assert.Equal(t, perms[1:], stored)
+}
+
+// TestRewriteRowKeys checks that row keys are stored by value, so that changing a grant's rows leaves the rows kept
+// untouched.
+func TestRewriteRowKeys(t *testing.T) {
+	ctx := context.Background()
+	s, path := newStorage(t)
+	grant := &permissions.Permission{ID: "g1", Type: permissions.Read, Table: "t1", RowKeys: [][]string{{"1"}, {"2"}, {"3"}}}
+	assert.NoError(t, s.StoreUserPerms(ctx, "alice", []*permissions.Permission{grant}))
+
+	db, err := sql.Open("sqlite3", path)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer db.Close()
+	keyRows := func() map[string]int64 {
+		rows, err := db.Query("SELECT key_json, rowid FROM ACL_GRANT_ROW_KEYS WHERE grant_id = 'g1'")
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		defer rows.Close()
+		byKey := make(map[string]int64)
+		for rows.Next() {
+			var key string
+			var rowid int64
+			assert.NoError(t, rows.Scan(&key, &rowid))
+			byKey[key] = rowid
+		}
+		assert.NoError(t, rows.Err())
+		return byKey
+	}
+	before := keyRows()
+
+	// dropping the first key does not shift the others
+	grant.RowKeys = [][]string{{"2"}, {"3"}, {"4"}}
+	assert.NoError(t, s.StoreUserPerms(ctx, "alice", []*permissions.Permission{grant}))
+	after := keyRows()
+	assert.Len(t, after, 3)
+	assert.NotContains(t, after, `["1"]`)
+	assert.Equal(t, before[`["2"]`], after[`["2"]`])
+	assert.Equal(t, before[`["3"]`], after[`["3"]`])
+	stored, err := s.GetUserPerms(ctx, "alice")
+	assert.NoError(t, err)
+	if assert.Len(t, stored, 1) {
+		assert.Equal(t, grant.RowKeys, stored[0].RowKeys)
+	}
+
+	// and listing the same keys in another order is no change
+	version, err := s.ChangeVersion(ctx)
+	assert.NoError(t, err)
+	grant.RowKeys = [][]string{{"4"}, {"2"}, {"3"}}
+	assert.NoError(t, s.StoreUserPerms(ctx, "alice", []*permissions.Permission{grant}))
+	latest, err := s.ChangeVersion(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, version, latest)
+	assert.Equal(t, after, keyRows())
+}
@@ -0,0 +1,77 @@
+// Package storage defines the interface ACL backing stores implement. Implementations live in its subpackages, and
+// storagetest holds the conformance tests every implementation should pass.
+package storage
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"chroma1/model/keys"
+	"chroma1/model/permissions"
+)
+
+var (
+	ClosedError = fmt.Errorf("storage is closed")
+	// Returned by calls on a user that does not exist.
+	NoSuchUserError = fmt.Errorf("no such user")
+)
+
+// Elevation is a recorded break-glass elevation, in effect from Start until End.
+type Elevation struct {
+	ID     string
+	User   string
+	Reason string
+	Start  time.Time
+	End    time.Time
+}
+
+type ACLStorage interface {
+	// Replaces all of the user's grants. Grants without an ID are assigned one, which is set on the grant.
+	StoreUserPerms(ctx context.Context, user string, perms []*permissions.Permission) error
+	// Gets the user's grants, each with its ID.
+	GetUserPerms(ctx context.Context, user string) ([]*permissions.Permission, error)
+	// Stores each grant in store, replacing any grant with the same ID, and deletes the user's grants with the IDs in
+	// remove, atomically. Grants in store must have an ID.
+	UpdateGrants(ctx context.Context, user string, store []*permissions.Permission, remove []string) error
+	// Gets the user's grants, as GetUserPerms does, along with their version (see GrantsVersion).
+	GetUserPermsVersion(ctx context.Context, user string) ([]*permissions.Permission, string, error)
+	// Does UpdateGrants if the user's grants are still at version, failing with VersionConflictError otherwise, and
+	// returns their new version. Version "" matches only a user that does not exist yet.
+	UpdateGrantsIf(ctx context.Context, user, version string, store []*permissions.Permission, remove []string) (string, error)
+	// Gets every grant on table, by user id.
+	GetTableGrants(ctx context.Context, table string) (map[string][]*permissions.Permission, error)
+	// Gets a map from user id to permissions, and the set of admin user ids
+	GetAllUserInfo(ctx context.Context) (map[string][]*permissions.Permission, map[string]struct{}, error)
+	// Gets every API key, including expired keys that have not yet been deleted.
+	GetAllKeys(ctx context.Context) ([]*keys.APIKey, error)
+	// Stores a new key. Only the hash is persisted; the plaintext secret must not be.
+	StoreKey(ctx context.Context, key *keys.APIKey) error
+	// Replaces a legacy plaintext key with its hash.
+	SetKeyHash(ctx context.Context, id string, hash []byte) error
+	SetKeyExpiry(ctx context.Context, id string, expiresAt time.Time) error
+	DeleteKey(ctx context.Context, id string) error
+	// Gets the set of disabled user ids. Disabled users keep their permissions but their keys are rejected.
+	GetDisabledUsers(ctx context.Context) (map[string]struct{}, error)
+	// Creates the user along with their first key.
+	CreateUser(ctx context.Context, user string, key *keys.APIKey, isAdmin bool) error
+	SetUserDisabled(ctx context.Context, user string, disabled bool) error
+	SetUserAdmin(ctx context.Context, user string, isAdmin bool) error
+	// Deletes the user along with their keys and permissions.
+	DeleteUser(ctx context.Context, user string) error
+	// Gets a map from user id to the tables that user administers.
+	GetTableAdmins(ctx context.Context) (map[string][]string, error)
+	// Gets the set of user ids allowed to self-elevate via break-glass.
+	GetBreakGlassUsers(ctx context.Context) (map[string]struct{}, error)
+	// Records the start of a break-glass elevation, and each query run under it.
+	RecordElevation(ctx context.Context, id, user, reason string, start, end time.Time) error
+	RecordElevatedQuery(ctx context.Context, elevationID, sql string, at time.Time) error
+	// Gets the recorded elevations that have not ended at time at, oldest first.
+	GetActiveElevations(ctx context.Context, at time.Time) ([]*Elevation, error)
+	// Gets the version of the latest change, or 0 if nothing has changed.
+	ChangeVersion(ctx context.Context) (uint64, error)
+	// Calls fn with each change after version since, in version order, including changes made by other clients of the
+	// store, until ctx is done or watching fails. Blocks, returning ctx's error once ctx is done.
+	Watch(ctx context.Context, since uint64, fn func(Change)) error
+	Close() error
+}
@@ -0,0 +1,419 @@
+// Package storagetest holds conformance tests for ACLStorage implementations. An implementation's tests call Run with
+// a function opening an empty store.
+package storagetest
+
+import (
+	"context"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"chroma1/internal/acl/storage"
+	"chroma1/model/keys"
+	"chroma1/model/permissions"
+)
+
+// Run runs the conformance tests against stores returned by open, which must return a new, empty store each call.
+// Stores are closed when each test finishes. Stores that poll for changes should poll often, as watch tests wait at most
+// watchTimeout for each change.
+func Run(t *testing.T, open func(t *testing.T) storage.ACLStorage) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, s storage.ACLStorage)
+	}{
+		{"StoreUserPermsRoundTrip", testStoreUserPermsRoundTrip},
+		{"StoreUserPermsReplaces", testStoreUserPermsReplaces},
+		{"GetUserPermsMissing", testGetUserPermsMissing},
+		{"UpdateGrants", testUpdateGrants},
+		{"GrantsVersion", testGrantsVersion},
+		{"GetTableGrants", testGetTableGrants},
+		{"UserLifecycle", testUserLifecycle},
+		{"Keys", testKeys},
+		{"Elevations", testElevations},
+		{"Watch", testWatch},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			s := open(t)
+			t.Cleanup(func() { s.Close() })
+			tc.test(t, s)
+		})
+	}
+}
+
+const watchTimeout = 5 * time.Second
+
+// NewKey returns a hashed key for user.
+func NewKey(user string) *keys.APIKey {
+	return &keys.APIKey{
+		ID:        "id-" + user,
+		User:      user,
+		Hash:      []byte("hash-" + user),
+		Label:     "initial",
+		CreatedAt: time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC),
+	}
+}
+
+func testStoreUserPermsRoundTrip(t *testing.T, s storage.ACLStorage) {
+	expires := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	testcases := []struct {
+		user  string
+		perms []*permissions.Permission
+	}{
+		{
+			user:  "alice",
+			perms: []*permissions.Permission{{Type: permissions.Read, Table: "t1"}},
+		},
+		{
+			user: "o'brien",
+			perms: []*permissions.Permission{
+				{Type: permissions.Write, Table: "t'; DROP TABLE ACLS; --", RowKeys: [][]string{{"1"}, {"it's"}}},
+			},
+		},
+		{
+			user: `bob" OR "1"="1`,
+			perms: []*permissions.Permission{
+				{Type: permissions.Read, Table: "t2", RowRanges: []permissions.KeyRange{{Start: []string{"5"}}}},
+				{Type: permissions.Read, Table: "t3", ExceptKeys: [][]string{{"7"}}, Condition: `claims.team == "x"`},
+			},
+		},
+		{
+			user:  "empty",
+			perms: []*permissions.Permission{},
+		},
+		{
+			user: "limited",
+			perms: []*permissions.Permission{
+				{Type: permissions.Read, Table: "t1", RowKeys: [][]string{}},
+				{Type: permissions.Write, Table: "t1", RowKeys: [][]string{{"1", "a"}}, RowRanges: []permissions.KeyRange{{Start: []string{"2"}, End: []string{"3"}, EndAfter: true}}},
+				{Type: permissions.Read, Table: "t2", ExpiresAt: &expires, Inherit: true, GrantOption: true},
+			},
+		},
+	}
+	ctx := context.Background()
+	for _, tc := range testcases {
+		assert.NoError(t, s.CreateUser(ctx, tc.user, NewKey(tc.user), false))
+		assert.NoError(t, s.StoreUserPerms(ctx, tc.user, tc.perms))
+		for _, p := range tc.perms {
+			assert.NotEmpty(t, p.ID, "ids are assigned")
+		}
+	}
+
+	all, admins, err := s.GetAllUserInfo(ctx)
+	assert.NoError(t, err)
+	assert.Len(t, all, len(testcases))
+	assert.Empty(t, admins)
+	for i, tc := range testcases {
+		got, err := s.GetUserPerms(ctx, tc.user)
+		assert.NoError(t, err, "case %v", i)
+		assert.Equal(t, tc.perms, got, "case %v", i)
+		assert.Equal(t, tc.perms, all[tc.user], "case %v", i)
+	}
+}
+
+func testStoreUserPermsReplaces(t *testing.T, s storage.ACLStorage) {
+	ctx := context.Background()
+	perms := []*permissions.Permission{{Type: permissions.Read, Table: "t1"}}
+
+	// the user need not have been created
+	assert.NoError(t, s.StoreUserPerms(ctx, "new-user", perms))
+	got, err := s.GetUserPerms(ctx, "new-user")
+	assert.NoError(t, err)
+	assert.Equal(t, perms, got)
+
+	// storing again replaces rather than duplicates
+	perms = append(perms, &permissions.Permission{Type: permissions.Write, Table: "t1"})
+	assert.NoError(t, s.StoreUserPerms(ctx, "new-user", perms))
+	all, _, err := s.GetAllUserInfo(ctx)
+	assert.NoError(t, err)
+	assert.Len(t, all, 1)
+	assert.Equal(t, perms, all["new-user"])
+
+	// stored grants are copies
+	got[0].Table = "changed"
+	perms[0].Table = "changed too"
+	again, err := s.GetUserPerms(ctx, "new-user")
+	assert.NoError(t, err)
+	assert.Equal(t, "t1", again[0].Table)
+}
+
+func testGetUserPermsMissing(t *testing.T, s storage.ACLStorage) {
+	_, err := s.GetUserPerms(context.Background(), "nobody' OR '1'='1")
+	assert.ErrorIs(t, err, storage.NoSuchUserError)
+}
+
+func testUpdateGrants(t *testing.T, s storage.ACLStorage) {
+	ctx := context.Background()
+	perms := []*permissions.Permission{
+		{Type: permissions.Read, Table: "t1"},
+		{Type: permissions.Write, Table: "t1", RowKeys: [][]string{{"1"}}},
+	}
+	assert.NoError(t, s.StoreUserPerms(ctx, "alice", perms))
+
+	changed := perms[1].Clone()
+	changed.RowKeys = [][]string{{"1"}, {"2"}}
+	added := &permissions.Permission{ID: "new", Type: permissions.Read, Table: "t2", ExceptKeys: [][]string{{"9"}}}
+	assert.NoError(t, s.UpdateGrants(ctx, "alice", []*permissions.Permission{changed, added}, []string{perms[0].ID}))
+	got, err := s.GetUserPerms(ctx, "alice")
+	assert.NoError(t, err)
+	assert.Equal(t, []*permissions.Permission{changed, added}, got)
+
+	// grants are scoped to their user
+	assert.Error(t, s.UpdateGrants(ctx, "bob", []*permissions.Permission{added}, nil))
+	assert.NoError(t, s.UpdateGrants(ctx, "bob", nil, []string{added.ID}))
+	assert.Error(t, s.UpdateGrants(ctx, "alice", []*permissions.Permission{{Type: permissions.Read, Table: "t3"}}, nil), "missing id")
+	got, err = s.GetUserPerms(ctx, "alice")
+	assert.NoError(t, err)
+	assert.Equal(t, []*permissions.Permission{changed, added}, got)
+}
+
+func testGrantsVersion(t *testing.T, s storage.ACLStorage) {
+	ctx := context.Background()
+	g1 := &permissions.Permission{ID: "g1", Type: permissions.Read, Table: "t1"}
+	g2 := &permissions.Permission{ID: "g2", Type: permissions.Write, Table: "t2"}
+
+	_, _, err := s.GetUserPermsVersion(ctx, "alice")
+	assert.ErrorIs(t, err, storage.NoSuchUserError, "missing user")
+	v1, err := s.UpdateGrantsIf(ctx, "alice", "", []*permissions.Permission{g1}, nil)
+	assert.NoError(t, err, "version \"\" creates the user")
+	assert.NotEmpty(t, v1)
+	perms, version, err := s.GetUserPermsVersion(ctx, "alice")
+	assert.NoError(t, err)
+	assert.Equal(t, []*permissions.Permission{g1}, perms)
+	assert.Equal(t, v1, version)
+	_, err = s.UpdateGrantsIf(ctx, "alice", "", []*permissions.Permission{g2}, nil)
+	assert.ErrorIs(t, err, storage.VersionConflictError, "alice exists")
+
+	// an unconditional write moves the version on, so writes based on the old one fail and change nothing
+	assert.NoError(t, s.UpdateGrants(ctx, "alice", []*permissions.Permission{g2}, nil))
+	perms, v2, err := s.GetUserPermsVersion(ctx, "alice")
+	assert.NoError(t, err)
+	assert.NotEqual(t, v1, v2)
+	_, err = s.UpdateGrantsIf(ctx, "alice", v1, nil, []string{"g1"})
+	assert.ErrorIs(t, err, storage.VersionConflictError)
+	unchanged, err := s.GetUserPerms(ctx, "alice")
+	assert.NoError(t, err)
+	assert.Equal(t, perms, unchanged)
+
+	v3, err := s.UpdateGrantsIf(ctx, "alice", v2, nil, []string{"g1"})
+	assert.NoError(t, err)
+	perms, version, err = s.GetUserPermsVersion(ctx, "alice")
+	assert.NoError(t, err)
+	assert.Equal(t, []*permissions.Permission{g2}, perms)
+	assert.Equal(t, v3, version)
+
+	// versions are never reused, even when the grants return to an earlier state or the user is created again
+	seen := map[string]bool{v1: true, v2: true, v3: true}
+	v4, err := s.UpdateGrantsIf(ctx, "alice", v3, []*permissions.Permission{g1}, []string{"g2"})
+	assert.NoError(t, err)
+	assert.False(t, seen[v4], "grants changed back")
+	seen[v4] = true
+	_, err = s.UpdateGrantsIf(ctx, "alice", v1, nil, []string{"g1"})
+	assert.ErrorIs(t, err, storage.VersionConflictError, "the grants are as at v1, but changed since")
+	assert.NoError(t, s.DeleteUser(ctx, "alice"))
+	v5, err := s.UpdateGrantsIf(ctx, "alice", "", []*permissions.Permission{g1}, nil)
+	assert.NoError(t, err)
+	assert.False(t, seen[v5], "user created again")
+	_, version, err = s.GetUserPermsVersion(ctx, "alice")
+	assert.NoError(t, err)
+	assert.Equal(t, v5, version)
+
+	// a user without grants exists, so is not at version ""
+	assert.NoError(t, s.CreateUser(ctx, "bob", NewKey("bob"), false))
+	_, err = s.UpdateGrantsIf(ctx, "bob", "", []*permissions.Permission{{ID: "g3", Type: permissions.Read, Table: "t1"}}, nil)
+	assert.ErrorIs(t, err, storage.VersionConflictError)
+	_, version, err = s.GetUserPermsVersion(ctx, "bob")
+	assert.NoError(t, err)
+	_, err = s.UpdateGrantsIf(ctx, "bob", version, []*permissions.Permission{{ID: "g3", Type: permissions.Read, Table: "t1"}}, nil)
+	assert.NoError(t, err)
+}
+
+func testGetTableGrants(t *testing.T, s storage.ACLStorage) {
+	ctx := context.Background()
+	alice := []*permissions.Permission{{Type: permissions.Read, Table: "t1"}, {Type: permissions.Read, Table: "t2"}}
+	bob := []*permissions.Permission{{Type: permissions.Write, Table: "t1", RowKeys: [][]string{{"5"}}}}
+	assert.NoError(t, s.StoreUserPerms(ctx, "alice", alice))
+	assert.NoError(t, s.StoreUserPerms(ctx, "bob", bob))
+
+	grants, err := s.GetTableGrants(ctx, "t1")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]*permissions.Permission{"alice": alice[:1], "bob": bob}, grants)
+	grants, err = s.GetTableGrants(ctx, "t3")
+	assert.NoError(t, err)
+	assert.Empty(t, grants)
+}
+
+func testUserLifecycle(t *testing.T, s storage.ACLStorage) {
+	ctx := context.Background()
+	user := "eve'; --"
+
+	assert.NoError(t, s.CreateUser(ctx, user, NewKey(user), true))
+	assert.Error(t, s.CreateUser(ctx, user, NewKey("other"), false), "duplicate user")
+	assert.NoError(t, s.StoreUserPerms(ctx, user, []*permissions.Permission{{Type: permissions.Read, Table: "t1"}}))
+
+	_, admins, err := s.GetAllUserInfo(ctx)
+	assert.NoError(t, err)
+	assert.Contains(t, admins, user)
+
+	assert.NoError(t, s.SetUserAdmin(ctx, user, false))
+	assert.NoError(t, s.SetUserDisabled(ctx, user, true))
+	assert.Error(t, s.SetUserDisabled(ctx, "missing", true))
+	assert.Error(t, s.SetUserAdmin(ctx, "missing", true))
+	_, admins, err = s.GetAllUserInfo(ctx)
+	assert.NoError(t, err)
+	assert.Empty(t, admins)
+	disabled, err := s.GetDisabledUsers(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]struct{}{user: {}}, disabled)
+
+	assert.NoError(t, s.DeleteUser(ctx, user))
+	all, _, err := s.GetAllUserInfo(ctx)
+	assert.NoError(t, err)
+	assert.Empty(t, all)
+	allKeys, err := s.GetAllKeys(ctx)
+	assert.NoError(t, err)
+	assert.Empty(t, allKeys)
+	grants, err := s.GetTableGrants(ctx, "t1")
+	assert.NoError(t, err)
+	assert.Empty(t, grants)
+	disabled, err = s.GetDisabledUsers(ctx)
+	assert.NoError(t, err)
+	assert.Empty(t, disabled)
+}
+
+func testKeys(t *testing.T, s storage.ACLStorage) {
+	ctx := context.Background()
+	assert.NoError(t, s.CreateUser(ctx, "alice", NewKey("alice"), false))
+
+	expires := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	second := NewKey("alice")
+	second.ID = "second'key"
+	second.Secret = "second'key.plaintext"
+	second.ExpiresAt = &expires
+	assert.NoError(t, s.StoreKey(ctx, second))
+	assert.Error(t, s.StoreKey(ctx, second), "duplicate id")
+	assert.NoError(t, s.SetKeyHash(ctx, second.ID, []byte("rehashed")))
+	assert.NoError(t, s.SetKeyExpiry(ctx, "id-alice", expires))
+
+	allKeys, err := s.GetAllKeys(ctx)
+	assert.NoError(t, err)
+	assert.Len(t, allKeys, 2)
+	sort.Slice(allKeys, func(i, j int) bool {
+		return allKeys[i].ID < allKeys[j].ID
+	})
+	for _, k := range allKeys {
+		assert.Equal(t, "alice", k.User)
+		assert.Equal(t, expires, *k.ExpiresAt)
+		assert.Empty(t, k.Secret, "plaintext secrets are not stored")
+	}
+	assert.Equal(t, []byte("hash-alice"), allKeys[0].Hash)
+	assert.Equal(t, []byte("rehashed"), allKeys[1].Hash)
+
+	assert.NoError(t, s.DeleteKey(ctx, second.ID))
+	allKeys, err = s.GetAllKeys(ctx)
+	assert.NoError(t, err)
+	assert.Len(t, allKeys, 1)
+}
+
+func testElevations(t *testing.T, s storage.ACLStorage) {
+	ctx := context.Background()
+	now := time.Now()
+	assert.NoError(t, s.CreateUser(ctx, "alice", NewKey("alice"), false))
+	assert.NoError(t, s.RecordElevation(ctx, "e1", "alice", "incident 'INC-1'", now, now.Add(time.Hour)))
+	assert.NoError(t, s.RecordElevatedQuery(ctx, "e1", "SELECT * FROM t WHERE name = 'x'", now))
+	assert.NoError(t, s.RecordElevation(ctx, "e0", "alice", "earlier", now.Add(-time.Hour), now))
+	assert.NoError(t, s.RecordElevation(ctx, "e2", "alice", "", now.Add(time.Minute), now.Add(2*time.Hour)))
+
+	active, err := s.GetActiveElevations(ctx, now)
+	assert.NoError(t, err)
+	if assert.Len(t, active, 2, "elevations that have ended are not active") {
+		assert.Equal(t, "e1", active[0].ID)
+		assert.Equal(t, "alice", active[0].User)
+		assert.Equal(t, "incident 'INC-1'", active[0].Reason)
+		assert.True(t, now.Equal(active[0].Start))
+		assert.True(t, now.Add(time.Hour).Equal(active[0].End))
+		assert.Equal(t, "e2", active[1].ID)
+	}
+	active, err = s.GetActiveElevations(ctx, now.Add(time.Hour))
+	assert.NoError(t, err)
+	if assert.Len(t, active, 1) {
+		assert.Equal(t, "e2", active[0].ID)
+	}
+
+	breakGlass, err := s.GetBreakGlassUsers(ctx)
+	assert.NoError(t, err)
+	assert.Empty(t, breakGlass)
+	tableAdmins, err := s.GetTableAdmins(ctx)
+	assert.NoError(t, err)
+	assert.Empty(t, tableAdmins)
+}
+
+func testWatch(t *testing.T, s storage.ACLStorage) {
+	ctx := context.Background()
+	start, err := s.ChangeVersion(ctx)
+	assert.NoError(t, err)
+
+	watchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	changes, done := watch(watchCtx, s, start)
+
+	assert.NoError(t, s.StoreUserPerms(ctx, "alice", []*permissions.Permission{{ID: "g1", Type: permissions.Read, Table: "t1"}}))
+	seen := waitForChanges(t, changes, start, storage.Change{User: "alice", Kind: storage.GrantsChanged})
+	aliceVersion := seen[len(seen)-1].Version
+	assert.NoError(t, s.CreateUser(ctx, "bob", NewKey("bob"), false))
+	assert.NoError(t, s.SetUserDisabled(ctx, "bob", true))
+	seen = waitForChanges(t, changes, aliceVersion, storage.Change{User: "bob", Kind: storage.UserChanged})
+	latest, err := s.ChangeVersion(ctx)
+	assert.NoError(t, err)
+	assert.GreaterOrEqual(t, latest, seen[len(seen)-1].Version)
+
+	// resuming skips the changes already seen
+	resumed, resumedDone := watch(watchCtx, s, aliceVersion)
+	assert.NoError(t, s.DeleteUser(ctx, "bob"))
+	for _, c := range waitForChanges(t, resumed, aliceVersion, storage.Change{User: "bob", Kind: storage.UserChanged}) {
+		assert.NotEqual(t, "alice", c.User)
+	}
+
+	cancel()
+	for _, done := range []chan error{done, resumedDone} {
+		select {
+		case err := <-done:
+			assert.ErrorIs(t, err, context.Canceled)
+		case <-time.After(watchTimeout):
+			t.Fatal("Watch did not return once its context was cancelled")
+		}
+	}
+}
+
+// watch runs s.Watch in the background, passing on the changes it sees and its result.
+func watch(ctx context.Context, s storage.ACLStorage, since uint64) (chan storage.Change, chan error) {
+	changes := make(chan storage.Change, 100)
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Watch(ctx, since, func(c storage.Change) { changes <- c })
+	}()
+	return changes, done
+}
+
+// waitForChanges reads changes until one matches want's user and kind, checking that versions increase from after,
+// and returns those read.
+func waitForChanges(t *testing.T, changes chan storage.Change, after uint64, want storage.Change) []storage.Change {
+	t.Helper()
+	var seen []storage.Change
+	timeout := time.After(watchTimeout)
+	for {
+		select {
+		case c := <-changes:
+			assert.Greater(t, c.Version, after, "versions increase")
+			after = c.Version
+			seen = append(seen, c)
+			if c.User == want.User && c.Kind == want.Kind {
+				return seen
+			}
+		case <-timeout:
+			t.Fatalf("no %v change to %s within %v, saw %v", want.Kind, want.User, watchTimeout, seen)
+		}
+	}
+}
@@ -0,0 +1,16 @@
+package storage
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// VersionConflictError is returned by conditional writes when the user's grants changed since the given version.
+var VersionConflictError = fmt.Errorf("grants changed since they were read")
+
+// GrantsVersion formats a user's grants version, a counter stores keep for each user and move on with every change to
+// the user's grants. Counters never go back, even when a user is deleted and created again, so a version is never
+// reused. A user that does not exist has version "".
+func GrantsVersion(counter uint64) string {
+	return strconv.FormatUint(counter, 10)
+}
@@ -0,0 +1,224 @@
+package acl
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"chroma1/internal/acl/storage"
+	"chroma1/internal/auth"
+	"chroma1/model/identity"
+	"chroma1/model/keys"
+	"chroma1/model/permissions"
+)
+
+var (
+	UserExistsError  = fmt.Errorf("user already exists")
+	NoSuchUserError  = fmt.Errorf("no such user")
+	SelfLockoutError = fmt.Errorf("admins cannot disable, demote or delete themselves")
+)
+
+// CreateUser creates a user with no permissions and returns their first API key.
+func (acl *ACLManager) CreateUser(ctx context.Context, caller *identity.Identity, user string, isAdmin bool) (string, error) {
+	acl.mu.Lock()
+	defer acl.mu.Unlock()
+
+	if !acl.isAdmin(caller) {
+		return "", NotAdminError
+	}
+	if acl.userExists(user) {
+		return "", UserExistsError
+	}
+
+	newKey, err := acl.newAPIKey(user, "initial", nil)
+	if err != nil {
+		return "", err
+	}
+	if err := acl.storage.CreateUser(ctx, user, newKey, isAdmin); err != nil {
+		return "", fmt.Errorf("error creating user %s: %w", user, err)
+	}
+	acl.keys[newKey.ID] = newKey
+	acl.cachePerms(user, make([]*permissions.Permission, 0))
+	if isAdmin {
+		acl.admins[user] = struct{}{}
+	}
+	return newKey.Secret, nil
+}
+
+// SetUserDisabled disables or re-enables a user. A disabled user's keys are rejected but their permissions are kept.
+func (acl *ACLManager) SetUserDisabled(ctx context.Context, caller *identity.Identity, user string, disabled bool) error {
+	acl.mu.Lock()
+	defer acl.mu.Unlock()
+
+	if err := acl.checkUserAdmin(caller, user); err != nil {
+		return err
+	}
+	if err := acl.storage.SetUserDisabled(ctx, user, disabled); err != nil {
+		return fmt.Errorf("error updating user %s: %w", user, err)
+	}
+	if disabled {
+		acl.disabledUsers[user] = struct{}{}
+		delete(acl.elevations, user)
+	} else {
+		delete(acl.disabledUsers, user)
+	}
+	return nil
+}
+
+// SetAdmin promotes a user to superadmin or demotes them.
+func (acl *ACLManager) SetAdmin(ctx context.Context, caller *identity.Identity, user string, isAdmin bool) error {
+	acl.mu.Lock()
+	defer acl.mu.Unlock()
+
+	if err := acl.checkUserAdmin(caller, user); err != nil {
+		return err
+	}
+	if err := acl.storage.SetUserAdmin(ctx, user, isAdmin); err != nil {
+		return fmt.Errorf("error updating user %s: %w", user, err)
+	}
+	if isAdmin {
+		acl.admins[user] = struct{}{}
+	} else {
+		delete(acl.admins, user)
+	}
+	return nil
+}
+
+// DeleteUser removes a user, their keys and all of their permissions.
+func (acl *ACLManager) DeleteUser(ctx context.Context, caller *identity.Identity, user string) error {
+	acl.mu.Lock()
+	defer acl.mu.Unlock()
+
+	if err := acl.checkUserAdmin(caller, user); err != nil {
+		return err
+	}
+	if err := acl.storage.DeleteUser(ctx, user); err != nil {
+		return fmt.Errorf("error deleting user %s: %w", user, err)
+	}
+	acl.forgetUser(user)
+	return nil
+}
+
+// forgetUser drops user, their keys and everything cached about them. Must be called with acl.mu held.
+func (acl *ACLManager) forgetUser(user string) {
+	for id, k := range acl.keys {
+		if k.User == user {
+			delete(acl.keys, id)
+		}
+	}
+	acl.uncachePerms(user)
+	delete(acl.admins, user)
+	delete(acl.disabledUsers, user)
+	delete(acl.tableAdmins, user)
+	delete(acl.breakGlassUsers, user)
+	delete(acl.elevations, user)
+}
+
+// forgetIfDeleted forgets user if err says storage no longer has them, e.g. because another process deleted them and
+// their cached permissions expired before the change was seen. Users cached again meanwhile, e.g. because they were
+// created again, are kept. Must be called with acl.mu held.
+func (acl *ACLManager) forgetIfDeleted(user string, err error) {
+	if _, cached := acl.perms.Peek(user); !cached && errors.Is(err, storage.NoSuchUserError) {
+		acl.forgetUser(user)
+	}
+}
+
+// checkUserAdmin verifies that the caller is a superadmin who may manage the existing user target.
+// Must be called with acl.mu held.
+func (acl *ACLManager) checkUserAdmin(caller *identity.Identity, target string) error {
+	if !acl.isAdmin(caller) {
+		return NotAdminError
+	}
+	if !acl.userExists(target) {
+		return NoSuchUserError
+	}
+	if caller.User == target {
+		return SelfLockoutError
+	}
+	return nil
+}
+
+// AuthenticateKey resolves an API key token to the identity of its user, rejecting unknown or expired keys and
+// disabled users.
+func (acl *ACLManager) AuthenticateKey(key string) (*identity.Identity, error) {
+	acl.mu.Lock()
+	defer acl.mu.Unlock()
+
+	k, ok := acl.lookupKey(key)
+	if !ok || !k.ValidAt(acl.now()) {
+		return nil, NoSuchKeyError
+	}
+	if _, ok := acl.disabledUsers[k.User]; ok {
+		return nil, UserDisabledError
+	}
+	_, admin := acl.admins[k.User]
+	return &identity.Identity{
+		User:   k.User,
+		Admin:  admin,
+		Method: auth.MethodAPIKey,
+	}, nil
+}
+
+// callerUser returns the caller's user id, rejecting unauthenticated callers, users unknown to the ACL store and
+// disabled users.
+// Must be called with acl.mu held.
+func (acl *ACLManager) callerUser(caller *identity.Identity) (string, error) {
+	if caller == nil || !acl.userExists(caller.User) {
+		return "", UnauthenticatedError
+	}
+	if _, ok := acl.disabledUsers[caller.User]; ok {
+		return "", UserDisabledError
+	}
+	return caller.User, nil
+}
+
+// isAdmin reports whether the caller is an enabled superadmin, either per the ACL store or per their authenticator.
+// Must be called with acl.mu held.
+func (acl *ACLManager) isAdmin(caller *identity.Identity) bool {
+	user, err := acl.callerUser(caller)
+	if err != nil {
+		return false
+	}
+	_, ok := acl.admins[user]
+	return ok || caller.Admin
+}
+
+// userExists reports whether user is known to exist. Users stay known while their cached permissions are expired, so
+// that they keep their access through storage outages, until storage says they are gone (see forgetIfDeleted) or a
+// reload drops them. Must be called with acl.mu held.
+func (acl *ACLManager) userExists(user string) bool {
+	return acl.perms.Contains(user)
+}
+
+// newAPIKey generates a fresh key for user. It is not stored. The returned Secret holds the full client token.
+// Must be called with acl.mu held.
+func (acl *ACLManager) newAPIKey(user, label string, expiresAt *time.Time) (*keys.APIKey, error) {
+	id, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+	secret, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+	return &keys.APIKey{
+		ID:        id,
+		User:      user,
+		Secret:    id + "." + secret,
+		Hash:      acl.hashSecret(secret),
+		Label:     label,
+		CreatedAt: acl.now(),
+		ExpiresAt: expiresAt,
+	}, nil
+}
+
+func randomToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
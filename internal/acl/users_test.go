@@ -0,0 +1,157 @@
+package acl_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"chroma1/internal/acl"
+	"chroma1/internal/acl/storage/memory"
+	"chroma1/model/identity"
+	"chroma1/model/permissions"
+)
+
+// storedUsers returns the users s holds, the admins among them and the disabled ones.
+func storedUsers(t *testing.T, s *memory.MemoryACLStorage) (users, admins, disabled map[string]struct{}) {
+	t.Helper()
+	ctx := context.Background()
+	perms, admins, err := s.GetAllUserInfo(ctx)
+	assert.NoError(t, err)
+	users = make(map[string]struct{}, len(perms))
+	for u := range perms {
+		users[u] = struct{}{}
+	}
+	disabled, err = s.GetDisabledUsers(ctx)
+	assert.NoError(t, err)
+	return users, admins, disabled
+}
+
+func TestCreateUser(t *testing.T) {
+	ctx := context.Background()
+	man, s, _ := newManager(t, nil)
+
+	_, err := man.CreateUser(ctx, alice, "bob", false)
+	assert.ErrorIs(t, err, acl.NotAdminError)
+	_, err = man.CreateUser(ctx, root, "alice", false)
+	assert.ErrorIs(t, err, acl.UserExistsError)
+
+	key, err := man.CreateUser(ctx, root, "bob", false)
+	assert.NoError(t, err)
+	if k := storedKey(t, s, key); assert.NotNil(t, k) {
+		assert.Equal(t, "bob", k.User)
+	}
+	_, admins, _ := storedUsers(t, s)
+	assert.NotContains(t, admins, "bob")
+	perms, _, err := man.GetPermissions(ctx, root, "bob")
+	assert.NoError(t, err)
+	assert.Empty(t, perms, "a new user holds no permissions")
+	bob, err := man.AuthenticateKey(key)
+	if assert.NoError(t, err, "the new key is accepted") {
+		assert.Equal(t, "bob", bob.User)
+		assert.False(t, bob.Admin)
+	}
+	_, err = man.CheckPermissions(ctx, bob, "SELECT * FROM accounts WHERE id = 1")
+	assert.ErrorAs(t, err, &acl.InsufficientPermissionsError{})
+
+	key, err = man.CreateUser(ctx, root, "carol", true)
+	assert.NoError(t, err)
+	_, admins, _ = storedUsers(t, s)
+	assert.Contains(t, admins, "carol")
+	carol, err := man.AuthenticateKey(key)
+	if assert.NoError(t, err) {
+		assert.True(t, carol.Admin)
+	}
+	_, err = man.CreateUser(ctx, carol, "dave", false)
+	assert.NoError(t, err, "a new admin can manage users")
+}
+
+func TestSetUserDisabled(t *testing.T) {
+	ctx := context.Background()
+	man, s, _ := newManager(t, []*permissions.Permission{
+		{Type: permissions.Read, Table: "accounts"},
+	})
+	sql := "SELECT * FROM accounts WHERE id = 1"
+	key, err := man.MintKey(ctx, alice, "alice", "", nil)
+	assert.NoError(t, err)
+
+	assert.ErrorIs(t, man.SetUserDisabled(ctx, alice, "root", true), acl.NotAdminError)
+	assert.ErrorIs(t, man.SetUserDisabled(ctx, root, "bob", true), acl.NoSuchUserError)
+	assert.ErrorIs(t, man.SetUserDisabled(ctx, root, "root", true), acl.SelfLockoutError)
+
+	assert.NoError(t, man.SetUserDisabled(ctx, root, "alice", true))
+	_, _, disabled := storedUsers(t, s)
+	assert.Contains(t, disabled, "alice")
+	_, err = man.CheckPermissions(ctx, alice, sql)
+	assert.ErrorIs(t, err, acl.UserDisabledError)
+	_, err = man.AuthenticateKey(key.Secret)
+	assert.ErrorIs(t, err, acl.UserDisabledError)
+	perms, _, err := man.GetPermissions(ctx, root, "alice")
+	assert.NoError(t, err)
+	assert.Len(t, perms, 1, "a disabled user keeps their permissions")
+
+	assert.NoError(t, man.SetUserDisabled(ctx, root, "alice", false))
+	_, _, disabled = storedUsers(t, s)
+	assert.NotContains(t, disabled, "alice")
+	_, err = man.CheckPermissions(ctx, alice, sql)
+	assert.NoError(t, err)
+
+	// a disabled admin loses their admin rights too
+	_, err = man.CreateUser(ctx, root, "bob", true)
+	assert.NoError(t, err)
+	assert.NoError(t, man.SetUserDisabled(ctx, root, "bob", true))
+	bob := &identity.Identity{User: "bob", Admin: true}
+	_, err = man.CreateUser(ctx, bob, "carol", false)
+	assert.ErrorIs(t, err, acl.NotAdminError)
+}
+
+func TestSetAdmin(t *testing.T) {
+	ctx := context.Background()
+	man, s, _ := newManager(t, nil)
+
+	assert.ErrorIs(t, man.SetAdmin(ctx, alice, "alice", true), acl.NotAdminError)
+	assert.ErrorIs(t, man.SetAdmin(ctx, root, "bob", true), acl.NoSuchUserError)
+	assert.ErrorIs(t, man.SetAdmin(ctx, root, "root", false), acl.SelfLockoutError)
+
+	assert.NoError(t, man.SetAdmin(ctx, root, "alice", true))
+	_, admins, _ := storedUsers(t, s)
+	assert.Contains(t, admins, "alice")
+	_, err := man.CreateUser(ctx, alice, "bob", false)
+	assert.NoError(t, err)
+
+	assert.NoError(t, man.SetAdmin(ctx, root, "alice", false))
+	_, admins, _ = storedUsers(t, s)
+	assert.NotContains(t, admins, "alice")
+	_, err = man.CreateUser(ctx, alice, "carol", false)
+	assert.ErrorIs(t, err, acl.NotAdminError)
+}
+
+func TestDeleteUser(t *testing.T) {
+	ctx := context.Background()
+	man, s, _ := newManager(t, []*permissions.Permission{
+		{Type: permissions.Read, Table: "accounts"},
+	})
+	key, err := man.MintKey(ctx, alice, "alice", "", nil)
+	assert.NoError(t, err)
+
+	assert.ErrorIs(t, man.DeleteUser(ctx, alice, "root"), acl.NotAdminError)
+	assert.ErrorIs(t, man.DeleteUser(ctx, root, "bob"), acl.NoSuchUserError)
+	assert.ErrorIs(t, man.DeleteUser(ctx, root, "root"), acl.SelfLockoutError)
+
+	assert.NoError(t, man.DeleteUser(ctx, root, "alice"))
+	users, _, _ := storedUsers(t, s)
+	assert.NotContains(t, users, "alice")
+	assert.Nil(t, storedKey(t, s, key.Secret))
+	assert.Nil(t, storedKey(t, s, "id-alice"))
+	_, err = man.AuthenticateKey(key.Secret)
+	assert.ErrorIs(t, err, acl.NoSuchKeyError)
+	_, err = man.CheckPermissions(ctx, alice, "SELECT * FROM accounts WHERE id = 1")
+	assert.ErrorIs(t, err, acl.UnauthenticatedError)
+	assert.ErrorIs(t, man.DeleteUser(ctx, root, "alice"), acl.NoSuchUserError)
+
+	// the name can be reused, without the old permissions
+	_, err = man.CreateUser(ctx, root, "alice", false)
+	assert.NoError(t, err)
+	_, err = man.CheckPermissions(ctx, alice, "SELECT * FROM accounts WHERE id = 1")
+	assert.ErrorAs(t, err, &acl.InsufficientPermissionsError{})
+}
@@ -0,0 +1,161 @@
+package acl
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"chroma1/internal/acl/storage"
+	"chroma1/model/permissions"
+)
+
+// watchRetryDelay is how long StartWatching waits before watching again after watching failed.
+const watchRetryDelay = 5 * time.Second
+
+// StartWatching keeps the caches in step with changes to storage made elsewhere, e.g. by other servers sharing it, until
+// ctx is cancelled, the manager is closed or storage is closed. A user's grants are refetched when they change; other changes reload
+// everything, as Reload does. Errors are passed to onErr if it is non-nil, and watching resumes after a delay.
+func (acl *ACLManager) StartWatching(ctx context.Context, onErr func(error)) {
+	ctx, cancel := acl.untilClosed(ctx)
+	w := &watcher{acl: acl, wake: make(chan struct{}, 1)}
+	acl.background.Add(2)
+	go func() {
+		defer acl.background.Done()
+		w.apply(ctx, onErr)
+	}()
+	go func() {
+		defer acl.background.Done()
+		defer cancel()
+		for {
+			acl.mu.Lock()
+			since := acl.version
+			acl.mu.Unlock()
+
+			err := acl.storage.Watch(ctx, since, w.add)
+			if ctx.Err() != nil {
+				return
+			}
+			if onErr != nil {
+				onErr(fmt.Errorf("error watching ACL storage: %w", err))
+			}
+			if errors.Is(err, storage.ClosedError) {
+				return
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(watchRetryDelay):
+			}
+		}
+	}()
+}
+
+// watcher queues changes from storage.Watch, so that a burst of them is applied in one go rather than one by one.
+type watcher struct {
+	acl *ACLManager
+
+	mu      sync.Mutex
+	pending []storage.Change
+	wake    chan struct{}
+}
+
+func (w *watcher) add(c storage.Change) {
+	w.mu.Lock()
+	w.pending = append(w.pending, c)
+	w.mu.Unlock()
+	w.signal()
+}
+
+func (w *watcher) signal() {
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+// apply applies the queued changes each time more arrive, until ctx is cancelled. Changes that fail to apply are retried.
+func (w *watcher) apply(ctx context.Context, onErr func(error)) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-w.wake:
+		}
+		w.mu.Lock()
+		changes := w.pending
+		w.pending = nil
+		w.mu.Unlock()
+
+		if err := w.acl.applyChanges(ctx, changes); err != nil {
+			if onErr != nil {
+				onErr(err)
+			}
+			// try again later, along with anything that arrives meanwhile
+			w.mu.Lock()
+			w.pending = append(changes, w.pending...)
+			w.mu.Unlock()
+			time.AfterFunc(watchRetryDelay, w.signal)
+		}
+	}
+}
+
+// applyChanges updates the caches for changes, skipping those they already reflect.
+func (acl *ACLManager) applyChanges(ctx context.Context, changes []storage.Change) error {
+	acl.mu.Lock()
+	defer acl.mu.Unlock()
+
+	var latest uint64
+	reload := false
+	users := make(map[string]struct{})
+	for _, c := range changes {
+		if c.Version <= acl.version {
+			continue
+		}
+		latest = c.Version
+		if c.Kind == storage.GrantsChanged {
+			users[c.User] = struct{}{}
+		} else {
+			reload = true
+		}
+	}
+	if latest == 0 {
+		return nil
+	}
+
+	if !reload {
+		for user := range users {
+			if err := acl.refetchPerms(ctx, user); err != nil {
+				// e.g. the user was deleted since; a reload catches up with whatever happened
+				reload = true
+				break
+			}
+		}
+	}
+	if reload {
+		if err := acl.load(ctx); err != nil {
+			return fmt.Errorf("error reloading ACLs after changes up to version %d: %w", latest, err)
+		}
+		if err := acl.hashPlaintextKeys(ctx); err != nil {
+			return err
+		}
+	}
+	if latest > acl.version {
+		acl.version = latest
+	}
+	return nil
+}
+
+// refetchPerms replaces the cached permissions for user with those in storage. Must be called with acl.mu held.
+func (acl *ACLManager) refetchPerms(ctx context.Context, user string) error {
+	perms, err := acl.storage.GetUserPerms(ctx, user)
+	if err != nil {
+		return err
+	}
+	for _, perm := range perms {
+		permissions.Normalize(perm)
+	}
+	acl.cachePerms(user, perms)
+	return nil
+}
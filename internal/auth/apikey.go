@@ -0,0 +1,30 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+
+	"chroma1/model/identity"
+)
+
+// APIKeyAuthenticator authenticates requests carrying an API key, either as a bearer token or in the X-API-Key header.
+type APIKeyAuthenticator struct {
+	keys KeyResolver
+}
+
+func NewAPIKeyAuthenticator(keys KeyResolver) *APIKeyAuthenticator {
+	return &APIKeyAuthenticator{
+		keys: keys,
+	}
+}
+
+func (a *APIKeyAuthenticator) Authenticate(ctx context.Context, r *http.Request) (*identity.Identity, error) {
+	key, ok := bearerToken(r)
+	if !ok {
+		key = r.Header.Get(apiKeyHeader)
+	}
+	if key == "" {
+		return nil, MissingCredentialsError
+	}
+	return a.keys.AuthenticateKey(key)
+}
@@ -0,0 +1,80 @@
+package auth_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"chroma1/internal/auth"
+	"chroma1/model/identity"
+)
+
+var unknownKeyError = fmt.Errorf("unknown key")
+
+// keyResolver resolves the single key it holds.
+type keyResolver struct {
+	key string
+	id  *identity.Identity
+}
+
+func (k keyResolver) AuthenticateKey(key string) (*identity.Identity, error) {
+	if key != k.key {
+		return nil, unknownKeyError
+	}
+	return k.id, nil
+}
+
+func TestAPIKeyAuthenticator(t *testing.T) {
+	alice := &identity.Identity{User: "alice", Method: auth.MethodAPIKey}
+	a, err := auth.New(auth.Config{}, keyResolver{key: "k1.secret", id: alice})
+	require.NoError(t, err)
+
+	testcases := []struct {
+		headers map[string]string
+		expErr  error
+	}{
+		{
+			headers: map[string]string{"Authorization": "Bearer k1.secret"},
+		},
+		{
+			headers: map[string]string{"Authorization": "bearer  k1.secret "},
+		},
+		{
+			headers: map[string]string{"X-API-Key": "k1.secret"},
+		},
+		{
+			// a bearer token takes precedence over the header
+			headers: map[string]string{"Authorization": "Bearer k2.secret", "X-API-Key": "k1.secret"},
+			expErr:  unknownKeyError,
+		},
+		{
+			// other schemes are not API keys
+			headers: map[string]string{"Authorization": "Basic k1.secret"},
+			expErr:  auth.MissingCredentialsError,
+		},
+		{
+			expErr: auth.MissingCredentialsError,
+		},
+	}
+	for i, tc := range testcases {
+		t.Run(fmt.Sprintf("TestAPIKeyAuthenticator case %v", i), func(t *testing.T) {
+			r, err := http.NewRequest(http.MethodPost, "/query", nil)
+			require.NoError(t, err)
+			for k, v := range tc.headers {
+				r.Header.Set(k, v)
+			}
+
+			id, err := a.Authenticate(context.Background(), r)
+			if tc.expErr != nil {
+				assert.ErrorIs(t, err, tc.expErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, alice, id)
+		})
+	}
+}
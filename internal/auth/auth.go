@@ -0,0 +1,65 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"chroma1/model/identity"
+)
+
+const (
+	MethodAPIKey = "api_key"
+	MethodJWT    = "jwt"
+	MethodMTLS   = "mtls"
+
+	apiKeyHeader = "X-API-Key"
+)
+
+var (
+	MissingCredentialsError = fmt.Errorf("no credentials supplied")
+)
+
+// Authenticator establishes the identity of the caller making an incoming request.
+type Authenticator interface {
+	Authenticate(ctx context.Context, r *http.Request) (*identity.Identity, error)
+}
+
+// KeyResolver resolves API key tokens to identities. Implemented by acl.ACLManager.
+type KeyResolver interface {
+	AuthenticateKey(key string) (*identity.Identity, error)
+}
+
+// Config selects and configures the authenticator used by the server.
+type Config struct {
+	// One of MethodAPIKey (the default), MethodJWT or MethodMTLS.
+	Method string     `json:"method"`
+	JWT    JWTConfig  `json:"jwt"`
+	MTLS   MTLSConfig `json:"mtls"`
+	// Secret the server HMACs API keys with at rest. Required whatever the method, since the server issues keys.
+	KeySecret string `json:"key_secret"`
+}
+
+// New builds the authenticator selected by cfg. keys is only used by the API key authenticator.
+func New(cfg Config, keys KeyResolver) (Authenticator, error) {
+	switch cfg.Method {
+	case "", MethodAPIKey:
+		return NewAPIKeyAuthenticator(keys), nil
+	case MethodJWT:
+		return NewJWTAuthenticator(cfg.JWT)
+	case MethodMTLS:
+		return NewTLSAuthenticator(cfg.MTLS), nil
+	}
+	return nil, fmt.Errorf("unknown authentication method %q", cfg.Method)
+}
+
+// bearerToken extracts the token from an "Authorization: Bearer <token>" header.
+func bearerToken(r *http.Request) (string, bool) {
+	h := r.Header.Get("Authorization")
+	scheme, token, ok := strings.Cut(h, " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") || token == "" {
+		return "", false
+	}
+	return strings.TrimSpace(token), true
+}
@@ -0,0 +1,271 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"chroma1/model/identity"
+)
+
+var (
+	InvalidTokenError = fmt.Errorf("invalid token")
+	ExpiredTokenError = fmt.Errorf("token has expired")
+)
+
+type JWTConfig struct {
+	// Path to a JSON Web Key Set holding the HMAC ("oct") and RSA verification keys.
+	JWKSFile string `json:"jwks_file"`
+	// If set, tokens must carry a matching "iss" claim.
+	Issuer string `json:"issuer"`
+	// If set, tokens must list this audience in their "aud" claim.
+	Audience string `json:"audience"`
+	// Claim holding the user id. Defaults to "sub".
+	UserClaim string `json:"user_claim"`
+	// Boolean claim that marks the caller as a superadmin. Admin rights are never derived from tokens if unset.
+	AdminClaim string `json:"admin_claim"`
+	// Tolerance for clock skew when checking "exp" and "nbf".
+	Leeway time.Duration `json:"leeway"`
+}
+
+// JWTAuthenticator authenticates bearer tokens that are JWTs signed with HS256/384/512 or RS256/384/512, verified
+// against keys from a local JWKS file.
+type JWTAuthenticator struct {
+	cfg  JWTConfig
+	keys []*jwk
+	now  func() time.Time
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	K   string `json:"k"` // oct
+	N   string `json:"n"` // RSA
+	E   string `json:"e"` // RSA
+
+	secret []byte
+	rsaKey *rsa.PublicKey
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+func NewJWTAuthenticator(cfg JWTConfig) (*JWTAuthenticator, error) {
+	b, err := os.ReadFile(cfg.JWKSFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading JWKS file: %w", err)
+	}
+	keys, err := parseJWKS(b)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.UserClaim == "" {
+		cfg.UserClaim = "sub"
+	}
+	return &JWTAuthenticator{
+		cfg:  cfg,
+		keys: keys,
+		now:  time.Now,
+	}, nil
+}
+
+func (a *JWTAuthenticator) Authenticate(ctx context.Context, r *http.Request) (*identity.Identity, error) {
+	token, ok := bearerToken(r)
+	if !ok {
+		return nil, MissingCredentialsError
+	}
+	claims, err := a.verify(token)
+	if err != nil {
+		return nil, err
+	}
+	user, ok := claims[a.cfg.UserClaim].(string)
+	if !ok || user == "" {
+		return nil, fmt.Errorf("%w: missing %q claim", InvalidTokenError, a.cfg.UserClaim)
+	}
+	admin := false
+	if a.cfg.AdminClaim != "" {
+		admin, _ = claims[a.cfg.AdminClaim].(bool)
+	}
+	return &identity.Identity{
+		User:   user,
+		Admin:  admin,
+		Method: MethodJWT,
+		Claims: claims,
+	}, nil
+}
+
+// verify checks the token's signature and standard claims, returning its claims.
+func (a *JWTAuthenticator) verify(token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, InvalidTokenError
+	}
+	var header jwtHeader
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, InvalidTokenError
+	}
+	if err := a.verifySignature(header, parts[0]+"."+parts[1], sig); err != nil {
+		return nil, err
+	}
+
+	var claims map[string]interface{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	if err := a.validateClaims(claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+type jwtAlg struct {
+	kty      string
+	hashFn   func() hash.Hash
+	hashType crypto.Hash
+}
+
+// Supported signing algorithms. "none" and everything else is rejected.
+var jwtAlgs = map[string]jwtAlg{
+	"HS256": {"oct", sha256.New, crypto.SHA256},
+	"HS384": {"oct", sha512.New384, crypto.SHA384},
+	"HS512": {"oct", sha512.New, crypto.SHA512},
+	"RS256": {"RSA", sha256.New, crypto.SHA256},
+	"RS384": {"RSA", sha512.New384, crypto.SHA384},
+	"RS512": {"RSA", sha512.New, crypto.SHA512},
+}
+
+func (a *JWTAuthenticator) verifySignature(header jwtHeader, signed string, sig []byte) error {
+	alg, ok := jwtAlgs[header.Alg]
+	if !ok {
+		return fmt.Errorf("%w: unsupported algorithm %q", InvalidTokenError, header.Alg)
+	}
+
+	for _, k := range a.candidateKeys(header.Kid, alg.kty) {
+		switch alg.kty {
+		case "oct":
+			mac := hmac.New(alg.hashFn, k.secret)
+			mac.Write([]byte(signed))
+			if hmac.Equal(mac.Sum(nil), sig) {
+				return nil
+			}
+		case "RSA":
+			h := alg.hashFn()
+			h.Write([]byte(signed))
+			if rsa.VerifyPKCS1v15(k.rsaKey, alg.hashType, h.Sum(nil), sig) == nil {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("%w: bad signature", InvalidTokenError)
+}
+
+// candidateKeys returns the keys of the given type that may have signed a token with the given key id. Tokens without
+// a key id are tried against every key of the right type.
+func (a *JWTAuthenticator) candidateKeys(kid, kty string) []*jwk {
+	res := make([]*jwk, 0)
+	for _, k := range a.keys {
+		if k.Kty == kty && (kid == "" || k.Kid == kid) {
+			res = append(res, k)
+		}
+	}
+	return res
+}
+
+func (a *JWTAuthenticator) validateClaims(claims map[string]interface{}) error {
+	now := a.now()
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return fmt.Errorf("%w: missing exp claim", InvalidTokenError)
+	}
+	if now.After(time.Unix(int64(exp), 0).Add(a.cfg.Leeway)) {
+		return ExpiredTokenError
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(a.cfg.Leeway).Before(time.Unix(int64(nbf), 0)) {
+		return fmt.Errorf("%w: token not yet valid", InvalidTokenError)
+	}
+	if a.cfg.Issuer != "" && claims["iss"] != a.cfg.Issuer {
+		return fmt.Errorf("%w: unexpected issuer", InvalidTokenError)
+	}
+	if a.cfg.Audience != "" && !hasAudience(claims["aud"], a.cfg.Audience) {
+		return fmt.Errorf("%w: unexpected audience", InvalidTokenError)
+	}
+	return nil
+}
+
+func hasAudience(aud interface{}, want string) bool {
+	switch v := aud.(type) {
+	case string:
+		return v == want
+	case []interface{}:
+		for _, a := range v {
+			if a == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func decodeSegment(seg string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return InvalidTokenError
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return InvalidTokenError
+	}
+	return nil
+}
+
+func parseJWKS(b []byte) ([]*jwk, error) {
+	var set struct {
+		Keys []*jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(b, &set); err != nil {
+		return nil, fmt.Errorf("error parsing JWKS: %w", err)
+	}
+	for _, k := range set.Keys {
+		switch k.Kty {
+		case "oct":
+			secret, err := base64.RawURLEncoding.DecodeString(k.K)
+			if err != nil {
+				return nil, fmt.Errorf("error decoding key %q: %w", k.Kid, err)
+			}
+			k.secret = secret
+		case "RSA":
+			n, err := base64.RawURLEncoding.DecodeString(k.N)
+			if err != nil {
+				return nil, fmt.Errorf("error decoding key %q: %w", k.Kid, err)
+			}
+			e, err := base64.RawURLEncoding.DecodeString(k.E)
+			if err != nil {
+				return nil, fmt.Errorf("error decoding key %q: %w", k.Kid, err)
+			}
+			k.rsaKey = &rsa.PublicKey{
+				N: new(big.Int).SetBytes(n),
+				E: int(new(big.Int).SetBytes(e).Int64()),
+			}
+		default:
+			return nil, fmt.Errorf("unsupported key type %q for key %q", k.Kty, k.Kid)
+		}
+	}
+	return set.Keys, nil
+}
@@ -0,0 +1,147 @@
+package auth_test
+
+import (
+	"context"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"chroma1/internal/auth"
+)
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func signedToken(t *testing.T, alg, kid string, claims map[string]interface{}, sign func(string) []byte) string {
+	h, err := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	require.NoError(t, err)
+	c, err := json.Marshal(claims)
+	require.NoError(t, err)
+	signed := b64(h) + "." + b64(c)
+	return signed + "." + b64(sign(signed))
+}
+
+func TestJWTAuthenticator(t *testing.T) {
+	hmacSecret := []byte("0123456789abcdef0123456789abcdef")
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	jwks, err := json.Marshal(map[string]interface{}{
+		"keys": []map[string]string{
+			{"kty": "oct", "kid": "hmac", "k": b64(hmacSecret)},
+			{"kty": "RSA", "kid": "rsa", "n": b64(rsaKey.N.Bytes()), "e": b64(big.NewInt(int64(rsaKey.E)).Bytes())},
+		},
+	})
+	require.NoError(t, err)
+	jwksFile := filepath.Join(t.TempDir(), "jwks.json")
+	require.NoError(t, os.WriteFile(jwksFile, jwks, 0600))
+
+	a, err := auth.New(auth.Config{
+		Method: auth.MethodJWT,
+		JWT: auth.JWTConfig{
+			JWKSFile:   jwksFile,
+			Issuer:     "sso",
+			Audience:   "acl",
+			AdminClaim: "acl_admin",
+		},
+	}, nil)
+	require.NoError(t, err)
+
+	hs256 := func(s string) []byte {
+		mac := hmac.New(sha256.New, hmacSecret)
+		mac.Write([]byte(s))
+		return mac.Sum(nil)
+	}
+	rs256 := func(s string) []byte {
+		d := sha256.Sum256([]byte(s))
+		sig, err := rsa.SignPKCS1v15(rand.Reader, rsaKey, crypto.SHA256, d[:])
+		require.NoError(t, err)
+		return sig
+	}
+	claims := func(overrides map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{
+			"sub": "alice",
+			"iss": "sso",
+			"aud": []string{"acl", "other"},
+			"exp": time.Now().Add(time.Hour).Unix(),
+		}
+		for k, v := range overrides {
+			c[k] = v
+		}
+		return c
+	}
+
+	testcases := []struct {
+		token     string
+		expUser   string
+		expAdmin  bool
+		expFailed bool
+	}{
+		{
+			token:   signedToken(t, "HS256", "hmac", claims(nil), hs256),
+			expUser: "alice",
+		},
+		{
+			token:    signedToken(t, "RS256", "rsa", claims(map[string]interface{}{"acl_admin": true}), rs256),
+			expUser:  "alice",
+			expAdmin: true,
+		},
+		{
+			// RSA-signed token claiming to be HMAC-signed
+			token:     signedToken(t, "HS256", "rsa", claims(nil), rs256),
+			expFailed: true,
+		},
+		{
+			token:     signedToken(t, "none", "", claims(nil), func(string) []byte { return nil }),
+			expFailed: true,
+		},
+		{
+			token:     signedToken(t, "HS256", "hmac", claims(map[string]interface{}{"exp": time.Now().Add(-time.Hour).Unix()}), hs256),
+			expFailed: true,
+		},
+		{
+			token:     signedToken(t, "HS256", "hmac", claims(map[string]interface{}{"iss": "elsewhere"}), hs256),
+			expFailed: true,
+		},
+		{
+			token:     signedToken(t, "HS256", "hmac", claims(map[string]interface{}{"aud": "other"}), hs256),
+			expFailed: true,
+		},
+		{
+			token:     signedToken(t, "HS256", "hmac", claims(nil), hs256) + "x",
+			expFailed: true,
+		},
+	}
+	for i, tc := range testcases {
+		t.Run(fmt.Sprintf("TestJWTAuthenticator case %v", i), func(t *testing.T) {
+			r, err := http.NewRequest(http.MethodPost, "/query", nil)
+			require.NoError(t, err)
+			r.Header.Set("Authorization", "Bearer "+tc.token)
+
+			id, err := a.Authenticate(context.Background(), r)
+			if tc.expFailed {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expUser, id.User)
+			assert.Equal(t, tc.expAdmin, id.Admin)
+			assert.Equal(t, auth.MethodJWT, id.Method)
+		})
+	}
+}
@@ -0,0 +1,90 @@
+package auth
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+
+	"chroma1/model/identity"
+)
+
+const (
+	CertFieldCommonName = "cn"
+	CertFieldEmail      = "email"
+	CertFieldURI        = "uri"
+)
+
+type MTLSConfig struct {
+	// Which certificate field holds the user id: CertFieldCommonName (the default), CertFieldEmail or CertFieldURI.
+	UserField string `json:"user_field"`
+	// Certificates carrying any of these organizational units are superadmins.
+	AdminOrganizationalUnits []string `json:"admin_organizational_units"`
+}
+
+// TLSAuthenticator identifies callers by the client certificate they presented. Chain verification is left to the
+// TLS listener (tls.Config.ClientAuth and ClientCAs); only verified chains are trusted here.
+type TLSAuthenticator struct {
+	cfg MTLSConfig
+}
+
+func NewTLSAuthenticator(cfg MTLSConfig) *TLSAuthenticator {
+	return &TLSAuthenticator{
+		cfg: cfg,
+	}
+}
+
+func (a *TLSAuthenticator) Authenticate(ctx context.Context, r *http.Request) (*identity.Identity, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil, MissingCredentialsError
+	}
+	cert := r.TLS.VerifiedChains[0][0]
+	user, err := a.userFromCert(cert)
+	if err != nil {
+		return nil, err
+	}
+	return &identity.Identity{
+		User:   user,
+		Admin:  a.isAdminCert(cert),
+		Method: MethodMTLS,
+		Claims: map[string]interface{}{
+			"subject":             cert.Subject.String(),
+			"organizational_unit": cert.Subject.OrganizationalUnit,
+		},
+	}, nil
+}
+
+func (a *TLSAuthenticator) userFromCert(cert *x509.Certificate) (string, error) {
+	field := a.cfg.UserField
+	if field == "" {
+		field = CertFieldCommonName
+	}
+	switch field {
+	case CertFieldCommonName:
+		if cert.Subject.CommonName != "" {
+			return cert.Subject.CommonName, nil
+		}
+	case CertFieldEmail:
+		if len(cert.EmailAddresses) > 0 {
+			return cert.EmailAddresses[0], nil
+		}
+	case CertFieldURI:
+		if len(cert.URIs) > 0 {
+			return cert.URIs[0].String(), nil
+		}
+	default:
+		return "", fmt.Errorf("unknown certificate user field %q", field)
+	}
+	return "", fmt.Errorf("client certificate has no %s to identify the user", field)
+}
+
+func (a *TLSAuthenticator) isAdminCert(cert *x509.Certificate) bool {
+	for _, ou := range cert.Subject.OrganizationalUnit {
+		for _, admin := range a.cfg.AdminOrganizationalUnits {
+			if ou == admin {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,103 @@
+package auth_test
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"chroma1/internal/auth"
+)
+
+func TestTLSAuthenticator(t *testing.T) {
+	spiffe, err := url.Parse("spiffe://example.org/alice")
+	require.NoError(t, err)
+	cert := &x509.Certificate{
+		Subject:        pkix.Name{CommonName: "alice", OrganizationalUnit: []string{"eng", "dba"}},
+		EmailAddresses: []string{"alice@example.org"},
+		URIs:           []*url.URL{spiffe},
+	}
+
+	testcases := []struct {
+		cfg       auth.MTLSConfig
+		cert      *x509.Certificate
+		expUser   string
+		expAdmin  bool
+		expFailed bool
+	}{
+		{
+			cert:    cert,
+			expUser: "alice",
+		},
+		{
+			cfg:      auth.MTLSConfig{AdminOrganizationalUnits: []string{"ops", "dba"}},
+			cert:     cert,
+			expUser:  "alice",
+			expAdmin: true,
+		},
+		{
+			cfg:     auth.MTLSConfig{UserField: auth.CertFieldEmail, AdminOrganizationalUnits: []string{"ops"}},
+			cert:    cert,
+			expUser: "alice@example.org",
+		},
+		{
+			cfg:     auth.MTLSConfig{UserField: auth.CertFieldURI},
+			cert:    cert,
+			expUser: "spiffe://example.org/alice",
+		},
+		{
+			cfg:       auth.MTLSConfig{UserField: "serial"},
+			cert:      cert,
+			expFailed: true,
+		},
+		{
+			cfg:       auth.MTLSConfig{UserField: auth.CertFieldEmail},
+			cert:      &x509.Certificate{Subject: pkix.Name{CommonName: "alice"}},
+			expFailed: true,
+		},
+		{
+			// no verified chain
+			expFailed: true,
+		},
+	}
+	for i, tc := range testcases {
+		t.Run(fmt.Sprintf("TestTLSAuthenticator case %v", i), func(t *testing.T) {
+			a, err := auth.New(auth.Config{Method: auth.MethodMTLS, MTLS: tc.cfg}, nil)
+			require.NoError(t, err)
+			r, err := http.NewRequest(http.MethodPost, "/query", nil)
+			require.NoError(t, err)
+			if tc.cert != nil {
+				r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{tc.cert}}}
+			}
+
+			id, err := a.Authenticate(context.Background(), r)
+			if tc.expFailed {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expUser, id.User)
+			assert.Equal(t, tc.expAdmin, id.Admin)
+			assert.Equal(t, auth.MethodMTLS, id.Method)
+			assert.Equal(t, tc.cert.Subject.OrganizationalUnit, id.Claims["organizational_unit"])
+		})
+	}
+}
+
+func TestTLSAuthenticatorUnverified(t *testing.T) {
+	a := auth.NewTLSAuthenticator(auth.MTLSConfig{})
+	r, err := http.NewRequest(http.MethodPost, "/query", nil)
+	require.NoError(t, err)
+	// a presented certificate the listener did not verify is not trusted
+	r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{{Subject: pkix.Name{CommonName: "alice"}}}}
+
+	_, err = a.Authenticate(context.Background(), r)
+	assert.ErrorIs(t, err, auth.MissingCredentialsError)
+}
@@ -5,8 +5,27 @@ import (
 	"database/sql"
 )
 
+// ForeignKey describes a reference from columns of a child table to columns of a parent table.
+type ForeignKey struct {
+	// Parent table name
+	Table string
+	// Child columns, in the same order as the parent columns they reference.
+	From []string
+	To   []string
+}
+
 type DB interface {
+	// Gets every primary key column of each table, in key order. Permissions key rows by the whole primary key, and
+	// foreign keys to a composite key reference all of it.
 	GetPKs(ctx context.Context) (map[string][]string, error)
+	// Gets whether each primary key column, in the order GetPKs returns them, has numeric (INTEGER, REAL or NUMERIC)
+	// affinity, and so compares numbers by value.
+	GetNumericPKs(ctx context.Context) (map[string][]bool, error)
+	// Gets a map from child table to the foreign keys declared on it.
+	GetForeignKeys(ctx context.Context) (map[string][]ForeignKey, error)
+	// Looks up the values of cols in the row of table whose keyCols equal key. Returns false if no such row exists.
+	// NULL values are returned as nil.
+	LookupColumns(ctx context.Context, table string, keyCols, key, cols []string) ([]*string, bool, error)
 	// Caller is responsible for calling Close() on the rows when done.
 	Query(ctx context.Context, sql string) (*sql.Rows, error)
 	Close() error
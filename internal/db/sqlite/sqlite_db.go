@@ -3,9 +3,13 @@ package sqlite
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
+	"strings"
 
 	_ "github.com/mattn/go-sqlite3"
+
+	dbpkg "chroma1/internal/db"
 )
 
 type SQLiteDB struct {
@@ -24,25 +28,53 @@ func NewSQLiteDB(ctx context.Context, connectionStr string) (*SQLiteDB, error) {
 }
 
 func (db *SQLiteDB) GetPKs(ctx context.Context) (map[string][]string, error) {
-	// Query list of table names
-	rows, err := db.db.QueryContext(ctx, "SELECT name FROM sqlite_master WHERE type='table'")
+	cols, err := db.pkColumns(ctx)
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
+	pks := make(map[string][]string, len(cols))
+	for tableName, tableCols := range cols {
+		pksForTable := make([]string, len(tableCols))
+		for i, c := range tableCols {
+			pksForTable[i] = c.name
+		}
+		pks[tableName] = pksForTable
+	}
+	return pks, nil
+}
 
-	pks := make(map[string][]string)
-	for rows.Next() {
-		var tableName string
-		pksForTable := make([]string, 0)
-		err := rows.Scan(&tableName)
-		if err != nil {
-			return nil, err
+func (db *SQLiteDB) GetNumericPKs(ctx context.Context) (map[string][]bool, error) {
+	cols, err := db.pkColumns(ctx)
+	if err != nil {
+		return nil, err
+	}
+	numeric := make(map[string][]bool, len(cols))
+	for tableName, tableCols := range cols {
+		numericForTable := make([]bool, len(tableCols))
+		for i, c := range tableCols {
+			numericForTable[i] = numericAffinity(c.ttype)
 		}
+		numeric[tableName] = numericForTable
+	}
+	return numeric, nil
+}
 
+type column struct {
+	name  string
+	ttype string // declared type
+}
+
+// pkColumns returns the primary key columns of every table, in key order.
+func (db *SQLiteDB) pkColumns(ctx context.Context) (map[string][]column, error) {
+	tables, err := db.tableNames(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	pks := make(map[string][]column)
+	for _, tableName := range tables {
 		// For each table, get primary keys
-		// SQLite PRAGMA gives columns in cid order, so should match composite key order.
-		pkRows, err := db.db.QueryContext(ctx, fmt.Sprintf("PRAGMA table_info(%s)", tableName))
+		pkRows, err := db.db.QueryContext(ctx, fmt.Sprintf("PRAGMA table_info(%s)", quoteIdent(tableName)))
 		if err != nil {
 			return nil, err
 		}
@@ -54,22 +86,161 @@ func (db *SQLiteDB) GetPKs(ctx context.Context) (map[string][]string, error) {
 		var dflt_value *string
 		var pk int
 
+		// pk is the 1-based position of the column in the primary key, or 0 if it is not part of it.
+		byPosition := make(map[int]column)
 		for pkRows.Next() {
 			err = pkRows.Scan(&cid, &name, &ttype, &notnull, &dflt_value, &pk)
 			if err != nil {
+				pkRows.Close()
 				return nil, err
 			}
-
-			// If pk column value is 1, then it's a primary key
-			if pk == 1 {
-				pksForTable = append(pksForTable, name)
+			if pk > 0 {
+				byPosition[pk] = column{name: name, ttype: ttype}
 			}
 		}
+		err = pkRows.Err()
 		pkRows.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		pksForTable := make([]column, len(byPosition))
+		for pos, c := range byPosition {
+			pksForTable[pos-1] = c
+		}
+		pks[tableName] = pksForTable
 	}
 	return pks, nil
 }
 
+// numericAffinity reports whether a column declared with type ttype has INTEGER, REAL or NUMERIC affinity, following
+// https://www.sqlite.org/datatype3.html#determination_of_column_affinity.
+func numericAffinity(ttype string) bool {
+	t := strings.ToUpper(ttype)
+	switch {
+	case strings.Contains(t, "INT"):
+		return true
+	case strings.Contains(t, "CHAR"), strings.Contains(t, "CLOB"), strings.Contains(t, "TEXT"):
+		return false
+	case strings.Contains(t, "BLOB"), t == "":
+		return false
+	}
+	return true // REAL or NUMERIC
+}
+
+func (db *SQLiteDB) GetForeignKeys(ctx context.Context) (map[string][]dbpkg.ForeignKey, error) {
+	tables, err := db.tableNames(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	fks := make(map[string][]dbpkg.ForeignKey)
+	for _, tableName := range tables {
+		fkRows, err := db.db.QueryContext(ctx, fmt.Sprintf("PRAGMA foreign_key_list(%s)", quoteIdent(tableName)))
+		if err != nil {
+			return nil, err
+		}
+
+		var id, seq int
+		var parent, from string
+		var to *string
+		var onUpdate, onDelete, match string
+
+		// Composite foreign keys are reported as several rows sharing an id, ordered by seq.
+		byID := make(map[int]*dbpkg.ForeignKey)
+		ids := make([]int, 0)
+		for fkRows.Next() {
+			if err := fkRows.Scan(&id, &seq, &parent, &from, &to, &onUpdate, &onDelete, &match); err != nil {
+				fkRows.Close()
+				return nil, err
+			}
+			fk, ok := byID[id]
+			if !ok {
+				fk = &dbpkg.ForeignKey{Table: parent}
+				byID[id] = fk
+				ids = append(ids, id)
+			}
+			fk.From = append(fk.From, from)
+			if to != nil {
+				fk.To = append(fk.To, *to)
+			}
+		}
+		err = fkRows.Err()
+		fkRows.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, id := range ids {
+			fks[tableName] = append(fks[tableName], *byID[id])
+		}
+	}
+
+	// A foreign key that omits the parent columns references the parent's primary key.
+	pks, err := db.GetPKs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, tableFKs := range fks {
+		for i := range tableFKs {
+			if len(tableFKs[i].To) == 0 {
+				tableFKs[i].To = pks[tableFKs[i].Table]
+			}
+		}
+	}
+	return fks, nil
+}
+
+func (db *SQLiteDB) LookupColumns(ctx context.Context, table string, keyCols, key, cols []string) ([]*string, bool, error) {
+	selected := make([]string, len(cols))
+	for i, c := range cols {
+		selected[i] = quoteIdent(c)
+	}
+	conds := make([]string, len(keyCols))
+	args := make([]interface{}, len(key))
+	for i, c := range keyCols {
+		conds[i] = fmt.Sprintf("%s = ?", quoteIdent(c))
+		args[i] = key[i]
+	}
+	q := fmt.Sprintf("SELECT %s FROM %s WHERE %s", strings.Join(selected, ", "), quoteIdent(table), strings.Join(conds, " AND "))
+
+	vals := make([]*string, len(cols))
+	ptrs := make([]interface{}, len(cols))
+	for i := range vals {
+		ptrs[i] = &vals[i]
+	}
+	if err := db.db.QueryRowContext(ctx, q, args...).Scan(ptrs...); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+	return vals, true, nil
+}
+
+func (db *SQLiteDB) tableNames(ctx context.Context) ([]string, error) {
+	// Query list of table names
+	rows, err := db.db.QueryContext(ctx, "SELECT name FROM sqlite_master WHERE type='table'")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tables := make([]string, 0)
+	for rows.Next() {
+		var tableName string
+		if err := rows.Scan(&tableName); err != nil {
+			return nil, err
+		}
+		tables = append(tables, tableName)
+	}
+	return tables, rows.Err()
+}
+
+func quoteIdent(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
 func (db *SQLiteDB) Query(ctx context.Context, sql string) (*sql.Rows, error) {
 	return db.db.QueryContext(ctx, sql)
 }
@@ -0,0 +1,54 @@
+package sqlite_test
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"chroma1/internal/db"
+	"chroma1/internal/db/sqlite"
+)
+
+func TestCompositeKeys(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "app.db")
+	schema, err := sql.Open("sqlite3", path)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	for _, stmt := range []string{
+		"CREATE TABLE accounts (id INTEGER PRIMARY KEY, name TEXT)",
+		// key columns in another order than the table's columns
+		"CREATE TABLE ledgers (name TEXT, region TEXT, year INT, PRIMARY KEY (region, year))",
+		"CREATE TABLE entries (id INTEGER PRIMARY KEY, region TEXT, year INT, FOREIGN KEY (region, year) REFERENCES ledgers)",
+	} {
+		_, err := schema.Exec(stmt)
+		assert.NoError(t, err, stmt)
+	}
+	schema.Close()
+	d, err := sqlite.NewSQLiteDB(ctx, path)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer d.Close()
+
+	// every key column is returned, in key order, as permissions key rows by the whole key
+	pks, err := d.GetPKs(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]string{
+		"accounts": {"id"},
+		"ledgers":  {"region", "year"},
+		"entries":  {"id"},
+	}, pks)
+	numeric, err := d.GetNumericPKs(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, []bool{false, true}, numeric["ledgers"])
+
+	// so that a foreign key to a composite primary key references all of it
+	fks, err := d.GetForeignKeys(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, []db.ForeignKey{{Table: "ledgers", From: []string{"region", "year"}, To: []string{"region", "year"}}}, fks["entries"])
+}
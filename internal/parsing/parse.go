@@ -1,7 +1,9 @@
 package parsing
 
 import (
+	"errors"
 	"fmt"
+	"strconv"
 	"strings"
 
 	"chroma1/model/permissions"
@@ -10,26 +12,39 @@ import (
 )
 
 type RequiredPermission struct {
-	Perm     permissions.Permission
+	Perm permissions.Permission
+	// Columns an UPDATE sets, to their new value, or to nil if it is not a literal. Nil for other statements.
+	Assigned map[string]*string
+	// The rows an INSERT adds, each as its columns to their value, or to nil if it is not a literal. Nil for other
+	// statements, and for inserts whose rows are not known up front: without a column list or VALUES, or that may also
+	// replace or update existing rows.
+	Inserted []map[string]*string
 	fromNode sqlparser.SQLNode
 }
 
+// SQL returns the statement the requirement was derived from.
+func (rp *RequiredPermission) SQL() string {
+	return sqlparser.String(rp.fromNode)
+}
+
 func (rp *RequiredPermission) DebugString() string {
 	var ds strings.Builder
 	ds.WriteString(fmt.Sprintf("Table %s: (%sv) for ", rp.Perm.Table, rp.Perm.Type))
-	if rp.Perm.RowKeys == nil {
-		ds.WriteString("all")
+	if rp.Perm.Blanket() {
+		ds.WriteString("all keys")
 	} else {
-		ds.WriteString(fmt.Sprintf("%d", len(rp.Perm.RowKeys)))
+		ds.WriteString(fmt.Sprintf("%d keys and %d key ranges", len(rp.Perm.RowKeys), len(rp.Perm.RowRanges)))
 	}
-	ds.WriteString(" keys (due to \"")
+	ds.WriteString(" (due to \"")
 	ds.WriteString(sqlparser.String(rp.fromNode))
 	ds.WriteString(")")
 	return ds.String()
 }
 
-// Parse a sql statement, return the list of required permissions.
-func Parse(sql string, tableToPK map[string][]string) ([]*RequiredPermission, error) {
+// Parse a sql statement, return the list of required permissions. numericPKs says, for each primary key column in
+// tableToPK, whether it has numeric (INTEGER, REAL or NUMERIC) affinity. Rows are only narrowed to key ranges on
+// numeric columns, where SQLite orders values as permissions.CompareKeyColumn does; other columns compare as text.
+func Parse(sql string, tableToPK map[string][]string, numericPKs map[string][]bool) ([]*RequiredPermission, error) {
 	pieces, err := sqlparser.SplitStatementToPieces(sql)
 	if err != nil {
 		return nil, err
@@ -48,12 +63,14 @@ func Parse(sql string, tableToPK map[string][]string) ([]*RequiredPermission, er
 			case *sqlparser.Select:
 				// TODO: handle joins
 				tableName := sqlparser.String(v.From[0])
+				rows, ranges := whereNodeToRows(v.Where, tableToPK[tableName], numericPKs[tableName])
 				reqs = append(reqs, &RequiredPermission{
 					fromNode: node,
 					Perm: permissions.Permission{
-						Table:   tableName,
-						Type:    permissions.Read,
-						RowKeys: whereNodeToRows(v.Where, tableToPK[tableName]),
+						Table:     tableName,
+						Type:      permissions.Read,
+						RowKeys:   rows,
+						RowRanges: ranges,
 					},
 				})
 			case *sqlparser.Update:
@@ -63,13 +80,16 @@ func Parse(sql string, tableToPK map[string][]string) ([]*RequiredPermission, er
 				}
 				tableName := sqlparser.String(v.TableExprs[0])
 
+				rows, ranges := whereNodeToRows(v.Where, tableToPK[tableName], numericPKs[tableName])
 				reqs = append(reqs, &RequiredPermission{
 					fromNode: node,
 					Perm: permissions.Permission{
-						Table:   tableName,
-						Type:    permissions.Write,
-						RowKeys: whereNodeToRows(v.Where, tableToPK[tableName]),
+						Table:     tableName,
+						Type:      permissions.Write,
+						RowKeys:   rows,
+						RowRanges: ranges,
 					},
+					Assigned: assignedValues(v.Exprs),
 				})
 			case *sqlparser.Delete:
 				if len(v.TableExprs) > 1 {
@@ -78,12 +98,14 @@ func Parse(sql string, tableToPK map[string][]string) ([]*RequiredPermission, er
 				}
 				tableName := sqlparser.String(v.TableExprs[0])
 
+				rows, ranges := whereNodeToRows(v.Where, tableToPK[tableName], numericPKs[tableName])
 				reqs = append(reqs, &RequiredPermission{
 					fromNode: node,
 					Perm: permissions.Permission{
-						Table:   tableName,
-						Type:    permissions.Write,
-						RowKeys: whereNodeToRows(v.Where, tableToPK[tableName]),
+						Table:     tableName,
+						Type:      permissions.Write,
+						RowKeys:   rows,
+						RowRanges: ranges,
 					},
 				})
 			case *sqlparser.Insert:
@@ -93,6 +115,7 @@ func Parse(sql string, tableToPK map[string][]string) ([]*RequiredPermission, er
 						Table: sqlparser.String(v.Table.Expr),
 						Type:  permissions.Write,
 					},
+					Inserted: insertedValues(v),
 				})
 			}
 			return true, nil
@@ -105,43 +128,221 @@ func Parse(sql string, tableToPK map[string][]string) ([]*RequiredPermission, er
 	return reqs, nil
 }
 
-// Helper to get the directly specified rows given a WHERE clause. Each entry is a map of column requirements.
-// e.g. {"x": "5", "y":"foo"} means the row with x = 5 and y = "foo".
-// If empty, the rows were not directly specified.
-func whereNodeToRows(where *sqlparser.Where, pk []string) [][]string {
-	if where == nil {
+// assignedValues maps each column an UPDATE sets to its new value, or to nil if the value is not a literal.
+func assignedValues(exprs sqlparser.UpdateExprs) map[string]*string {
+	assigned := make(map[string]*string, len(exprs))
+	for _, e := range exprs {
+		var val *string
+		if lit, ok := e.Expr.(*sqlparser.Literal); ok {
+			val = &lit.Val
+		}
+		assigned[e.Name.Name.String()] = val
+	}
+	return assigned
+}
+
+// insertedValues maps the columns of each row ins adds to their value, or to nil if the value is not a literal. Returns
+// nil if the rows are not known up front.
+func insertedValues(ins *sqlparser.Insert) []map[string]*string {
+	values, ok := ins.Rows.(sqlparser.Values)
+	if !ok || len(ins.Columns) == 0 || ins.Action != sqlparser.InsertAct || len(ins.OnDup) > 0 {
 		return nil
 	}
+	inserted := make([]map[string]*string, len(values))
+	for i, tuple := range values {
+		if len(tuple) != len(ins.Columns) {
+			return nil
+		}
+		row := make(map[string]*string, len(tuple))
+		for j, e := range tuple {
+			var val *string
+			if lit, ok := e.(*sqlparser.Literal); ok {
+				val = &lit.Val
+			}
+			row[ins.Columns[j].String()] = val
+		}
+		inserted[i] = row
+	}
+	return inserted
+}
+
+// Helper to get the directly specified rows given a WHERE clause, as exact primary keys and key ranges.
+// e.g. x = 5 AND y = 'foo' gives the key (5, foo) for a primary key (x, y), and x = 5 alone gives the prefix range of
+// all keys starting with 5.
+// If both are nil, the rows were not directly specified. numeric says which primary key columns have numeric affinity.
+func whereNodeToRows(where *sqlparser.Where, pk []string, numeric []bool) ([][]string, []permissions.KeyRange) {
+	if where == nil || len(pk) == 0 {
+		return nil, nil
+	}
 	rows := make([][]string, 0)
+	var ranges []permissions.KeyRange
 	for _, spec := range recurseOnWhereExpr(where.Expr) {
-		row := make([]string, len(pk))
-		for i, c := range pk {
-			if v, ok := spec[c]; ok {
-				row[i] = v
-			} else {
-				return nil // if any row returned did not specify the primary key, then the whole expression needs full permissions.
+		prefix := make([]string, 0, len(pk))
+		for _, c := range pk {
+			cs, ok := spec[c]
+			if !ok || !cs.hasEq {
+				break
 			}
+			prefix = append(prefix, cs.eq)
+		}
+		if len(prefix) == len(pk) {
+			rows = append(rows, prefix)
+			continue
 		}
-		rows = append(rows, row)
+		col := len(prefix)
+		r, ok := spec[pk[col]].keyRange(prefix, col < len(numeric) && numeric[col])
+		if !ok {
+			return nil, nil // if any row returned did not bound the primary key, then the whole expression needs full permissions.
+		}
+		ranges = append(ranges, r)
+	}
+	if len(rows) == 0 && len(ranges) == 0 {
+		return nil, nil
 	}
 	if len(rows) == 0 {
-		return nil
+		rows = nil
 	}
-	return rows
+	return rows, ranges
+}
+
+// colSpec is what a WHERE clause says about a single column: an exact value, or lower and upper bounds.
+type colSpec struct {
+	eq           string
+	hasEq        bool
+	lo, hi       string
+	hasLo, hasHi bool
+	loIncl       bool
+	hiIncl       bool
 }
 
-func recurseOnWhereExpr(expr sqlparser.Expr) []map[string]string {
+// keyRange turns a constraint on the primary key column after prefix into a range. With no constraint at all, the
+// range is every key with the prefix, unless the prefix is empty and the rows are therefore unbounded. Bounds are only
+// used on numeric columns, and only if they are canonical numbers, which SQLite orders as key ranges do.
+func (cs *colSpec) keyRange(prefix []string, numeric bool) (permissions.KeyRange, bool) {
+	if cs != nil && (!numeric || (cs.hasLo && !permissions.IsCanonicalNumber(cs.lo)) || (cs.hasHi && !permissions.IsCanonicalNumber(cs.hi))) {
+		cs = nil
+	}
+	if cs == nil || (!cs.hasLo && !cs.hasHi) {
+		if len(prefix) == 0 {
+			return permissions.KeyRange{}, false
+		}
+		return permissions.PrefixRange(prefix), true
+	}
+	withCol := func(v string) []string {
+		return append(append(make([]string, 0, len(prefix)+1), prefix...), v)
+	}
+	r := permissions.KeyRange{}
+	if cs.hasLo {
+		r.Start, r.StartAfter = withCol(cs.lo), !cs.loIncl
+	} else if len(prefix) > 0 {
+		r.Start = prefix
+	}
+	if cs.hasHi {
+		r.End, r.EndAfter = withCol(cs.hi), cs.hiIncl
+	} else if len(prefix) > 0 {
+		r.End, r.EndAfter = prefix, true
+	}
+	return r, true
+}
+
+// and narrows cs by o. Conflicting values are kept from cs, which can only widen the rows required. So does keeping a
+// bound keyRange later discards, since either bound alone holds every row both do.
+func (cs *colSpec) and(o *colSpec) {
+	if o.hasEq && !cs.hasEq {
+		cs.eq, cs.hasEq = o.eq, true
+	}
+	if o.hasLo {
+		c := permissions.CompareKeyColumn(o.lo, cs.lo)
+		if !cs.hasLo || c > 0 || (c == 0 && !o.loIncl) {
+			cs.lo, cs.hasLo, cs.loIncl = o.lo, true, o.loIncl
+		}
+	}
+	if o.hasHi {
+		c := permissions.CompareKeyColumn(o.hi, cs.hi)
+		if !cs.hasHi || c < 0 || (c == 0 && !o.hiIncl) {
+			cs.hi, cs.hasHi, cs.hiIncl = o.hi, true, o.hiIncl
+		}
+	}
+}
+
+// comparisonSpec returns the constraint a comparison between a column and a literal puts on the column.
+func comparisonSpec(op sqlparser.ComparisonExprOperator, left, right sqlparser.Expr) (string, *colSpec, bool) {
+	col, ok := left.(*sqlparser.ColName)
+	val, vOk := right.(*sqlparser.Literal)
+	if !ok || !vOk {
+		// try the reversed form, e.g. 5 < k
+		col, ok = right.(*sqlparser.ColName)
+		val, vOk = left.(*sqlparser.Literal)
+		if !ok || !vOk {
+			return "", nil, false
+		}
+		switch op {
+		case sqlparser.LessThanOp:
+			op = sqlparser.GreaterThanOp
+		case sqlparser.LessEqualOp:
+			op = sqlparser.GreaterEqualOp
+		case sqlparser.GreaterThanOp:
+			op = sqlparser.LessThanOp
+		case sqlparser.GreaterEqualOp:
+			op = sqlparser.LessEqualOp
+		}
+	}
+	cs := &colSpec{}
+	switch op {
+	case sqlparser.EqualOp:
+		if !exactKey(val) {
+			return col.Name.String(), cs, true // some row, but which one depends on the column's affinity
+		}
+		cs.eq, cs.hasEq = val.Val, true
+	case sqlparser.GreaterThanOp, sqlparser.GreaterEqualOp:
+		cs.lo, cs.hasLo, cs.loIncl = val.Val, true, op == sqlparser.GreaterEqualOp
+	case sqlparser.LessThanOp, sqlparser.LessEqualOp:
+		cs.hi, cs.hasHi, cs.hiIncl = val.Val, true, op == sqlparser.LessEqualOp
+	default:
+		return "", nil, false // could be anything.
+	}
+	return col.Name.String(), cs, true
+}
+
+// exactKey reports whether the row a column equals val to has val as its key, whatever the column's affinity. A
+// numeric column holds other spellings of a number, such as 007, 7.0 or 7e0, as the canonical number, and a text
+// column holds them as written, so only canonical numbers and values that are not numbers at all are exact.
+func exactKey(val *sqlparser.Literal) bool {
+	switch val.Type {
+	case sqlparser.StrVal, sqlparser.IntVal, sqlparser.FloatVal, sqlparser.DecimalVal:
+	default:
+		return false // e.g. hex and bit literals, which SQLite reads as blobs or integers
+	}
+	if permissions.IsCanonicalNumber(val.Val) {
+		return true
+	}
+	s := strings.TrimSpace(val.Val)
+	if s != "" && strings.ContainsRune("+-.0123456789", rune(s[0])) {
+		return false
+	}
+	_, err := strconv.ParseFloat(s, 64)
+	return errors.Is(err, strconv.ErrSyntax) // "Inf" and "NaN" parse
+}
+
+func recurseOnWhereExpr(expr sqlparser.Expr) []map[string]*colSpec {
 	switch v := expr.(type) {
 	case *sqlparser.ComparisonExpr:
-		if v.Operator != sqlparser.EqualOp {
-			return nil // if not equality, could be anything.
+		name, cs, ok := comparisonSpec(v.Operator, v.Left, v.Right)
+		if !ok {
+			return nil // left side was not a column or right was not a value
 		}
-		if col, ok := v.Left.(*sqlparser.ColName); ok {
-			if val, ok := v.Right.(*sqlparser.Literal); ok {
-				return []map[string]string{{col.Name.String(): val.Val}}
-			}
+		return []map[string]*colSpec{{name: cs}}
+	case *sqlparser.BetweenExpr:
+		col, ok := v.Left.(*sqlparser.ColName)
+		from, fOk := v.From.(*sqlparser.Literal)
+		to, tOk := v.To.(*sqlparser.Literal)
+		if !v.IsBetween || !ok || !fOk || !tOk {
+			return nil
 		}
-		return nil // left side was not a column or right was not a value
+		return []map[string]*colSpec{{col.Name.String(): {
+			lo: from.Val, hasLo: true, loIncl: true,
+			hi: to.Val, hasHi: true, hiIncl: true,
+		}}}
 	case *sqlparser.AndExpr:
 		lV := recurseOnWhereExpr(v.Left)
 		rV := recurseOnWhereExpr(v.Right)
@@ -149,16 +350,20 @@ func recurseOnWhereExpr(expr sqlparser.Expr) []map[string]string {
 		if len(lV) != 1 || len(rV) != 1 {
 			return nil
 		}
-		specced := make(map[string]string)
+		specced := make(map[string]*colSpec)
 		for k, v := range lV[0] {
 			specced[k] = v
 		}
 		for k, v := range rV[0] {
-			specced[k] = v
+			if cs, ok := specced[k]; ok {
+				cs.and(v)
+			} else {
+				specced[k] = v
+			}
 		}
-		return []map[string]string{specced}
+		return []map[string]*colSpec{specced}
 	case *sqlparser.OrExpr:
-		specced := make([]map[string]string, 0)
+		specced := make([]map[string]*colSpec, 0)
 		lV := recurseOnWhereExpr(v.Left)
 		rV := recurseOnWhereExpr(v.Right)
 		if lV == nil || rV == nil {
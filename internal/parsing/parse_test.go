@@ -32,7 +32,7 @@ func TestInsert(t *testing.T) {
 	}
 	for i, tc := range testcases {
 		t.Run(fmt.Sprintf("TestInsert case %v", i), func(t *testing.T) {
-			reqs, err := parsing.Parse(tc.sql, nil)
+			reqs, err := parsing.Parse(tc.sql, nil, nil)
 			assert.NoError(t, err)
 			assert.Len(t, reqs, 1)
 			assert.Equal(t, tc.exp, reqs[0].Perm)
@@ -47,6 +47,10 @@ func TestDelete(t *testing.T) {
 		t1: {"k"},
 		t2: {"k1", "k2"},
 	}
+	numeric := map[string][]bool{
+		t1: {true},
+		t2: {true, true},
+	}
 
 	testcases := []struct {
 		sql string
@@ -99,6 +103,31 @@ func TestDelete(t *testing.T) {
 		},
 		{
 			sql: "DELETE FROM table1 WHERE k > 5",
+			exp: permissions.Permission{
+				Type:      permissions.Write,
+				Table:     t1,
+				RowRanges: []permissions.KeyRange{{Start: []string{"5"}, StartAfter: true}},
+			},
+		},
+		{
+			sql: "DELETE FROM table1 WHERE 5 <= k AND k < 10",
+			exp: permissions.Permission{
+				Type:      permissions.Write,
+				Table:     t1,
+				RowRanges: []permissions.KeyRange{{Start: []string{"5"}, End: []string{"10"}}},
+			},
+		},
+		{
+			sql: "DELETE FROM table1 WHERE k BETWEEN 5 AND 10 OR k = 20",
+			exp: permissions.Permission{
+				Type:      permissions.Write,
+				Table:     t1,
+				RowKeys:   [][]string{{"20"}},
+				RowRanges: []permissions.KeyRange{{Start: []string{"5"}, End: []string{"10"}, EndAfter: true}},
+			},
+		},
+		{
+			sql: "DELETE FROM table1 WHERE k != 5",
 			exp: permissions.Permission{
 				Type:  permissions.Write,
 				Table: t1,
@@ -114,6 +143,22 @@ func TestDelete(t *testing.T) {
 		},
 		{
 			sql: "DELETE FROM table2 WHERE k1 = 5",
+			exp: permissions.Permission{
+				Type:      permissions.Write,
+				Table:     t2,
+				RowRanges: []permissions.KeyRange{permissions.PrefixRange([]string{"5"})},
+			},
+		},
+		{
+			sql: "DELETE FROM table2 WHERE k1 = 5 AND k2 <= 10",
+			exp: permissions.Permission{
+				Type:      permissions.Write,
+				Table:     t2,
+				RowRanges: []permissions.KeyRange{{Start: []string{"5"}, End: []string{"5", "10"}, EndAfter: true}},
+			},
+		},
+		{
+			sql: "DELETE FROM table2 WHERE k2 = 10",
 			exp: permissions.Permission{
 				Type:  permissions.Write,
 				Table: t2,
@@ -146,7 +191,7 @@ func TestDelete(t *testing.T) {
 	}
 	for i, tc := range testcases {
 		t.Run(fmt.Sprintf("TestDelete case %v", i), func(t *testing.T) {
-			reqs, err := parsing.Parse(tc.sql, pks)
+			reqs, err := parsing.Parse(tc.sql, pks, numeric)
 			assert.NoError(t, err)
 			assert.Len(t, reqs, 1)
 			assert.Equal(t, tc.exp, reqs[0].Perm)
@@ -161,6 +206,10 @@ func TestUpdate(t *testing.T) {
 		t1: {"k"},
 		t2: {"k1", "k2"},
 	}
+	numeric := map[string][]bool{
+		t1: {true},
+		t2: {true, true},
+	}
 
 	testcases := []struct {
 		sql string
@@ -192,7 +241,7 @@ func TestUpdate(t *testing.T) {
 	}
 	for i, tc := range testcases {
 		t.Run(fmt.Sprintf("TestUpdate case %v", i), func(t *testing.T) {
-			reqs, err := parsing.Parse(tc.sql, pks)
+			reqs, err := parsing.Parse(tc.sql, pks, numeric)
 			assert.NoError(t, err)
 			assert.Len(t, reqs, 1)
 			assert.Equal(t, tc.exp, reqs[0].Perm)
@@ -200,6 +249,76 @@ func TestUpdate(t *testing.T) {
 	}
 }
 
+func TestUpdateAssigned(t *testing.T) {
+	five, bob := "5", "bob"
+	testcases := []struct {
+		sql string
+		exp map[string]*string
+	}{
+		{
+			sql: "UPDATE table1 SET x = 5, name = 'bob' WHERE k = 10",
+			exp: map[string]*string{"x": &five, "name": &bob},
+		},
+		{
+			sql: "UPDATE table1 SET x = x + 1, y = NULL",
+			exp: map[string]*string{"x": nil, "y": nil},
+		},
+	}
+	for i, tc := range testcases {
+		t.Run(fmt.Sprintf("TestUpdateAssigned case %v", i), func(t *testing.T) {
+			reqs, err := parsing.Parse(tc.sql, map[string][]string{"table1": {"k"}}, nil)
+			assert.NoError(t, err)
+			assert.Len(t, reqs, 1)
+			assert.Equal(t, tc.exp, reqs[0].Assigned)
+		})
+	}
+
+	reqs, err := parsing.Parse("DELETE FROM table1 WHERE k = 10", nil, nil)
+	assert.NoError(t, err)
+	assert.Nil(t, reqs[0].Assigned)
+}
+
+func TestInsertInserted(t *testing.T) {
+	one, two, bob := "1", "2", "bob"
+	testcases := []struct {
+		sql string
+		exp []map[string]*string
+	}{
+		{
+			sql: "INSERT INTO table1 (k, name) VALUES (1, 'bob'), (2, NULL)",
+			exp: []map[string]*string{{"k": &one, "name": &bob}, {"k": &two, "name": nil}},
+		},
+		{
+			sql: "INSERT INTO table1 (k, name) VALUES (1, lower('BOB'))",
+			exp: []map[string]*string{{"k": &one, "name": nil}},
+		},
+		{
+			// the columns are unknown
+			sql: "INSERT INTO table1 VALUES (1, 'bob')",
+		},
+		{
+			// as are the rows
+			sql: "INSERT INTO table1 (k, name) SELECT k, name FROM table2",
+		},
+		{
+			// and an existing row may be changed instead
+			sql: "REPLACE INTO table1 (k, name) VALUES (1, 'bob')",
+		},
+		{
+			sql: "INSERT INTO table1 (k, name) VALUES (1, 'bob') ON DUPLICATE KEY UPDATE name = 'bob'",
+		},
+	}
+	for i, tc := range testcases {
+		t.Run(fmt.Sprintf("TestInsertInserted case %v", i), func(t *testing.T) {
+			reqs, err := parsing.Parse(tc.sql, map[string][]string{"table1": {"k"}, "table2": {"k"}}, nil)
+			assert.NoError(t, err)
+			if assert.NotEmpty(t, reqs) {
+				assert.Equal(t, tc.exp, reqs[0].Inserted)
+			}
+		})
+	}
+}
+
 func TestSelect(t *testing.T) {
 	t1 := "table1"
 	t2 := "table2"
@@ -207,6 +326,10 @@ func TestSelect(t *testing.T) {
 		t1: {"k"},
 		t2: {"k1", "k2"},
 	}
+	numeric := map[string][]bool{
+		t1: {true},
+		t2: {true, true},
+	}
 
 	testcases := []struct {
 		sql string
@@ -244,8 +367,9 @@ func TestSelect(t *testing.T) {
 		{
 			sql: "SELECT a, b FROM table2 WHERE k1 = 10",
 			exp: permissions.Permission{
-				Type:  permissions.Read,
-				Table: t2,
+				Type:      permissions.Read,
+				Table:     t2,
+				RowRanges: []permissions.KeyRange{permissions.PrefixRange([]string{"10"})},
 			},
 		},
 		{
@@ -259,7 +383,7 @@ func TestSelect(t *testing.T) {
 	}
 	for i, tc := range testcases {
 		t.Run(fmt.Sprintf("TestSelect case %v", i), func(t *testing.T) {
-			reqs, err := parsing.Parse(tc.sql, pks)
+			reqs, err := parsing.Parse(tc.sql, pks, numeric)
 			assert.NoError(t, err)
 			assert.Len(t, reqs, 1)
 			assert.Equal(t, tc.exp, reqs[0].Perm)
@@ -267,6 +391,105 @@ func TestSelect(t *testing.T) {
 	}
 }
 
+func TestKeyAffinity(t *testing.T) {
+	pks := map[string][]string{
+		"nums":  {"k"},
+		"texts": {"k"},
+		"pairs": {"k1", "k2"},
+	}
+	numeric := map[string][]bool{
+		"nums":  {true},
+		"texts": {false},
+		"pairs": {true, false},
+	}
+
+	testcases := []struct {
+		sql string
+		exp permissions.Permission
+	}{
+		{
+			sql: "SELECT * FROM nums WHERE k = '7'",
+			exp: permissions.Permission{Type: permissions.Read, Table: "nums", RowKeys: [][]string{{"7"}}},
+		},
+		{
+			sql: "SELECT * FROM texts WHERE k = 'NaNa'",
+			exp: permissions.Permission{Type: permissions.Read, Table: "texts", RowKeys: [][]string{{"NaNa"}}},
+		},
+		// other spellings of a number may name the same row as the canonical one
+		{
+			sql: "SELECT * FROM nums WHERE k = 007",
+			exp: permissions.Permission{Type: permissions.Read, Table: "nums"},
+		},
+		{
+			sql: "SELECT * FROM nums WHERE k = 7.0 OR k = 8",
+			exp: permissions.Permission{Type: permissions.Read, Table: "nums"},
+		},
+		{
+			sql: "SELECT * FROM texts WHERE k = 7e0",
+			exp: permissions.Permission{Type: permissions.Read, Table: "texts"},
+		},
+		{
+			sql: "SELECT * FROM nums WHERE k = 'NaN'",
+			exp: permissions.Permission{Type: permissions.Read, Table: "nums"},
+		},
+		{
+			sql: "SELECT * FROM nums WHERE k = 0x07",
+			exp: permissions.Permission{Type: permissions.Read, Table: "nums"},
+		},
+		{
+			sql: "SELECT * FROM pairs WHERE k1 = 5 AND k2 = '05'",
+			exp: permissions.Permission{Type: permissions.Read, Table: "pairs", RowRanges: []permissions.KeyRange{permissions.PrefixRange([]string{"5"})}},
+		},
+		// text is ordered byte by byte, so its ranges hold other rows than numeric ones
+		{
+			sql: "SELECT * FROM nums WHERE k > 5 AND k <= 10",
+			exp: permissions.Permission{Type: permissions.Read, Table: "nums", RowRanges: []permissions.KeyRange{{Start: []string{"5"}, StartAfter: true, End: []string{"10"}, EndAfter: true}}},
+		},
+		{
+			sql: "SELECT * FROM texts WHERE k > 5 AND k <= 10",
+			exp: permissions.Permission{Type: permissions.Read, Table: "texts"},
+		},
+		{
+			sql: "SELECT * FROM texts WHERE k BETWEEN 'a' AND 'c'",
+			exp: permissions.Permission{Type: permissions.Read, Table: "texts"},
+		},
+		{
+			sql: "SELECT * FROM pairs WHERE k1 = 5 AND k2 < 'b'",
+			exp: permissions.Permission{Type: permissions.Read, Table: "pairs", RowRanges: []permissions.KeyRange{permissions.PrefixRange([]string{"5"})}},
+		},
+		{
+			sql: "SELECT * FROM nums WHERE k > 'NaN'",
+			exp: permissions.Permission{Type: permissions.Read, Table: "nums"},
+		},
+		{
+			sql: "SELECT * FROM nums WHERE k < 1e3",
+			exp: permissions.Permission{Type: permissions.Read, Table: "nums"},
+		},
+		{
+			// the narrower bound replaces the other, but is not canonical
+			sql: "SELECT * FROM nums WHERE k > 5 AND k > 'x'",
+			exp: permissions.Permission{Type: permissions.Read, Table: "nums"},
+		},
+		{
+			sql: "SELECT * FROM nums WHERE k > 5",
+			exp: permissions.Permission{Type: permissions.Read, Table: "nums", RowRanges: []permissions.KeyRange{{Start: []string{"5"}, StartAfter: true}}},
+		},
+	}
+	for i, tc := range testcases {
+		t.Run(fmt.Sprintf("TestKeyAffinity case %v", i), func(t *testing.T) {
+			reqs, err := parsing.Parse(tc.sql, pks, numeric)
+			assert.NoError(t, err)
+			assert.Len(t, reqs, 1)
+			assert.Equal(t, tc.exp, reqs[0].Perm)
+		})
+	}
+
+	// without affinities, columns are taken not to be numeric
+	reqs, err := parsing.Parse("SELECT * FROM nums WHERE k > 5", pks, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, permissions.Permission{Type: permissions.Read, Table: "nums"}, reqs[0].Perm)
+}
+
 func TestSelectFailing(t *testing.T) {
 	t1 := "table1"
 	t2 := "table2"
@@ -274,6 +497,10 @@ func TestSelectFailing(t *testing.T) {
 		t1: {"k"},
 		t2: {"k1", "k2"},
 	}
+	numeric := map[string][]bool{
+		t1: {true},
+		t2: {true, true},
+	}
 
 	testcases := []struct {
 		sql string
@@ -309,7 +536,7 @@ func TestSelectFailing(t *testing.T) {
 	}
 	for i, tc := range testcases {
 		t.Run(fmt.Sprintf("TestSelectFailing case %v", i), func(t *testing.T) {
-			reqs, err := parsing.Parse(tc.sql, pks)
+			reqs, err := parsing.Parse(tc.sql, pks, numeric)
 			assert.NoError(t, err)
 			assert.Len(t, reqs, len(tc.exp))
 			for i := range reqs {
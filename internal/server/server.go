@@ -2,50 +2,109 @@ package server
 
 import (
 	"context"
+	"net"
+	"net/http"
+	"time"
 
 	"chroma1/internal/acl"
+	"chroma1/internal/auth"
 	"chroma1/internal/db"
+	"chroma1/model/identity"
+	"chroma1/model/keys"
 	"chroma1/model/permissions"
 )
 
 type Server struct {
-	aclManager *acl.ACLManager
-	db         db.DB
+	aclManager    *acl.ACLManager
+	db            db.DB
+	authenticator auth.Authenticator
 }
 
-func NewServer(ctx context.Context, aclStorage acl.ACLStorage, database db.DB) (*Server, error) {
-	pks, err := database.GetPKs()
+// NewServer builds a server over the ACL store and the database it guards, authenticating callers as authCfg selects.
+// It fails with acl.MissingKeySecretError unless authCfg carries a key secret.
+func NewServer(ctx context.Context, aclStorage acl.ACLStorage, database db.DB, authCfg auth.Config, opts ...acl.Option) (*Server, error) {
+	if authCfg.KeySecret == "" {
+		return nil, acl.MissingKeySecretError
+	}
+	pks, err := database.GetPKs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	numeric, err := database.GetNumericPKs(ctx)
 	if err != nil {
 		return nil, err
 	}
-	man, err := acl.NewACLManager(ctx, aclStorage, pks)
+	fks, err := database.GetForeignKeys(ctx)
 	if err != nil {
 		return nil, err
 	}
+	opts = append([]acl.Option{
+		acl.WithKeySecret([]byte(authCfg.KeySecret)),
+		acl.WithNumericKeys(numeric),
+		acl.WithForeignKeyInheritance(fks, database),
+	}, opts...)
+	man, err := acl.NewACLManager(ctx, aclStorage, pks, opts...)
+	if err != nil {
+		return nil, err
+	}
+	authenticator, err := auth.New(authCfg, man)
+	if err != nil {
+		man.Close()
+		return nil, err
+	}
 	return &Server{
-		aclManager: man,
-		db:         database,
+		aclManager:    man,
+		db:            database,
+		authenticator: authenticator,
 	}, nil
 }
 
-func (s *Server) Query(ctx context.Context, key string, req *QueryRequest) (*QueryResponse, error) {
-	if err := s.aclManager.CheckPermissions(ctx, key, req.SQL); err != nil {
+// Close stops the server's background work. The ACL store and database are left open for their owner to close.
+func (s *Server) Close() {
+	s.aclManager.Close()
+}
+
+// Authenticate establishes the caller of an incoming request, using the configured authenticator. The resulting
+// identity is passed to the other Server methods.
+func (s *Server) Authenticate(ctx context.Context, r *http.Request) (*identity.Identity, error) {
+	id, err := s.authenticator.Authenticate(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+	id.SourceAddr = r.RemoteAddr
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		id.SourceAddr = host
+	}
+	return id, nil
+}
+
+func (s *Server) Query(ctx context.Context, caller *identity.Identity, req *QueryRequest) (*QueryResponse, error) {
+	elevation, err := s.aclManager.CheckPermissions(ctx, caller, req.SQL)
+	if err != nil {
 		return nil, err
 	}
-	rows, err := s.db.Query(req.SQL)
+	rows, err := s.db.Query(ctx, req.SQL)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 	res := &QueryResponse{
 		Rows: make([]map[string]interface{}, 0),
 	}
+	if elevation != nil {
+		res.ElevationID = elevation.ID
+	}
 	cols, err := rows.Columns()
 	if err != nil {
 		return nil, err
 	}
 	for rows.Next() {
 		vals := make([]interface{}, len(cols))
-		if err := rows.Scan(vals...); err != nil {
+		ptrs := make([]interface{}, len(cols))
+		for i := range vals {
+			ptrs[i] = &vals[i]
+		}
+		if err := rows.Scan(ptrs...); err != nil {
 			return nil, err
 		}
 		valMap := make(map[string]interface{})
@@ -60,18 +119,32 @@ func (s *Server) Query(ctx context.Context, key string, req *QueryRequest) (*Que
 	return res, nil
 }
 
-func (s *Server) GetPermissions(ctx context.Context, key string, req *AddPermissionsRequest) (*GetPermissionsResponse, error) {
-	p, err := s.aclManager.GetPermissions(ctx, key, req.User)
+// BreakGlass grants the caller temporary blanket read access. Every query run during the window is recorded and tagged
+// with the returned elevation id.
+func (s *Server) BreakGlass(ctx context.Context, caller *identity.Identity, req *BreakGlassRequest) (*BreakGlassResponse, error) {
+	e, err := s.aclManager.BreakGlass(ctx, caller, req.Reason, time.Duration(req.DurationSeconds)*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	return &BreakGlassResponse{
+		ElevationID: e.ID,
+		ExpiresAt:   e.ExpiresAt,
+	}, nil
+}
+
+func (s *Server) GetPermissions(ctx context.Context, caller *identity.Identity, req *AddPermissionsRequest) (*GetPermissionsResponse, error) {
+	p, version, err := s.aclManager.GetPermissions(ctx, caller, req.User)
 	if err != nil {
 		return nil, err
 	}
 	return &GetPermissionsResponse{
 		Permissions: p,
+		Version:     version,
 	}, nil
 }
 
-func (s *Server) GetAllPermissions(ctx context.Context, key string) (*GetAllPermissionsResponse, error) {
-	p, err := s.aclManager.GetAllPermissions(key)
+func (s *Server) GetAllPermissions(ctx context.Context, caller *identity.Identity) (*GetAllPermissionsResponse, error) {
+	p, err := s.aclManager.GetAllPermissions(ctx, caller)
 	if err != nil {
 		return nil, err
 	}
@@ -80,21 +153,129 @@ func (s *Server) GetAllPermissions(ctx context.Context, key string) (*GetAllPerm
 	}, nil
 }
 
-func (s *Server) AddPermissions(ctx context.Context, key string, req *AddPermissionsRequest) error {
-	return s.aclManager.AddPermissions(ctx, key, req.User, req.Permissions)
+// AddPermissions adds permissions to a user. With IfVersion set, it fails with acl.VersionConflictError if the user's
+// permissions changed since that version was read.
+func (s *Server) AddPermissions(ctx context.Context, caller *identity.Identity, req *AddPermissionsRequest) (*UpdatePermissionsResponse, error) {
+	version, err := s.aclManager.AddPermissionsIf(ctx, caller, req.User, req.IfVersion, req.Permissions)
+	if err != nil {
+		return nil, err
+	}
+	return &UpdatePermissionsResponse{Version: version}, nil
+}
+
+// RemovePermissions removes permissions from a user, conditionally on IfVersion as AddPermissions is.
+func (s *Server) RemovePermissions(ctx context.Context, caller *identity.Identity, req *RemovePermissionsRequest) (*UpdatePermissionsResponse, error) {
+	version, err := s.aclManager.RemovePermissionsIf(ctx, caller, req.User, req.IfVersion, req.Permissions)
+	if err != nil {
+		return nil, err
+	}
+	return &UpdatePermissionsResponse{Version: version}, nil
+}
+
+// CreateUser creates a user with no permissions and returns their first API key.
+func (s *Server) CreateUser(ctx context.Context, caller *identity.Identity, req *CreateUserRequest) (*CreateUserResponse, error) {
+	newKey, err := s.aclManager.CreateUser(ctx, caller, req.User, req.IsAdmin)
+	if err != nil {
+		return nil, err
+	}
+	return &CreateUserResponse{
+		Key: newKey,
+	}, nil
+}
+
+func (s *Server) SetUserDisabled(ctx context.Context, caller *identity.Identity, req *SetUserDisabledRequest) error {
+	return s.aclManager.SetUserDisabled(ctx, caller, req.User, req.Disabled)
+}
+
+func (s *Server) SetAdmin(ctx context.Context, caller *identity.Identity, req *SetAdminRequest) error {
+	return s.aclManager.SetAdmin(ctx, caller, req.User, req.IsAdmin)
+}
+
+func (s *Server) DeleteUser(ctx context.Context, caller *identity.Identity, req *DeleteUserRequest) error {
+	return s.aclManager.DeleteUser(ctx, caller, req.User)
+}
+
+// MintKey issues an additional key for a user, for rotation. The secret is only ever returned here.
+func (s *Server) MintKey(ctx context.Context, caller *identity.Identity, req *MintKeyRequest) (*MintKeyResponse, error) {
+	k, err := s.aclManager.MintKey(ctx, caller, req.User, req.Label, req.ExpiresAt)
+	if err != nil {
+		return nil, err
+	}
+	return &MintKeyResponse{
+		Key:      k.Secret,
+		Metadata: k,
+	}, nil
+}
+
+// RevokeKey stops a key from working once the grace period has elapsed.
+func (s *Server) RevokeKey(ctx context.Context, caller *identity.Identity, req *RevokeKeyRequest) error {
+	return s.aclManager.RevokeKey(ctx, caller, req.User, req.KeyID, time.Duration(req.GraceSeconds)*time.Second)
 }
 
-func (s *Server) RemovePermissions(ctx context.Context, key string, req *RemovePermissionsRequest) error {
-	return s.aclManager.RemovePermissions(ctx, key, req.User, req.Permissions)
+func (s *Server) ListKeys(ctx context.Context, caller *identity.Identity, req *ListKeysRequest) (*ListKeysResponse, error) {
+	k, err := s.aclManager.ListKeys(ctx, caller, req.User)
+	if err != nil {
+		return nil, err
+	}
+	return &ListKeysResponse{
+		Keys: k,
+	}, nil
+}
+
+// Explain reports how a query would be checked, without running it. Users may explain their own queries; admins may
+// explain anyone's.
+func (s *Server) Explain(ctx context.Context, caller *identity.Identity, req *ExplainRequest) (*ExplainResponse, error) {
+	ex, err := s.aclManager.Explain(ctx, caller, req.User, req.SQL)
+	if err != nil {
+		return nil, err
+	}
+	return &ExplainResponse{
+		Explanation: ex,
+	}, nil
+}
+
+// Simulate reports which queries would newly succeed or fail if the proposed changes were applied, without applying
+// them.
+func (s *Server) Simulate(ctx context.Context, caller *identity.Identity, req *SimulateRequest) (*SimulateResponse, error) {
+	res, err := s.aclManager.Simulate(ctx, caller, req.Changes, req.Queries)
+	if err != nil {
+		return nil, err
+	}
+	return &SimulateResponse{
+		Result: res,
+	}, nil
+}
+
+// WhoCanAccess answers which users can access a table, or a row of it, and through which grants.
+func (s *Server) WhoCanAccess(ctx context.Context, caller *identity.Identity, req *WhoCanAccessRequest) (*WhoCanAccessResponse, error) {
+	a, err := s.aclManager.WhoCanAccess(ctx, caller, req.Table, req.Key, req.Type)
+	if err != nil {
+		return nil, err
+	}
+	return &WhoCanAccessResponse{
+		Access: a,
+	}, nil
 }
 
 type QueryRequest struct {
-	Key string `json:"key"`
 	SQL string `json:"sql"`
 }
 
 type QueryResponse struct {
 	Rows []map[string]interface{} `json:"rows"`
+	// Set when the query was allowed under a break-glass elevation.
+	ElevationID string `json:"elevation_id,omitempty"`
+}
+
+type BreakGlassRequest struct {
+	Reason string `json:"reason"`
+	// Requested window length. Zero or anything above the server maximum is clamped to the maximum.
+	DurationSeconds int `json:"duration_seconds"`
+}
+
+type BreakGlassResponse struct {
+	ElevationID string    `json:"elevation_id"`
+	ExpiresAt   time.Time `json:"expires_at"`
 }
 
 type GetPermissionsRequest struct {
@@ -103,6 +284,8 @@ type GetPermissionsRequest struct {
 
 type GetPermissionsResponse struct {
 	Permissions []*permissions.Permission `json:"permissions"`
+	// Opaque version of the permissions, to pass as if_version to make a change conditional on them
+	Version string `json:"version"`
 }
 
 type GetAllPermissionsResponse struct {
@@ -112,9 +295,95 @@ type GetAllPermissionsResponse struct {
 type AddPermissionsRequest struct {
 	User        string                    `json:"user"`
 	Permissions []*permissions.Permission `json:"permissions"`
+	// If set, the change is only made if the user's permissions are still at this version
+	IfVersion string `json:"if_version,omitempty"`
 }
 
 type RemovePermissionsRequest struct {
 	User        string                    `json:"user"`
 	Permissions []*permissions.Permission `json:"permissions"`
+	IfVersion   string                    `json:"if_version,omitempty"`
+}
+
+type UpdatePermissionsResponse struct {
+	Version string `json:"version"`
+}
+
+type CreateUserRequest struct {
+	User    string `json:"user"`
+	IsAdmin bool   `json:"is_admin"`
+}
+
+type CreateUserResponse struct {
+	Key string `json:"key"`
+}
+
+type SetUserDisabledRequest struct {
+	User     string `json:"user"`
+	Disabled bool   `json:"disabled"`
+}
+
+type SetAdminRequest struct {
+	User    string `json:"user"`
+	IsAdmin bool   `json:"is_admin"`
+}
+
+type DeleteUserRequest struct {
+	User string `json:"user"`
+}
+
+type MintKeyRequest struct {
+	User      string     `json:"user"`
+	Label     string     `json:"label"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+type MintKeyResponse struct {
+	Key      string       `json:"key"`
+	Metadata *keys.APIKey `json:"metadata"`
+}
+
+type RevokeKeyRequest struct {
+	User         string `json:"user"`
+	KeyID        string `json:"key_id"`
+	GraceSeconds int    `json:"grace_seconds"`
+}
+
+type ListKeysRequest struct {
+	User string `json:"user"`
+}
+
+type ListKeysResponse struct {
+	Keys []*keys.APIKey `json:"keys"`
+}
+
+type ExplainRequest struct {
+	// Optional; defaults to the caller.
+	User string `json:"user,omitempty"`
+	SQL  string `json:"sql"`
+}
+
+type ExplainResponse struct {
+	Explanation *acl.Explanation `json:"explanation"`
+}
+
+type SimulateRequest struct {
+	Changes []*acl.PolicyChange    `json:"changes"`
+	Queries []*acl.HistoricalQuery `json:"queries"`
+}
+
+type SimulateResponse struct {
+	Result *acl.SimulationResult `json:"result"`
+}
+
+type WhoCanAccessRequest struct {
+	Table string `json:"table"`
+	// Optional primary key of a single row.
+	Key []string `json:"key,omitempty"`
+	// Optional permission type; zero matches both reads and writes.
+	Type permissions.PermissionType `json:"type,omitempty"`
+}
+
+type WhoCanAccessResponse struct {
+	Access []*acl.Access `json:"access"`
 }
@@ -0,0 +1,57 @@
+package server_test
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"chroma1/internal/acl"
+	"chroma1/internal/acl/storage/memory"
+	"chroma1/internal/acl/storage/storagetest"
+	"chroma1/internal/auth"
+	"chroma1/internal/db/sqlite"
+	"chroma1/internal/server"
+	"chroma1/model/identity"
+)
+
+func TestNewServer(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "app.db")
+	schema, err := sql.Open("sqlite3", path)
+	require.NoError(t, err)
+	_, err = schema.Exec("CREATE TABLE accounts (id INTEGER PRIMARY KEY, name TEXT)")
+	require.NoError(t, err)
+	schema.Close()
+	database, err := sqlite.NewSQLiteDB(ctx, path)
+	require.NoError(t, err)
+	defer database.Close()
+	s := memory.NewMemoryACLStorage()
+	defer s.Close()
+	require.NoError(t, s.CreateUser(ctx, "root", storagetest.NewKey("root"), true))
+
+	// the key secret is part of the authentication config, and required
+	_, err = server.NewServer(ctx, s, database, auth.Config{})
+	assert.ErrorIs(t, err, acl.MissingKeySecretError)
+
+	srv, err := server.NewServer(ctx, s, database, auth.Config{KeySecret: "secret"})
+	require.NoError(t, err)
+	defer srv.Close()
+	created, err := srv.CreateUser(ctx, &identity.Identity{User: "root"}, &server.CreateUserRequest{User: "alice"})
+	require.NoError(t, err)
+
+	// keys the server issues authenticate their user
+	r, err := http.NewRequest(http.MethodPost, "/query", nil)
+	require.NoError(t, err)
+	r.Header.Set("Authorization", "Bearer "+created.Key)
+	r.RemoteAddr = "10.0.0.1:4242"
+	id, err := srv.Authenticate(ctx, r)
+	require.NoError(t, err)
+	assert.Equal(t, "alice", id.User)
+	assert.Equal(t, auth.MethodAPIKey, id.Method)
+	assert.Equal(t, "10.0.0.1", id.SourceAddr)
+}
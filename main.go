@@ -1,6 +1,9 @@
 package main
 
 import (
+	"fmt"
+	"os"
+
 	"chroma1/internal/server"
 )
 
@@ -8,11 +11,29 @@ var (
 	s server.Server
 )
 
+// commands are the offline subcommands, run as `<binary> <command> [flags]`.
+var commands = map[string]func(args []string) error{
+	"export":   runExport,
+	"import":   runImport,
+	"migrate":  runMigrate,
+	"simulate": runSimulate,
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		if cmd, ok := commands[os.Args[1]]; ok {
+			if err := cmd(os.Args[2:]); err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %v\n", os.Args[1], err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
 	// TODO: fill this out
 	// create DB and ACL-backing objects
 	// Use them to create the server object
 	// handle json encoding/decoding the requests/responses
-	// extract API key from header
+	// authenticate each request with Server.Authenticate (API key, JWT or mTLS, per config)
 	// hook handlers to the Server methods.
 }
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	aclsqlite "chroma1/internal/acl/storage/sqlite"
+)
+
+// runMigrate shows the schema migration status of the ACL store, or applies or reverts migrations.
+func runMigrate(args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	aclPath := fs.String("acl", "", "path to the SQLite ACL store")
+	to := fs.Int("to", -1, "schema version to migrate to (default: latest for up; required for down)")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: migrate -acl acl.db [-to version] [status|up|down]\n")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *aclPath == "" {
+		return fmt.Errorf("-acl is required")
+	}
+	action := "status"
+	if fs.NArg() > 1 {
+		return fmt.Errorf("unexpected arguments %v", fs.Args()[1:])
+	} else if fs.NArg() == 1 {
+		action = fs.Arg(0)
+	}
+
+	ctx := context.Background()
+	m, err := aclsqlite.NewMigrator(ctx, *aclPath)
+	if err != nil {
+		return fmt.Errorf("error opening ACL store %s: %w", *aclPath, err)
+	}
+	defer m.Close()
+
+	switch action {
+	case "status":
+	case "up":
+		target := *to
+		if target < 0 {
+			target = 0
+		}
+		if err := m.Up(ctx, target); err != nil {
+			return err
+		}
+	case "down":
+		if *to < 0 {
+			return fmt.Errorf("down requires -to")
+		}
+		if err := m.Down(ctx, *to); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown action %q, expected status, up or down", action)
+	}
+	return printMigrationStatus(ctx, m)
+}
+
+func printMigrationStatus(ctx context.Context, m *aclsqlite.Migrator) error {
+	status, err := m.Status(ctx)
+	if err != nil {
+		return err
+	}
+	version, err := m.Version(ctx)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stdout, "schema version %d (latest known %d)\n", version, aclsqlite.LatestSchemaVersion())
+	for _, st := range status {
+		state := "pending"
+		if st.AppliedAt != nil {
+			state = "applied " + st.AppliedAt.Local().Format(time.RFC3339)
+		}
+		if st.Unknown {
+			state += ", unknown to this version"
+		}
+		fmt.Fprintf(os.Stdout, "%4d  %-24s %s\n", st.Version, st.Name, state)
+	}
+	return nil
+}
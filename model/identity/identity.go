@@ -0,0 +1,15 @@
+package identity
+
+// Identity is an authenticated caller, as established by an Authenticator.
+type Identity struct {
+	User string
+	// Admin is set when the authentication source itself asserts superadmin rights (e.g. a JWT claim). Users marked as
+	// admins in the ACL store are admins regardless of this flag.
+	Admin bool
+	// Method names the authenticator that produced this identity, e.g. "api_key", "jwt" or "mtls".
+	Method string
+	// Claims carries any additional attributes the authentication source asserted about the caller.
+	Claims map[string]interface{}
+	// SourceAddr is the IP address the request came from.
+	SourceAddr string
+}
@@ -0,0 +1,36 @@
+package keys
+
+import (
+	"strings"
+	"time"
+)
+
+// LegacyIDPrefix starts the id of every key carried over from the single per-user key of stores older than multiple
+// keys, which the initial SQLite migration names "legacy-<user>". Clients present such keys as the bare secret rather
+// than "<id>.<secret>".
+const LegacyIDPrefix = "legacy-"
+
+// APIKey is one of possibly several credentials belonging to a user.
+type APIKey struct {
+	// Stable, non-secret identifier used to refer to the key when listing or revoking it.
+	ID   string `json:"id"`
+	User string `json:"user"`
+	// The token presented by clients, "<id>.<secret>". Only populated when the key is minted, or when a storage backend
+	// still holds a legacy plaintext key that has not been hashed yet. Never serialized.
+	Secret string `json:"-"`
+	// HMAC of the secret part of the token. Never serialized.
+	Hash      []byte     `json:"-"`
+	Label     string     `json:"label,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"` // nil means the key never expires
+}
+
+// ValidAt reports whether the key can be used at time t.
+func (k *APIKey) ValidAt(t time.Time) bool {
+	return k.ExpiresAt == nil || t.Before(*k.ExpiresAt)
+}
+
+// Legacy reports whether the key was carried over from a store older than multiple keys, see LegacyIDPrefix.
+func (k *APIKey) Legacy() bool {
+	return strings.HasPrefix(k.ID, LegacyIDPrefix)
+}
@@ -0,0 +1,265 @@
+package permissions
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// KeyRange is a range of primary keys, half-open by default: [Start, End). Bounds may be prefixes of a composite key,
+// in which case they apply to every key sharing that prefix, so that for a key (a, b), {Start: ["5"], End: ["6"]}
+// holds every key with a = 5. StartAfter and EndAfter move a bound to after all keys with that prefix, making Start
+// exclusive and End inclusive respectively; {Start: p, End: p, EndAfter: true} therefore holds exactly the keys with
+// prefix p. A nil Start or End leaves that side unbounded.
+type KeyRange struct {
+	Start      []string `json:",omitempty"`
+	StartAfter bool     `json:",omitempty"`
+	End        []string `json:",omitempty"`
+	EndAfter   bool     `json:",omitempty"`
+}
+
+// PrefixRange returns the range of all keys beginning with prefix.
+func PrefixRange(prefix []string) KeyRange {
+	return KeyRange{Start: prefix, End: prefix, EndAfter: true}
+}
+
+// PointRanges returns a range holding exactly each of the full keys.
+func PointRanges(keys [][]string) []KeyRange {
+	ranges := make([]KeyRange, len(keys))
+	for i, k := range keys {
+		ranges[i] = KeyRange{Start: k, End: k, EndAfter: true}
+	}
+	return ranges
+}
+
+// ContainsKey reports whether the full key k lies inside the range.
+func (r KeyRange) ContainsKey(k []string) bool {
+	return cmpBound(r.lo(), bound{key: k}) <= 0 && cmpBound(bound{key: k, after: true}, r.hi()) <= 0
+}
+
+// Contains reports whether o lies entirely inside r.
+func (r KeyRange) Contains(o KeyRange) bool {
+	return cmpBound(r.lo(), o.lo()) <= 0 && cmpBound(o.hi(), r.hi()) <= 0
+}
+
+// Empty reports whether the range holds no keys.
+func (r KeyRange) Empty() bool {
+	return cmpBound(r.lo(), r.hi()) >= 0
+}
+
+// bound is a position in key space: just before every key with prefix key, or just after them if after is set. The
+// empty prefix gives the positions before and after every key.
+type bound struct {
+	key   []string
+	after bool
+}
+
+func (r KeyRange) lo() bound {
+	return bound{key: r.Start, after: r.StartAfter && r.Start != nil}
+}
+
+func (r KeyRange) hi() bound {
+	if r.End == nil {
+		return bound{after: true}
+	}
+	return bound{key: r.End, after: r.EndAfter}
+}
+
+func rangeFromBounds(lo, hi bound) KeyRange {
+	r := KeyRange{}
+	if len(lo.key) > 0 {
+		r.Start, r.StartAfter = lo.key, lo.after
+	}
+	if len(hi.key) > 0 || !hi.after {
+		r.End, r.EndAfter = hi.key, hi.after
+		if r.End == nil {
+			r.End = []string{}
+		}
+	}
+	return r
+}
+
+func cmpBound(a, b bound) int {
+	n := len(a.key)
+	if len(b.key) < n {
+		n = len(b.key)
+	}
+	if c := CompareKeys(a.key[:n], b.key[:n]); c != 0 {
+		return c
+	}
+	switch {
+	case len(a.key) < len(b.key):
+		// a is a shorter prefix of b: it sits outside all of b's keys, on the side given by its flag.
+		if a.after {
+			return 1
+		}
+		return -1
+	case len(a.key) > len(b.key):
+		if b.after {
+			return -1
+		}
+		return 1
+	case a.after == b.after:
+		return 0
+	case a.after:
+		return 1
+	}
+	return -1
+}
+
+// CompareKeyColumn orders single key column values as SQLite orders the values of a column with numeric affinity:
+// numbers sort before text, numbers compare by value and text byte by byte. Only canonical numbers (see
+// IsCanonicalNumber) count as numbers, so two values compare equal only if they are identical; "NaN", "007", "7.0" and
+// "7e0" are text.
+func CompareKeyColumn(a, b string) int {
+	aNum, bNum := IsCanonicalNumber(a), IsCanonicalNumber(b)
+	switch {
+	case aNum && bNum:
+		return compareNumbers(a, b)
+	case aNum:
+		return -1
+	case bNum:
+		return 1
+	}
+	return strings.Compare(a, b)
+}
+
+// IsCanonicalNumber reports whether s is the one way this package writes a number: an integer in the int64 range
+// without sign, leading zeros or negative zero, or a finite non-integral float64 in its shortest decimal form without
+// exponent, e.g. "-7" and "0.5" but not "+7", "007", "-0", "7.0", ".5", "5e-1" or "NaN".
+func IsCanonicalNumber(s string) bool {
+	intPart, frac, hasFrac := strings.Cut(strings.TrimPrefix(s, "-"), ".")
+	if !isDigits(intPart) || (len(intPart) > 1 && intPart[0] == '0') {
+		return false
+	}
+	if !hasFrac {
+		_, err := strconv.ParseInt(s, 10, 64)
+		return err == nil && s != "-0"
+	}
+	if !isDigits(frac) || frac[len(frac)-1] == '0' {
+		return false
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	return err == nil && strconv.FormatFloat(f, 'f', -1, 64) == s
+}
+
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// compareNumbers orders canonical numbers by value.
+func compareNumbers(a, b string) int {
+	ai, aErr := strconv.ParseInt(a, 10, 64)
+	bi, bErr := strconv.ParseInt(b, 10, 64)
+	if aErr == nil && bErr == nil {
+		switch {
+		case ai < bi:
+			return -1
+		case ai > bi:
+			return 1
+		}
+		return 0
+	}
+	// Non-integral float64s are below 2^52, where integers are exact, so comparing as float64 is exact too.
+	af, _ := strconv.ParseFloat(a, 64)
+	bf, _ := strconv.ParseFloat(b, 64)
+	switch {
+	case af < bf:
+		return -1
+	case af > bf:
+		return 1
+	}
+	return 0
+}
+
+// CompareKeys orders keys column by column. A key sorts before any longer key it is a prefix of.
+func CompareKeys(a, b []string) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if c := CompareKeyColumn(a[i], b[i]); c != 0 {
+			return c
+		}
+	}
+	return len(a) - len(b)
+}
+
+// NormalizeRanges sorts ranges, drops empty ones and merges those that overlap or touch.
+func NormalizeRanges(ranges []KeyRange) []KeyRange {
+	sorted := make([]KeyRange, 0, len(ranges))
+	for _, r := range ranges {
+		if !r.Empty() {
+			sorted = append(sorted, r)
+		}
+	}
+	if len(sorted) == 0 {
+		return nil
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return cmpBound(sorted[i].lo(), sorted[j].lo()) < 0
+	})
+	merged := []KeyRange{sorted[0]}
+	for _, r := range sorted[1:] {
+		last := &merged[len(merged)-1]
+		if cmpBound(r.lo(), last.hi()) <= 0 {
+			if cmpBound(r.hi(), last.hi()) > 0 {
+				*last = rangeFromBounds(last.lo(), r.hi())
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+// UnionRanges returns the normalized union of a and b.
+func UnionRanges(a, b []KeyRange) []KeyRange {
+	return NormalizeRanges(append(append(make([]KeyRange, 0, len(a)+len(b)), a...), b...))
+}
+
+// SubtractRanges returns the normalized set of keys in a but not in b, splitting ranges of a where needed.
+func SubtractRanges(a, b []KeyRange) []KeyRange {
+	res := NormalizeRanges(a)
+	for _, r := range b {
+		next := make([]KeyRange, 0, len(res))
+		for _, s := range res {
+			if cmpBound(s.hi(), r.lo()) <= 0 || cmpBound(r.hi(), s.lo()) <= 0 {
+				next = append(next, s) // disjoint
+				continue
+			}
+			if cmpBound(s.lo(), r.lo()) < 0 {
+				next = append(next, rangeFromBounds(s.lo(), r.lo()))
+			}
+			if cmpBound(r.hi(), s.hi()) < 0 {
+				next = append(next, rangeFromBounds(r.hi(), s.hi()))
+			}
+		}
+		res = next
+	}
+	return NormalizeRanges(res)
+}
+
+// rangesContainKey reports whether the normalized ranges hold k.
+func rangesContainKey(ranges []KeyRange, k []string) bool {
+	kb := bound{key: k}
+	// first range starting after k; only the one before it can hold k
+	i := sort.Search(len(ranges), func(i int) bool {
+		return cmpBound(ranges[i].lo(), kb) > 0
+	})
+	return i > 0 && ranges[i-1].ContainsKey(k)
+}
+
+// rangesContain reports whether the normalized ranges hold all of r.
+func rangesContain(ranges []KeyRange, r KeyRange) bool {
+	lo := r.lo()
+	i := sort.Search(len(ranges), func(i int) bool {
+		return cmpBound(ranges[i].lo(), lo) > 0
+	})
+	return i > 0 && ranges[i-1].Contains(r)
+}
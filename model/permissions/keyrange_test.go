@@ -0,0 +1,208 @@
+package permissions_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"chroma1/model/permissions"
+)
+
+func k(cols ...string) []string {
+	return cols
+}
+
+func TestCoversKey(t *testing.T) {
+	testcases := []struct {
+		perm permissions.Permission
+		key  []string
+		exp  bool
+	}{
+		{perm: permissions.Permission{}, key: k("5"), exp: true},
+		{perm: permissions.Permission{RowKeys: [][]string{k("5"), k("10")}}, key: k("10"), exp: true},
+		{perm: permissions.Permission{RowKeys: [][]string{k("5"), k("10")}}, key: k("7"), exp: false},
+		{perm: permissions.Permission{RowRanges: []permissions.KeyRange{{Start: k("1"), End: k("10")}}}, key: k("9"), exp: true},
+		{perm: permissions.Permission{RowRanges: []permissions.KeyRange{{Start: k("1"), End: k("10")}}}, key: k("10"), exp: false},
+		{perm: permissions.Permission{RowRanges: []permissions.KeyRange{{Start: k("1"), End: k("10"), EndAfter: true}}}, key: k("10"), exp: true},
+		{perm: permissions.Permission{RowRanges: []permissions.KeyRange{{Start: k("1"), StartAfter: true}}}, key: k("1"), exp: false},
+		{perm: permissions.Permission{RowRanges: []permissions.KeyRange{{Start: k("1"), StartAfter: true}}}, key: k("1000000"), exp: true},
+		{perm: permissions.Permission{RowRanges: []permissions.KeyRange{permissions.PrefixRange(k("5"))}}, key: k("5", "a"), exp: true},
+		{perm: permissions.Permission{RowRanges: []permissions.KeyRange{permissions.PrefixRange(k("5"))}}, key: k("6", "a"), exp: false},
+		{perm: permissions.Permission{RowRanges: []permissions.KeyRange{{Start: k("5", "b"), End: k("6")}}}, key: k("5", "a"), exp: false},
+		{perm: permissions.Permission{RowRanges: []permissions.KeyRange{{Start: k("5", "b"), End: k("6")}}}, key: k("5", "c"), exp: true},
+		{perm: permissions.Permission{ExceptKeys: [][]string{k("7")}}, key: k("7"), exp: false},
+		{perm: permissions.Permission{ExceptKeys: [][]string{k("7")}}, key: k("8"), exp: true},
+	}
+	for i, tc := range testcases {
+		t.Run(fmt.Sprintf("TestCoversKey case %v", i), func(t *testing.T) {
+			assert.Equal(t, tc.exp, tc.perm.CoversKey(tc.key))
+		})
+	}
+}
+
+func TestCoversRows(t *testing.T) {
+	grant := permissions.Permission{
+		RowKeys:   [][]string{k("50")},
+		RowRanges: []permissions.KeyRange{{Start: k("1"), End: k("10")}, {Start: k("20"), End: k("30")}},
+	}
+	testcases := []struct {
+		want permissions.Permission
+		exp  bool
+	}{
+		{want: permissions.Permission{}, exp: false},
+		{want: permissions.Permission{RowKeys: [][]string{k("2"), k("50")}}, exp: true},
+		{want: permissions.Permission{RowRanges: []permissions.KeyRange{{Start: k("2"), End: k("5")}}}, exp: true},
+		{want: permissions.Permission{RowRanges: []permissions.KeyRange{{Start: k("5"), End: k("25")}}}, exp: false},
+		{want: permissions.Permission{RowRanges: []permissions.KeyRange{{Start: k("20"), End: k("30"), EndAfter: true}}}, exp: false},
+		{want: permissions.Permission{ExceptKeys: [][]string{k("7")}}, exp: false},
+	}
+	for i, tc := range testcases {
+		t.Run(fmt.Sprintf("TestCoversRows case %v", i), func(t *testing.T) {
+			assert.Equal(t, tc.exp, grant.CoversRows(&tc.want))
+		})
+	}
+}
+
+func TestCoversRowsExcept(t *testing.T) {
+	grant := permissions.Permission{ExceptKeys: [][]string{k("7"), k("9")}}
+	testcases := []struct {
+		want permissions.Permission
+		exp  bool
+	}{
+		{want: permissions.Permission{}, exp: false},
+		{want: permissions.Permission{RowKeys: [][]string{k("1"), k("8")}}, exp: true},
+		{want: permissions.Permission{RowKeys: [][]string{k("7")}}, exp: false},
+		{want: permissions.Permission{RowRanges: []permissions.KeyRange{{Start: k("1"), End: k("7")}}}, exp: true},
+		{want: permissions.Permission{RowRanges: []permissions.KeyRange{{Start: k("1"), End: k("7"), EndAfter: true}}}, exp: false},
+		{want: permissions.Permission{ExceptKeys: [][]string{k("7"), k("8"), k("9")}}, exp: true},
+		{want: permissions.Permission{ExceptKeys: [][]string{k("7")}}, exp: false},
+	}
+	for i, tc := range testcases {
+		t.Run(fmt.Sprintf("TestCoversRowsExcept case %v", i), func(t *testing.T) {
+			assert.Equal(t, tc.exp, grant.CoversRows(&tc.want))
+		})
+	}
+
+	ranged := permissions.Permission{RowRanges: []permissions.KeyRange{{End: k("7")}, {Start: k("7"), StartAfter: true}}}
+	assert.True(t, ranged.CoversRows(&permissions.Permission{ExceptKeys: [][]string{k("7")}}))
+	assert.False(t, ranged.CoversRows(&permissions.Permission{ExceptKeys: [][]string{k("8")}}))
+}
+
+func TestRangeSetOps(t *testing.T) {
+	testcases := []struct {
+		a, b     []permissions.KeyRange
+		union    []permissions.KeyRange
+		subtract []permissions.KeyRange
+	}{
+		{
+			a:        []permissions.KeyRange{{Start: k("1"), End: k("5")}},
+			b:        []permissions.KeyRange{{Start: k("5"), End: k("10")}},
+			union:    []permissions.KeyRange{{Start: k("1"), End: k("10")}},
+			subtract: []permissions.KeyRange{{Start: k("1"), End: k("5")}},
+		},
+		{
+			a:        []permissions.KeyRange{{Start: k("1"), End: k("10")}},
+			b:        []permissions.KeyRange{{Start: k("4"), End: k("4"), EndAfter: true}},
+			union:    []permissions.KeyRange{{Start: k("1"), End: k("10")}},
+			subtract: []permissions.KeyRange{{Start: k("1"), End: k("4")}, {Start: k("4"), StartAfter: true, End: k("10")}},
+		},
+		{
+			a:        []permissions.KeyRange{{Start: k("1"), End: k("3")}},
+			b:        []permissions.KeyRange{{End: k("2")}, {Start: k("20")}},
+			union:    []permissions.KeyRange{{End: k("3")}, {Start: k("20")}},
+			subtract: []permissions.KeyRange{{Start: k("2"), End: k("3")}},
+		},
+		{
+			a:        []permissions.KeyRange{{Start: k("3"), End: k("3")}},
+			b:        []permissions.KeyRange{{Start: k("1"), End: k("2")}},
+			union:    []permissions.KeyRange{{Start: k("1"), End: k("2")}},
+			subtract: nil,
+		},
+	}
+	for i, tc := range testcases {
+		t.Run(fmt.Sprintf("TestRangeSetOps case %v", i), func(t *testing.T) {
+			assert.Equal(t, tc.union, permissions.UnionRanges(tc.a, tc.b))
+			assert.Equal(t, tc.subtract, permissions.SubtractRanges(tc.a, tc.b))
+		})
+	}
+}
+
+func TestCompareKeyColumn(t *testing.T) {
+	testcases := []struct {
+		a, b string
+		exp  int
+	}{
+		{a: "9", b: "10", exp: -1},
+		{a: "-10", b: "-9", exp: -1},
+		{a: "0.5", b: "1", exp: -1},
+		{a: "9007199254740993", b: "9007199254740992", exp: 1},
+		{a: "4503599627370495.5", b: "4503599627370496", exp: -1},
+		{a: "10", b: "a", exp: -1},
+		{a: "a", b: "b", exp: -1},
+		// only identical values are equal
+		{a: "7", b: "007", exp: -1},
+		{a: "7", b: "7.0", exp: -1},
+		{a: "7", b: "7e0", exp: -1},
+		{a: "7", b: "+7", exp: -1},
+		{a: "0", b: "-0", exp: -1},
+		{a: "NaN", b: "1", exp: 1},
+		{a: "NaN", b: "NaN", exp: 0},
+		// non-canonical numbers are text, ordered byte by byte
+		{a: "007", b: "7.0", exp: -1},
+		{a: "1e1", b: "2", exp: 1},
+	}
+	for i, tc := range testcases {
+		t.Run(fmt.Sprintf("TestCompareKeyColumn case %v", i), func(t *testing.T) {
+			assert.Equal(t, tc.exp, permissions.CompareKeyColumn(tc.a, tc.b))
+			assert.Equal(t, -tc.exp, permissions.CompareKeyColumn(tc.b, tc.a))
+		})
+	}
+
+	for _, s := range []string{"0", "7", "-7", "0.5", "-0.25", "9223372036854775807"} {
+		assert.True(t, permissions.IsCanonicalNumber(s), s)
+	}
+	for _, s := range []string{"", "-", "-0", "+7", "007", "7.0", "7.", ".5", "7e0", "0x7", "1_000", " 7", "NaN", "Inf", "9223372036854775808", "9007199254740992.5", "0.1000000000000000055511151231257827"} {
+		assert.False(t, permissions.IsCanonicalNumber(s), s)
+	}
+}
+
+func TestMixedRanges(t *testing.T) {
+	numbers := permissions.Permission{RowRanges: []permissions.KeyRange{{Start: k("1"), End: k("10")}}}
+	for _, key := range []string{"NaN", "007", "5.0", "5e0", "a"} {
+		assert.False(t, numbers.CoversKey(k(key)), "text %s is not a number in range", key)
+	}
+	assert.True(t, numbers.CoversKey(k("9.5")))
+
+	// text sorts after every number, so an unbounded range above a number holds all of it
+	above := permissions.Permission{RowRanges: []permissions.KeyRange{{Start: k("5")}}}
+	assert.True(t, above.CoversKey(k("a")))
+	assert.True(t, above.CoversKey(k("007")))
+	below := permissions.Permission{RowRanges: []permissions.KeyRange{{End: k("a")}}}
+	assert.True(t, below.CoversKey(k("1000")))
+	assert.True(t, below.CoversKey(k("007")))
+	assert.False(t, below.CoversKey(k("b")))
+
+	except := permissions.Permission{ExceptKeys: [][]string{k("7")}}
+	assert.False(t, except.CoversKey(k("7")))
+	assert.True(t, except.CoversKey(k("007")), "a differently spelled key is another row")
+	assert.False(t, except.CoversRows(&permissions.Permission{RowRanges: []permissions.KeyRange{{Start: k("5"), End: k("10")}}}))
+}
+
+func TestNormalize(t *testing.T) {
+	p := permissions.Permission{
+		RowKeys:   [][]string{k("10"), k("2"), k("10"), k("a"), k("7")},
+		RowRanges: []permissions.KeyRange{{Start: k("5"), End: k("8")}, {Start: k("1"), End: k("3")}},
+	}
+	permissions.Normalize(&p)
+	assert.Equal(t, [][]string{k("10"), k("a")}, p.RowKeys)
+	assert.Equal(t, []permissions.KeyRange{{Start: k("1"), End: k("3")}, {Start: k("5"), End: k("8")}}, p.RowRanges)
+
+	except := permissions.Permission{RowKeys: [][]string{k("1"), k("2")}, ExceptKeys: [][]string{k("2")}}
+	permissions.Normalize(&except)
+	assert.Equal(t, permissions.Permission{RowKeys: [][]string{k("1")}}, except)
+
+	empty := permissions.Permission{RowKeys: [][]string{}}
+	permissions.Normalize(&empty)
+	assert.False(t, empty.Blanket())
+}
@@ -0,0 +1,56 @@
+package permissions
+
+import "sort"
+
+// SortKeys sorts keys in place and drops duplicates, returning the shortened slice.
+func SortKeys(keys [][]string) [][]string {
+	if !sort.SliceIsSorted(keys, func(i, j int) bool { return CompareKeys(keys[i], keys[j]) < 0 }) {
+		sort.Slice(keys, func(i, j int) bool { return CompareKeys(keys[i], keys[j]) < 0 })
+	}
+	out := keys[:0]
+	for _, k := range keys {
+		if len(out) > 0 && CompareKeys(out[len(out)-1], k) == 0 {
+			continue
+		}
+		out = append(out, k)
+	}
+	return out
+}
+
+// UnionKeys merges two sorted, duplicate-free key lists into a new one in linear time.
+func UnionKeys(a, b [][]string) [][]string {
+	out := make([][]string, 0, len(a)+len(b))
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch c := CompareKeys(a[i], b[j]); {
+		case c < 0:
+			out = append(out, a[i])
+			i++
+		case c > 0:
+			out = append(out, b[j])
+			j++
+		default:
+			out = append(out, a[i])
+			i++
+			j++
+		}
+	}
+	out = append(out, a[i:]...)
+	return append(out, b[j:]...)
+}
+
+// SubtractKeys returns the keys of sorted list a that are not in sorted list b, in linear time.
+func SubtractKeys(a, b [][]string) [][]string {
+	out := make([][]string, 0, len(a))
+	j := 0
+	for _, k := range a {
+		for j < len(b) && CompareKeys(b[j], k) < 0 {
+			j++
+		}
+		if j < len(b) && CompareKeys(b[j], k) == 0 {
+			continue
+		}
+		out = append(out, k)
+	}
+	return out
+}
@@ -0,0 +1,127 @@
+package permissions_test
+
+import (
+	"fmt"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"chroma1/model/permissions"
+)
+
+func TestKeySetOps(t *testing.T) {
+	testcases := []struct {
+		a, b     [][]string
+		union    [][]string
+		subtract [][]string
+	}{
+		{
+			a:        [][]string{},
+			b:        [][]string{k("1")},
+			union:    [][]string{k("1")},
+			subtract: [][]string{},
+		},
+		{
+			a:        [][]string{k("1"), k("3"), k("5")},
+			b:        [][]string{k("2"), k("3"), k("10")},
+			union:    [][]string{k("1"), k("2"), k("3"), k("5"), k("10")},
+			subtract: [][]string{k("1"), k("5")},
+		},
+		{
+			a:        [][]string{k("1", "a"), k("1", "b"), k("2", "a")},
+			b:        [][]string{k("1", "b")},
+			union:    [][]string{k("1", "a"), k("1", "b"), k("2", "a")},
+			subtract: [][]string{k("1", "a"), k("2", "a")},
+		},
+		{
+			// other spellings of a number are different keys
+			a:        [][]string{k("7"), k("NaN")},
+			b:        [][]string{k("007"), k("7.0"), k("7e0")},
+			union:    [][]string{k("7"), k("007"), k("7.0"), k("7e0"), k("NaN")},
+			subtract: [][]string{k("7"), k("NaN")},
+		},
+		{
+			a:        [][]string{k("1"), k("2"), k("NaN")},
+			b:        [][]string{k("1"), k("NaN")},
+			union:    [][]string{k("1"), k("2"), k("NaN")},
+			subtract: [][]string{k("2")},
+		},
+	}
+	for i, tc := range testcases {
+		t.Run(fmt.Sprintf("TestKeySetOps case %v", i), func(t *testing.T) {
+			assert.Equal(t, tc.union, permissions.UnionKeys(tc.a, tc.b))
+			assert.Equal(t, tc.subtract, permissions.SubtractKeys(tc.a, tc.b))
+		})
+	}
+}
+
+func TestSortKeys(t *testing.T) {
+	keys := permissions.SortKeys([][]string{k("10"), k("9"), k("10"), k("b"), k("a"), k("9")})
+	assert.Equal(t, [][]string{k("9"), k("10"), k("a"), k("b")}, keys)
+
+	keys = permissions.SortKeys([][]string{k("NaN"), k("7"), k("-0.5"), k("7.0"), k("007"), k("-1"), k("1e1"), k("9"), k("+7")})
+	assert.Equal(t, [][]string{k("-1"), k("-0.5"), k("7"), k("9"), k("+7"), k("007"), k("1e1"), k("7.0"), k("NaN")}, keys)
+}
+
+// evenKeys returns the sorted keys 0, 2, 4, ... with n entries, offset by start.
+func evenKeys(n, start int) [][]string {
+	keys := make([][]string, n)
+	for i := range keys {
+		keys[i] = []string{strconv.Itoa(start + 2*i)}
+	}
+	return keys
+}
+
+var benchSizes = []int{10_000, 100_000, 1_000_000}
+
+func BenchmarkUnionKeys(b *testing.B) {
+	for _, n := range benchSizes {
+		held, added := evenKeys(n, 0), evenKeys(n, n)
+		b.Run(fmt.Sprintf("keys=%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				permissions.UnionKeys(held, added)
+			}
+		})
+	}
+}
+
+func BenchmarkSubtractKeys(b *testing.B) {
+	for _, n := range benchSizes {
+		held, removed := evenKeys(n, 0), evenKeys(n/2, n/2)
+		b.Run(fmt.Sprintf("keys=%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				permissions.SubtractKeys(held, removed)
+			}
+		})
+	}
+}
+
+func BenchmarkNormalize(b *testing.B) {
+	for _, n := range benchSizes {
+		keys := evenKeys(n, 0)
+		for i, j := 0, len(keys)-1; i < j; i, j = i+1, j-1 {
+			keys[i], keys[j] = keys[j], keys[i] // worst case for the sortedness check
+		}
+		b.Run(fmt.Sprintf("keys=%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				p := permissions.Permission{RowKeys: append([][]string(nil), keys...)}
+				b.StartTimer()
+				permissions.Normalize(&p)
+			}
+		})
+	}
+}
+
+func BenchmarkCoversRows(b *testing.B) {
+	for _, n := range benchSizes {
+		grant := permissions.Permission{RowKeys: evenKeys(n, 0)}
+		want := permissions.Permission{RowKeys: evenKeys(100, n/2)}
+		b.Run(fmt.Sprintf("keys=%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				grant.CoversRows(&want)
+			}
+		})
+	}
+}
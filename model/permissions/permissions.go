@@ -2,6 +2,8 @@ package permissions
 
 import (
 	"fmt"
+	"sort"
+	"time"
 )
 
 type PermissionType int
@@ -23,11 +25,187 @@ func (pt PermissionType) String() string {
 
 // Permission represents permissions on a given table or table subset.
 type Permission struct {
+	// identifies the grant in storage. Assigned when the grant is first stored; ignored on grants being added.
+	ID   string `json:",omitempty"`
 	Type PermissionType
 	// name of the table containing the rows
 	Table string
-	// a list of the allowed rows (by primary key). Empty represents 'all rows'.
+	// a list of the allowed rows (by primary key). Empty represents 'all rows', unless RowRanges is set.
 	// Keys are stored as lists of strings, with each item being one column. Ordering matches the PK definition.
-	// Kept in sorted order.
+	// Kept in sorted order (see CompareKeys).
 	RowKeys [][]string
+	// ranges of allowed rows, in addition to RowKeys. Kept normalized (see NormalizeRanges).
+	RowRanges []KeyRange `json:",omitempty"`
+	// rows excluded from an otherwise all-rows permission, e.g. every account but account 7. Only used when RowKeys and
+	// RowRanges are empty. Kept in sorted order.
+	ExceptKeys [][]string `json:",omitempty"`
+	// Optional validity window. Nil NotBefore means valid immediately, nil ExpiresAt means the permission never expires.
+	NotBefore *time.Time `json:",omitempty"`
+	ExpiresAt *time.Time `json:",omitempty"`
+	// Optional condition, in the language of internal/acl/condition, that must hold for the request for this permission
+	// to apply. Empty means unconditional.
+	Condition string `json:",omitempty"`
+	// Inherit extends the permission to rows of child tables that reference the permitted rows through foreign keys,
+	// transitively.
+	Inherit bool `json:",omitempty"`
+	// GrantOption allows the holder to grant this permission, or any subset of it, to other users.
+	GrantOption bool `json:",omitempty"`
+	// Role names the role the permission is held through, for stores that support roles. Empty for the user's own.
+	Role string `json:",omitempty"`
+}
+
+// Blanket reports whether the permission covers all rows of its table.
+func (p *Permission) Blanket() bool {
+	return p.RowKeys == nil && p.RowRanges == nil && p.ExceptKeys == nil
+}
+
+// HasExceptions reports whether the permission covers all rows of its table but those in ExceptKeys.
+func (p *Permission) HasExceptions() bool {
+	return p.RowKeys == nil && p.RowRanges == nil && p.ExceptKeys != nil
+}
+
+// Empty reports whether the permission covers no rows at all.
+func (p *Permission) Empty() bool {
+	return !p.Blanket() && !p.HasExceptions() && len(p.RowKeys) == 0 && len(p.RowRanges) == 0
+}
+
+// exceptRanges returns the rows of a permission with exceptions as the ranges around the excluded keys.
+func (p *Permission) exceptRanges() []KeyRange {
+	return SubtractRanges([]KeyRange{{}}, PointRanges(p.ExceptKeys))
+}
+
+// CoversKey reports whether the permission allows the row with full primary key k.
+func (p *Permission) CoversKey(k []string) bool {
+	if p.Blanket() {
+		return true
+	}
+	if p.HasExceptions() {
+		return !containsKey(p.ExceptKeys, k)
+	}
+	if containsKey(p.RowKeys, k) {
+		return true
+	}
+	return rangesContainKey(p.RowRanges, k)
+}
+
+// CoversRows reports whether the permission allows every row of o, ignoring type, table and everything but rows.
+func (p *Permission) CoversRows(o *Permission) bool {
+	if p.Blanket() {
+		return true
+	}
+	if o.Blanket() {
+		return false
+	}
+	if p.HasExceptions() {
+		if o.HasExceptions() {
+			return len(SubtractKeys(p.ExceptKeys, o.ExceptKeys)) == 0
+		}
+		for _, k := range o.RowKeys {
+			if !p.CoversKey(k) {
+				return false
+			}
+		}
+		for _, r := range o.RowRanges {
+			for _, e := range p.ExceptKeys {
+				if r.ContainsKey(e) {
+					return false
+				}
+			}
+		}
+		return true
+	}
+	ranges := o.RowRanges
+	if o.HasExceptions() {
+		ranges = o.exceptRanges()
+	}
+	for _, k := range o.RowKeys {
+		if !p.CoversKey(k) {
+			return false
+		}
+	}
+	for _, r := range ranges {
+		if !rangesContain(p.RowRanges, r) {
+			return false
+		}
+	}
+	return true
+}
+
+// containsKey reports whether the sorted list keys holds k.
+func containsKey(keys [][]string, k []string) bool {
+	_, ok := sort.Find(len(keys), func(i int) int { return CompareKeys(k, keys[i]) })
+	return ok
+}
+
+// Clone returns a copy of p that shares no row slices with it.
+func (p *Permission) Clone() *Permission {
+	c := *p
+	if p.RowKeys != nil {
+		c.RowKeys = append(make([][]string, 0, len(p.RowKeys)), p.RowKeys...)
+	}
+	if p.RowRanges != nil {
+		c.RowRanges = append(make([]KeyRange, 0, len(p.RowRanges)), p.RowRanges...)
+	}
+	if p.ExceptKeys != nil {
+		c.ExceptKeys = append(make([][]string, 0, len(p.ExceptKeys)), p.ExceptKeys...)
+	}
+	return &c
+}
+
+// Normalize restores the ordering invariants on RowKeys and RowRanges, dropping duplicate keys and keys already
+// covered by a range. A permission that ends up with no rows at all is left with empty, non-nil RowKeys, so it is not
+// mistaken for a blanket permission. ExceptKeys given alongside rows are subtracted from them.
+func Normalize(p *Permission) {
+	if p.Blanket() {
+		return
+	}
+	if p.HasExceptions() {
+		p.ExceptKeys = SortKeys(p.ExceptKeys)
+		return
+	}
+	if p.ExceptKeys != nil {
+		except := SortKeys(p.ExceptKeys)
+		p.ExceptKeys = nil
+		p.RowKeys = SubtractKeys(SortKeys(p.RowKeys), except)
+		p.RowRanges = SubtractRanges(p.RowRanges, PointRanges(except))
+	}
+	p.RowRanges = NormalizeRanges(p.RowRanges)
+	p.RowKeys = SortKeys(p.RowKeys)
+	if len(p.RowRanges) > 0 {
+		keys := p.RowKeys[:0]
+		for _, k := range p.RowKeys {
+			if !rangesContainKey(p.RowRanges, k) {
+				keys = append(keys, k)
+			}
+		}
+		p.RowKeys = keys
+	}
+	if len(p.RowKeys) == 0 && p.RowRanges != nil {
+		p.RowKeys = nil
+	}
+}
+
+// ActiveAt reports whether t falls inside the permission's validity window.
+func (p *Permission) ActiveAt(t time.Time) bool {
+	if p.NotBefore != nil && t.Before(*p.NotBefore) {
+		return false
+	}
+	return !p.ExpiredAt(t)
+}
+
+// ExpiredAt reports whether the permission can no longer become active at or after t.
+func (p *Permission) ExpiredAt(t time.Time) bool {
+	return p.ExpiresAt != nil && !t.Before(*p.ExpiresAt)
+}
+
+// SameWindow reports whether p and o have identical validity windows, i.e. whether their row keys can be merged.
+func (p *Permission) SameWindow(o *Permission) bool {
+	return timesEqual(p.NotBefore, o.NotBefore) && timesEqual(p.ExpiresAt, o.ExpiresAt)
+}
+
+func timesEqual(a, b *time.Time) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Equal(*b)
 }
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"chroma1/internal/acl"
+)
+
+// runSimulate reports how proposed permission changes would affect a log of past queries.
+func runSimulate(args []string) error {
+	fs := flag.NewFlagSet("simulate", flag.ContinueOnError)
+	aclPath, dbPath := storeFlags(fs)
+	changesPath := fs.String("changes", "", "JSON file with a list of proposed changes ({user, add, remove})")
+	queriesPath := fs.String("queries", "", "query log with one JSON object ({user, sql}) per line")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *changesPath == "" || *queriesPath == "" {
+		return fmt.Errorf("both -changes and -queries are required")
+	}
+
+	var changes []*acl.PolicyChange
+	raw, err := os.ReadFile(*changesPath)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(raw, &changes); err != nil {
+		return fmt.Errorf("error parsing changes %s: %w", *changesPath, err)
+	}
+	queries, err := readQueryLog(*queriesPath)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	man, closeAll, err := openACLManager(ctx, *aclPath, *dbPath)
+	if err != nil {
+		return err
+	}
+	defer closeAll()
+
+	res, err := man.SimulateTrusted(ctx, changes, queries)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(res)
+}
+
+func readQueryLog(path string) ([]*acl.HistoricalQuery, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	queries := make([]*acl.HistoricalQuery, 0)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		q := &acl.HistoricalQuery{}
+		if err := json.Unmarshal(scanner.Bytes(), q); err != nil {
+			return nil, fmt.Errorf("error parsing query log %s line %d: %w", path, line, err)
+		}
+		queries = append(queries, q)
+	}
+	return queries, scanner.Err()
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+
+	"chroma1/internal/acl"
+	aclsqlite "chroma1/internal/acl/storage/sqlite"
+	"chroma1/model/keys"
+	"chroma1/model/permissions"
+)
+
+func TestSimulate(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	t.Setenv(keySecretEnv, "secret")
+
+	aclPath := filepath.Join(dir, "acl.db")
+	s, err := aclsqlite.NewSQLiteACLStorage(ctx, aclPath)
+	assert.NoError(t, err)
+	assert.NoError(t, s.CreateUser(ctx, "alice", &keys.APIKey{ID: "id-alice", User: "alice", Hash: []byte("hash-alice"), CreatedAt: time.Now()}, false))
+	assert.NoError(t, s.StoreUserPerms(ctx, "alice", []*permissions.Permission{
+		{Type: permissions.Read, Table: "accounts", RowKeys: [][]string{{"1"}}},
+	}))
+	s.Close()
+
+	dbPath := filepath.Join(dir, "app.db")
+	database, err := sql.Open("sqlite3", dbPath)
+	assert.NoError(t, err)
+	_, err = database.Exec("CREATE TABLE accounts (id INTEGER PRIMARY KEY)")
+	assert.NoError(t, err)
+	database.Close()
+
+	changes, err := json.Marshal([]*acl.PolicyChange{
+		{User: "alice", Add: []*permissions.Permission{{Type: permissions.Read, Table: "accounts", RowKeys: [][]string{{"2"}}}}},
+		{User: "alice", Remove: []*permissions.Permission{{Type: permissions.Read, Table: "accounts", RowKeys: [][]string{{"1"}}}}},
+	})
+	assert.NoError(t, err)
+	changesPath := filepath.Join(dir, "changes.json")
+	assert.NoError(t, os.WriteFile(changesPath, changes, 0o600))
+	queriesPath := filepath.Join(dir, "queries.jsonl")
+	assert.NoError(t, os.WriteFile(queriesPath, []byte(
+		`{"user": "alice", "sql": "SELECT * FROM accounts WHERE id = 1"}`+"\n"+
+			`{"user": "alice", "sql": "SELECT * FROM accounts WHERE id = 2"}`+"\n"+
+			`{"user": "alice", "sql": "SELECT * FROM accounts WHERE id = 3"}`+"\n"), 0o600))
+
+	// no caller is needed on the command line, the operator owns the store
+	out := captureStdout(t, func() error {
+		return runSimulate([]string{"-acl", aclPath, "-db", dbPath, "-changes", changesPath, "-queries", queriesPath})
+	})
+	var res acl.SimulationResult
+	if !assert.NoError(t, json.Unmarshal(out, &res), string(out)) {
+		return
+	}
+	if assert.Len(t, res.NewlyAllowed, 1) {
+		assert.Equal(t, "SELECT * FROM accounts WHERE id = 2", res.NewlyAllowed[0].SQL)
+	}
+	if assert.Len(t, res.NewlyDenied, 1) {
+		assert.Equal(t, "SELECT * FROM accounts WHERE id = 1", res.NewlyDenied[0].SQL)
+	}
+	assert.Equal(t, 1, res.Unchanged)
+	assert.Empty(t, res.Errors)
+}
+
+// captureStdout returns what run writes to stdout.
+func captureStdout(t *testing.T, run func() error) []byte {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	done := make(chan []byte)
+	go func() {
+		b, _ := io.ReadAll(r)
+		done <- b
+	}()
+	err = run()
+	os.Stdout = stdout
+	w.Close()
+	assert.NoError(t, err)
+	return <-done
+}
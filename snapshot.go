@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"chroma1/internal/acl/storage/snapshot"
+)
+
+// runExport writes a snapshot of an ACL store, to back it up or to import it into another store.
+func runExport(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	aclLocation := fs.String("acl", "", "ACL store to export: a SQLite path, a .yaml/.json policy file or a redis:// URL")
+	outPath := fs.String("o", "-", "file to write the snapshot to, or - for stdout")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *aclLocation == "" {
+		return fmt.Errorf("-acl is required")
+	}
+	if !strings.HasPrefix(*aclLocation, "redis://") {
+		// opening a missing file store would create an empty one
+		if _, err := os.Stat(*aclLocation); err != nil {
+			return err
+		}
+	}
+
+	ctx := context.Background()
+	s, err := openStore(ctx, *aclLocation)
+	if err != nil {
+		return fmt.Errorf("error opening ACL store %s: %w", *aclLocation, err)
+	}
+	defer s.Close()
+	snap, err := snapshot.Export(ctx, s)
+	if err != nil {
+		return err
+	}
+
+	if *outPath == "-" {
+		return snap.Write(os.Stdout)
+	}
+	f, err := os.Create(*outPath)
+	if err != nil {
+		return err
+	}
+	if err := snap.Write(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// runImport brings an ACL store in line with a snapshot, or with -dry-run prints the changes that would take.
+func runImport(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	aclLocation := fs.String("acl", "", "ACL store to import into: a SQLite path, a .yaml/.json policy file or a redis:// URL")
+	modeName := fs.String("mode", "merge", "merge to keep what the snapshot does not hold, or replace to delete it")
+	dryRun := fs.Bool("dry-run", false, "print the changes without making them")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: import -acl store [-mode merge|replace] [-dry-run] snapshot.json|-\n")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *aclLocation == "" || fs.NArg() != 1 {
+		return fmt.Errorf("-acl and one snapshot file are required")
+	}
+	var mode snapshot.Mode
+	switch *modeName {
+	case "merge":
+		mode = snapshot.Merge
+	case "replace":
+		mode = snapshot.Replace
+	default:
+		return fmt.Errorf("unknown mode %q, expected merge or replace", *modeName)
+	}
+
+	var in io.Reader = os.Stdin
+	if path := fs.Arg(0); path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+	snap, err := snapshot.Read(in)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	s, err := openStore(ctx, *aclLocation)
+	if err != nil {
+		return fmt.Errorf("error opening ACL store %s: %w", *aclLocation, err)
+	}
+	defer s.Close()
+	plan, err := snapshot.Diff(ctx, s, snap, mode)
+	if err != nil {
+		return err
+	}
+	for _, st := range plan.Steps {
+		fmt.Fprintln(os.Stdout, st)
+	}
+	for _, st := range plan.Unsupported {
+		fmt.Fprintf(os.Stdout, "skipped, the store cannot %s\n", st)
+	}
+	if plan.Empty() {
+		fmt.Fprintln(os.Stdout, "the store already matches the snapshot")
+	}
+	if *dryRun {
+		return nil
+	}
+	return plan.Apply(ctx, s)
+}